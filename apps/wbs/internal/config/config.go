@@ -1,21 +1,25 @@
 package config
 
 import (
-	"fmt"
-	"os"
 	"time"
 
 	"github.com/Regeneric/iot-drivers/libs/sx126x"
 
 	"github.com/Regeneric/iot-drivers/libs/sgp30"
 
-	"github.com/ilyakaznacheev/cleanenv"
 	"periph.io/x/conn/v3/spi"
 	"periph.io/x/conn/v3/uart"
 )
 
 type Config struct {
 	Logging Logging       `yaml:"logging"`
+	Station Station       `yaml:"station"`
+	Link    Link          `yaml:"link"`
+	Duty    DutyCycle     `yaml:"duty_cycle"`
+	LBT     LBT           `yaml:"lbt"`
+	ADR     ADR           `yaml:"adr"`
+	FSK     FSK           `yaml:"fsk"`
+	Capture Capture       `yaml:"capture"`
 	MQTT    MQTT          `yaml:"mqtt"`
 	SPI     SPI           `yaml:"spi"`
 	I2C     I2C           `yaml:"i2c"`
@@ -33,7 +37,118 @@ type Config struct {
 // = Logging ===
 // ------------------------------------------------------------------------
 type Logging struct {
-	LogLevel string `yaml:"log_level"`
+	LogLevel   string            `yaml:"log_level" env:"LOG_LEVEL" env-default:"DEBUG"`
+	Format     string            `yaml:"format" env:"LOG_FORMAT" env-default:"text"`
+	File       string            `yaml:"file" env:"LOG_FILE"`                          // Empty - stdout
+	MaxSize    uint16            `yaml:"max_size" env:"LOG_MAX_SIZE" env-default:"10"` // MiB
+	MaxBackups uint8             `yaml:"max_backups" env:"LOG_MAX_BACKUPS" env-default:"3"`
+	Packages   map[string]string `yaml:"packages" env:"LOG_PACKAGES" env-separator:","` // Package name -> level
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Station ===
+// ------------------------------------------------------------------------
+type Station struct {
+	Interval      time.Duration `yaml:"interval" env:"STATION_INTERVAL" env-default:"60s"`
+	RxWindow      time.Duration `yaml:"rx_window" env:"STATION_RX_WINDOW" env-default:"5s"`
+	RetryInterval time.Duration `yaml:"retry_interval" env:"STATION_RETRY_INTERVAL" env-default:"30s"`
+	Address       uint16        `yaml:"address" env:"STATION_ADDRESS" env-default:"1"` // Source address of every packet
+	Gateway       uint16        `yaml:"gateway" env:"STATION_GATEWAY" env-default:"0"` // Destination of telemetry; the gateway itself has address = gateway
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Link ===
+// ------------------------------------------------------------------------
+type Link struct {
+	Reliable bool          `yaml:"reliable" env:"LINK_RELIABLE" env-default:"false"` // Unicast packets wait for an ACK
+	Retries  uint8         `yaml:"retries" env:"LINK_RETRIES" env-default:"3"`
+	Backoff  time.Duration `yaml:"backoff" env:"LINK_BACKOFF" env-default:"1s"` // Base of the randomized exponential backoff
+
+	Fragment          bool          `yaml:"fragment" env:"LINK_FRAGMENT" env-default:"false"`     // Split messages larger than payload_length
+	MaxMessage        uint16        `yaml:"max_message" env:"LINK_MAX_MESSAGE" env-default:"512"` // Bytes
+	ReassemblyTimeout time.Duration `yaml:"reassembly_timeout" env:"LINK_REASSEMBLY_TIMEOUT" env-default:"30s"`
+	MaxPartials       uint8         `yaml:"max_partials" env:"LINK_MAX_PARTIALS" env-default:"4"` // Messages in reassembly per peer
+
+	Encrypt       bool   `yaml:"encrypt" env:"LINK_ENCRYPT" env-default:"false"`
+	NetworkSecret string `yaml:"network_secret" env:"LINK_NETWORK_SECRET"` // Hex AES-128 / AES-256 key shared by the network
+	CounterFile   string `yaml:"counter_file" env:"LINK_COUNTER_FILE" env-default:"counters.json"`
+
+	StatsInterval time.Duration `yaml:"stats_interval" env:"LINK_STATS_INTERVAL" env-default:"1m"` // Modem packet counters as readings; 0 - off
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Duty cycle ===
+// ------------------------------------------------------------------------
+type DutyCycle struct {
+	Enable   bool            `yaml:"enable" env:"DUTY_CYCLE_ENABLE" env-default:"true"`
+	Window   time.Duration   `yaml:"window" env:"DUTY_CYCLE_WINDOW" env-default:"1h"`  // Rolling window the limits apply to
+	Delay    bool            `yaml:"delay" env:"DUTY_CYCLE_DELAY" env-default:"false"` // Wait for budget instead of rejecting
+	MaxDelay time.Duration   `yaml:"max_delay" env:"DUTY_CYCLE_MAX_DELAY" env-default:"5m"`
+	Bands    map[string]Band `yaml:"bands"` // Empty - ETSI EN 300 220 sub-bands
+}
+
+type Band struct {
+	Low   uint32  `yaml:"low"`   // Hz
+	High  uint32  `yaml:"high"`  // Hz
+	Limit float64 `yaml:"limit"` // Percent of the window
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Listen before talk ===
+// ------------------------------------------------------------------------
+type LBT struct {
+	Enable   bool          `yaml:"enable" env:"LBT_ENABLE" env-default:"false"` // CAD before every Tx, LoRa only
+	Attempts uint8         `yaml:"attempts" env:"LBT_ATTEMPTS" env-default:"5"`
+	Backoff  time.Duration `yaml:"backoff" env:"LBT_BACKOFF" env-default:"100ms"` // Base of the randomized exponential backoff
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = ADR ===
+// ------------------------------------------------------------------------
+// ADR lets the gateway pick the Tx power of each station from its SNR; the SF stays
+// sx126x.lora.spreading_factor, the only one a single SX126x gateway hears
+type ADR struct {
+	Enable       bool    `yaml:"enable" env:"ADR_ENABLE" env-default:"false"`
+	History      uint8   `yaml:"history" env:"ADR_HISTORY" env-default:"20"`            // Uplinks per recommendation, gateway only
+	Margin       float32 `yaml:"margin" env:"ADR_MARGIN" env-default:"10"`              // dB kept above the demodulation floor, gateway only
+	MinTxPower   int8    `yaml:"min_tx_power" env:"ADR_MIN_TX_POWER" env-default:"2"`   // dBm
+	MaxTxPower   int8    `yaml:"max_tx_power" env:"ADR_MAX_TX_POWER" env-default:"14"`  // dBm
+	FallbackAcks uint8   `yaml:"fallback_acks" env:"ADR_FALLBACK_ACKS" env-default:"3"` // Missed ACKs in a row before max_tx_power; 0 - never
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = FSK ===
+// ------------------------------------------------------------------------
+// FSK holds the GFSK settings sx126x.fsk has no keys for
+type FSK struct {
+	SyncWord         string `yaml:"sync_word" env:"FSK_SYNC_WORD" env-default:"C194C1"` // Hex, 1 - 8 bytes
+	NodeAddress      uint8  `yaml:"node_address" env:"FSK_NODE_ADDRESS" env-default:"0"`
+	BroadcastAddress uint8  `yaml:"broadcast_address" env:"FSK_BROADCAST_ADDRESS" env-default:"255"`
+	PreambleLength   uint16 `yaml:"preamble_length" env:"FSK_PREAMBLE_LENGTH" env-default:"32"` // Bits, sx126x.preamble_length counts LoRa symbols
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Capture ===
+// ------------------------------------------------------------------------
+// Capture records LoRa traffic and replays it instead of the SX126x
+type Capture struct {
+	File   string  `yaml:"file" env:"CAPTURE_FILE"`                   // Empty - no recording; JSON lines, appended
+	Replay string  `yaml:"replay" env:"CAPTURE_REPLAY"`               // Capture or message_debug output fed through Rx; empty - SX126x
+	Speed  float64 `yaml:"speed" env:"CAPTURE_SPEED" env-default:"1"` // Replay pace; 1 - original, 0 - as fast as frames are read
 }
 
 // ------------------------------------------------------------------------
@@ -49,9 +164,12 @@ type MQTT struct {
 	KeepAlive         time.Duration `yaml:"keep_alive" env:"MQTT_KEEP_ALIVE" env-default:"60s"`
 	ReconnectInterval time.Duration `yaml:"reconnect_interval" env:"MQTT_RECONNECT_INTERVAL" env-default:"10s"`
 	AutoReconnect     bool          `yaml:"auto_reconnect" env:"MQTT_AUTO_RECONNECT" env-default:"true"`
+	PublishInterval   time.Duration `yaml:"publish_interval" env:"MQTT_PUBLISH_INTERVAL" env-default:"10s"`
 	DeviceName        string        `yaml:"device_name" env:"MQTT_DEVICE_NAME" env-default:"example"`
 	Username          string        `yaml:"username" env:"MQTT_USERNAME"` // Empty by default
 	Password          string        `yaml:"password" env:"MQTT_PASSWORD"` // Empty by default
+	Discovery         bool          `yaml:"discovery" env:"MQTT_DISCOVERY" env-default:"true"`
+	DiscoveryPrefix   string        `yaml:"discovery_prefix" env:"MQTT_DISCOVERY_PREFIX" env-default:"homeassistant"`
 }
 
 // ------------------------------------------------------------------------
@@ -133,11 +251,18 @@ type BME280 struct {
 }
 
 type bme280Device struct {
-	Enable   bool   `yaml:"enable" env:"BME280_ENABLE" env-default:"false"`
-	Name     string `yaml:"name" env:"BME280_DEVICE"`
-	UseI2C   bool   `yaml:"use_i2c" env:"BME280_USE_I2C" env-default:"true"`
-	Address  uint8  `yaml:"address" env:"BME280_ADDRESS" env-default:"0x76"`
-	Location string `yaml:"location" env:"BME280_LOCATION"`
+	Enable        bool          `yaml:"enable" env:"BME280_ENABLE" env-default:"false"`
+	Name          string        `yaml:"name" env:"BME280_DEVICE"`
+	UseI2C        bool          `yaml:"use_i2c" env:"BME280_USE_I2C" env-default:"true"`
+	Bus           string        `yaml:"bus" env:"BME280_BUS" env-default:"i2c1"`
+	Address       uint8         `yaml:"address" env:"BME280_ADDRESS" env-default:"0x76"`
+	OversamplingT uint8         `yaml:"oversampling_temperature" env:"BME280_OVERSAMPLING_TEMPERATURE" env-default:"1"`
+	OversamplingP uint8         `yaml:"oversampling_pressure" env:"BME280_OVERSAMPLING_PRESSURE" env-default:"1"`
+	OversamplingH uint8         `yaml:"oversampling_humidity" env:"BME280_OVERSAMPLING_HUMIDITY" env-default:"1"`
+	Filter        uint8         `yaml:"filter" env:"BME280_FILTER" env-default:"0"`
+	StandbyTime   time.Duration `yaml:"standby_time" env:"BME280_STANDBY_TIME" env-default:"1s"`
+	Interval      time.Duration `yaml:"interval" env:"BME280_INTERVAL" env-default:"10s"`
+	Location      string        `yaml:"location" env:"BME280_LOCATION"`
 }
 
 // ------------------------------------------------------------------------
@@ -151,11 +276,15 @@ type DHT struct {
 }
 
 type dhtDevice struct {
-	Enable   bool   `yaml:"enable" env:"DHT_ENABLE" env-default:"false"`
-	Name     string `yaml:"name" env:"DHT_NAME"`
-	Type     uint8  `yaml:"type" env:"DHT_TYPE" env-default:"20"`
-	Address  uint8  `yaml:"address" env:"DHT_ADDRESS" env-default:"56"` // Aka 0x38
-	Location string `yaml:"location" env:"DHT_LOCATION"`
+	Enable   bool          `yaml:"enable" env:"DHT_ENABLE" env-default:"false"`
+	Name     string        `yaml:"name" env:"DHT_NAME"`
+	Type     uint8         `yaml:"type" env:"DHT_TYPE" env-default:"20"`
+	Bus      string        `yaml:"bus" env:"DHT_BUS" env-default:"i2c1"`       // DHT20 only
+	Address  uint8         `yaml:"address" env:"DHT_ADDRESS" env-default:"56"` // Aka 0x38
+	Pin      string        `yaml:"pin" env:"DHT_PIN" env-default:"GPIO4"`      // DHT11 / DHT22 only
+	Interval time.Duration `yaml:"interval" env:"DHT_INTERVAL" env-default:"10s"`
+	Retries  uint8         `yaml:"retries" env:"DHT_RETRIES" env-default:"3"`
+	Location string        `yaml:"location" env:"DHT_LOCATION"`
 }
 
 // ------------------------------------------------------------------------
@@ -164,14 +293,19 @@ type dhtDevice struct {
 // = DS18B20 === TO BE REMOVED FROM HERE
 // ------------------------------------------------------------------------
 type DS18B20 struct {
-	Enable  bool                     `yaml:"enable" env:"DS18B20_ENABLE" env-default:"false"`
-	Devices map[string]ds18b20Device `yaml:"device"`
+	Enable   bool                     `yaml:"enable" env:"DS18B20_ENABLE" env-default:"false"`
+	Interval time.Duration            `yaml:"interval" env:"DS18B20_INTERVAL" env-default:"10s"` // All probes on a bus convert at once
+	Rescan   time.Duration            `yaml:"rescan" env:"DS18B20_RESCAN" env-default:"10m"`
+	Devices  map[string]ds18b20Device `yaml:"device"`
 }
 
 type ds18b20Device struct {
-	Enable   bool   `yaml:"enable" env:"DS18B20_ENABLE" env-default:"false"`
-	Name     string `yaml:"name" env:"DS18B20_NAME"`
-	Location string `yaml:"location" env:"DS18B20_LOCATION"`
+	Enable     bool   `yaml:"enable" env:"DS18B20_ENABLE" env-default:"false"`
+	Name       string `yaml:"name" env:"DS18B20_NAME"`
+	Bus        string `yaml:"bus" env:"DS18B20_BUS" env-default:"ow0"`
+	ROM        string `yaml:"rom" env:"DS18B20_ROM"` // 28-0000012345ab
+	Resolution uint8  `yaml:"resolution" env:"DS18B20_RESOLUTION" env-default:"12"`
+	Location   string `yaml:"location" env:"DS18B20_LOCATION"`
 }
 
 // ------------------------------------------------------------------------
@@ -185,30 +319,16 @@ type PMS5003 struct {
 }
 
 type pms5003Device struct {
-	Enable               bool   `yaml:"enable" env:"PMS5003_ENABLE" env-default:"false"`
-	Name                 string `yaml:"name" env:"PMS5003_NAME"`
-	HumidityCompensation bool   `yaml:"humidity_compensation" env:"PMS5003_HUMIDITY_COMPENSATION" env-default:"false"`
-	UseDHT               bool   `yaml:"use_dht" env:"PMS5003_USE_DHT" env-default:"false"`
-	UseBME               bool   `yaml:"use_bme" env:"PMS5003_USE_BME" env-default:"false"`
-	NormalizeData        bool   `yaml:"normalize_data" env:"PMS5003_NORMALIZE_DATA" env-default:"false"`
-	Location             string `yaml:"location" env:"PMS5003_LOCATION"`
-}
-
-func LoadConfig(path string) (*Config, error) {
-	cfg := &Config{}
-
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		if err := cleanenv.ReadEnv(cfg); err != nil {
-			return nil, fmt.Errorf("Config file not found and failed to read ENV: %w", err)
-		}
-
-		return cfg, nil
-	}
-
-	err := cleanenv.ReadConfig(path, cfg)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to read config file '%s': %w", path, err)
-	}
-
-	return cfg, nil
+	Enable               bool          `yaml:"enable" env:"PMS5003_ENABLE" env-default:"false"`
+	Name                 string        `yaml:"name" env:"PMS5003_NAME"`
+	Port                 string        `yaml:"port" env:"PMS5003_PORT" env-default:"uart0"`
+	Mode                 string        `yaml:"mode" env:"PMS5003_MODE" env-default:"passive"`
+	Interval             time.Duration `yaml:"interval" env:"PMS5003_INTERVAL" env-default:"60s"`
+	Sleep                bool          `yaml:"sleep" env:"PMS5003_SLEEP" env-default:"false"` // Passive mode only
+	HumidityCompensation bool          `yaml:"humidity_compensation" env:"PMS5003_HUMIDITY_COMPENSATION" env-default:"false"`
+	UseDHT               bool          `yaml:"use_dht" env:"PMS5003_USE_DHT" env-default:"false"`
+	UseBME               bool          `yaml:"use_bme" env:"PMS5003_USE_BME" env-default:"false"`
+	NormalizeData        bool          `yaml:"normalize_data" env:"PMS5003_NORMALIZE_DATA" env-default:"false"`
+	Samples              uint8         `yaml:"samples" env:"PMS5003_SAMPLES" env-default:"5"`
+	Location             string        `yaml:"location" env:"PMS5003_LOCATION"`
 }
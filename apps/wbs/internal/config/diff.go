@@ -0,0 +1,156 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Change is a single value that differs between two configs; Path is the YAML path.
+type Change struct {
+	Path string
+	Old  any
+	New  any
+}
+
+func (c Change) String() string {
+	if c.Secret() {
+		return fmt.Sprintf("%s: changed", c.Path)
+	}
+	return fmt.Sprintf("%s: %v -> %v", c.Path, c.Old, c.New)
+}
+
+// Secret reports whether the values must not end up in logs
+func (c Change) Secret() bool {
+	return secret(c.Path)
+}
+
+func secret(path string) bool {
+	path = strings.ToLower(path)
+	return strings.Contains(path, "password") || strings.Contains(path, "secret") || strings.Contains(path, "token")
+}
+
+// Diff lists every leaf value that differs between old and new, sorted by path.
+func Diff(old, new *Config) []Change {
+	var changes []Change
+	diff("", reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem(), &changes)
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+func diff(path string, old, new reflect.Value, changes *[]Change) {
+	switch old.Kind() {
+	case reflect.Struct:
+		t := old.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			diff(join(path, yamlName(field)), old.Field(i), new.Field(i), changes)
+		}
+
+	case reflect.Map:
+		keys := make(map[string]reflect.Value)
+		for _, k := range old.MapKeys() {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		for _, k := range new.MapKeys() {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+
+		for name, k := range keys {
+			o, n := old.MapIndex(k), new.MapIndex(k)
+			switch {
+			case !o.IsValid():
+				*changes = append(*changes, Change{Path: join(path, name), Old: nil, New: n.Interface()})
+			case !n.IsValid():
+				*changes = append(*changes, Change{Path: join(path, name), Old: o.Interface(), New: nil})
+			default:
+				diff(join(path, name), o, n, changes)
+			}
+		}
+
+	default:
+		if !reflect.DeepEqual(old.Interface(), new.Interface()) {
+			*changes = append(*changes, Change{Path: path, Old: old.Interface(), New: new.Interface()})
+		}
+	}
+}
+
+// Revert sets the value at path in cfg back to its value in old; a map entry old doesn't
+// have is removed. Maps on the way are copied first, so whoever holds on to cfg's maps
+// doesn't see the change.
+func Revert(cfg, old *Config, path string) {
+	revert(reflect.ValueOf(cfg).Elem(), reflect.ValueOf(old).Elem(), strings.Split(path, "."))
+}
+
+func revert(dst, src reflect.Value, path []string) {
+	if len(path) == 0 {
+		dst.Set(src)
+		return
+	}
+
+	switch dst.Kind() {
+	case reflect.Struct:
+		t := dst.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.IsExported() && yamlName(field) == path[0] {
+				revert(dst.Field(i), src.Field(i), path[1:])
+				return
+			}
+		}
+
+	case reflect.Map:
+		var key reflect.Value
+		for _, m := range []reflect.Value{dst, src} {
+			for _, k := range m.MapKeys() {
+				if fmt.Sprint(k.Interface()) == path[0] {
+					key = k
+				}
+			}
+		}
+		if !key.IsValid() {
+			return
+		}
+
+		copied := reflect.MakeMapWithSize(dst.Type(), dst.Len())
+		iter := dst.MapRange()
+		for iter.Next() {
+			copied.SetMapIndex(iter.Key(), iter.Value())
+		}
+		dst.Set(copied)
+
+		o, n := src.MapIndex(key), dst.MapIndex(key)
+		switch {
+		case !o.IsValid():
+			dst.SetMapIndex(key, reflect.Value{})
+		case !n.IsValid() || len(path) == 1:
+			dst.SetMapIndex(key, o)
+		default:
+			// Map values aren't addressable; change a copy and put it back
+			v := reflect.New(n.Type()).Elem()
+			v.Set(n)
+			revert(v, o, path[1:])
+			dst.SetMapIndex(key, v)
+		}
+	}
+}
+
+func yamlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
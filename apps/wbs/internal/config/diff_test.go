@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func diffConfigs() (old, new *Config) {
+	old = &Config{
+		Station: Station{Interval: time.Minute, Address: 1},
+		Link:    Link{NetworkSecret: "00112233"},
+		BME280: BME280{Enable: true, Devices: map[string]bme280Device{
+			"bme280_0": {Enable: true, Name: "attic", Address: 0x76},
+			"bme280_1": {Enable: true, Name: "cellar", Address: 0x77},
+		}},
+	}
+	new = &Config{
+		Station: Station{Interval: 30 * time.Second, Address: 1},
+		Link:    Link{NetworkSecret: "44556677"},
+		BME280: BME280{Enable: true, Devices: map[string]bme280Device{
+			"bme280_0": {Enable: true, Name: "loft", Address: 0x76},
+			"bme280_2": {Enable: true, Name: "garage", Address: 0x77},
+		}},
+	}
+	return old, new
+}
+
+func TestDiff(t *testing.T) {
+	old, new := diffConfigs()
+
+	changes := Diff(old, new)
+	got := make([]string, 0, len(changes))
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+
+	want := []string{
+		"bme280.device.bme280_0.name: attic -> loft",
+		fmt.Sprintf("bme280.device.bme280_1: %v -> <nil>", old.BME280.Devices["bme280_1"]),
+		fmt.Sprintf("bme280.device.bme280_2: <nil> -> %v", new.BME280.Devices["bme280_2"]),
+		"link.network_secret: changed",
+		"station.interval: 1m0s -> 30s",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Diff =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if changes := Diff(old, old); len(changes) != 0 {
+		t.Errorf("Diff of the same config = %v", changes)
+	}
+}
+
+func TestRevert(t *testing.T) {
+	old, new := diffConfigs()
+	devices := new.BME280.Devices
+
+	Revert(new, old, "station.interval")
+	Revert(new, old, "bme280.device.bme280_0.name")
+	Revert(new, old, "bme280.device.bme280_1")
+	Revert(new, old, "bme280.device.bme280_2")
+	Revert(new, old, "link.network_secret")
+
+	if changes := Diff(old, new); len(changes) != 0 {
+		t.Errorf("left after Revert: %v", changes)
+	}
+
+	// Whoever holds the map of new still sees it unchanged
+	if len(devices) != 2 || devices["bme280_0"].Name != "loft" || devices["bme280_2"].Name != "garage" {
+		t.Errorf("original map changed to %v", devices)
+	}
+}
+
+// A single field of an entry goes back, the rest of the entry stays new
+func TestRevertField(t *testing.T) {
+	old, new := diffConfigs()
+	new.BME280.Devices["bme280_0"] = bme280Device{Enable: true, Name: "loft", Address: 0x77}
+
+	Revert(new, old, "bme280.device.bme280_0.name")
+
+	if dev := new.BME280.Devices["bme280_0"]; dev.Name != "attic" || dev.Address != 0x77 {
+		t.Errorf("bme280_0 = %+v, want attic at 0x77", dev)
+	}
+	if _, ok := new.BME280.Devices["bme280_2"]; !ok {
+		t.Error("bme280_2 reverted too")
+	}
+}
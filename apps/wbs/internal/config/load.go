@@ -0,0 +1,325 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Indexed env keys are the YAML path in upper case, "__" between the segments and
+// the "device" segment of map sections left out, e.g. WBS_SPI__SPI1__SPEED.
+const envPrefix = "WBS_"
+
+type Layer string
+
+const (
+	LayerDefault Layer = "default"
+	LayerFile    Layer = "file"
+	LayerEnv     Layer = "env"
+)
+
+// Origin tells which layer set a value; Name is the file path or the env variable.
+type Origin struct {
+	Layer Layer
+	Name  string
+}
+
+func (o Origin) String() string {
+	if o.Name == "" {
+		return string(o.Layer)
+	}
+	return fmt.Sprintf("%s %s", o.Layer, o.Name)
+}
+
+// leaf is a single settable value of the config tree
+type leaf struct {
+	path   string // YAML path, spi.device.spi1.speed
+	env    string // Indexed env key, WBS_SPI__SPI1__SPEED
+	field  reflect.StructField
+	value  reflect.Value
+	legacy bool // Outside of map entries, the env tag still applies
+}
+
+func LoadConfig(path string) (*Config, error) {
+	cfg, _, err := Load(path)
+	return cfg, err
+}
+
+// Load applies the layers in order: env-default tags, then the file (when it exists),
+// then the env tags of non-map fields, then indexed WBS_ keys. Indexed keys may also
+// add map entries the file doesn't have.
+func Load(path string) (*Config, map[string]Origin, error) {
+	cfg := &Config{}
+	present := make(map[string]bool)
+
+	if data, err := os.ReadFile(path); err == nil {
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, nil, fmt.Errorf("Failed to read config file '%s': %w", path, err)
+		}
+
+		var root yaml.Node
+		if err := yaml.Unmarshal(data, &root); err != nil {
+			return nil, nil, fmt.Errorf("Failed to read config file '%s': %w", path, err)
+		}
+		if len(root.Content) > 0 {
+			collectPaths(root.Content[0], "", present)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("Failed to read config file '%s': %w", path, err)
+	}
+
+	origins := make(map[string]Origin)
+	err := walk(reflect.ValueOf(cfg).Elem(), "", "", false, func(l leaf) error {
+		origins[l.path] = Origin{Layer: LayerDefault}
+
+		if present[l.path] {
+			origins[l.path] = Origin{Layer: LayerFile, Name: path}
+		} else if def, ok := l.field.Tag.Lookup("env-default"); ok {
+			if err := setValue(l.value, def, separator(l.field)); err != nil {
+				return fmt.Errorf("Invalid default for %s: %w", l.path, err)
+			}
+		}
+
+		if name := l.field.Tag.Get("env"); l.legacy && name != "" {
+			if s, ok := os.LookupEnv(name); ok {
+				if err := setValue(l.value, s, separator(l.field)); err != nil {
+					return fmt.Errorf("Invalid value of %s for %s: %w", name, l.path, err)
+				}
+				origins[l.path] = Origin{Layer: LayerEnv, Name: name}
+			}
+		}
+
+		if s, ok := os.LookupEnv(l.env); ok {
+			if err := setValue(l.value, s, separator(l.field)); err != nil {
+				return fmt.Errorf("Invalid value of %s for %s: %w", l.env, l.path, err)
+			}
+			origins[l.path] = Origin{Layer: LayerEnv, Name: l.env}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cfg, origins, nil
+}
+
+// PrintEffective writes every value with the layer it came from; secrets are masked.
+func PrintEffective(w io.Writer, cfg *Config, origins map[string]Origin) error {
+	return walk(reflect.ValueOf(cfg).Elem(), "", "", false, func(l leaf) error {
+		value := fmt.Sprintf("%v", l.value.Interface())
+		if secret(l.path) && value != "" {
+			value = "***"
+		}
+
+		_, err := fmt.Fprintf(w, "%-50s = %-24s # %s\n", l.path, value, origins[l.path])
+		return err
+	})
+}
+
+// collectPaths records the path of every key present in the YAML document
+func collectPaths(node *yaml.Node, path string, present map[string]bool) {
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		p := join(path, node.Content[i].Value)
+		present[p] = true
+		collectPaths(node.Content[i+1], p, present)
+	}
+}
+
+func walk(v reflect.Value, path, env string, inMap bool, fn func(leaf) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := yamlName(field)
+		fv := v.Field(i)
+
+		switch {
+		case fv.Kind() == reflect.Map && fv.Type().Elem().Kind() == reflect.Struct:
+			// Device maps are the common case, their segment is left out of env names
+			mapEnv := env
+			if name != "device" {
+				mapEnv = envJoin(env, name)
+			}
+			if err := walkMap(fv, join(path, name), mapEnv, fn); err != nil {
+				return err
+			}
+		case fv.Kind() == reflect.Struct:
+			if err := walk(fv, join(path, name), envJoin(env, name), inMap, fn); err != nil {
+				return err
+			}
+		default:
+			if err := fn(leaf{path: join(path, name), env: envJoin(env, name), field: field, value: fv, legacy: !inMap}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// walkMap descends into every entry of a map of structs; map values aren't addressable,
+// so each entry is copied out, walked and stored back.
+func walkMap(m reflect.Value, path, env string, fn func(leaf) error) error {
+	if m.IsNil() {
+		m.Set(reflect.MakeMap(m.Type()))
+	}
+
+	existing := make(map[string]string)
+	for _, k := range m.MapKeys() {
+		existing[strings.ToUpper(k.String())] = k.String()
+	}
+
+	// Entries only defined through the environment
+	prefix := envJoin(env, "") + "__"
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok {
+			continue
+		}
+		key, _, ok := strings.Cut(rest, "__")
+		if !ok || key == "" {
+			continue
+		}
+		if _, ok := existing[key]; !ok {
+			existing[key] = strings.ToLower(key)
+			m.SetMapIndex(reflect.ValueOf(existing[key]).Convert(m.Type().Key()), reflect.Zero(m.Type().Elem()))
+		}
+	}
+
+	keys := make([]string, 0, len(existing))
+	for _, k := range existing {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		key := reflect.ValueOf(k).Convert(m.Type().Key())
+
+		entry := reflect.New(m.Type().Elem()).Elem()
+		entry.Set(m.MapIndex(key))
+
+		if err := walk(entry, join(path, k), envJoin(env, k), true, fn); err != nil {
+			return err
+		}
+		m.SetMapIndex(key, entry)
+	}
+	return nil
+}
+
+func envJoin(env, name string) string {
+	name = strings.ToUpper(name)
+	if env == "" {
+		return strings.TrimSuffix(envPrefix+name, "_")
+	}
+	if name == "" {
+		return env
+	}
+	return env + "__" + name
+}
+
+func separator(field reflect.StructField) string {
+	if sep := field.Tag.Get("env-separator"); sep != "" {
+		return sep
+	}
+	return ","
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setValue parses s into v; lists are split on sep, maps are sep separated key:value pairs.
+func setValue(v reflect.Value, s, sep string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		parts := strings.Split(s, sep)
+		list := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			if err := setValue(list.Index(i), strings.TrimSpace(p), sep); err != nil {
+				return err
+			}
+		}
+		v.Set(list)
+	case reflect.Array:
+		parts := strings.Split(s, sep)
+		if len(parts) != v.Len() {
+			return fmt.Errorf("expected %d values, got %d", v.Len(), len(parts))
+		}
+		for i, p := range parts {
+			if err := setValue(v.Index(i), strings.TrimSpace(p), sep); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		for _, pair := range strings.Split(s, sep) {
+			k, val, ok := strings.Cut(pair, ":")
+			if !ok {
+				return fmt.Errorf("expected key:value, got %q", pair)
+			}
+
+			key := reflect.New(v.Type().Key()).Elem()
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := setValue(key, strings.TrimSpace(k), sep); err != nil {
+				return err
+			}
+			if err := setValue(elem, strings.TrimSpace(val), sep); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, elem)
+		}
+		v.Set(m)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
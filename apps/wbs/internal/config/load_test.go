@@ -0,0 +1,143 @@
+package config
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Each layer wins over the ones before it: default < file < env tag < WBS_ key
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		env    map[string]string
+		want   time.Duration
+		origin string
+	}{
+		{"default", "", nil, 60 * time.Second, "default"},
+		{"file", "station:\n  interval: 30s\n", nil, 30 * time.Second, "file"},
+		{"env tag", "station:\n  interval: 30s\n", map[string]string{"STATION_INTERVAL": "20s"}, 20 * time.Second, "env STATION_INTERVAL"},
+		{"indexed", "station:\n  interval: 30s\n", map[string]string{"STATION_INTERVAL": "20s", "WBS_STATION__INTERVAL": "10s"}, 10 * time.Second, "env WBS_STATION__INTERVAL"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if tt.file != "" {
+				writeConfig(t, path, tt.file)
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			cfg, origins, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Station.Interval != tt.want {
+				t.Errorf("interval %v, want %v", cfg.Station.Interval, tt.want)
+			}
+			if o := origins["station.interval"]; !strings.HasPrefix(o.String(), tt.origin) {
+				t.Errorf("origin %q, want %q", o, tt.origin)
+			}
+		})
+	}
+}
+
+func TestLoadMapEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, `
+bme280:
+  device:
+    bme280_0:
+      enable: true
+      address: 0x76
+`)
+
+	// Env tags are for the old single device layout, they don't reach map entries
+	t.Setenv("BME280_ADDRESS", "0x10")
+	t.Setenv("WBS_BME280__BME280_0__NAME", "attic")
+	// An entry the file doesn't have, with the defaults of every other key
+	t.Setenv("WBS_BME280__BME280_1__ENABLE", "true")
+	t.Setenv("WBS_BME280__BME280_1__ADDRESS", "0x77")
+
+	cfg, origins, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dev := cfg.BME280.Devices["bme280_0"]; dev.Address != 0x76 || dev.Name != "attic" || dev.Bus != "i2c1" {
+		t.Errorf("bme280_0 = %+v, want attic at 0x76 on i2c1", dev)
+	}
+	dev, ok := cfg.BME280.Devices["bme280_1"]
+	if !ok {
+		t.Fatal("bme280_1 not created from the environment")
+	}
+	if dev.Enable == false || dev.Address != 0x77 || dev.Bus != "i2c1" || dev.Interval != 10*time.Second {
+		t.Errorf("bme280_1 = %+v, want enabled at 0x77 with defaults", dev)
+	}
+	if o := origins["bme280.device.bme280_1.address"]; o.Name != "WBS_BME280__BME280_1__ADDRESS" {
+		t.Errorf("bme280_1 address from %s", o)
+	}
+	if o := origins["bme280.device.bme280_1.bus"]; o.Layer != LayerDefault {
+		t.Errorf("bme280_1 bus from %s, want default", o)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	writeConfig(t, path, "station: [\n")
+	if _, _, err := Load(path); err == nil {
+		t.Error("Load of broken YAML succeeded")
+	}
+
+	writeConfig(t, path, "")
+	t.Setenv("WBS_STATION__INTERVAL", "soon")
+	if _, _, err := Load(path); err == nil || strings.Contains(err.Error(), "WBS_STATION__INTERVAL") == false {
+		t.Errorf("Load = %v, want an error naming WBS_STATION__INTERVAL", err)
+	}
+}
+
+func TestPrintEffective(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, `
+mqtt:
+  username: "wbs"
+  password: "hunter2"
+`)
+	t.Setenv("WBS_LINK__NETWORK_SECRET", "000102030405060708090a0b0c0d0e0f")
+	t.Setenv("WBS_STATION__ADDRESS", "7")
+
+	cfg, origins, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := PrintEffective(&buf, cfg, origins); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, leaked := range []string{"hunter2", "000102030405060708090a0b0c0d0e0f"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("%s printed", leaked)
+		}
+	}
+	for _, line := range []string{
+		`mqtt\.username += wbs +# file .*config\.yaml`,
+		`mqtt\.password += \*\*\* +# file .*`,
+		`link\.network_secret += \*\*\* +# env WBS_LINK__NETWORK_SECRET`,
+		`station\.address += 7 +# env WBS_STATION__ADDRESS`,
+		`station\.interval += 1m0s +# default`,
+	} {
+		if regexp.MustCompile(`(?m)^`+line+`$`).MatchString(out) == false {
+			t.Errorf("no line %s in\n%s", line, out)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"periph.io/x/conn/v3/uart"
+)
+
+// Problem is a single invalid value; Path is the YAML path of the offending key.
+type Problem struct {
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// ValidationError carries every problem found by Validate, not just the first one.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		lines = append(lines, p.String())
+	}
+	return fmt.Sprintf("%d config problem(s): %s", len(e.Problems), strings.Join(lines, "; "))
+}
+
+type validator struct {
+	problems []Problem
+}
+
+func (v *validator) addf(path, format string, args ...any) {
+	v.problems = append(v.problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks the values the HAL and LoRa setup would otherwise silently replace
+// with defaults. It touches no hardware, so it can run before anything is opened.
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	v.sx126x(c)
+	v.link(c)
+	v.dutyCycle(c)
+	v.lbt(c)
+	v.adr(c)
+	v.capture(c)
+	v.uart(c)
+	v.i2c(c)
+
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: v.problems}
+}
+
+// ************************************************************************
+// = SX126X ===
+// ------------------------------------------------------------------------
+var (
+	// 13.4.4 SetTxParams
+	txPowerRange = map[string][2]int8{
+		"1261": {-17, 15},
+		"1262": {-9, 22},
+	}
+
+	// 9.2.1 Image Calibration for Specific Frequency Bands
+	frequencyRanges = map[[2]uint16]bool{
+		{430, 440}: true,
+		{470, 510}: true,
+		{779, 787}: true,
+		{863, 870}: true,
+		{902, 928}: true,
+	}
+
+	rampTimes    = map[uint16]bool{10: true, 20: true, 40: true, 80: true, 200: true, 800: true, 1700: true, 3400: true}
+	standbyModes = map[string]bool{"rc": true, "xosc": true}
+	sleepModes   = map[string]bool{"cold_start": true, "warm_start": true, "cold_start_rtc": true, "warm_start_rtc": true}
+	modems       = map[string]bool{"lora": true, "fsk": true}
+
+	// 13.4.5.2 LoRa ModParam2 - BW
+	loraBandwidths = map[uint32]bool{7810: true, 10420: true, 15630: true, 20830: true, 31250: true, 41670: true, 62500: true, 125000: true, 250000: true, 500000: true}
+
+	// 13.4.7 SetCadParams - cadSymbolNum
+	cadSymbols = map[uint8]bool{1: true, 2: true, 4: true, 8: true, 16: true}
+
+	tcxoVoltages = map[float32]bool{0: true, 1.6: true, 1.7: true, 1.8: true, 2.2: true, 2.4: true, 2.7: true, 3.0: true, 3.3: true}
+)
+
+func (v *validator) sx126x(c *Config) {
+	cfg := &c.SX126X
+	if cfg.Enable == false {
+		return
+	}
+
+	if !modems[cfg.Modem] {
+		v.addf("sx126x.modem", "unknown modem %q; lora / fsk", cfg.Modem)
+	}
+
+	if power, ok := txPowerRange[cfg.Type]; !ok {
+		v.addf("sx126x.type", "unknown type %q; 1261 / 1262", cfg.Type)
+	} else if cfg.TransmitPower < power[0] || cfg.TransmitPower > power[1] {
+		v.addf("sx126x.tx_power", "%d dBm out of range for SX%s; %d - %d dBm", cfg.TransmitPower, cfg.Type, power[0], power[1])
+	}
+
+	if !frequencyRanges[cfg.FrequencyRange] {
+		v.addf("sx126x.frequency_range", "unknown range %d-%d; 430-440 ; 470-510 ; 779-787 ; 863-870 ; 902-928", cfg.FrequencyRange[0], cfg.FrequencyRange[1])
+	} else if low, high := uint32(cfg.FrequencyRange[0])*1_000_000, uint32(cfg.FrequencyRange[1])*1_000_000; cfg.Frequency < low || cfg.Frequency > high {
+		v.addf("sx126x.frequency", "%d Hz outside of frequency_range %d-%d MHz", cfg.Frequency, cfg.FrequencyRange[0], cfg.FrequencyRange[1])
+	}
+
+	if !rampTimes[cfg.RampTime] {
+		v.addf("sx126x.ramp_time", "unknown ramp time %d us; 10 ; 20 ; 40 ; 80 ; 200 ; 800 ; 1700 ; 3400", cfg.RampTime)
+	}
+	if !standbyModes[cfg.StandbyMode] {
+		v.addf("sx126x.standby_mode", "unknown standby mode %q; rc / xosc", cfg.StandbyMode)
+	}
+	if !sleepModes[cfg.SleepMode] {
+		v.addf("sx126x.sleep_mode", "unknown sleep mode %q; cold_start ; warm_start ; cold_start_rtc ; warm_start_rtc", cfg.SleepMode)
+	}
+	if !tcxoVoltages[cfg.TcxoVoltage] {
+		v.addf("sx126x.tcxo_voltage", "unsupported voltage %.1f V", cfg.TcxoVoltage)
+	}
+
+	// Both buffers live in the same 256 byte RAM, each needs room for a full payload
+	if cfg.PayloadLength == 0 {
+		v.addf("sx126x.payload_length", "must be at least 1 byte")
+	} else if cfg.TxBufferAddress != cfg.RxBufferAddress {
+		low, high := min(cfg.TxBufferAddress, cfg.RxBufferAddress), max(cfg.TxBufferAddress, cfg.RxBufferAddress)
+		if int(high)-int(low) < int(cfg.PayloadLength) {
+			v.addf("sx126x.rx_buffer_address", "buffers at %d and %d overlap for payload_length %d", cfg.TxBufferAddress, cfg.RxBufferAddress, cfg.PayloadLength)
+		}
+		if 256-int(high) < int(cfg.PayloadLength) {
+			v.addf("sx126x.tx_buffer_address", "buffer at %d has no room for payload_length %d", high, cfg.PayloadLength)
+		}
+	}
+
+	if cfg.Modem != "lora" {
+		return
+	}
+
+	if sf := cfg.LoRa.SpreadingFactor; sf < 7 || sf > 12 {
+		v.addf("sx126x.lora.spreading_factor", "%d out of range; 7 - 12", sf)
+	}
+	if cr := cfg.LoRa.CodingRate; cr < 5 || cr > 8 {
+		v.addf("sx126x.lora.coding_rate", "%d out of range; 5 - 8", cr)
+	}
+	if !loraBandwidths[cfg.Bandwidth] {
+		v.addf("sx126x.bandwidth", "unsupported LoRa bandwidth %d Hz", cfg.Bandwidth)
+	}
+	if c.LBT.Enable && !cadSymbols[cfg.LoRa.CAD.SymbolNumber] {
+		v.addf("sx126x.lora.cad.symbol_number", "unsupported CAD symbol number %d; 1 ; 2 ; 4 ; 8 ; 16", cfg.LoRa.CAD.SymbolNumber)
+	}
+	if c.LBT.Enable && cfg.LoRa.CAD.ExitMode > 1 {
+		v.addf("sx126x.lora.cad.exit_mode", "unknown exit mode %d; 0 - CAD only ; 1 - CAD and Rx", cfg.LoRa.CAD.ExitMode)
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Link ===
+// ------------------------------------------------------------------------
+func (v *validator) link(c *Config) {
+	cfg := &c.Link
+	if cfg.StatsInterval < 0 {
+		v.addf("link.stats_interval", "%s below 0", cfg.StatsInterval)
+	}
+
+	if cfg.Encrypt == false {
+		return
+	}
+
+	// Never echo the key itself
+	key, err := hex.DecodeString(cfg.NetworkSecret)
+	if err != nil {
+		v.addf("link.network_secret", "not a hex string")
+	} else if n := len(key); n != 16 && n != 32 {
+		v.addf("link.network_secret", "%d byte key; 16 (AES-128) / 32 (AES-256)", n)
+	}
+	if cfg.CounterFile == "" {
+		v.addf("link.counter_file", "required for replay protection")
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Duty cycle ===
+// ------------------------------------------------------------------------
+func (v *validator) dutyCycle(c *Config) {
+	cfg := &c.Duty
+	if cfg.Enable == false {
+		return
+	}
+
+	if cfg.Window <= 0 {
+		v.addf("duty_cycle.window", "must be longer than 0")
+	}
+	for _, key := range sortedKeys(cfg.Bands) {
+		b := cfg.Bands[key]
+		if b.Low >= b.High {
+			v.addf("duty_cycle.bands."+key+".low", "%d Hz not below high %d Hz", b.Low, b.High)
+		}
+		if b.Limit <= 0 || b.Limit > 100 {
+			v.addf("duty_cycle.bands."+key+".limit", "%g%% out of range; 0 - 100", b.Limit)
+		}
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Listen before talk ===
+// ------------------------------------------------------------------------
+func (v *validator) lbt(c *Config) {
+	if c.LBT.Enable == false {
+		return
+	}
+
+	if c.SX126X.Modem != "lora" {
+		v.addf("lbt.enable", "channel activity detection needs sx126x.modem lora")
+	}
+	if c.LBT.Attempts == 0 {
+		v.addf("lbt.attempts", "must be at least 1")
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = ADR ===
+// ------------------------------------------------------------------------
+func (v *validator) adr(c *Config) {
+	cfg := &c.ADR
+	if cfg.Enable == false {
+		return
+	}
+
+	if c.SX126X.Modem != "lora" {
+		v.addf("adr.enable", "Tx power control needs sx126x.modem lora")
+	}
+	if cfg.MinTxPower < -9 || cfg.MinTxPower > cfg.MaxTxPower || cfg.MaxTxPower > 22 {
+		v.addf("adr.min_tx_power", "%d - %d dBm out of range; -9 - 22", cfg.MinTxPower, cfg.MaxTxPower)
+	}
+	// The gateway never falls back, it has no ACKs to miss
+	gateway := c.Station.Address == c.Station.Gateway
+	if cfg.FallbackAcks > 0 && c.Link.Reliable == false && gateway == false {
+		v.addf("adr.fallback_acks", "counts missed ACKs, needs link.reliable")
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Capture ===
+// ------------------------------------------------------------------------
+func (v *validator) capture(c *Config) {
+	cfg := &c.Capture
+
+	if cfg.Speed < 0 {
+		v.addf("capture.speed", "%g below 0", cfg.Speed)
+	}
+	if cfg.File != "" && cfg.File == cfg.Replay {
+		v.addf("capture.file", "would record over the replayed capture")
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = UART ===
+// ------------------------------------------------------------------------
+var (
+	parities  = map[string]bool{"N": true, "O": true, "E": true, "M": true, "S": true}
+	stopBits  = map[uart.Stop]bool{uart.One: true, uart.OneHalf: true, uart.Two: true}
+	dataFlows = map[uint8]bool{0: true, 1: true, 2: true}
+)
+
+func (v *validator) uart(c *Config) {
+	if c.UART.Enable == false {
+		return
+	}
+
+	for _, key := range sortedKeys(c.UART.Devices) {
+		dev := c.UART.Devices[key]
+		if dev.Enable == false {
+			continue
+		}
+
+		path := "uart.device." + key
+		if !parities[dev.Parity] {
+			v.addf(path+".parity_bit", "unknown parity %q; N ; O ; E ; M ; S", dev.Parity)
+		}
+		if !stopBits[dev.StopBit] {
+			v.addf(path+".stop_bit", "unknown stop bit %d; 1 ; 15 ; 2", dev.StopBit)
+		}
+		if !dataFlows[dev.DataFlow] {
+			v.addf(path+".data_flow", "unknown flow control %d; 0 ; 1 ; 2", dev.DataFlow)
+		}
+		if dev.DataLength < 5 || dev.DataLength > 8 {
+			v.addf(path+".data_length", "%d bits out of range; 5 - 8", dev.DataLength)
+		}
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = I2C ===
+// ------------------------------------------------------------------------
+func (v *validator) i2c(c *Config) {
+	type slot struct {
+		bus     string
+		address uint8
+	}
+	taken := make(map[slot]string)
+
+	claim := func(path, bus string, address uint8) {
+		if c.I2C.Enable == false || c.I2C.Devices[bus].Enable == false {
+			v.addf(path+".bus", "I2C bus %q not configured or disabled", bus)
+			return
+		}
+
+		s := slot{bus, address}
+		if other, ok := taken[s]; ok {
+			v.addf(path+".address", "0x%02X on %s already used by %s", address, bus, other)
+			return
+		}
+		taken[s] = path
+	}
+
+	if c.BME280.Enable {
+		for _, key := range sortedKeys(c.BME280.Devices) {
+			dev := c.BME280.Devices[key]
+			if dev.Enable && dev.UseI2C {
+				claim("bme280.device."+key, dev.Bus, dev.Address)
+			}
+		}
+	}
+
+	if c.DHT.Enable {
+		for _, key := range sortedKeys(c.DHT.Devices) {
+			dev := c.DHT.Devices[key]
+			if dev.Enable && dev.Type == 20 {
+				claim("dht.device."+key, dev.Bus, dev.Address)
+			}
+		}
+	}
+
+	// The SGP30 config names no bus, the driver is handed every one of them; its address
+	// is taken on each enabled bus
+	if c.SGP30.Enable {
+		var buses []string
+		if c.I2C.Enable {
+			for _, bus := range sortedKeys(c.I2C.Devices) {
+				if c.I2C.Devices[bus].Enable {
+					buses = append(buses, bus)
+				}
+			}
+		}
+
+		for _, key := range sortedKeys(c.SGP30.Devices) {
+			dev := c.SGP30.Devices[key]
+			if dev.Enable == false {
+				continue
+			}
+			if len(buses) == 0 {
+				v.addf("sgp30.device."+key+".enable", "no I2C bus configured or enabled")
+				continue
+			}
+			for _, bus := range buses {
+				claim("sgp30.device."+key, bus, dev.Address)
+			}
+		}
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// Map order is random; problems should come out the same on every run
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
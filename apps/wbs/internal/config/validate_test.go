@@ -0,0 +1,198 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Regeneric/iot-drivers/libs/sgp30"
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+// validConfig passes Validate; every test case breaks it in its own way
+func validConfig() *Config {
+	return &Config{
+		SX126X: sx126x.Config{
+			Enable:         true,
+			Modem:          "lora",
+			Type:           "1262",
+			Bandwidth:      125_000,
+			Frequency:      868_100_000,
+			PayloadLength:  64,
+			TransmitPower:  14,
+			StandbyMode:    "rc",
+			SleepMode:      "warm_start",
+			FrequencyRange: [2]uint16{863, 870},
+			RampTime:       40,
+			LoRa:           sx126x.LoRa{SpreadingFactor: 7, CodingRate: 5},
+		},
+		I2C: I2C{Enable: true, Devices: map[string]i2cDevice{
+			"i2c1": {Enable: true, Name: "1"},
+			"i2c2": {Enable: true, Name: "2"},
+		}},
+		UART: UART{Enable: true, Devices: map[string]uartDevice{
+			"uart0": {Enable: true, Name: "/dev/ttyS0", Speed: 9600, DataLength: 8, Parity: "N", StopBit: 1},
+		}},
+		BME280: BME280{Enable: true, Devices: map[string]bme280Device{
+			"bme280_0": {Enable: true, UseI2C: true, Bus: "i2c1", Address: 0x76},
+		}},
+	}
+}
+
+// adrConfig is ADR enabled with the defaults of config.example.yaml
+func adrConfig() ADR {
+	return ADR{Enable: true, History: 20, Margin: 10, MinTxPower: 2, MaxTxPower: 14, FallbackAcks: 3}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string // YAML paths of the problems, in order
+	}{
+		{"valid", func(c *Config) {}, nil},
+		{"disabled sx126x", func(c *Config) { c.SX126X = sx126x.Config{} }, nil},
+
+		// SX126X
+		{"modem", func(c *Config) { c.SX126X.Modem = "ook" }, []string{"sx126x.modem"}},
+		{"type", func(c *Config) { c.SX126X.Type = "1268" }, []string{"sx126x.type"}},
+		{"tx power 1262", func(c *Config) { c.SX126X.TransmitPower = 23 }, []string{"sx126x.tx_power"}},
+		{"tx power 1262 low", func(c *Config) { c.SX126X.TransmitPower = -10 }, []string{"sx126x.tx_power"}},
+		{"tx power 1261", func(c *Config) { c.SX126X.Type, c.SX126X.TransmitPower = "1261", 16 }, []string{"sx126x.tx_power"}},
+		{"tx power 1261 low end", func(c *Config) { c.SX126X.Type, c.SX126X.TransmitPower = "1261", -17 }, nil},
+		{"frequency range", func(c *Config) { c.SX126X.FrequencyRange = [2]uint16{860, 870} }, []string{"sx126x.frequency_range"}},
+		{"frequency outside range", func(c *Config) { c.SX126X.Frequency = 433_000_000 }, []string{"sx126x.frequency"}},
+		{"other range", func(c *Config) { c.SX126X.FrequencyRange, c.SX126X.Frequency = [2]uint16{430, 440}, 433_000_000 }, nil},
+		{"ramp time", func(c *Config) { c.SX126X.RampTime = 50 }, []string{"sx126x.ramp_time"}},
+		{"standby mode", func(c *Config) { c.SX126X.StandbyMode = "deep" }, []string{"sx126x.standby_mode"}},
+		{"sleep mode", func(c *Config) { c.SX126X.SleepMode = "cold" }, []string{"sx126x.sleep_mode"}},
+		{"tcxo voltage", func(c *Config) { c.SX126X.TcxoVoltage = 2.0 }, []string{"sx126x.tcxo_voltage"}},
+		{"payload length", func(c *Config) { c.SX126X.PayloadLength = 0 }, []string{"sx126x.payload_length"}},
+		{"buffers overlap", func(c *Config) { c.SX126X.TxBufferAddress, c.SX126X.RxBufferAddress = 0, 32 }, []string{"sx126x.rx_buffer_address"}},
+		{"buffer past the end", func(c *Config) { c.SX126X.TxBufferAddress, c.SX126X.RxBufferAddress = 0, 200 }, []string{"sx126x.tx_buffer_address"}},
+		{"split buffers", func(c *Config) { c.SX126X.TxBufferAddress, c.SX126X.RxBufferAddress = 0, 128 }, nil},
+		{"spreading factor", func(c *Config) { c.SX126X.LoRa.SpreadingFactor = 13 }, []string{"sx126x.lora.spreading_factor"}},
+		{"coding rate", func(c *Config) { c.SX126X.LoRa.CodingRate = 1 }, []string{"sx126x.lora.coding_rate"}},
+		{"bandwidth", func(c *Config) { c.SX126X.Bandwidth = 100_000 }, []string{"sx126x.bandwidth"}},
+		// LoRa only keys are left alone in GFSK mode
+		{"fsk", func(c *Config) { c.SX126X.Modem, c.SX126X.LoRa, c.SX126X.Bandwidth = "fsk", sx126x.LoRa{}, 23_400 }, nil},
+		{"cad", func(c *Config) {
+			c.LBT = LBT{Enable: true, Attempts: 5}
+			c.SX126X.LoRa.CAD = sx126x.CAD{SymbolNumber: 3, ExitMode: 2}
+		}, []string{"sx126x.lora.cad.symbol_number", "sx126x.lora.cad.exit_mode"}},
+
+		// Link
+		{"network secret", func(c *Config) { c.Link = Link{Encrypt: true, NetworkSecret: "zz", CounterFile: "c.json"} }, []string{"link.network_secret"}},
+		{"key length", func(c *Config) { c.Link = Link{Encrypt: true, NetworkSecret: "00112233", CounterFile: "c.json"} }, []string{"link.network_secret"}},
+		{"counter file", func(c *Config) {
+			c.Link = Link{Encrypt: true, NetworkSecret: "000102030405060708090a0b0c0d0e0f"}
+		}, []string{"link.counter_file"}},
+
+		// Duty cycle, listen before talk, capture
+		{"duty cycle", func(c *Config) {
+			c.Duty = DutyCycle{Enable: true, Bands: map[string]Band{
+				"b": {Low: 869_700_000, High: 869_400_000, Limit: 10},
+				"a": {Low: 868_000_000, High: 868_600_000, Limit: 0},
+			}}
+		}, []string{"duty_cycle.window", "duty_cycle.bands.a.limit", "duty_cycle.bands.b.low"}},
+		{"lbt", func(c *Config) {
+			c.LBT = LBT{Enable: true}
+			c.SX126X.LoRa.CAD.SymbolNumber = 4
+			c.SX126X.Modem = "fsk"
+		}, []string{"lbt.enable", "lbt.attempts"}},
+		// ADR, as shipped; validConfig is the gateway
+		{"adr gateway", func(c *Config) { c.ADR = adrConfig() }, nil},
+		{"adr station", func(c *Config) { c.ADR, c.Station.Address = adrConfig(), 1 }, []string{"adr.fallback_acks"}},
+		{"adr reliable station", func(c *Config) { c.ADR, c.Station.Address, c.Link.Reliable = adrConfig(), 1, true }, nil},
+		{"adr", func(c *Config) {
+			c.ADR = adrConfig()
+			c.ADR.MinTxPower, c.ADR.MaxTxPower = 14, 2
+			c.SX126X.Modem, c.SX126X.LoRa, c.SX126X.Bandwidth = "fsk", sx126x.LoRa{}, 23_400
+		}, []string{"adr.enable", "adr.min_tx_power"}},
+		{"capture", func(c *Config) { c.Capture = Capture{File: "a.jsonl", Replay: "a.jsonl", Speed: -1} }, []string{"capture.speed", "capture.file"}},
+
+		// UART
+		{"uart", func(c *Config) {
+			c.UART.Devices["uart0"] = uartDevice{Enable: true, DataLength: 9, Parity: "X", StopBit: 3, DataFlow: 3}
+		}, []string{"uart.device.uart0.parity_bit", "uart.device.uart0.stop_bit", "uart.device.uart0.data_flow", "uart.device.uart0.data_length"}},
+		{"disabled uart device", func(c *Config) { c.UART.Devices["uart1"] = uartDevice{Parity: "X"} }, nil},
+
+		// I2C
+		{"i2c duplicate", func(c *Config) {
+			c.BME280.Devices["bme280_1"] = bme280Device{Enable: true, UseI2C: true, Bus: "i2c1", Address: 0x76}
+		}, []string{"bme280.device.bme280_1.address"}},
+		{"same address on another bus", func(c *Config) {
+			c.BME280.Devices["bme280_1"] = bme280Device{Enable: true, UseI2C: true, Bus: "i2c2", Address: 0x76}
+		}, nil},
+		{"i2c bus", func(c *Config) {
+			c.DHT = DHT{Enable: true, Devices: map[string]dhtDevice{"dht_0": {Enable: true, Type: 20, Bus: "i2c3", Address: 0x38}}}
+		}, []string{"dht.device.dht_0.bus"}},
+		{"dht22 needs no bus", func(c *Config) {
+			c.DHT = DHT{Enable: true, Devices: map[string]dhtDevice{"dht_0": {Enable: true, Type: 22, Pin: "GPIO4"}}}
+		}, nil},
+		// The SGP30 claims its address on every enabled bus
+		{"sgp30 duplicate", func(c *Config) {
+			c.DHT = DHT{Enable: true, Devices: map[string]dhtDevice{"dht_0": {Enable: true, Type: 20, Bus: "i2c2", Address: 0x58}}}
+			c.SGP30 = sgp30.Group{Enable: true, Devices: map[string]sgp30.DeviceConfig{"sgp30_0": {Enable: true, Address: 0x58}}}
+		}, []string{"sgp30.device.sgp30_0.address"}},
+		{"sgp30", func(c *Config) {
+			c.SGP30 = sgp30.Group{Enable: true, Devices: map[string]sgp30.DeviceConfig{"sgp30_0": {Enable: true, Address: 0x58}}}
+		}, nil},
+		{"sgp30 without i2c", func(c *Config) {
+			c.I2C.Enable, c.BME280.Enable = false, false
+			c.SGP30 = sgp30.Group{Enable: true, Devices: map[string]sgp30.DeviceConfig{"sgp30_0": {Enable: true, Address: 0x58}}}
+		}, []string{"sgp30.device.sgp30_0.enable"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			tt.change(c)
+
+			err := c.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate = %v", err)
+				}
+				return
+			}
+
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("Validate = %v, want a ValidationError", err)
+			}
+			got := make([]string, 0, len(verr.Problems))
+			for _, p := range verr.Problems {
+				got = append(got, p.Path)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("problems %v, want %v", verr.Problems, tt.want)
+			}
+		})
+	}
+}
+
+// Every problem is reported at once, not just the first one
+func TestValidateAggregates(t *testing.T) {
+	c := validConfig()
+	c.SX126X.Type = "1268"
+	c.SX126X.LoRa.SpreadingFactor = 4
+	c.Link = Link{Encrypt: true, NetworkSecret: "0123456789abcdef"}
+
+	err := c.Validate()
+	var verr *ValidationError
+	if !errors.As(err, &verr) || len(verr.Problems) != 4 {
+		t.Fatalf("Validate = %v, want 4 problems", err)
+	}
+
+	msg := err.Error()
+	for _, part := range []string{"4 config problem(s)", "sx126x.type: unknown type \"1268\"", "sx126x.lora.spreading_factor: 4 out of range", "link.network_secret: 8 byte key", "link.counter_file"} {
+		if strings.Contains(msg, part) == false {
+			t.Errorf("%q missing from %q", part, msg)
+		}
+	}
+	// The key never shows up in an error
+	if strings.Contains(msg, "0123456789abcdef") {
+		t.Errorf("key in %q", msg)
+	}
+}
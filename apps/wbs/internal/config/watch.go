@@ -0,0 +1,188 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Editors write a file in several steps; wait for them to settle before reloading
+const reloadDebounce = 500 * time.Millisecond
+
+// Applier hot-applies the changes whose path matches Match to a running subsystem.
+type Applier struct {
+	Name  string
+	Match *regexp.Regexp
+	Apply func(cfg *Config, changes []Change) error
+}
+
+// Watcher re-reads the config file on SIGHUP or when the file changes and hands the
+// differences to the registered appliers. Changes no applier claims need a restart.
+type Watcher struct {
+	path     string
+	appliers []Applier
+
+	mu      sync.Mutex
+	current *Config
+}
+
+func NewWatcher(path string, cfg *Config) *Watcher {
+	return &Watcher{path: path, current: cfg}
+}
+
+// Handle registers an applier; match is a regular expression on the YAML path.
+func (w *Watcher) Handle(name, match string, apply func(cfg *Config, changes []Change) error) {
+	w.appliers = append(w.appliers, Applier{Name: name, Match: regexp.MustCompile(match), Apply: apply})
+}
+
+// Current is the config as of the last reload, without the changes that failed to apply
+func (w *Watcher) Current() *Config {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.current
+}
+
+// Run blocks until ctx is cancelled. Every value received on signals triggers a reload.
+func (w *Watcher) Run(ctx context.Context, signals <-chan os.Signal) error {
+	log := slog.With("func", "Watcher.Run()", "params", "(context.Context, <-chan os.Signal)", "return", "(error)", "package", "config")
+	log.Info("[ CONFIG ] Config watcher", "file", w.path)
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+
+	// The directory is watched, editors and ConfigMaps replace the file instead of writing it
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Warn("[ CONFIG ] File watcher unavailable, reloading on SIGHUP only", "error", err)
+	} else {
+		defer fsw.Close()
+
+		if err := fsw.Add(filepath.Dir(w.path)); err != nil {
+			log.Warn("[ CONFIG ] File watcher unavailable, reloading on SIGHUP only", "error", err)
+		} else {
+			events, errs = fsw.Events, fsw.Errors
+		}
+	}
+
+	debounce := time.NewTimer(reloadDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case sig := <-signals:
+			log.Info("[ CONFIG ] Reload requested", "signal", sig)
+			w.Reload()
+
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(w.path) || event.Has(fsnotify.Chmod) {
+				continue
+			}
+			debounce.Reset(reloadDebounce)
+
+		case <-debounce.C:
+			log.Info("[ CONFIG ] Config file changed", "file", w.path)
+			w.Reload()
+
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			log.Warn("[ CONFIG ] File watcher failure", "error", err)
+		}
+	}
+}
+
+// Reload reads the file, applies what can be applied and reports the rest.
+// An invalid file is rejected as a whole; the running config stays in place.
+func (w *Watcher) Reload() {
+	log := slog.With("func", "Watcher.Reload()", "params", "(-)", "return", "(-)", "package", "config")
+
+	next, err := LoadConfig(w.path)
+	if err != nil {
+		log.Error("[ CONFIG ] Reload failed, keeping running config", "error", err)
+		return
+	}
+
+	if err := next.Validate(); err != nil {
+		log.Error("[ CONFIG ] Reloaded config invalid, keeping running config", "error", err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	changes := Diff(w.current, next)
+	if len(changes) == 0 {
+		log.Info("[ CONFIG ] Reload found no changes")
+		return
+	}
+
+	// What failed to apply is still running the old way; current keeps saying so, and the
+	// next reload offers those changes again. next itself is left alone, appliers may hold it.
+	kept := *next
+
+	claimed := make([]bool, len(changes))
+	for _, a := range w.appliers {
+		var matched []Change
+		for i, c := range changes {
+			if a.Match.MatchString(c.Path) {
+				matched = append(matched, c)
+				claimed[i] = true
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		if err := a.Apply(next, matched); err != nil {
+			log.Error("[ CONFIG ] Hot reload failed", "subsystem", a.Name, "error", err)
+			for _, c := range matched {
+				Revert(&kept, w.current, c.Path)
+			}
+			continue
+		}
+		for _, c := range matched {
+			log.Info("[ CONFIG ] Change applied", "subsystem", a.Name, "change", c.String())
+		}
+	}
+
+	restart := 0
+	for i, c := range changes {
+		if !claimed[i] {
+			log.Warn("[ CONFIG ] Change needs a restart to take effect", "change", c.String())
+			restart++
+		}
+	}
+
+	w.current = &kept
+	log.Info("[ CONFIG ] Reload done", "changes", len(changes), "restartRequired", restart)
+}
+
+// Paths is a helper for Applier.Match; it matches any of the given YAML paths exactly.
+func Paths(paths ...string) string {
+	pattern := ""
+	for i, p := range paths {
+		if i > 0 {
+			pattern += "|"
+		}
+		pattern += regexp.QuoteMeta(p)
+	}
+	return fmt.Sprintf("^(%s)$", pattern)
+}
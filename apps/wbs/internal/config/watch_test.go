@@ -0,0 +1,109 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, path, yaml string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []uint8(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcherReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, `
+station:
+  interval: 60s
+bme280:
+  enable: true
+  device:
+    bme280_0:
+      name: attic
+`)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWatcher(path, cfg)
+
+	var stationCalls, labelCalls int
+	var applied []Change
+	w.Handle("station", Paths("station.interval"), func(next *Config, changes []Change) error {
+		stationCalls++
+		applied = changes
+		return nil
+	})
+	w.Handle("labels", `\.name$`, func(next *Config, changes []Change) error {
+		labelCalls++
+		return errors.New("sensor busy")
+	})
+
+	writeConfig(t, path, `
+station:
+  interval: 30s
+  rx_window: 10s
+bme280:
+  enable: true
+  device:
+    bme280_0:
+      name: loft
+`)
+	w.Reload()
+
+	current := w.Current()
+	if stationCalls != 1 || len(applied) != 1 || applied[0].Path != "station.interval" {
+		t.Errorf("station applier called %d times with %v", stationCalls, applied)
+	}
+	if current.Station.Interval != 30*time.Second {
+		t.Errorf("interval %v, want the applied 30s", current.Station.Interval)
+	}
+	// Nobody applies rx_window, it takes effect on restart
+	if current.Station.RxWindow != 10*time.Second {
+		t.Errorf("rx_window %v, want 10s", current.Station.RxWindow)
+	}
+	// The failed label is still the running one
+	if name := current.BME280.Devices["bme280_0"].Name; labelCalls != 1 || name != "attic" {
+		t.Errorf("label applier called %d times, name %q; want 1, attic", labelCalls, name)
+	}
+
+	// The next reload offers the failed change again, and only that one
+	w.Reload()
+	if stationCalls != 1 || labelCalls != 2 {
+		t.Errorf("second reload: station %d, labels %d calls; want 1, 2", stationCalls, labelCalls)
+	}
+}
+
+// A file that doesn't load or validate leaves the running config alone
+func TestWatcherInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "station:\n  interval: 60s\n")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWatcher(path, cfg)
+
+	calls := 0
+	w.Handle("all", `.`, func(*Config, []Change) error { calls++; return nil })
+
+	for _, yaml := range []string{
+		"station: [\n",
+		"station:\n  interval: 30s\nduty_cycle:\n  window: 0s\n",
+	} {
+		writeConfig(t, path, yaml)
+		w.Reload()
+	}
+
+	if calls != 0 || w.Current() != cfg {
+		t.Errorf("%d applier calls, config replaced; want none", calls)
+	}
+}
@@ -1 +1,481 @@
 package fsk
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/lora"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+// Transceiver is the part of the SX126x driver the GFSK modem needs. The driver only
+// builds LoRa modulation and packet params, GFSK ones are written as raw commands.
+type Transceiver interface {
+	lora.Chip
+
+	SetRx(timeout int32) error
+	SetDioIrqParams(irqMask sx126x.IrqMask, dioIRQ ...sx126x.IrqMask) error
+	SetDIO2AsRfSwitchCtrl(enable bool) error
+	SetPacketType(packet sx126x.PacketType) error
+
+	Write(w []uint8, r []uint8, timeout ...<-chan time.Time) error
+	WriteRegister(address uint16, data []uint8) (uint8, error)
+	ReadRegister(address uint16, data []uint8) (uint8, error)
+
+	EnqueueTx(payload []uint8) error
+	DequeueRx(timeout time.Duration) ([]uint8, error)
+
+	Run(ctx context.Context) error
+}
+
+// ************************************************************************
+// = 13.4.5 / 13.4.6 GFSK params ===
+// ------------------------------------------------------------------------
+const (
+	opSetModulationParams = 0x8B
+	opSetPacketParams     = 0x8C
+
+	xtal = 32_000_000 // Hz
+
+	regCrcInitMsb       = 0x06BC
+	regCrcPolynomialMsb = 0x06BE
+	regSyncWord0        = 0x06C0
+	regNodeAddress      = 0x06CD // Broadcast address follows at 0x06CE
+)
+
+var (
+	stringToPulseShape = map[string]uint8{"": 0x00, "0.0": 0x00, "0.3": 0x08, "0.5": 0x09, "0.7": 0x0A, "1.0": 0x0B}
+
+	// Table 13-45 - Rx bandwidths, narrowest first
+	rxBandwidths = []struct {
+		hz   uint32
+		code uint8
+	}{
+		{4800, 0x1F}, {5800, 0x17}, {7300, 0x0F}, {9700, 0x1E}, {11700, 0x16}, {14600, 0x0E}, {19500, 0x1D},
+		{23400, 0x15}, {29300, 0x0D}, {39000, 0x1C}, {46900, 0x14}, {58600, 0x0C}, {78200, 0x1B}, {93800, 0x13},
+		{117300, 0x0B}, {156200, 0x1A}, {187200, 0x12}, {234300, 0x0A}, {312000, 0x19}, {373600, 0x11}, {467000, 0x09},
+	}
+
+	stringToPreambleDetector = map[string]uint8{"": 0x00, "0": 0x00, "8": 0x04, "16": 0x05, "24": 0x06, "32": 0x07}
+	stringToAddressComp      = map[string]uint8{"": 0x00, "0": 0x00, "1": 0x01, "2": 0x02}
+	stringToPacketType       = map[string]uint8{"": 0x01, "static": 0x00, "variable": 0x01}
+
+	// CRC type, its length and the polynomial / seed, 6.2.3.5
+	stringToCrc = map[string]struct {
+		code, length uint8
+		polynomial   uint16
+		seed         uint16
+	}{
+		"":      {0x01, 0, 0, 0},
+		"off":   {0x01, 0, 0, 0},
+		"1":     {0x00, 1, 0x0007, 0x00FF},
+		"2":     {0x02, 2, 0x8005, 0xFFFF}, // IBM
+		"1_inv": {0x04, 1, 0x0007, 0x00FF},
+		"2_inv": {0x06, 2, 0x1021, 0x1D0F}, // CCITT
+	}
+)
+
+// params are the sx126x.fsk strings resolved to register values
+type params struct {
+	bitrate          uint32 // bit/s
+	preamble         uint16 // Bits
+	pulseShape       uint8
+	rxBandwidth      uint8
+	deviation        uint32 // Hz
+	preambleDetector uint8
+	syncWord         []uint8
+	addressComp      uint8
+	variable         bool
+	crc              uint8
+	crcLength        uint8
+	crcPolynomial    uint16
+	crcSeed          uint16
+	whitening        bool
+}
+
+func parseHz(key, s string) (uint32, error) {
+	s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "Hz"))
+	if s == "" {
+		return 0, fmt.Errorf("sx126x.fsk.%s is required for FSK mode", key)
+	}
+	v, err := strconv.ParseUint(strings.ReplaceAll(s, "_", ""), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("sx126x.fsk.%s %q is not a number", key, s)
+	}
+	return uint32(v), nil
+}
+
+func parse(cfg *sx126x.Config, extra *config.FSK) (params, error) {
+	var p params
+	var err error
+	c := cfg.FSK
+
+	if p.bitrate, err = parseHz("bitrate", c.Bitrate); err != nil {
+		return p, err
+	}
+	if p.bitrate < 600 || p.bitrate > 300_000 {
+		return p, fmt.Errorf("sx126x.fsk.bitrate %d out of range; 600 - 300000", p.bitrate)
+	}
+	if p.deviation, err = parseHz("frequency_deviation", c.FrequencyDeviation); err != nil {
+		return p, err
+	}
+
+	var ok bool
+	if p.pulseShape, ok = stringToPulseShape[c.PulseShape]; !ok {
+		return p, fmt.Errorf("unknown sx126x.fsk.pulse_shape %q; 0.0 ; 0.3 ; 0.5 ; 0.7 ; 1.0", c.PulseShape)
+	}
+	if p.preambleDetector, ok = stringToPreambleDetector[c.PreambleDetectionLength]; !ok {
+		return p, fmt.Errorf("unknown sx126x.fsk.preamble_detection_length %q; 0 ; 8 ; 16 ; 24 ; 32", c.PreambleDetectionLength)
+	}
+
+	// A preamble shorter than the detector never gets a frame past it
+	detector, _ := strconv.Atoi(c.PreambleDetectionLength)
+	if extra.PreambleLength == 0 || int(extra.PreambleLength) < detector {
+		return p, fmt.Errorf("fsk.preamble_length %d bits shorter than sx126x.fsk.preamble_detection_length %s", extra.PreambleLength, c.PreambleDetectionLength)
+	}
+	p.preamble = extra.PreambleLength
+	if p.addressComp, ok = stringToAddressComp[c.AddressComparison]; !ok {
+		return p, fmt.Errorf("unknown sx126x.fsk.address_comparison %q; 0 ; 1 ; 2", c.AddressComparison)
+	}
+
+	packetType, ok := stringToPacketType[c.PacketType]
+	if !ok {
+		return p, fmt.Errorf("unknown sx126x.fsk.packet_type %q; static / variable", c.PacketType)
+	}
+	p.variable = packetType == 0x01
+
+	crc, ok := stringToCrc[c.CRC]
+	if !ok {
+		return p, fmt.Errorf("unknown sx126x.fsk.crc %q; off ; 1 ; 2 ; 1_inv ; 2_inv", c.CRC)
+	}
+	p.crc, p.crcLength, p.crcPolynomial, p.crcSeed = crc.code, crc.length, crc.polynomial, crc.seed
+
+	// sx126x.bandwidth, widened when the signal, about 2 * deviation + bitrate, wouldn't fit
+	required := max(cfg.Bandwidth, 2*p.deviation+p.bitrate)
+	p.rxBandwidth = rxBandwidths[len(rxBandwidths)-1].code
+	for _, bw := range rxBandwidths {
+		if bw.hz >= required {
+			p.rxBandwidth = bw.code
+			break
+		}
+	}
+
+	sync, err := hex.DecodeString(extra.SyncWord)
+	if err != nil || len(sync) == 0 || len(sync) > 8 {
+		return p, fmt.Errorf("fsk.sync_word %q must be 1 - 8 hex bytes", extra.SyncWord)
+	}
+	if c.SyncWordDetectionLength != "" {
+		n, err := strconv.Atoi(c.SyncWordDetectionLength)
+		if err != nil || n < 0 || n > len(sync) {
+			return p, fmt.Errorf("sx126x.fsk.sync_word_detection_length %q; 0 - %d bytes of fsk.sync_word", c.SyncWordDetectionLength, len(sync))
+		}
+		sync = sync[:n]
+	}
+	p.syncWord = sync
+	p.whitening = c.Whitening
+
+	return p, nil
+}
+
+// modulation is the SetModulationParams payload, 13.4.5.3
+func (p params) modulation() []uint8 {
+	br := uint32(32 * uint64(xtal) / uint64(p.bitrate))
+	fdev := uint32(uint64(p.deviation) << 25 / xtal)
+
+	return []uint8{
+		opSetModulationParams,
+		uint8(br >> 16), uint8(br >> 8), uint8(br),
+		p.pulseShape,
+		p.rxBandwidth,
+		uint8(fdev >> 16), uint8(fdev >> 8), uint8(fdev),
+	}
+}
+
+// packet is the SetPacketParams payload, 13.4.6.2
+func (p params) packet(payloadLength uint8) []uint8 {
+	variable, whitening := uint8(0x00), uint8(0x00)
+	if p.variable {
+		variable = 0x01
+	}
+	if p.whitening {
+		whitening = 0x01
+	}
+
+	return []uint8{
+		opSetPacketParams,
+		uint8(p.preamble >> 8), uint8(p.preamble),
+		p.preambleDetector,
+		uint8(len(p.syncWord) * 8),
+		p.addressComp,
+		variable,
+		payloadLength,
+		p.crc,
+		whitening,
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Node ===
+// ------------------------------------------------------------------------
+// Node is the GFSK counterpart of lora.Node on the same SX126x; it satisfies lora.Link.
+type Node struct {
+	hw    Transceiver
+	cfg   *sx126x.Config
+	extra *config.FSK
+	p     params
+
+	duty     *lora.DutyCycle
+	onBudget func(b lora.Budget)
+}
+
+type NodeOption func(*Node)
+
+// WithDutyCycle books the airtime of every Tx with a lora.DutyCycle
+func WithDutyCycle(cfg *config.DutyCycle) NodeOption {
+	return func(n *Node) {
+		if cfg != nil && cfg.Enable {
+			n.duty = lora.NewDutyCycle(cfg)
+		}
+	}
+}
+
+// WithBudgetHandler reports the band's budget once a Tx booked its airtime
+func WithBudgetHandler(h func(b lora.Budget)) NodeOption {
+	return func(n *Node) { n.onBudget = h }
+}
+
+func New(modem Transceiver, cfg *sx126x.Config, extra *config.FSK, opts ...NodeOption) (*Node, error) {
+	log := slog.With("func", "New()", "params", "(Transceiver, *sx126x.Config, *config.FSK, ...NodeOption)", "return", "(*Node, error)", "package", "fsk")
+	log.Info("[ FSK ] Modem constructor")
+
+	if cfg == nil || extra == nil {
+		return nil, fmt.Errorf("FSK modem state improper; cfg is nil")
+	}
+	if modem == nil || reflect.ValueOf(modem).IsNil() {
+		return nil, fmt.Errorf("FSK modem state improper; modem is nil")
+	}
+
+	if cfg.Enable == false {
+		return nil, fmt.Errorf("FSK modem disabled in the config")
+	}
+	if cfg.Modem != "fsk" {
+		return nil, fmt.Errorf("FSK modem state improper; sx126x.modem is %q", cfg.Modem)
+	}
+
+	p, err := parse(cfg, extra)
+	if err != nil {
+		return nil, fmt.Errorf("[ FSK ] Invalid config: %w", err)
+	}
+
+	n := &Node{
+		hw:    modem,
+		cfg:   cfg,
+		extra: extra,
+		p:     p,
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+
+	return n, nil
+}
+
+func Setup(n *Node) error {
+	log := slog.With("func", "Setup()", "params", "(*Node)", "return", "(error)", "package", "fsk")
+	log.Info("[ FSK ] Modem setup")
+
+	if n == nil {
+		return fmt.Errorf("FSK modem state improper; node is nil")
+	}
+	if n.cfg == nil {
+		return fmt.Errorf("FSK modem state improper; cfg is nil")
+	}
+	if n.hw == nil || reflect.ValueOf(n.hw).IsNil() {
+		return fmt.Errorf("FSK modem state improper; hw is nil")
+	}
+
+	// ************************************************************************
+	// = 14.3 Circuit Configuration for Basic Rx Operation ===
+	// ------------------------------------------------------------------------
+	if err := lora.Reset(n.hw, n.cfg, log); err != nil {
+		return err
+	}
+
+	// = 13.4.2 SetPacketType ==========
+	if err := n.hw.SetPacketType(sx126x.PacketTypeGFSK); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	// = RF, PA and buffers ===========
+	if err := lora.SetRf(n.hw, n.cfg, log); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	// = 13.4.5 SetModulationParams ====
+	if err := n.command(n.p.modulation()); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	// = 13.4.6 SetPacketParams ========
+	if err := n.command(n.p.packet(n.cfg.PayloadLength)); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	// = 13.3.1 SetDioIrqParams ========
+	mask := sx126x.IrqTxDone | sx126x.IrqRxDone | sx126x.IrqTimeout | sx126x.IrqCrcErr
+	if err := n.hw.SetDioIrqParams(mask); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	// = 6.2.3 Sync word, CRC, addresses
+	if err := n.setRegisters(log); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	// = 13.3.5 SetDIO2AsRfSwitchCtrl ==
+	if err := n.hw.SetDIO2AsRfSwitchCtrl(n.cfg.DIO2AsRfSwitch); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	// = 13.1.5 SetRx ==================
+	if err := n.hw.SetRx(int32(sx126x.RxContinuous)); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	// ------------------------------------------------------------------------
+	return nil
+}
+
+// command writes an opcode and its params; the driver has no GFSK option builders
+func (n *Node) command(w []uint8) error {
+	return n.hw.Write(w, make([]uint8, len(w)))
+}
+
+func (n *Node) setRegisters(log *slog.Logger) error {
+	if _, err := n.hw.WriteRegister(regSyncWord0, n.p.syncWord); err != nil {
+		return err
+	}
+
+	syncWord := make([]uint8, len(n.p.syncWord))
+	if _, err := n.hw.ReadRegister(regSyncWord0, syncWord); err != nil {
+		return err
+	}
+	log.Info("[ FSK ] Read register success", "syncWord", fmt.Sprintf("% X", syncWord))
+
+	if n.p.crcLength > 0 {
+		if _, err := n.hw.WriteRegister(regCrcInitMsb, []uint8{uint8(n.p.crcSeed >> 8), uint8(n.p.crcSeed)}); err != nil {
+			return err
+		}
+		if _, err := n.hw.WriteRegister(regCrcPolynomialMsb, []uint8{uint8(n.p.crcPolynomial >> 8), uint8(n.p.crcPolynomial)}); err != nil {
+			return err
+		}
+	}
+
+	if n.p.addressComp > 0 {
+		if _, err := n.hw.WriteRegister(regNodeAddress, []uint8{n.extra.NodeAddress, n.extra.BroadcastAddress}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (n *Node) Close() error {
+	log := slog.With("func", "Close()", "params", "(-)", "return", "(error)", "package", "fsk")
+	log.Info("[ FSK ] FSK modem destructor")
+
+	return lora.Sleep(n.hw, n.cfg, log)
+}
+
+// MTU is payload_length; the length byte of variable packets isn't part of it
+func (n *Node) MTU() int {
+	return int(n.cfg.PayloadLength)
+}
+
+// TimeOnAir of a frame carrying payload bytes; whitening doesn't change the length
+func (n *Node) TimeOnAir(payload int) time.Duration {
+	bits := int(n.p.preamble) + 8*len(n.p.syncWord) + 8*payload + 8*int(n.p.crcLength)
+	if n.p.variable {
+		bits += 8
+	}
+	if n.p.addressComp > 0 {
+		bits += 8
+	}
+
+	return time.Duration(math.Ceil(float64(bits) / float64(n.p.bitrate) * float64(time.Second)))
+}
+
+func (n *Node) Tx(data []uint8) error {
+	log := slog.With("func", "Tx()", "params", "([]uint8)", "return", "(error)", "package", "fsk")
+	log.Info("[ FSK ] Data transmit")
+
+	airtime := n.TimeOnAir(len(data))
+	if n.duty != nil {
+		if err := n.duty.Reserve(n.cfg.Frequency, airtime); err != nil {
+			return err
+		}
+	}
+
+	if err := n.hw.EnqueueTx(data); err != nil {
+		if n.duty != nil {
+			n.duty.Release(n.cfg.Frequency, airtime)
+		}
+		return err
+	}
+
+	if b, ok := n.Budget(); ok {
+		log.Debug("[ FSK ] Duty cycle budget", "band", b.Band, "used", b.Used, "remaining", b.Remaining)
+		if n.onBudget != nil {
+			n.onBudget(b)
+		}
+	}
+	return nil
+}
+
+// Budget left on the band of sx126x.frequency; false outside of every band
+func (n *Node) Budget() (lora.Budget, bool) {
+	if n.duty == nil {
+		return lora.Budget{}, false
+	}
+	return n.duty.Budget(n.cfg.Frequency)
+}
+
+func (n *Node) Rx(timeout time.Duration) ([]uint8, error) {
+	log := slog.With("func", "Rx()", "params", "(time.Duration)", "return", "([]uint8, error)", "package", "fsk")
+
+	payload, err := n.hw.DequeueRx(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Debug, the timeouts of an idle link come by the second
+	log.Debug("[ FSK ] Data receive", "size", len(payload))
+	return payload, nil
+}
+
+func (n *Node) Run(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return n.hw.Run(ctx)
+}
+
+// ------------------------------------------------------------------------
@@ -0,0 +1,325 @@
+package fsk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/lora"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+// fakeTransceiver records the raw commands and register writes; the typed driver calls
+// are accepted and ignored
+type fakeTransceiver struct {
+	commands  [][]uint8
+	registers map[uint16][]uint8
+	writes    []uint16 // Register addresses in write order
+	sent      [][]uint8
+	txErr     error
+}
+
+func newFakeTransceiver() *fakeTransceiver {
+	return &fakeTransceiver{registers: make(map[uint16][]uint8)}
+}
+
+func (f *fakeTransceiver) SetStandby(sx126x.StandbyMode) error                     { return nil }
+func (f *fakeTransceiver) SetRx(int32) error                                       { return nil }
+func (f *fakeTransceiver) SetRegulatorMode(sx126x.RegulatorMode) error             { return nil }
+func (f *fakeTransceiver) CalibrateImage(_, _ sx126x.CalibrationImageFreq) error   { return nil }
+func (f *fakeTransceiver) SetPaConfig(...sx126x.OptionsPa) error                   { return nil }
+func (f *fakeTransceiver) SetDioIrqParams(sx126x.IrqMask, ...sx126x.IrqMask) error { return nil }
+func (f *fakeTransceiver) SetDIO2AsRfSwitchCtrl(bool) error                        { return nil }
+func (f *fakeTransceiver) SetRfFrequency(sx126x.Frequency) error                   { return nil }
+func (f *fakeTransceiver) SetPacketType(sx126x.PacketType) error                   { return nil }
+func (f *fakeTransceiver) SetTxParams(int8, sx126x.RampTime) error                 { return nil }
+func (f *fakeTransceiver) SetBufferBaseAddress(_, _ uint8) error                   { return nil }
+func (f *fakeTransceiver) ClearDeviceErrors(bool) error                            { return nil }
+func (f *fakeTransceiver) HardReset(...<-chan time.Time) error                     { return nil }
+func (f *fakeTransceiver) DequeueRx(time.Duration) ([]uint8, error) {
+	return nil, errors.New("nothing received")
+}
+func (f *fakeTransceiver) Run(ctx context.Context) error  { <-ctx.Done(); return nil }
+func (f *fakeTransceiver) Close(sx126x.SleepConfig) error { return nil }
+
+func (f *fakeTransceiver) Write(w []uint8, r []uint8, _ ...<-chan time.Time) error {
+	f.commands = append(f.commands, bytes.Clone(w))
+	return nil
+}
+
+func (f *fakeTransceiver) WriteRegister(address uint16, data []uint8) (uint8, error) {
+	f.registers[address] = bytes.Clone(data)
+	f.writes = append(f.writes, address)
+	return 0, nil
+}
+
+func (f *fakeTransceiver) ReadRegister(address uint16, data []uint8) (uint8, error) {
+	copy(data, f.registers[address])
+	return 0, nil
+}
+
+func (f *fakeTransceiver) EnqueueTx(payload []uint8) error {
+	if f.txErr != nil {
+		return f.txErr
+	}
+	f.sent = append(f.sent, payload)
+	return nil
+}
+
+func testConfig() (*sx126x.Config, *config.FSK) {
+	cfg := &sx126x.Config{
+		Enable:        true,
+		Modem:         "fsk",
+		Type:          "1262",
+		Bandwidth:     23_400,
+		Frequency:     433_500_000,
+		PayloadLength: 32,
+		FSK: sx126x.FSK{
+			Bitrate:                 "4800",
+			PulseShape:              "0.5",
+			FrequencyDeviation:      "5000",
+			PreambleDetectionLength: "16",
+			AddressComparison:       "2",
+			PacketType:              "variable",
+			CRC:                     "2_inv",
+			Whitening:               true,
+		},
+	}
+	extra := &config.FSK{SyncWord: "C194C1", NodeAddress: 0x12, BroadcastAddress: 0xFF, PreambleLength: 32}
+	return cfg, extra
+}
+
+// ************************************************************************
+// = 13.4.5 / 13.4.6 GFSK params ===
+// ------------------------------------------------------------------------
+func TestModulation(t *testing.T) {
+	tests := []struct {
+		name      string
+		bitrate   string
+		deviation string
+		bandwidth uint32
+		want      []uint8
+	}{
+		// br = 32 * 32 MHz / 4800, fdev = 5000 * 2^25 / 32 MHz; 23.4 kHz Rx bandwidth
+		{"4800", "4800", "5000", 23_400, []uint8{0x8B, 0x03, 0x41, 0x55, 0x09, 0x15, 0x00, 0x14, 0x7A}},
+		// 2 * deviation + bitrate doesn't fit 23.4 kHz, widened to 117.3 kHz
+		{"widened", "50000", "25000", 23_400, []uint8{0x8B, 0x00, 0x50, 0x00, 0x09, 0x0B, 0x00, 0x66, 0x66}},
+		// Wider than any Rx bandwidth, clamped to 467 kHz
+		{"clamped", "300000", "100000", 23_400, []uint8{0x8B, 0x00, 0x0D, 0x55, 0x09, 0x09, 0x01, 0x99, 0x99}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, extra := testConfig()
+			cfg.FSK.Bitrate, cfg.FSK.FrequencyDeviation, cfg.Bandwidth = tt.bitrate, tt.deviation, tt.bandwidth
+
+			p, err := parse(cfg, extra)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.modulation(); !bytes.Equal(got, tt.want) {
+				t.Errorf("modulation = % X, want % X", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPacket(t *testing.T) {
+	cfg, extra := testConfig()
+
+	p, err := parse(cfg, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 32 bit preamble, 16 bit detector, 24 bit sync word, node and broadcast address,
+	// variable length up to 32 bytes, CCITT CRC inverted, whitening
+	want := []uint8{0x8C, 0x00, 0x20, 0x05, 0x18, 0x02, 0x01, 0x20, 0x06, 0x01}
+	if got := p.packet(cfg.PayloadLength); !bytes.Equal(got, want) {
+		t.Errorf("packet = % X, want % X", got, want)
+	}
+
+	cfg.FSK.PacketType, cfg.FSK.CRC, cfg.FSK.Whitening, cfg.FSK.AddressComparison = "static", "off", false, "0"
+	cfg.FSK.SyncWordDetectionLength = "2"
+	if p, err = parse(cfg, extra); err != nil {
+		t.Fatal(err)
+	}
+	want = []uint8{0x8C, 0x00, 0x20, 0x05, 0x10, 0x00, 0x00, 0x20, 0x01, 0x00}
+	if got := p.packet(cfg.PayloadLength); !bytes.Equal(got, want) {
+		t.Errorf("packet = % X, want % X", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *sx126x.Config, extra *config.FSK)
+	}{
+		{"no bitrate", func(cfg *sx126x.Config, _ *config.FSK) { cfg.FSK.Bitrate = "" }},
+		{"bitrate too low", func(cfg *sx126x.Config, _ *config.FSK) { cfg.FSK.Bitrate = "599" }},
+		{"bitrate too high", func(cfg *sx126x.Config, _ *config.FSK) { cfg.FSK.Bitrate = "300001" }},
+		{"pulse shape", func(cfg *sx126x.Config, _ *config.FSK) { cfg.FSK.PulseShape = "0.4" }},
+		{"detector", func(cfg *sx126x.Config, _ *config.FSK) { cfg.FSK.PreambleDetectionLength = "12" }},
+		{"crc", func(cfg *sx126x.Config, _ *config.FSK) { cfg.FSK.CRC = "4" }},
+		{"sync word", func(_ *sx126x.Config, extra *config.FSK) { extra.SyncWord = "C194C" }},
+		{"sync word too long", func(_ *sx126x.Config, extra *config.FSK) { extra.SyncWord = "0102030405060708090A" }},
+		{"sync word detection", func(cfg *sx126x.Config, _ *config.FSK) { cfg.FSK.SyncWordDetectionLength = "4" }},
+		{"no preamble", func(_ *sx126x.Config, extra *config.FSK) { extra.PreambleLength = 0 }},
+		// sx126x.preamble_length of 12 LoRa symbols would be 12 bits here
+		{"preamble under detector", func(cfg *sx126x.Config, extra *config.FSK) {
+			cfg.FSK.PreambleDetectionLength, extra.PreambleLength = "16", 12
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, extra := testConfig()
+			tt.change(cfg, extra)
+			if _, err := parse(cfg, extra); err == nil {
+				t.Error("parse succeeded")
+			}
+		})
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Node ===
+// ------------------------------------------------------------------------
+func TestSetup(t *testing.T) {
+	hw := newFakeTransceiver()
+	cfg, extra := testConfig()
+
+	n, err := New(hw, cfg, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Setup(n); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]uint8{
+		{0x8B, 0x03, 0x41, 0x55, 0x09, 0x15, 0x00, 0x14, 0x7A},
+		{0x8C, 0x00, 0x20, 0x05, 0x18, 0x02, 0x01, 0x20, 0x06, 0x01},
+	}
+	if len(hw.commands) != len(want) {
+		t.Fatalf("commands % X, want % X", hw.commands, want)
+	}
+	for i := range want {
+		if !bytes.Equal(hw.commands[i], want[i]) {
+			t.Errorf("command %d = % X, want % X", i, hw.commands[i], want[i])
+		}
+	}
+
+	registers := []struct {
+		address uint16
+		want    []uint8
+	}{
+		{0x06C0, []uint8{0xC1, 0x94, 0xC1}}, // Sync word
+		{0x06BC, []uint8{0x1D, 0x0F}},       // CRC init
+		{0x06BE, []uint8{0x10, 0x21}},       // CRC polynomial
+		{0x06CD, []uint8{0x12, 0xFF}},       // Node, broadcast address
+	}
+	for _, r := range registers {
+		if got := hw.registers[r.address]; !bytes.Equal(got, r.want) {
+			t.Errorf("register 0x%04X = % X, want % X", r.address, got, r.want)
+		}
+	}
+	if len(hw.writes) != len(registers) {
+		t.Errorf("register writes %04X, want %d", hw.writes, len(registers))
+	}
+}
+
+// No CRC and no address filtering leave those registers alone
+func TestSetupPlain(t *testing.T) {
+	hw := newFakeTransceiver()
+	cfg, extra := testConfig()
+	cfg.FSK.CRC, cfg.FSK.AddressComparison = "off", "0"
+
+	n, err := New(hw, cfg, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Setup(n); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hw.writes) != 1 || hw.writes[0] != 0x06C0 {
+		t.Errorf("register writes %04X, want only the sync word", hw.writes)
+	}
+}
+
+func TestTimeOnAir(t *testing.T) {
+	cfg, extra := testConfig()
+	n, err := New(newFakeTransceiver(), cfg, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 32 preamble + 24 sync + 8 length + 8 address + 80 payload + 16 CRC = 168 bits at 4800 bit/s
+	if got := n.TimeOnAir(10); got != 35*time.Millisecond {
+		t.Errorf("TimeOnAir(10) = %v, want 35ms", got)
+	}
+}
+
+func TestTxDutyCycle(t *testing.T) {
+	hw := newFakeTransceiver()
+	cfg, extra := testConfig()
+
+	// 100 ms a second, two 35 ms frames fit
+	duty := &config.DutyCycle{
+		Enable: true,
+		Window: time.Second,
+		Bands:  map[string]config.Band{"test": {Low: 433_000_000, High: 434_000_000, Limit: 10}},
+	}
+	var budgets []lora.Budget
+	n, err := New(hw, cfg, extra, WithDutyCycle(duty), WithBudgetHandler(func(b lora.Budget) { budgets = append(budgets, b) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A frame the driver refused gives its airtime back
+	frame := make([]uint8, 10)
+	hw.txErr = errors.New("queue full")
+	if err := n.Tx(frame); err == nil {
+		t.Fatal("Tx into a full queue succeeded")
+	}
+	if b, _ := n.Budget(); b.Used != 0 {
+		t.Errorf("%v used after a refused frame, want none", b.Used)
+	}
+	hw.txErr = nil
+
+	for i := 0; i < 2; i++ {
+		if err := n.Tx(frame); err != nil {
+			t.Fatalf("Tx %d: %v", i, err)
+		}
+	}
+	if err := n.Tx(frame); !errors.Is(err, lora.ErrDutyCycle) {
+		t.Fatalf("Tx over budget = %v, want ErrDutyCycle", err)
+	}
+	if len(hw.sent) != 2 {
+		t.Errorf("%d frames sent, want 2", len(hw.sent))
+	}
+
+	if len(budgets) != 2 || budgets[1].Used != 70*time.Millisecond {
+		t.Errorf("budgets %+v, want 70ms used after the second frame", budgets)
+	}
+}
+
+func TestNew(t *testing.T) {
+	cfg, extra := testConfig()
+	if _, err := New(nil, cfg, extra); err == nil {
+		t.Error("New without modem succeeded")
+	}
+
+	cfg.Modem = "lora"
+	if _, err := New(newFakeTransceiver(), cfg, extra); err == nil {
+		t.Error("New with sx126x.modem lora succeeded")
+	}
+}
+
+// ------------------------------------------------------------------------
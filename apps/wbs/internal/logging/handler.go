@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// Attribute every package attaches with slog.With; per-package levels key off it
+const packageKey = "package"
+
+// Attribute keys containing any of these are never written out
+var secretKeys = []string{"password", "passwd", "secret", "token"}
+
+const redacted = "***"
+
+// levelHandler filters records by the level configured for the package that logged
+// them and falls back to the global level. The wrapped handler must accept everything.
+type levelHandler struct {
+	inner    slog.Handler
+	level    slog.Level
+	packages map[string]slog.Level
+	pkg      string // Last "package" attribute added through WithAttrs
+}
+
+func (h *levelHandler) levelFor(pkg string) slog.Level {
+	if lvl, ok := h.packages[pkg]; ok {
+		return lvl
+	}
+	return h.level
+}
+
+// Enabled is called before the record attributes are known; records that carry
+// "package" inline are let through here and filtered again in Handle.
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if h.pkg != "" {
+		return level >= h.levelFor(h.pkg)
+	}
+	return level >= h.minLevel()
+}
+
+func (h *levelHandler) minLevel() slog.Level {
+	lvl := h.level
+	for _, l := range h.packages {
+		lvl = min(lvl, l)
+	}
+	return lvl
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	pkg := h.pkg
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == packageKey {
+			pkg = a.Value.String()
+		}
+		return true
+	})
+
+	if r.Level < h.levelFor(pkg) {
+		return nil
+	}
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	for _, a := range attrs {
+		if a.Key == packageKey {
+			c.pkg = a.Value.String()
+		}
+	}
+	c.inner = h.inner.WithAttrs(attrs)
+	return &c
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.inner = h.inner.WithGroup(name)
+	return &c
+}
+
+// redact is a slog.HandlerOptions.ReplaceAttr hiding credentials, whatever the group.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) && a.Value.String() != "" {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	return a
+}
+
+// logfmt keeps the TextHandler output but uses the conventional ts / lowercase level.
+func logfmt(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return redact(groups, a)
+	}
+
+	switch a.Key {
+	case slog.TimeKey:
+		return slog.String("ts", a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+	case slog.LevelKey:
+		return slog.String(slog.LevelKey, strings.ToLower(a.Value.String()))
+	}
+	return redact(groups, a)
+}
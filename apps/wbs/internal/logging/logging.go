@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"wbs/internal/config"
+)
+
+var stringToLevel = map[string]slog.Level{
+	"DEBUG": slog.LevelDebug,
+	"INFO":  slog.LevelInfo,
+	"WARN":  slog.LevelWarn,
+	"ERROR": slog.LevelError,
+}
+
+func level(log *slog.Logger, name string) slog.Level {
+	lvl, ok := stringToLevel[strings.ToUpper(name)]
+	if !ok {
+		lvl = slog.LevelInfo
+		log.Warn("[ LOG ] Unknown log level", "level", name)
+		log.Warn("[ LOG ] Limiting log level to INFO")
+	}
+	return lvl
+}
+
+// Setup builds the logger described by the config. The returned logger is not set
+// as the default; the caller decides when to switch over.
+func Setup(cfg *config.Logging) (*slog.Logger, func(), error) {
+	log := slog.With("func", "Setup()", "params", "(*config.Logging)", "return", "(*slog.Logger, func(), error)", "package", "logging")
+	log.Info("[ LOG ] Logger setup")
+
+	if cfg == nil {
+		return nil, func() {}, fmt.Errorf("[ LOG ] Logger state improper; cfg is nil")
+	}
+
+	var out io.Writer = os.Stdout
+	cleanup := func() {}
+
+	if cfg.File != "" {
+		file, err := openRotating(cfg.File, int64(cfg.MaxSize)<<20, int(cfg.MaxBackups))
+		if err != nil {
+			return nil, func() {}, err
+		}
+		out = file
+		cleanup = func() { _ = file.Close() }
+	}
+
+	handler := &levelHandler{
+		level:    level(log, cfg.LogLevel),
+		packages: make(map[string]slog.Level),
+	}
+	for pkg, name := range cfg.Packages {
+		handler.packages[pkg] = level(log.With("override", pkg), name)
+	}
+
+	// Filtering happens in levelHandler, the inner handler takes everything
+	opts := &slog.HandlerOptions{
+		Level:       slog.Level(-8),
+		AddSource:   false,
+		ReplaceAttr: redact,
+	}
+
+	switch strings.ToLower(cfg.Format) {
+	case "json":
+		handler.inner = slog.NewJSONHandler(out, opts)
+	case "logfmt":
+		opts.ReplaceAttr = logfmt
+		handler.inner = slog.NewTextHandler(out, opts)
+	case "text":
+		handler.inner = slog.NewTextHandler(out, opts)
+	default:
+		handler.inner = slog.NewTextHandler(out, opts)
+		log.Warn("[ LOG ] Unknown log format", "format", cfg.Format)
+		log.Warn("[ LOG ] Limiting log format to text")
+	}
+
+	return slog.New(handler), cleanup, nil
+}
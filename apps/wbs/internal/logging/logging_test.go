@@ -0,0 +1,219 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"wbs/internal/config"
+)
+
+// ************************************************************************
+// = Levels ===
+// ------------------------------------------------------------------------
+func testLogger(level slog.Level, packages map[string]slog.Level) (*slog.Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	h := &levelHandler{
+		inner:    slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.Level(-8), ReplaceAttr: redact}),
+		level:    level,
+		packages: packages,
+	}
+	return slog.New(h), &buf
+}
+
+// messages returns the msg of every JSON line in buf
+func messages(t *testing.T, buf *bytes.Buffer) []string {
+	t.Helper()
+
+	var msgs []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var rec map[string]any
+		if err := json.Unmarshal([]uint8(line), &rec); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		msgs = append(msgs, rec["msg"].(string))
+	}
+	return msgs
+}
+
+func TestPackageLevels(t *testing.T) {
+	log, buf := testLogger(slog.LevelWarn, map[string]slog.Level{"lora": slog.LevelDebug, "mqtt": slog.LevelError})
+
+	// Through With, the way every package logs
+	lora := log.With("package", "lora")
+	lora.Debug("lora debug")
+	mqtt := log.With("func", "Connect()", "package", "mqtt")
+	mqtt.Warn("mqtt warn")
+	mqtt.Error("mqtt error")
+
+	// Inline on the record
+	log.Debug("inline lora debug", "package", "lora")
+	log.Info("inline station info", "package", "station")
+	log.Warn("inline station warn", "package", "station")
+
+	// No package at all gets the global level
+	log.Info("plain info")
+	log.Warn("plain warn")
+
+	want := []string{"lora debug", "mqtt error", "inline lora debug", "inline station warn", "plain warn"}
+	if got := messages(t, buf); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	log, _ := testLogger(slog.LevelWarn, map[string]slog.Level{"lora": slog.LevelDebug})
+	ctx := t.Context()
+
+	// Without a package yet, the lowest override lets the record on to Handle
+	if log.Enabled(ctx, slog.LevelDebug) == false {
+		t.Error("debug disabled before the package is known")
+	}
+	if log.With("package", "mqtt").Enabled(ctx, slog.LevelInfo) {
+		t.Error("info enabled for mqtt at the global WARN")
+	}
+	if log.With("package", "lora").Enabled(ctx, slog.LevelDebug) == false {
+		t.Error("debug disabled for lora")
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Output ===
+// ------------------------------------------------------------------------
+func TestRedact(t *testing.T) {
+	log, buf := testLogger(slog.LevelDebug, nil)
+
+	log.Info("connect", "user", "wbs", "password", "hunter2", "MQTT_Token", "abc", "secret", "")
+	log.WithGroup("mqtt").Info("nested", "client_secret", "xyz")
+
+	out := buf.String()
+	for _, leaked := range []string{"hunter2", "abc", "xyz"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("%q in %s", leaked, out)
+		}
+	}
+	for _, kept := range []string{`"user":"wbs"`, `"password":"***"`, `"MQTT_Token":"***"`, `"secret":""`, `"mqtt":{"client_secret":"***"}`} {
+		if strings.Contains(out, kept) == false {
+			t.Errorf("%s missing from %s", kept, out)
+		}
+	}
+}
+
+func TestLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{ReplaceAttr: logfmt}))
+
+	log.Info("[ LoRa ] Frame sent", "size", 12, "token", "abc")
+
+	pattern := regexp.MustCompile(`^ts=\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}Z level=info msg="\[ LoRa \] Frame sent" size=12 token=\*\*\*\n$`)
+	if pattern.Match(buf.Bytes()) == false {
+		t.Errorf("logfmt line %q", buf.String())
+	}
+}
+
+func TestSetup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wbs.log")
+
+	log, cleanup, err := Setup(&config.Logging{LogLevel: "warn", Format: "json", File: path, MaxSize: 10, MaxBackups: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Info("dropped")
+	log.Warn("kept", "package", "lora")
+	cleanup()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := messages(t, bytes.NewBuffer(data)); len(got) != 1 || got[0] != "kept" {
+		t.Errorf("logged %q, want [kept]", got)
+	}
+
+	if _, _, err := Setup(nil); err == nil {
+		t.Error("Setup without cfg succeeded")
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Rotation ===
+// ------------------------------------------------------------------------
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wbs.log")
+
+	r, err := openRotating(path, 16, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two lines per file, the fifth starts a third rotation
+	for i := 0; i < 5; i++ {
+		if _, err := fmt.Fprintf(r, "line %d\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"wbs.log":   "line 4\n",
+		"wbs.log.1": "line 2\nline 3\n",
+		"wbs.log.2": "line 0\nline 1\n",
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(want) {
+		t.Errorf("%d files, want %d", len(entries), len(want))
+	}
+	for name, content := range want {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("%s = %q, want %q", name, data, content)
+		}
+	}
+}
+
+// An existing file counts towards the size, and without backups it is just truncated
+func TestRotateNoBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wbs.log")
+	if err := os.WriteFile(path, []uint8("old line 0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openRotating(path, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Write([]uint8("line 1\n")); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	entries, _ := os.ReadDir(dir)
+	data, _ := os.ReadFile(path)
+	if len(entries) != 1 || string(data) != "line 1\n" {
+		t.Errorf("%d files, wbs.log = %q; want only line 1", len(entries), data)
+	}
+}
+
+// ------------------------------------------------------------------------
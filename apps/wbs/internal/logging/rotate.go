@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile renames path to path.1 (path.1 to path.2, ...) once it grows past
+// maxSize bytes and keeps at most maxBackups old files.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openRotating(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("[ LOG ] Could not open log file %s: %w", r.path, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("[ LOG ] Could not stat log file %s: %w", r.path, err)
+	}
+
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("[ LOG ] Could not close log file %s: %w", r.path, err)
+	}
+
+	if r.maxBackups <= 0 {
+		_ = os.Remove(r.path)
+	} else {
+		_ = os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return fmt.Errorf("[ LOG ] Could not rotate log file %s: %w", r.path, err)
+		}
+	}
+
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.file.Close()
+}
@@ -0,0 +1,568 @@
+package lora
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/lora/packet"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+const (
+	// SNR margin worth one Tx power step
+	adrStep = 3 // dB
+	// Station reports and gateway commands keep to the upper half of the sequences, away
+	// from the telemetry of PacketEncoder in the lower one, so duplicate suppression
+	// doesn't mistake one for the other
+	adrSequenceBase = 0x8000
+	// Symbols longer than this need the low data rate optimization, datasheet 6.1.1.4
+	ldroSymbol = 16 * time.Millisecond
+)
+
+// adrSequence follows s within the upper half; the first one after a boot is random,
+// see sequences.restarted
+func adrSequence(s uint16) uint16 {
+	return (s + 1) | adrSequenceBase
+}
+
+// demodulationFloor is the lowest SNR a LoRa frame is received with, datasheet 6.1.1.2
+func demodulationFloor(sf uint8) float64 {
+	return -2.5 * (float64(sf) - 4) // SF7 -7.5 dB ... SF12 -20 dB
+}
+
+// ************************************************************************
+// = Node ===
+// ------------------------------------------------------------------------
+
+// SetDataRate switches spreading factor and Tx power, e.g. on an ADR command. Like
+// Reconfigure it goes through standby; LDRO follows the new symbol time. The data rate
+// outlives Reconfigure until it is the configured one again.
+func (n *Node) SetDataRate(sf uint8, power int8) error {
+	log := slog.With("func", "SetDataRate()", "params", "(uint8, int8)", "return", "(error)", "package", "lora")
+	log.Info("[ LoRa ] Data rate change", "sf", sf, "tx_power", power)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	rate := packet.ADR{SpreadingFactor: sf, TxPower: power}
+	n.rate = &rate
+	if rate == dataRate(n.base) {
+		n.rate = nil
+	}
+	n.cfg = n.withDataRate(n.base)
+
+	return n.applyDataRate(log)
+}
+
+// withDataRate is cfg with the data rate of SetDataRate on top; n.mu must be held
+func (n *Node) withDataRate(cfg *sx126x.Config) *sx126x.Config {
+	if n.rate == nil {
+		return cfg
+	}
+
+	c := *cfg
+	c.LoRa.SpreadingFactor = n.rate.SpreadingFactor
+	c.TransmitPower = n.rate.TxPower
+	if c.Bandwidth > 0 {
+		c.LoRa.LDRO = time.Duration(math.Exp2(float64(c.LoRa.SpreadingFactor))/float64(c.Bandwidth)*float64(time.Second)) > ldroSymbol
+	}
+	return &c
+}
+
+// applyDataRate sends the data rate part of cfg to the modem; n.mu must be held
+func (n *Node) applyDataRate(log *slog.Logger) error {
+	// = 13.1.2 SetStandby =============
+	if err := n.hw.SetStandby(sx126x.StandbyRc); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	// = 13.4.4 SetTxParams ============
+	if err := n.setTxParams(log); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	// = 13.4.5 SetModulationParams ====
+	if err := n.setModulationParams(); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	// = 13.1.5 SetRx ==================
+	return n.hw.SetRx(int32(sx126x.RxContinuous))
+}
+
+func dataRate(cfg *sx126x.Config) packet.ADR {
+	return packet.ADR{SpreadingFactor: cfg.LoRa.SpreadingFactor, TxPower: cfg.TransmitPower}
+}
+
+// DataRate is the spreading factor and Tx power the modem currently uses
+func (n *Node) DataRate() packet.ADR {
+	return dataRate(n.config())
+}
+
+// ConfiguredDataRate is the spreading factor and Tx power of the config, whatever SetDataRate did
+func (n *Node) ConfiguredDataRate() packet.ADR {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return dataRate(n.base)
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Station side ===
+// ------------------------------------------------------------------------
+
+// ADR applies the Tx power the gateway recommends; commands for an SF other than the
+// configured one, the only one the gateway hears, are ignored. After fallback_acks missed
+// ACKs in a row it raises Tx power to max_tx_power and reports that to the gateway. ADR
+// packets from the gateway never come out of Rx. It sits on top of Reliable, without it
+// no ACK is ever missed.
+type ADR struct {
+	link    Link
+	node    *Node
+	cfg     *config.ADR
+	address packet.Address
+	gateway packet.Address
+
+	mu         sync.Mutex
+	missed     int
+	sequence   uint16
+	unreported bool // The last fallback report was lost
+}
+
+func NewADR(link Link, node *Node, cfg *config.ADR, address, gateway packet.Address) (*ADR, error) {
+	log := slog.With("func", "NewADR()", "params", "(Link, *Node, *config.ADR, packet.Address, packet.Address)", "return", "(*ADR, error)", "package", "lora")
+	log.Info("[ LoRa ] ADR constructor", "address", address, "gateway", gateway)
+
+	if cfg == nil {
+		return nil, fmt.Errorf("LoRa link state improper; cfg is nil")
+	}
+	if link == nil || reflect.ValueOf(link).IsNil() {
+		return nil, fmt.Errorf("LoRa link state improper; link is nil")
+	}
+	if node == nil {
+		return nil, fmt.Errorf("LoRa link state improper; node is nil")
+	}
+
+	return &ADR{
+		link:     link,
+		node:     node,
+		cfg:      cfg,
+		address:  address,
+		gateway:  gateway,
+		sequence: adrSequence(rand.N[uint16](adrSequenceBase)),
+	}, nil
+}
+
+func (a *ADR) Tx(data []uint8) error {
+	err := a.link.Tx(data)
+
+	switch {
+	case err == nil:
+		a.mu.Lock()
+		a.missed = 0
+		unreported := a.unreported
+		a.mu.Unlock()
+
+		// The gateway hears us again, it must learn what we use now
+		if unreported {
+			a.report(a.node.DataRate())
+		}
+	case errors.Is(err, ErrNoAck):
+		a.missedAck()
+	}
+	return err
+}
+
+func (a *ADR) missedAck() {
+	log := slog.With("func", "ADR.missedAck()", "params", "(-)", "return", "(-)", "package", "lora")
+
+	a.mu.Lock()
+	a.missed++
+	missed := a.missed
+	a.mu.Unlock()
+
+	if a.cfg.FallbackAcks == 0 || missed < int(a.cfg.FallbackAcks) {
+		return
+	}
+
+	current := a.node.DataRate()
+	robust := packet.ADR{SpreadingFactor: current.SpreadingFactor, TxPower: a.cfg.MaxTxPower}
+	if robust == current {
+		return
+	}
+
+	log.Warn("[ LoRa ] Gateway lost, falling back to robust data rate", "missed_acks", missed, "sf", robust.SpreadingFactor, "tx_power", robust.TxPower)
+	if err := a.node.SetDataRate(robust.SpreadingFactor, robust.TxPower); err != nil {
+		log.Error("[ LoRa ] Could not fall back", "error", err)
+		return
+	}
+
+	a.mu.Lock()
+	a.missed = 0
+	a.mu.Unlock()
+
+	a.report(robust)
+}
+
+// report tells the gateway the data rate in use; it still assumes the old one until it hears this
+func (a *ADR) report(rate packet.ADR) {
+	log := slog.With("func", "ADR.report()", "params", "(packet.ADR)", "return", "(-)", "package", "lora")
+
+	a.mu.Lock()
+	a.sequence = adrSequence(a.sequence)
+	sequence := a.sequence
+	a.mu.Unlock()
+
+	data, err := packet.Encode(packet.Packet{
+		Header:  packet.Header{Source: a.address, Destination: a.gateway, Sequence: sequence},
+		Payload: &rate,
+	}, a.link.MTU())
+	if err == nil {
+		err = a.link.Tx(data)
+	}
+
+	a.mu.Lock()
+	a.unreported = err != nil
+	a.mu.Unlock()
+
+	if err != nil {
+		log.Warn("[ LoRa ] Could not report data rate", "error", err)
+	}
+}
+
+// Rx returns the next packet that isn't an ADR command
+func (a *ADR) Rx(timeout time.Duration) ([]uint8, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		payload, err := a.link.Rx(max(time.Until(deadline), time.Millisecond))
+		if err != nil {
+			return nil, err
+		}
+		if a.handle(payload) == false {
+			return payload, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("[ LoRa ] Nothing received in %s", timeout)
+		}
+	}
+}
+
+// handle applies ADR commands from the gateway; false for everything else
+func (a *ADR) handle(payload []uint8) bool {
+	log := slog.With("func", "ADR.handle()", "params", "([]uint8)", "return", "(bool)", "package", "lora")
+
+	h, err := packet.DecodeHeader(payload)
+	if err != nil || h.Type != packet.TypeADR || h.Source != a.gateway {
+		return false
+	}
+
+	p, err := packet.Decode(payload)
+	if err != nil {
+		log.Debug("[ LoRa ] Malformed ADR command", "error", err)
+		return true
+	}
+	rate := p.Payload.(*packet.ADR)
+
+	if rate.SpreadingFactor != a.node.ConfiguredDataRate().SpreadingFactor || rate.TxPower < a.cfg.MinTxPower || rate.TxPower > a.cfg.MaxTxPower {
+		log.Warn("[ LoRa ] ADR command out of the configured range, ignored", "sf", rate.SpreadingFactor, "tx_power", rate.TxPower)
+		return true
+	}
+	if a.node.DataRate() == *rate {
+		return true
+	}
+
+	if err := a.node.SetDataRate(rate.SpreadingFactor, rate.TxPower); err != nil {
+		log.Error("[ LoRa ] Could not apply ADR command", "error", err)
+		return true
+	}
+
+	a.mu.Lock()
+	a.missed = 0
+	a.unreported = false
+	a.mu.Unlock()
+	return true
+}
+
+func (a *ADR) TimeOnAir(payload int) time.Duration {
+	return a.link.TimeOnAir(payload)
+}
+
+func (a *ADR) MTU() int {
+	return a.link.MTU()
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Gateway side ===
+// ------------------------------------------------------------------------
+type adrStation struct {
+	rate    packet.ADR
+	history []float32 // SNR of the latest uplinks
+}
+
+// ADRController runs on the gateway, on top of its link. After adr.history uplinks of a
+// station it takes their best SNR, keeps adr.margin above the demodulation floor of the
+// station's SF and turns every further 3 dB into 3 dB less Tx power; a missing margin
+// raises it the same way, within min_tx_power - max_tx_power. Run sends the result to the
+// station as a packet.ADR. A gateway with a single SX126x hears its own SF only, so the
+// SF stays the configured one. The stations' fallback reports never come out of Rx.
+type ADRController struct {
+	link    Link
+	cfg     *config.ADR
+	initial packet.ADR
+	address packet.Address
+
+	mu       sync.Mutex
+	stations map[packet.Address]*adrStation
+	sequence uint16
+}
+
+// NewADRController assumes every station starts with the SF and Tx power of sx; address is the gateway's own
+func NewADRController(link Link, cfg *config.ADR, sx *sx126x.Config, address packet.Address) (*ADRController, error) {
+	log := slog.With("func", "NewADRController()", "params", "(Link, *config.ADR, *sx126x.Config, packet.Address)", "return", "(*ADRController, error)", "package", "lora")
+	log.Info("[ LoRa ] ADR controller constructor", "address", address)
+
+	if cfg == nil {
+		return nil, fmt.Errorf("LoRa ADR state improper; cfg is nil")
+	}
+	if sx == nil {
+		return nil, fmt.Errorf("LoRa ADR state improper; sx126x cfg is nil")
+	}
+	if link == nil || reflect.ValueOf(link).IsNil() {
+		return nil, fmt.Errorf("LoRa ADR state improper; link is nil")
+	}
+
+	return &ADRController{
+		link:     link,
+		cfg:      cfg,
+		initial:  dataRate(sx),
+		address:  address,
+		stations: make(map[packet.Address]*adrStation),
+		sequence: adrSequence(rand.N[uint16](adrSequenceBase)),
+	}, nil
+}
+
+// station is the state of source; c.mu must be held
+func (c *ADRController) station(source packet.Address) *adrStation {
+	s, ok := c.stations[source]
+	if !ok {
+		s = &adrStation{rate: c.initial}
+		c.stations[source] = s
+	}
+	return s
+}
+
+// Rate is the data rate the controller believes source uses
+func (c *ADRController) Rate(source packet.Address) packet.ADR {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.station(source).rate
+}
+
+// Observe adds the SNR of an uplink from source. Once enough were seen it returns the
+// data rate to send to the station as a packet.ADR, true when that is a change.
+func (c *ADRController) Observe(source packet.Address, snr float32) (packet.ADR, bool) {
+	log := slog.With("func", "ADRController.Observe()", "params", "(packet.Address, float32)", "return", "(packet.ADR, bool)", "package", "lora")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.station(source)
+	s.history = append(s.history, snr)
+	if len(s.history) < max(int(c.cfg.History), 1) {
+		return s.rate, false
+	}
+
+	rate := c.recommend(s)
+	log.Debug("[ LoRa ] ADR recommendation", "station", source, "best_snr", slices.Max(s.history), "sf", rate.SpreadingFactor, "tx_power", rate.TxPower)
+
+	// The next recommendation must only see uplinks sent with this one
+	s.history = s.history[:0]
+	if rate == s.rate {
+		return rate, false
+	}
+	s.rate = rate
+	return rate, true
+}
+
+// ObserveFrame is Observe for a frame straight from the modem, see WithFrameHandler;
+// the header is readable even on encrypted links. Broken frames, frames without a
+// Latched SNR, frames that aren't packets and frames that aren't for the gateway are
+// skipped.
+func (c *ADRController) ObserveFrame(f Frame) (packet.Address, packet.ADR, bool) {
+	source, ok := c.uplink(f)
+	if !ok {
+		return 0, packet.ADR{}, false
+	}
+
+	rate, changed := c.Observe(source, f.SNR)
+	return source, rate, changed
+}
+
+// uplink is the station that sent f to the gateway
+func (c *ADRController) uplink(f Frame) (packet.Address, bool) {
+	if f.Error || f.Latched == false {
+		return 0, false
+	}
+
+	h, err := packet.DecodeHeader(f.Payload)
+	if err != nil || h.Destination != c.address {
+		return 0, false
+	}
+	return h.Source, true
+}
+
+// Report takes the data rate a station says it uses, e.g. after a fallback; its
+// history starts over.
+func (c *ADRController) Report(source packet.Address, rate packet.ADR) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.station(source)
+	s.rate = rate
+	s.history = s.history[:0]
+}
+
+func (c *ADRController) recommend(s *adrStation) packet.ADR {
+	margin := float64(slices.Max(s.history)) - demodulationFloor(s.rate.SpreadingFactor) - float64(c.cfg.Margin)
+	steps := int(math.Floor(margin / adrStep))
+
+	rate := s.rate
+	for ; steps > 0 && rate.TxPower > c.cfg.MinTxPower; steps-- {
+		rate.TxPower = max(rate.TxPower-adrStep, c.cfg.MinTxPower)
+	}
+	for ; steps < 0 && rate.TxPower < c.cfg.MaxTxPower; steps++ {
+		rate.TxPower = min(rate.TxPower+adrStep, c.cfg.MaxTxPower)
+	}
+	return rate
+}
+
+// Run observes the frames of WithFrameHandler until ctx is cancelled and sends every
+// changed recommendation to its station. A station that doesn't acknowledge it keeps
+// its data rate as far as the controller is concerned.
+func (c *ADRController) Run(ctx context.Context, frames <-chan Frame) error {
+	log := slog.With("func", "ADRController.Run()", "params", "(context.Context, <-chan Frame)", "return", "(error)", "package", "lora")
+	log.Info("[ LoRa ] ADR controller event loop")
+
+	if ctx == nil {
+		return fmt.Errorf("LoRa ADR state improper; ctx is nil")
+	}
+
+	warned := false
+	for {
+		var f Frame
+		select {
+		case <-ctx.Done():
+			return nil
+		case f = <-frames:
+		}
+
+		if f.Latched == false && warned == false {
+			warned = true
+			log.Warn("[ LoRa ] Modem driver reads packet status after the frame, its SNR is no use for ADR")
+		}
+
+		source, ok := c.uplink(f)
+		if !ok {
+			continue
+		}
+
+		before := c.Rate(source)
+		rate, changed := c.Observe(source, f.SNR)
+		if changed == false {
+			continue
+		}
+
+		log.Info("[ LoRa ] Sending data rate to station", "station", source, "sf", rate.SpreadingFactor, "tx_power", rate.TxPower)
+		if err := c.command(source, rate); err != nil {
+			log.Warn("[ LoRa ] Could not send data rate", "station", source, "error", err)
+			c.Report(source, before)
+		}
+	}
+}
+
+func (c *ADRController) command(station packet.Address, rate packet.ADR) error {
+	c.mu.Lock()
+	c.sequence = adrSequence(c.sequence)
+	sequence := c.sequence
+	c.mu.Unlock()
+
+	data, err := packet.Encode(packet.Packet{
+		Header:  packet.Header{Source: c.address, Destination: station, Sequence: sequence},
+		Payload: &rate,
+	}, c.link.MTU())
+	if err != nil {
+		return err
+	}
+	return c.link.Tx(data)
+}
+
+func (c *ADRController) Tx(data []uint8) error {
+	return c.link.Tx(data)
+}
+
+// Rx returns the next packet that isn't a station's data rate report
+func (c *ADRController) Rx(timeout time.Duration) ([]uint8, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		payload, err := c.link.Rx(max(time.Until(deadline), time.Millisecond))
+		if err != nil {
+			return nil, err
+		}
+		if c.handle(payload) == false {
+			return payload, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("[ LoRa ] Nothing received in %s", timeout)
+		}
+	}
+}
+
+// handle takes data rate reports addressed to the gateway; false for everything else
+func (c *ADRController) handle(payload []uint8) bool {
+	log := slog.With("func", "ADRController.handle()", "params", "([]uint8)", "return", "(bool)", "package", "lora")
+
+	h, err := packet.DecodeHeader(payload)
+	if err != nil || h.Type != packet.TypeADR || h.Destination != c.address {
+		return false
+	}
+
+	p, err := packet.Decode(payload)
+	if err != nil {
+		log.Debug("[ LoRa ] Malformed data rate report", "error", err)
+		return true
+	}
+	rate := p.Payload.(*packet.ADR)
+
+	log.Info("[ LoRa ] Station reported data rate", "station", h.Source, "sf", rate.SpreadingFactor, "tx_power", rate.TxPower)
+	c.Report(h.Source, *rate)
+	return true
+}
+
+func (c *ADRController) TimeOnAir(payload int) time.Duration {
+	return c.link.TimeOnAir(payload)
+}
+
+func (c *ADRController) MTU() int {
+	return c.link.MTU()
+}
+
+// ------------------------------------------------------------------------
@@ -0,0 +1,227 @@
+package lora_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/lora"
+	"wbs/internal/lora/packet"
+	"wbs/internal/lora/sim"
+)
+
+// fakeLink keeps what is sent and fails every Tx with err; Rx hands out the queued frames
+type fakeLink struct {
+	mu     sync.Mutex
+	err    error
+	sent   [][]uint8
+	frames chan []uint8
+}
+
+func newFakeLink() *fakeLink {
+	return &fakeLink{frames: make(chan []uint8, 8)}
+}
+
+func (l *fakeLink) Tx(data []uint8) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sent = append(l.sent, data)
+	return l.err
+}
+
+func (l *fakeLink) Rx(timeout time.Duration) ([]uint8, error) {
+	select {
+	case data := <-l.frames:
+		return data, nil
+	case <-time.After(timeout):
+		return nil, errors.New("nothing received")
+	}
+}
+
+func (l *fakeLink) TimeOnAir(payload int) time.Duration {
+	return 0
+}
+
+func (l *fakeLink) MTU() int {
+	return 64
+}
+
+// reports are the data rates sent in ADR packets so far
+func (l *fakeLink) reports(t *testing.T) []packet.ADR {
+	t.Helper()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var list []packet.ADR
+	for _, data := range l.sent {
+		p, err := packet.Decode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rate, ok := p.Payload.(*packet.ADR); ok {
+			list = append(list, *rate)
+		}
+	}
+	return list
+}
+
+func adrConfig() *config.ADR {
+	return &config.ADR{Enable: true, History: 1, Margin: 10, MinTxPower: 2, MaxTxPower: 14, FallbackAcks: 2}
+}
+
+// SF7 demodulates down to -7.5 dB; with a 10 dB margin every 3 dB above -2.5 dB is one step
+func TestADRControllerRecommend(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    int8
+		snr     float32
+		want    int8
+		changed bool
+	}{
+		{"margin kept", 14, 2.5, 14, false},
+		{"one step down", 14, 5.5, 11, true},
+		{"three steps down", 14, 11.5, 5, true},
+		{"down to min_tx_power", 14, 30, 2, true},
+		{"up", 5, -1, 11, true},
+		{"up to max_tx_power", 5, -20, 14, true},
+		{"at max_tx_power", 14, -20, 14, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := lora.NewADRController(newFakeLink(), adrConfig(), testConfig(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Report(1, packet.ADR{SpreadingFactor: 7, TxPower: tt.from})
+
+			rate, changed := c.Observe(1, tt.snr)
+			if rate != (packet.ADR{SpreadingFactor: 7, TxPower: tt.want}) || changed != tt.changed {
+				t.Errorf("Observe = %+v, %v; want SF7 at %d dBm, %v", rate, changed, tt.want, tt.changed)
+			}
+			if got := c.Rate(1); got != rate {
+				t.Errorf("Rate = %+v after Observe, want %+v", got, rate)
+			}
+		})
+	}
+}
+
+// The best SNR of adr.history uplinks counts; a report starts the history over
+func TestADRControllerHistory(t *testing.T) {
+	cfg := adrConfig()
+	cfg.History = 3
+	c, err := lora.NewADRController(newFakeLink(), cfg, testConfig(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Observe(1, 11.5)
+	c.Observe(1, -5)
+	c.Report(1, packet.ADR{SpreadingFactor: 7, TxPower: 14})
+	if _, changed := c.Observe(1, -5); changed {
+		t.Error("recommendation from uplinks before the report")
+	}
+	if rate, changed := c.Observe(1, 11.5); changed || rate.TxPower != 14 {
+		t.Errorf("Observe = %+v, %v; want no recommendation before 3 uplinks", rate, changed)
+	}
+	if rate, changed := c.Observe(1, -5); !changed || rate.TxPower != 5 {
+		t.Errorf("Observe = %+v, %v; want 5 dBm from the best of 3", rate, changed)
+	}
+}
+
+// After fallback_acks missed ACKs in a row the station goes to max_tx_power and tells
+// the gateway; a lost report goes out again once an ACK comes back
+func TestADRFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	node, _ := newNode(t, ctx, sim.NewChannel(sim.WithSeed(1)), testConfig())
+	if err := node.SetDataRate(7, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	link := newFakeLink()
+	link.err = lora.ErrNoAck
+	a, err := lora.NewADR(link, node, adrConfig(), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	robust := packet.ADR{SpreadingFactor: 7, TxPower: 14}
+	steps := []struct {
+		err     error
+		rate    packet.ADR
+		reports int
+	}{
+		{lora.ErrNoAck, packet.ADR{SpreadingFactor: 7, TxPower: 5}, 0},
+		{lora.ErrNoAck, robust, 1}, // The report is lost as well
+		{lora.ErrNoAck, robust, 1},
+		{lora.ErrNoAck, robust, 1}, // Already at max_tx_power, nothing left to fall back to
+		{nil, robust, 2},
+		{nil, robust, 2},
+	}
+
+	for i, st := range steps {
+		link.mu.Lock()
+		link.err = st.err
+		link.mu.Unlock()
+
+		if err := a.Tx(uplink(t, 1)); !errors.Is(err, st.err) {
+			t.Fatalf("Tx %d = %v, want %v", i, err, st.err)
+		}
+		if rate := node.DataRate(); rate != st.rate {
+			t.Errorf("data rate %+v after Tx %d, want %+v", rate, i, st.rate)
+		}
+		reports := link.reports(t)
+		if len(reports) != st.reports {
+			t.Fatalf("%d reports after Tx %d, want %d", len(reports), i, st.reports)
+		}
+		if len(reports) > 0 && reports[len(reports)-1] != robust {
+			t.Errorf("reported %+v, want %+v", reports[len(reports)-1], robust)
+		}
+	}
+}
+
+// Commands for another SF or out of min_tx_power - max_tx_power are dropped
+func TestADRCommand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	node, _ := newNode(t, ctx, sim.NewChannel(sim.WithSeed(1)), testConfig())
+	link := newFakeLink()
+	a, err := lora.NewADR(link, node, adrConfig(), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	command := func(rate packet.ADR) {
+		data, err := packet.Encode(packet.Packet{
+			Header:  packet.Header{Source: 0, Destination: 1, Sequence: 0x8001},
+			Payload: &rate,
+		}, link.MTU())
+		if err != nil {
+			t.Fatal(err)
+		}
+		link.frames <- data
+	}
+
+	command(packet.ADR{SpreadingFactor: 9, TxPower: 8})
+	command(packet.ADR{SpreadingFactor: 7, TxPower: 20})
+	command(packet.ADR{SpreadingFactor: 7, TxPower: 8})
+	link.frames <- uplink(t, 0)
+
+	data, err := a.Rx(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := packet.Decode(data); err != nil || p.Type != packet.TypeCommand {
+		t.Errorf("Rx = %+v, %v; want the command packet past the ADR ones", p, err)
+	}
+	if rate := node.DataRate(); rate != (packet.ADR{SpreadingFactor: 7, TxPower: 8}) {
+		t.Errorf("data rate %+v, want SF7 at 8 dBm", rate)
+	}
+}
@@ -0,0 +1,47 @@
+package lora
+
+import (
+	"math"
+	"time"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+// TimeOnAir of a LoRa frame carrying payload bytes, SX126x datasheet 6.1.4.
+func TimeOnAir(cfg *sx126x.Config, payload int) time.Duration {
+	if cfg == nil || cfg.Bandwidth == 0 {
+		return 0
+	}
+
+	sf := float64(cfg.LoRa.SpreadingFactor)
+	cr := float64(max(int(cfg.LoRa.CodingRate)-4, 1)) // 5 - 4/5 ... 8 - 4/8
+
+	crc, implicit, ldro := 0.0, 0.0, 0.0
+	if cfg.LoRa.CRC {
+		crc = 1
+	}
+	if cfg.LoRa.HeaderImplicit {
+		implicit = 1
+	}
+	if cfg.LoRa.LDRO {
+		ldro = 1
+	}
+
+	symbol := math.Exp2(sf) / float64(cfg.Bandwidth) // s
+
+	bits := 8*float64(payload) + 16*crc - 4*sf + 8 + 20*(1-implicit)
+	symbols := float64(cfg.PreambleLength) + 4.25 + 8 + math.Ceil(max(bits, 0)/(4*(sf-2*ldro)))*(cr+4)
+
+	// SF5 and SF6 need two more preamble symbols and carry no extra header symbols
+	if sf < 7 {
+		bits = 8*float64(payload) + 16*crc - 4*sf + 20*(1-implicit)
+		symbols = float64(cfg.PreambleLength) + 6.25 + 8 + math.Ceil(max(bits, 0)/(4*sf))*(cr+4)
+	}
+
+	return time.Duration(symbols * symbol * float64(time.Second))
+}
+
+// TimeOnAir with the modem's current settings
+func (n *Node) TimeOnAir(payload int) time.Duration {
+	return TimeOnAir(n.config(), payload)
+}
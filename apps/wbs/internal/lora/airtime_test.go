@@ -0,0 +1,43 @@
+package lora
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+// Expected values from the SX126x datasheet 6.1.4 formulas, the first one as in
+// Semtech's LoRa calculator; 8 symbol preamble and 125 kHz throughout
+func TestTimeOnAir(t *testing.T) {
+	tests := []struct {
+		name    string
+		lora    sx126x.LoRa
+		payload int
+		want    time.Duration
+	}{
+		{"SF7 CR4/5", sx126x.LoRa{SpreadingFactor: 7, CodingRate: 5, CRC: true}, 32, 71_936 * time.Microsecond},
+		{"SF7 CR4/8", sx126x.LoRa{SpreadingFactor: 7, CodingRate: 8, CRC: true}, 32, 102_656 * time.Microsecond},
+		{"SF7 implicit header without CRC", sx126x.LoRa{SpreadingFactor: 7, CodingRate: 5, HeaderImplicit: true}, 32, 66_816 * time.Microsecond},
+		{"SF11 LDRO", sx126x.LoRa{SpreadingFactor: 11, CodingRate: 5, CRC: true, LDRO: true}, 32, 987_136 * time.Microsecond},
+		{"SF12 LDRO", sx126x.LoRa{SpreadingFactor: 12, CodingRate: 5, CRC: true, LDRO: true}, 32, 1_810_432 * time.Microsecond},
+		// Header and CRC alone fit in the eight symbols after the preamble
+		{"SF12 LDRO empty", sx126x.LoRa{SpreadingFactor: 12, CodingRate: 5, CRC: true, LDRO: true}, 0, 663_552 * time.Microsecond},
+		// Two more preamble symbols, no extra header symbols
+		{"SF5", sx126x.LoRa{SpreadingFactor: 5, CodingRate: 5, CRC: true}, 32, 23_616 * time.Microsecond},
+		{"SF6", sx126x.LoRa{SpreadingFactor: 6, CodingRate: 5, CRC: true}, 32, 42_112 * time.Microsecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &sx126x.Config{Bandwidth: 125_000, PreambleLength: 8, LoRa: tt.lora}
+			if got := TimeOnAir(cfg, tt.payload).Round(time.Microsecond); got != tt.want {
+				t.Errorf("TimeOnAir = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := TimeOnAir(&sx126x.Config{}, 32); got != 0 {
+		t.Errorf("TimeOnAir without bandwidth = %v, want 0", got)
+	}
+}
@@ -0,0 +1,290 @@
+package lora
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+const (
+	CaptureRx = "rx"
+	CaptureTx = "tx"
+
+	// message_debug prints no time, imported frames are spaced this far apart
+	importInterval = time.Second
+)
+
+// HexBytes is raw frame data, written as a hex string
+type HexBytes []uint8
+
+func (h HexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(h)), nil
+}
+
+func (h *HexBytes) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*h = b
+	return nil
+}
+
+// CaptureRecord is one frame of a capture file; every line holds one as JSON
+type CaptureRecord struct {
+	Time            time.Time `json:"time"`
+	Direction       string    `json:"direction"` // rx / tx
+	Frequency       uint32    `json:"frequency"` // Hz
+	SpreadingFactor uint8     `json:"sf"`
+	Bandwidth       uint32    `json:"bw"`   // Hz
+	RSSI            float32   `json:"rssi"` // dBm; rx only
+	SNR             float32   `json:"snr"`  // dB; rx only
+	Data            HexBytes  `json:"data"`
+}
+
+// Capture appends frames to a capture file
+type Capture struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func OpenCapture(path string) (*Capture, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Capture{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (c *Capture) Write(rec CaptureRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.enc.Encode(rec)
+}
+
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.file.Close()
+}
+
+// WithCapture records every frame the Node sends or receives
+func WithCapture(c *Capture) NodeOption {
+	return func(n *Node) { n.capture = c }
+}
+
+// record is best effort; a full disk must not stop the radio. cfg is what the frame went over the air with.
+func (n *Node) record(cfg *sx126x.Config, direction string, f Frame) {
+	log := slog.With("func", "record()", "params", "(*sx126x.Config, string, Frame)", "return", "(-)", "package", "lora")
+
+	if n.capture == nil {
+		return
+	}
+
+	rec := CaptureRecord{
+		Time:            f.Time,
+		Direction:       direction,
+		Frequency:       f.Frequency,
+		SpreadingFactor: cfg.LoRa.SpreadingFactor,
+		Bandwidth:       cfg.Bandwidth,
+		RSSI:            f.RSSI,
+		SNR:             f.SNR,
+		Data:            append(HexBytes(nil), f.Payload...),
+	}
+
+	if err := n.capture.Write(rec); err != nil {
+		log.Warn("[ LoRa ] Could not record frame", "error", err)
+	}
+}
+
+// ************************************************************************
+// = Reading captures ===
+// ------------------------------------------------------------------------
+
+// LoadCapture reads a capture file, or the output of blocks_message_debug in
+// tools/radio/lorarx.grc; see ImportMessageDebug for what cfg is used for.
+func LoadCapture(path string, cfg *sx126x.Config) ([]CaptureRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if messageDebugHeader.Match(data) {
+		start := time.Now()
+		if info, err := os.Stat(path); err == nil {
+			start = info.ModTime()
+		}
+		return ImportMessageDebug(bytes.NewReader(data), cfg, start)
+	}
+	return ReadCapture(bytes.NewReader(data))
+}
+
+func ReadCapture(r io.Reader) ([]CaptureRecord, error) {
+	var records []CaptureRecord
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var rec CaptureRecord
+		if err := json.Unmarshal([]byte(text), &rec); err != nil {
+			return nil, fmt.Errorf("[ LoRa ] Capture line %d: %w", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+var (
+	// ******* MESSAGE DEBUG PRINT ********, ***** VERBOSE PDU DEBUG PRINT ******
+	messageDebugHeader = regexp.MustCompile(`\*{3,} (?:[A-Z]+ )*DEBUG PRINT(?: [A-Z]+)* \*{3,}`)
+	// A line of nothing but stars closes a block
+	messageDebugFooter = regexp.MustCompile(`(?m)^\*{20,}\r?$`)
+	// 0000: 68 65 6c 6c 6f
+	pduLine = regexp.MustCompile(`^[0-9a-fA-F]{4}:((?:\s+[0-9a-fA-F]{2})+)\s*$`)
+	// pdu length = 5 bytes
+	pduLength = regexp.MustCompile(`^pdu length = (\d+)`)
+)
+
+// ImportMessageDebug turns the frames gr-lora_sdr handed to blocks_message_debug
+// into rx records. The verbose PDU hex dump is exact and preferred; the plain print
+// of the payload string is taken byte for byte, newlines and stars included, up to
+// the footer, a line of stars as wide as the header. Console lines between the blocks,
+// print_rx included, are skipped. The output carries no radio settings, time or signal
+// quality, so frequency, SF and BW come from cfg, which must match the flowgraph,
+// frames are importInterval apart from start and RSSI / SNR stay 0.
+func ImportMessageDebug(r io.Reader, cfg *sx126x.Config, start time.Time) ([]CaptureRecord, error) {
+	log := slog.With("func", "ImportMessageDebug()", "params", "(io.Reader, *sx126x.Config, time.Time)", "return", "([]CaptureRecord, error)", "package", "lora")
+
+	if cfg == nil {
+		return nil, fmt.Errorf("LoRa capture import improper; cfg is nil")
+	}
+
+	input, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []CaptureRecord
+	headers := messageDebugHeader.FindAllIndex(input, -1)
+	for i, h := range headers {
+		end := len(input)
+		if i+1 < len(headers) {
+			end = headers[i+1][0]
+		}
+
+		// The payload starts on the line after the header
+		block := input[h[1]:end]
+		if nl := bytes.IndexByte(block, '\n'); nl >= 0 {
+			block = block[nl+1:]
+		} else {
+			block = nil
+		}
+
+		n := messageDebugBody(block, h[1]-h[0])
+		if n < 0 {
+			log.Warn("[ LoRa ] message_debug block without footer, skipped", "frame", i+1)
+			continue
+		}
+
+		data := block[:n]
+		if bytes.Contains(input[h[0]:h[1]], []uint8("PDU")) {
+			data, err = parsePDU(data)
+			if err != nil {
+				return nil, fmt.Errorf("[ LoRa ] message_debug frame %d: %w", i+1, err)
+			}
+		}
+
+		if len(data) > 0 {
+			records = append(records, CaptureRecord{
+				Time:            start.Add(time.Duration(len(records)) * importInterval),
+				Direction:       CaptureRx,
+				Frequency:       cfg.Frequency,
+				SpreadingFactor: cfg.LoRa.SpreadingFactor,
+				Bandwidth:       cfg.Bandwidth,
+				Data:            bytes.Clone(data),
+			})
+		}
+	}
+
+	return records, nil
+}
+
+// messageDebugBody is the length of the payload at the start of block, without the newline
+// the print puts before the footer; -1 when the block has none. The footer is as wide as
+// the header, a payload line of stars only ends it when it is exactly as wide.
+func messageDebugBody(block []uint8, width int) int {
+	footer := bytes.Repeat([]uint8("*"), width)
+
+	for at := 0; at <= len(block); {
+		i := bytes.Index(block[at:], footer)
+		if i < 0 {
+			break
+		}
+		i += at
+
+		// A line of its own: after the newline that ends the payload, or the whole payload empty
+		rest := bytes.TrimPrefix(block[i+width:], []uint8("\r"))
+		if (i == 0 || block[i-1] == '\n') && (len(rest) == 0 || rest[0] == '\n') {
+			return max(i-1, 0)
+		}
+		at = i + 1
+	}
+
+	// Some other layout; the first long line of stars
+	if loc := messageDebugFooter.FindIndex(block); loc != nil {
+		return max(loc[0]-1, 0)
+	}
+	return -1
+}
+
+// parsePDU reads the hex dump of a verbose PDU print; the metadata dictionary is skipped
+func parsePDU(body []uint8) ([]uint8, error) {
+	var (
+		data   []uint8
+		length = -1
+	)
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+
+		if m := pduLength.FindStringSubmatch(line); m != nil {
+			length, _ = strconv.Atoi(m[1])
+			continue
+		}
+		m := pduLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		b, err := hex.DecodeString(strings.Join(strings.Fields(m[1]), ""))
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, b...)
+	}
+
+	if length >= 0 && length != len(data) {
+		return nil, fmt.Errorf("hex dump of %d bytes, pdu length %d", len(data), length)
+	}
+	return data, nil
+}
+
+// ------------------------------------------------------------------------
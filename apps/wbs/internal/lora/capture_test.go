@@ -0,0 +1,137 @@
+package lora
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+var (
+	textFrame = []uint8("hello world")
+
+	// Newlines bare and after CR, a line of stars longer than the footer and a NUL; only
+	// the print's own newline after the last byte is dropped
+	binaryFrame = append(append([]uint8{0x01, 0x0A, 0x0D, 0x0A, 0x00, 0xFF, 0x0A},
+		bytes.Repeat([]uint8("*"), 40)...), 0x0A, 0x2A, 0x0A)
+
+	// 18 byte packet, 16 per dump line
+	pduFrame = []uint8{
+		0x00, 0x01, 0x00, 0x02, 0x00, 0x07, 0x01, 0x00,
+		0x65, 0xA8, 0xC0, 0x00, 0x01, 0x00, 0x41, 0xAC,
+		0x00, 0x00,
+	}
+)
+
+// messageDebug is the console of tools/radio/lorarx.grc under GNU Radio 3.10: print_rx
+// shows the header and the payload of every frame, message_debug prints it after them.
+func messageDebug() []uint8 {
+	var b bytes.Buffer
+	frame := func(payload []uint8) {
+		b.WriteString("\n--------Header--------\n")
+		b.WriteString("Payload length: 11\nCRC presence:   1\nCoding rate:    1\n")
+		b.WriteString("rx msg: ")
+		b.Write(payload)
+		b.WriteString("\n\x1b[32mCRC valid!\x1b[0m\n")
+	}
+
+	b.WriteString("gr-osmosdr 0.2.0.0 (0.2.0) gnuradio 3.10.12.0\n")
+	b.WriteString("built-in source types: file rtl rtl_tcp uhd hackrf bladerf airspy soapy redpitaya\n")
+	b.WriteString("Using device #0 Realtek RTL2838UHIDIR SN: 00000001\n")
+
+	frame(textFrame)
+	b.WriteString("******* MESSAGE DEBUG PRINT ********\n")
+	b.Write(textFrame)
+	b.WriteString("\n************************************\n")
+
+	frame(binaryFrame)
+	b.WriteString("******* MESSAGE DEBUG PRINT ********\n")
+	b.Write(binaryFrame)
+	b.WriteString("\n************************************\n")
+
+	b.WriteString("***** VERBOSE PDU DEBUG PRINT ******\n")
+	b.WriteString("((crc_valid . #t) (sf . 9))\n")
+	b.WriteString("pdu length = 18 bytes\n")
+	b.WriteString("pdu vector contents = \n")
+	b.WriteString("0000: 00 01 00 02 00 07 01 00 65 a8 c0 00 01 00 41 ac \n")
+	b.WriteString("0010: 00 00 \n")
+	b.WriteString("************************************\n")
+
+	// Stopped with Ctrl-C in the middle of a print
+	frame(textFrame)
+	b.WriteString("******* MESSAGE DEBUG PRINT ********\n")
+	b.WriteString("hel")
+
+	return b.Bytes()
+}
+
+func TestImportMessageDebug(t *testing.T) {
+	cfg := &sx126x.Config{Frequency: 433_000_000, Bandwidth: 125_000, LoRa: sx126x.LoRa{SpreadingFactor: 9}}
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	records, err := ImportMessageDebug(bytes.NewReader(messageDebug()), cfg, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]uint8{textFrame, binaryFrame, pduFrame}
+	if len(records) != len(want) {
+		t.Fatalf("%d records, want %d", len(records), len(want))
+	}
+	for i, rec := range records {
+		if !bytes.Equal(rec.Data, want[i]) {
+			t.Errorf("record %d = % X, want % X", i, rec.Data, want[i])
+		}
+		if rec.Direction != CaptureRx || rec.Frequency != 433_000_000 || rec.SpreadingFactor != 9 || rec.Bandwidth != 125_000 {
+			t.Errorf("record %d %+v, want rx at 433 MHz, SF9, 125 kHz", i, rec)
+		}
+		if at := start.Add(time.Duration(i) * importInterval); !rec.Time.Equal(at) {
+			t.Errorf("record %d at %v, want %v", i, rec.Time, at)
+		}
+	}
+}
+
+func TestImportMessageDebugErrors(t *testing.T) {
+	if _, err := ImportMessageDebug(strings.NewReader(""), nil, time.Now()); err == nil {
+		t.Error("ImportMessageDebug without cfg succeeded")
+	}
+
+	// A hex dump that lost a line
+	short := "***** VERBOSE PDU DEBUG PRINT ******\n()\npdu length = 18 bytes\npdu vector contents = \n" +
+		"0010: 00 00 \n************************************\n"
+	if _, err := ImportMessageDebug(strings.NewReader(short), &sx126x.Config{}, time.Now()); err == nil {
+		t.Error("ImportMessageDebug of a truncated hex dump succeeded")
+	}
+}
+
+// LoadCapture tells message_debug output from a capture file
+func TestLoadCapture(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &sx126x.Config{Frequency: 433_000_000}
+
+	console := filepath.Join(dir, "lorarx.log")
+	if err := os.WriteFile(console, messageDebug(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	records, err := LoadCapture(console, cfg)
+	if err != nil || len(records) != 3 {
+		t.Fatalf("LoadCapture(message_debug) = %d records, %v; want 3", len(records), err)
+	}
+
+	capture := filepath.Join(dir, "capture.jsonl")
+	line := `{"time":"2026-10-16T12:00:00Z","direction":"rx","frequency":433000000,"sf":9,"bw":125000,"rssi":-80,"snr":7.5,"data":"68656c6c6f"}` + "\n"
+	if err := os.WriteFile(capture, []uint8(line), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	records, err = LoadCapture(capture, cfg)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("LoadCapture(capture) = %d records, %v; want 1", len(records), err)
+	}
+	if string(records[0].Data) != "hello" || records[0].RSSI != -80 {
+		t.Errorf("record %+v", records[0])
+	}
+}
@@ -0,0 +1,127 @@
+package lora
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// CCM mode, RFC 3610, with a 13 byte nonce (L = 2, messages up to 64 KiB) and an
+// 8 byte tag; the standard library has no CCM.
+const (
+	ccmNonceSize = 13
+	ccmTagSize   = 8
+	ccmLength    = 15 - ccmNonceSize // Bytes of the message length field, L
+)
+
+var errOpen = errors.New("[ LoRa ] Message authentication failed")
+
+type ccm struct {
+	block cipher.Block
+}
+
+// newCCM wraps a 16 byte block cipher, i.e. AES, in a cipher.AEAD
+func newCCM(block cipher.Block) (cipher.AEAD, error) {
+	if block.BlockSize() != 16 {
+		return nil, fmt.Errorf("[ LoRa ] CCM needs a 16 byte block cipher")
+	}
+	return &ccm{block: block}, nil
+}
+
+func (c *ccm) NonceSize() int {
+	return ccmNonceSize
+}
+
+func (c *ccm) Overhead() int {
+	return ccmTagSize
+}
+
+// mac is the CBC-MAC over B0, the length prefixed additional data and the plaintext
+func (c *ccm) mac(nonce, plaintext, data []byte) [16]byte {
+	var x, b [16]byte
+
+	flags := uint8(ccmTagSize-2) / 2 << 3
+	flags |= ccmLength - 1
+	if len(data) > 0 {
+		flags |= 1 << 6
+	}
+	b[0] = flags
+	copy(b[1:], nonce)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(plaintext)))
+	c.block.Encrypt(x[:], b[:])
+
+	chain := func(in []byte) {
+		for len(in) > 0 {
+			var block [16]byte
+			n := copy(block[:], in)
+			in = in[n:]
+
+			subtle.XORBytes(x[:], x[:], block[:])
+			c.block.Encrypt(x[:], x[:])
+		}
+	}
+
+	if len(data) > 0 {
+		// Additional data shorter than 0xFF00 bytes has a 2 byte length prefix
+		prefixed := binary.BigEndian.AppendUint16(nil, uint16(len(data)))
+		chain(append(prefixed, data...))
+	}
+	chain(plaintext)
+
+	return x
+}
+
+// ctr encrypts in place with the counter blocks A1, A2...; A0 is returned for the tag
+func (c *ccm) ctr(nonce, dst, src []byte) [16]byte {
+	var a, s, s0 [16]byte
+	a[0] = ccmLength - 1
+	copy(a[1:], nonce)
+	c.block.Encrypt(s0[:], a[:])
+
+	for i := 0; i < len(src); i += 16 {
+		binary.BigEndian.PutUint16(a[14:], uint16(i/16+1))
+		c.block.Encrypt(s[:], a[:])
+		subtle.XORBytes(dst[i:], src[i:], s[:min(16, len(src)-i)])
+	}
+	return s0
+}
+
+func (c *ccm) Seal(dst, nonce, plaintext, data []byte) []byte {
+	if len(nonce) != ccmNonceSize {
+		panic("lora: CCM nonce must be 13 bytes")
+	}
+	if len(plaintext) > 0xFFFF || len(data) >= 0xFF00 {
+		panic("lora: CCM message too long")
+	}
+
+	tag := c.mac(nonce, plaintext, data)
+
+	out := make([]byte, len(plaintext)+ccmTagSize)
+	s0 := c.ctr(nonce, out, plaintext)
+	subtle.XORBytes(out[len(plaintext):], tag[:ccmTagSize], s0[:ccmTagSize])
+
+	return append(dst, out...)
+}
+
+func (c *ccm) Open(dst, nonce, ciphertext, data []byte) ([]byte, error) {
+	if len(nonce) != ccmNonceSize || len(ciphertext) < ccmTagSize || len(data) >= 0xFF00 {
+		return nil, errOpen
+	}
+
+	n := len(ciphertext) - ccmTagSize
+	plaintext := make([]byte, n)
+	s0 := c.ctr(nonce, plaintext, ciphertext[:n])
+
+	var received [ccmTagSize]byte
+	subtle.XORBytes(received[:], ciphertext[n:], s0[:ccmTagSize])
+
+	tag := c.mac(nonce, plaintext, data)
+	if subtle.ConstantTimeCompare(received[:], tag[:ccmTagSize]) != 1 {
+		clear(plaintext)
+		return nil, errOpen
+	}
+
+	return append(dst, plaintext...), nil
+}
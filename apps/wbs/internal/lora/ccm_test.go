@@ -0,0 +1,89 @@
+package lora
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// RFC 3610, packet vector #1: M = 8, L = 2, 8 bytes of additional data
+func TestCCMVector(t *testing.T) {
+	block, err := aes.NewCipher(mustHex(t, "C0C1C2C3C4C5C6C7C8C9CACBCCCDCECF"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newCCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := mustHex(t, "00000003020100A0A1A2A3A4A5")
+	aad := mustHex(t, "0001020304050607")
+	plaintext := mustHex(t, "08090A0B0C0D0E0F101112131415161718191A1B1C1D1E")
+	want := mustHex(t, "588C979A61C663D2F066D0C2C0F989806D5F6B61DAC38417E8D12CFDF926E0")
+
+	sealed := aead.Seal(nil, nonce, plaintext, aad)
+	if !bytes.Equal(sealed, want) {
+		t.Fatalf("Seal = % X, want % X", sealed, want)
+	}
+
+	opened, err := aead.Open(nil, nonce, sealed, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Errorf("Open = % X, want % X", opened, plaintext)
+	}
+}
+
+func TestCCMTamper(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newCCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := make([]byte, ccmNonceSize)
+	aad := []byte("header")
+	sealed := aead.Seal(nil, nonce, []byte("21.5 C"), aad)
+
+	tests := []struct {
+		name   string
+		tamper func(nonce, sealed, aad []byte)
+	}{
+		{"ciphertext", func(_, sealed, _ []byte) { sealed[0] ^= 0x01 }},
+		{"tag", func(_, sealed, _ []byte) { sealed[len(sealed)-1] ^= 0x80 }},
+		{"additional data", func(_, _, aad []byte) { aad[0] ^= 0x01 }},
+		{"nonce", func(nonce, _, _ []byte) { nonce[12] ^= 0x01 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, s, a := bytes.Clone(nonce), bytes.Clone(sealed), bytes.Clone(aad)
+			tt.tamper(n, s, a)
+
+			if opened, err := aead.Open(nil, n, s, a); !errors.Is(err, errOpen) {
+				t.Errorf("Open = % X, %v; want errOpen", opened, err)
+			}
+		})
+	}
+
+	if _, err := aead.Open(nil, nonce, sealed[:ccmTagSize-1], aad); !errors.Is(err, errOpen) {
+		t.Errorf("Open of a frame shorter than the tag = %v, want errOpen", err)
+	}
+}
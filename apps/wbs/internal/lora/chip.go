@@ -0,0 +1,180 @@
+package lora
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+// Chip is the part of the SX126x set up the same way in either modem; lora.Node and
+// fsk.Node share the helpers below, only packet type and params differ between them.
+type Chip interface {
+	HardReset(timeout ...<-chan time.Time) error
+	ClearDeviceErrors(resetInternalCache bool) error
+	SetStandby(mode sx126x.StandbyMode) error
+	SetRegulatorMode(mode sx126x.RegulatorMode) error
+	CalibrateImage(freq1, freq2 sx126x.CalibrationImageFreq) error
+	SetRfFrequency(frequency sx126x.Frequency) error
+	SetPaConfig(opts ...sx126x.OptionsPa) error
+	SetTxParams(dbm int8, rampTime sx126x.RampTime) error
+	SetBufferBaseAddress(txBaseAddress, rxBaseAddress uint8) error
+	Close(sleepMode sx126x.SleepConfig) error
+}
+
+var (
+	stringToStandby = map[string]sx126x.StandbyMode{
+		"rc":   sx126x.StandbyRc,
+		"xosc": sx126x.StandbyXosc,
+	}
+
+	wordToFreq = map[uint16]sx126x.CalibrationImageFreq{
+		430: sx126x.CalImg430,
+		440: sx126x.CalImg440,
+		470: sx126x.CalImg470,
+		510: sx126x.CalImg510,
+		779: sx126x.CalImg779,
+		787: sx126x.CalImg787,
+		863: sx126x.CalImg863,
+		870: sx126x.CalImg870,
+		902: sx126x.CalImg902,
+		928: sx126x.CalImg928,
+	}
+
+	wordToRamp = map[uint16]sx126x.RampTime{
+		10:   sx126x.PaRamp10u,
+		20:   sx126x.PaRamp20u,
+		40:   sx126x.PaRamp40u,
+		80:   sx126x.PaRamp80u,
+		200:  sx126x.PaRamp200u,
+		800:  sx126x.PaRamp800u,
+		1700: sx126x.PaRamp1700u,
+		3400: sx126x.PaRamp3400u,
+	}
+
+	stringToSleep = map[string]sx126x.SleepConfig{
+		"cold_start":     sx126x.SleepColdStart,
+		"warm_start":     sx126x.SleepWarmStart,
+		"cold_start_rtc": sx126x.SleepColdStartRtc,
+		"warm_start_rtc": sx126x.SleepWarmStartRtc,
+	}
+)
+
+// Reset takes the chip from a hard reset to the standby mode of cfg, with the regulator
+// and the device errors dealt with on the way
+func Reset(hw Chip, cfg *sx126x.Config, log *slog.Logger) error {
+	if err := hw.HardReset(); err != nil {
+		return err
+	}
+
+	// = 13.6.2 ClearDeviceErrors ========
+	if err := hw.ClearDeviceErrors(true); err != nil {
+		log.Error("Could not clear device errors", "error", err)
+	}
+	// ---------------------------------
+
+	// = 13.1.11 SetRegulatorMode ======
+	if err := hw.SetStandby(sx126x.StandbyRc); err != nil {
+		return err
+	}
+
+	regulator := sx126x.RegulatorLdo
+	if cfg.DC_DC == true {
+		regulator = sx126x.RegulatorDcDc
+	}
+
+	if err := hw.SetRegulatorMode(regulator); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	// = 13.1.2 SetStandby =============
+	standby, ok := stringToStandby[cfg.StandbyMode]
+	if !ok {
+		standby = sx126x.StandbyRc
+		log.Warn("[ SX126X ] Unknown standby mode", "mode", cfg.StandbyMode)
+		log.Warn("[ SX126X ] Limiting standby mode to RC")
+	}
+
+	if err := hw.SetStandby(standby); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	return nil
+}
+
+// SetRf calibrates the image for frequency_range, tunes to frequency and sets up the PA
+// and the buffers; the packet type has to be set before
+func SetRf(hw Chip, cfg *sx126x.Config, log *slog.Logger) error {
+	// = 13.1.13 CalibrateImage ========
+	freq1, freq1Ok := wordToFreq[cfg.FrequencyRange[0]]
+	freq2, freq2Ok := wordToFreq[cfg.FrequencyRange[1]]
+
+	if !freq1Ok || !freq2Ok {
+		freq1 = sx126x.CalImg430
+		freq2 = sx126x.CalImg440
+
+		log.Warn("[ SX126X ] Unknown frequency", "freq1", cfg.FrequencyRange[0], "freq2", cfg.FrequencyRange[1])
+		log.Warn("[ SX126X ] Limiting frequency range to 430-440")
+	}
+
+	if err := hw.CalibrateImage(freq1, freq2); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	// = 13.4.1 SetRfFrequency =========
+	if err := hw.SetRfFrequency(sx126x.Frequency(cfg.Frequency)); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	// = 13.1.14 SetPaConfig ===========
+	if err := hw.SetPaConfig(); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	// = 13.4.4 SetTxParams ============
+	if err := SetTxParams(hw, cfg, log); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	// = 13.4.8 SetBufferBaseAddress ===
+	if err := hw.SetBufferBaseAddress(cfg.TxBufferAddress, cfg.RxBufferAddress); err != nil {
+		return err
+	}
+	// ---------------------------------
+
+	return nil
+}
+
+// SetTxParams sends transmit_power and ramp_time; unknown ramp times become 800 us
+func SetTxParams(hw Chip, cfg *sx126x.Config, log *slog.Logger) error {
+	ramp, ok := wordToRamp[cfg.RampTime]
+	if !ok {
+		ramp = sx126x.PaRamp800u
+		log.Warn("[ SX126X ] Unknown ramp time value", "rampTime", cfg.RampTime)
+		log.Warn("[ SX126X ] Limiting ramp time to 800us")
+	}
+
+	return hw.SetTxParams(cfg.TransmitPower, ramp)
+}
+
+// Sleep puts the chip into the sleep_mode of cfg and stops the driver
+func Sleep(hw Chip, cfg *sx126x.Config, log *slog.Logger) error {
+	mode, ok := stringToSleep[cfg.SleepMode]
+	if !ok {
+		mode = sx126x.SleepWarmStart
+		log.Warn("[ SX126X ] Unknown sleep mode", "mode", cfg.SleepMode)
+		log.Warn("[ SX126X ] Limiting sleep mode to Warm Start")
+	}
+
+	if err := hw.Close(mode); err != nil {
+		return fmt.Errorf("Critical failure during SX126X modem shutdown: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package lora
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+	"wbs/internal/config"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+var ErrDutyCycle = errors.New("[ LoRa ] Duty cycle budget exhausted")
+
+// ETSI EN 300 220-2 / ERC Recommendation 70-03 sub-bands for non-specific short range devices
+var etsiBands = map[string]config.Band{
+	"433":   {Low: 433_050_000, High: 434_790_000, Limit: 10},
+	"863":   {Low: 863_000_000, High: 865_000_000, Limit: 0.1},
+	"865":   {Low: 865_000_000, High: 868_000_000, Limit: 1},
+	"868":   {Low: 868_000_000, High: 868_600_000, Limit: 1},
+	"868.7": {Low: 868_700_000, High: 869_200_000, Limit: 0.1},
+	"869.4": {Low: 869_400_000, High: 869_650_000, Limit: 10},
+	"869.7": {Low: 869_700_000, High: 870_000_000, Limit: 1},
+}
+
+// Budget is the airtime left in a band's rolling window
+type Budget struct {
+	Band      string
+	Allowed   time.Duration
+	Used      time.Duration
+	Remaining time.Duration
+}
+
+// Percent of the allowed airtime still left, 0 - 100
+func (b Budget) Percent() float64 {
+	if b.Allowed <= 0 {
+		return 0
+	}
+	return 100 * float64(b.Remaining) / float64(b.Allowed)
+}
+
+type transmission struct {
+	at       time.Time
+	duration time.Duration
+}
+
+// DutyCycle keeps the transmissions of the last window for every band; lora.Node and
+// fsk.Node book their airtime with it
+type DutyCycle struct {
+	cfg *config.DutyCycle
+
+	mu   sync.Mutex
+	used map[string][]transmission
+}
+
+func NewDutyCycle(cfg *config.DutyCycle) *DutyCycle {
+	return &DutyCycle{cfg: cfg, used: make(map[string][]transmission)}
+}
+
+func (d *DutyCycle) bands() map[string]config.Band {
+	if len(d.cfg.Bands) > 0 {
+		return d.cfg.Bands
+	}
+	return etsiBands
+}
+
+// band the frequency falls into; frequencies outside of every band are not limited
+func (d *DutyCycle) band(frequency uint32) (string, config.Band, bool) {
+	for name, b := range d.bands() {
+		if frequency >= b.Low && frequency < b.High {
+			return name, b, true
+		}
+	}
+	return "", config.Band{}, false
+}
+
+func (d *DutyCycle) allowed(b config.Band) time.Duration {
+	return time.Duration(float64(d.cfg.Window) * b.Limit / 100)
+}
+
+// expire drops what left the window and returns the airtime still in it; d.mu must be held.
+func (d *DutyCycle) expire(name string, now time.Time) time.Duration {
+	kept := d.used[name][:0]
+	var used time.Duration
+	for _, t := range d.used[name] {
+		if now.Sub(t.at) < d.cfg.Window {
+			kept = append(kept, t)
+			used += t.duration
+		}
+	}
+	d.used[name] = kept
+	return used
+}
+
+// reserve books airtime on the band of frequency. It returns how long to wait
+// before the frame fits in the budget, or an error when it never will.
+func (d *DutyCycle) reserve(frequency uint32, airtime time.Duration) (time.Duration, error) {
+	name, b, ok := d.band(frequency)
+	if !ok {
+		return 0, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	allowed := d.allowed(b)
+	used := d.expire(name, now)
+
+	if airtime > allowed {
+		return 0, fmt.Errorf("%w; %s frame exceeds the %s allowed in band %s", ErrDutyCycle, airtime, allowed, name)
+	}
+
+	if used+airtime <= allowed {
+		d.used[name] = append(d.used[name], transmission{at: now, duration: airtime})
+		return 0, nil
+	}
+
+	// Oldest first, until enough airtime has left the window
+	for _, t := range d.used[name] {
+		used -= t.duration
+		if used+airtime <= allowed {
+			return t.at.Add(d.cfg.Window).Sub(now), nil
+		}
+	}
+	return d.cfg.Window, nil
+}
+
+// Reserve books airtime for a frame on the band of frequency. It blocks while the frame
+// has to wait for budget and delay is on, otherwise that's an ErrDutyCycle.
+func (d *DutyCycle) Reserve(frequency uint32, airtime time.Duration) error {
+	log := slog.With("func", "DutyCycle.Reserve()", "params", "(uint32, time.Duration)", "return", "(error)", "package", "lora")
+
+	for {
+		wait, err := d.reserve(frequency, airtime)
+		if err != nil {
+			return err
+		}
+		if wait == 0 {
+			return nil
+		}
+
+		if d.cfg.Delay == false || wait > d.cfg.MaxDelay {
+			return fmt.Errorf("%w; next %s frame fits in %s", ErrDutyCycle, airtime, wait.Round(time.Second))
+		}
+		log.Info("[ LoRa ] Waiting for duty cycle budget", "wait", wait, "airtime", airtime)
+		time.Sleep(wait)
+	}
+}
+
+// Release gives back airtime Reserve booked for a frame that never went out
+func (d *DutyCycle) Release(frequency uint32, airtime time.Duration) {
+	name, _, ok := d.band(frequency)
+	if !ok {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	used := d.used[name]
+	for i := len(used) - 1; i >= 0; i-- {
+		if used[i].duration == airtime {
+			d.used[name] = append(used[:i], used[i+1:]...)
+			return
+		}
+	}
+}
+
+// Budgets of every band, sorted by name
+func (d *DutyCycle) Budgets() []Budget {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	var budgets []Budget
+	for name, b := range d.bands() {
+		allowed := d.allowed(b)
+		used := d.expire(name, now)
+		budgets = append(budgets, Budget{Band: name, Allowed: allowed, Used: used, Remaining: max(allowed-used, 0)})
+	}
+
+	sort.Slice(budgets, func(i, j int) bool { return budgets[i].Band < budgets[j].Band })
+	return budgets
+}
+
+// ************************************************************************
+// = Node ===
+// ------------------------------------------------------------------------
+type NodeOption func(*Node)
+
+// WithDutyCycle limits Tx to the band's share of the rolling window
+func WithDutyCycle(cfg *config.DutyCycle) NodeOption {
+	return func(n *Node) {
+		if cfg != nil && cfg.Enable {
+			n.duty = NewDutyCycle(cfg)
+		}
+	}
+}
+
+// WithBudgetHandler is called with the budget of the current band after every Tx
+func WithBudgetHandler(h func(b Budget)) NodeOption {
+	return func(n *Node) { n.onBudget = h }
+}
+
+// reserveAirtime blocks while the frame has to wait for budget and delay is on
+func (n *Node) reserveAirtime(cfg *sx126x.Config, size int) error {
+	log := slog.With("func", "reserveAirtime()", "params", "(*sx126x.Config, int)", "return", "(error)", "package", "lora")
+
+	if n.duty == nil {
+		return nil
+	}
+
+	if err := n.duty.Reserve(cfg.Frequency, TimeOnAir(cfg, size)); err != nil {
+		return err
+	}
+
+	n.reportBudget(log)
+	return nil
+}
+
+// releaseAirtime undoes reserveAirtime for a frame that was dropped before it went out
+func (n *Node) releaseAirtime(cfg *sx126x.Config, size int) {
+	log := slog.With("func", "releaseAirtime()", "params", "(*sx126x.Config, int)", "return", "(-)", "package", "lora")
+
+	if n.duty == nil {
+		return
+	}
+
+	n.duty.Release(cfg.Frequency, TimeOnAir(cfg, size))
+	n.reportBudget(log)
+}
+
+func (n *Node) reportBudget(log *slog.Logger) {
+	if b, ok := n.Budget(); ok {
+		log.Debug("[ LoRa ] Duty cycle budget", "band", b.Band, "used", b.Used, "remaining", b.Remaining)
+		if n.onBudget != nil {
+			n.onBudget(b)
+		}
+	}
+}
+
+// Budget of the band frequency falls into; false when it isn't limited
+func (d *DutyCycle) Budget(frequency uint32) (Budget, bool) {
+	name, _, ok := d.band(frequency)
+	if !ok {
+		return Budget{}, false
+	}
+	for _, b := range d.Budgets() {
+		if b.Band == name {
+			return b, true
+		}
+	}
+	return Budget{}, false
+}
+
+// Budget of the band the modem currently transmits in; false when it isn't limited
+func (n *Node) Budget() (Budget, bool) {
+	if n.duty == nil {
+		return Budget{}, false
+	}
+	return n.duty.Budget(n.config().Frequency)
+}
+
+// Budgets of every band, sorted by name
+func (n *Node) Budgets() []Budget {
+	if n.duty == nil {
+		return nil
+	}
+	return n.duty.Budgets()
+}
+
+// ------------------------------------------------------------------------
@@ -0,0 +1,104 @@
+package lora
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"wbs/internal/config"
+)
+
+const testFrequency = 869_500_000
+
+// 10% of window in a single band around testFrequency
+func dutyConfig(window time.Duration) *config.DutyCycle {
+	return &config.DutyCycle{
+		Enable: true,
+		Window: window,
+		Bands:  map[string]config.Band{"869.4": {Low: 869_400_000, High: 869_650_000, Limit: 10}},
+	}
+}
+
+func TestDutyCycleReserve(t *testing.T) {
+	d := NewDutyCycle(dutyConfig(10 * time.Second))
+
+	if wait, err := d.reserve(testFrequency, 600*time.Millisecond); wait != 0 || err != nil {
+		t.Fatalf("reserve = %v, %v; want no wait", wait, err)
+	}
+
+	// The second frame fits once the first one left the window
+	wait, err := d.reserve(testFrequency, 600*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait < 9*time.Second || wait > 10*time.Second {
+		t.Errorf("reserve waits %v, want about 10s", wait)
+	}
+
+	if _, err := d.reserve(testFrequency, 2*time.Second); !errors.Is(err, ErrDutyCycle) {
+		t.Errorf("reserve of a frame over the whole budget = %v, want ErrDutyCycle", err)
+	}
+	if wait, err := d.reserve(433_500_000, time.Hour); wait != 0 || err != nil {
+		t.Errorf("reserve outside every band = %v, %v; want no wait", wait, err)
+	}
+
+	// Without delay the wait is an error
+	if err := d.Reserve(testFrequency, 600*time.Millisecond); !errors.Is(err, ErrDutyCycle) {
+		t.Errorf("Reserve over budget = %v, want ErrDutyCycle", err)
+	}
+}
+
+// Reserve with delay blocks until the oldest frame left the window
+func TestDutyCycleReserveWait(t *testing.T) {
+	cfg := dutyConfig(300 * time.Millisecond)
+	cfg.Delay, cfg.MaxDelay = true, time.Second
+	d := NewDutyCycle(cfg)
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := d.Reserve(testFrequency, 20*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > time.Second {
+		t.Errorf("second Reserve after %v, want about 300ms", elapsed)
+	}
+
+	// Past max_delay it fails right away
+	cfg.MaxDelay = 100 * time.Millisecond
+	start = time.Now()
+	if err := d.Reserve(testFrequency, 20*time.Millisecond); !errors.Is(err, ErrDutyCycle) {
+		t.Errorf("Reserve beyond max_delay = %v, want ErrDutyCycle", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Reserve beyond max_delay blocked for %v", elapsed)
+	}
+}
+
+// Airtime that left the rolling window is budget again
+func TestDutyCycleRollover(t *testing.T) {
+	d := NewDutyCycle(dutyConfig(200 * time.Millisecond))
+
+	if err := d.Reserve(testFrequency, 15*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := d.Budget(testFrequency); b.Used != 15*time.Millisecond || b.Remaining != 5*time.Millisecond {
+		t.Errorf("budget %+v, want 15ms used, 5ms left", b)
+	}
+	if err := d.Reserve(testFrequency, 15*time.Millisecond); !errors.Is(err, ErrDutyCycle) {
+		t.Fatalf("Reserve over budget = %v, want ErrDutyCycle", err)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if b, _ := d.Budget(testFrequency); b.Used != 0 || b.Percent() != 100 {
+		t.Errorf("budget %+v after the window, want all of it", b)
+	}
+	if err := d.Reserve(testFrequency, 15*time.Millisecond); err != nil {
+		t.Errorf("Reserve after the window = %v", err)
+	}
+
+	// A released frame gives its airtime back
+	d.Release(testFrequency, 15*time.Millisecond)
+	if b, _ := d.Budget(testFrequency); b.Used != 0 {
+		t.Errorf("budget %+v after Release, want none used", b)
+	}
+}
@@ -0,0 +1,406 @@
+package lora
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/lora/packet"
+)
+
+// Requests for the missing fragments of a message before waiting for the timeout
+const maxFragmentRequests = 3
+
+type partial struct {
+	count     uint8
+	fragments [][]byte // nil while missing
+	received  int
+	size      int
+	started   time.Time
+	last      time.Time // Last fragment or request
+	requests  int
+}
+
+func (p *partial) missing(limit int) []uint8 {
+	var missing []uint8
+	for i, f := range p.fragments {
+		if f == nil && len(missing) < limit {
+			missing = append(missing, uint8(i))
+		}
+	}
+	return missing
+}
+
+type completedMessage struct {
+	data []uint8
+	at   time.Time
+}
+
+type sentMessage struct {
+	frames [][]uint8
+	at     time.Time
+}
+
+// Fragmenter splits packets larger than the MTU of the Link below into numbered
+// fragments and puts them back together on the receiving side. Incomplete messages
+// ask their source for the missing fragments; the source keeps its fragments for
+// reassembly_timeout to answer. Smaller packets pass through untouched.
+type Fragmenter struct {
+	link    Link
+	cfg     *config.Link
+	address packet.Address
+
+	mu        sync.Mutex
+	partials  map[peerSequence]*partial
+	completed map[peerSequence]completedMessage
+	latest    sequences
+	sent      map[uint16]*sentMessage
+	rx        chan []uint8
+}
+
+func NewFragmenter(link Link, cfg *config.Link, address packet.Address) (*Fragmenter, error) {
+	log := slog.With("func", "NewFragmenter()", "params", "(Link, *config.Link, packet.Address)", "return", "(*Fragmenter, error)", "package", "lora")
+	log.Info("[ LoRa ] Fragmenter constructor", "address", address)
+
+	if cfg == nil {
+		return nil, fmt.Errorf("LoRa link state improper; cfg is nil")
+	}
+	if link == nil || reflect.ValueOf(link).IsNil() {
+		return nil, fmt.Errorf("LoRa link state improper; link is nil")
+	}
+
+	return &Fragmenter{
+		link:      link,
+		cfg:       cfg,
+		address:   address,
+		partials:  make(map[peerSequence]*partial),
+		completed: make(map[peerSequence]completedMessage),
+		latest:    make(sequences),
+		sent:      make(map[uint16]*sentMessage),
+		rx:        make(chan []uint8, rxBacklog),
+	}, nil
+}
+
+// MTU is the largest message, not the largest frame
+func (f *Fragmenter) MTU() int {
+	return int(f.cfg.MaxMessage)
+}
+
+// TimeOnAir of all fragments of a payload bytes long message
+func (f *Fragmenter) TimeOnAir(payload int) time.Duration {
+	mtu := f.link.MTU()
+	if payload <= mtu {
+		return f.link.TimeOnAir(payload)
+	}
+
+	chunk := mtu - packet.FragmentOverhead
+	if chunk <= 0 {
+		return 0
+	}
+
+	full, rest := payload/chunk, payload%chunk
+	total := time.Duration(full) * f.link.TimeOnAir(mtu)
+	if rest > 0 {
+		total += f.link.TimeOnAir(rest + packet.FragmentOverhead)
+	}
+	return total
+}
+
+func (f *Fragmenter) Tx(data []uint8) error {
+	log := slog.With("func", "Fragmenter.Tx()", "params", "([]uint8)", "return", "(error)", "package", "lora")
+
+	mtu := f.link.MTU()
+	if len(data) <= mtu {
+		return f.link.Tx(data)
+	}
+
+	if len(data) > int(f.cfg.MaxMessage) {
+		return fmt.Errorf("[ LoRa ] Message of %d bytes larger than max_message %d", len(data), f.cfg.MaxMessage)
+	}
+
+	h, err := packet.DecodeHeader(data)
+	if err != nil {
+		return fmt.Errorf("[ LoRa ] Only packets can be fragmented: %w", err)
+	}
+
+	chunk := mtu - packet.FragmentOverhead
+	if chunk <= 0 {
+		return fmt.Errorf("[ LoRa ] Payload length %d leaves no room for fragments", mtu)
+	}
+
+	count := (len(data) + chunk - 1) / chunk
+	if count > 255 {
+		return fmt.Errorf("[ LoRa ] Message of %d bytes needs %d fragments; 255 max", len(data), count)
+	}
+
+	frames := make([][]uint8, count)
+	for i := range frames {
+		frame, err := packet.Encode(packet.Packet{
+			Header:  packet.Header{Source: h.Source, Destination: h.Destination, Sequence: h.Sequence},
+			Payload: &packet.Fragment{Index: uint8(i), Count: uint8(count), Data: data[i*chunk : min((i+1)*chunk, len(data))]},
+		}, mtu)
+		if err != nil {
+			return err
+		}
+		frames[i] = frame
+	}
+
+	f.mu.Lock()
+	f.sent[h.Sequence] = &sentMessage{frames: frames, at: time.Now()}
+	f.mu.Unlock()
+
+	log.Debug("[ LoRa ] Message fragmented", "sequence", h.Sequence, "size", len(data), "fragments", count)
+	for _, frame := range frames {
+		if err := f.link.Tx(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rx returns the next complete message or unfragmented packet
+func (f *Fragmenter) Rx(timeout time.Duration) ([]uint8, error) {
+	return dequeue(f.rx, timeout)
+}
+
+// Run owns the Link's receive side until ctx is cancelled; Rx only works while it runs.
+func (f *Fragmenter) Run(ctx context.Context) error {
+	log := slog.With("func", "Fragmenter.Run()", "params", "(context.Context)", "return", "(error)", "package", "lora")
+	log.Info("[ LoRa ] Fragmenter event loop")
+
+	if ctx == nil {
+		return fmt.Errorf("LoRa link state improper; ctx is nil")
+	}
+
+	for ctx.Err() == nil {
+		payload, err := f.link.Rx(time.Second)
+		if err == nil && len(payload) > 0 {
+			f.handle(payload)
+		}
+		f.expire()
+	}
+	return nil
+}
+
+func (f *Fragmenter) handle(payload []uint8) {
+	log := slog.With("func", "Fragmenter.handle()", "params", "([]uint8)", "return", "(-)", "package", "lora")
+
+	h, err := packet.DecodeHeader(payload)
+	if err != nil {
+		enqueue(f.rx, payload)
+		return
+	}
+
+	switch h.Type {
+	case packet.TypeFragment:
+		if h.Destination != f.address && h.Destination != packet.Broadcast {
+			return
+		}
+
+		p, err := packet.Decode(payload)
+		if err != nil {
+			log.Debug("[ LoRa ] Malformed fragment", "source", h.Source, "error", err)
+			return
+		}
+		f.reassemble(h, p.Payload.(*packet.Fragment))
+
+	case packet.TypeFragmentRequest:
+		if h.Destination != f.address {
+			return
+		}
+
+		p, err := packet.Decode(payload)
+		if err != nil {
+			log.Debug("[ LoRa ] Malformed fragment request", "source", h.Source, "error", err)
+			return
+		}
+		f.resend(h, p.Payload.(*packet.FragmentRequest))
+
+	default:
+		enqueue(f.rx, payload)
+	}
+}
+
+func (f *Fragmenter) reassemble(h packet.Header, frag *packet.Fragment) {
+	log := slog.With("func", "Fragmenter.reassemble()", "params", "(packet.Header, *packet.Fragment)", "return", "(-)", "package", "lora")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.latest.restarted(h) {
+		log.Debug("[ LoRa ] Source restarted, its messages are forgotten", "source", h.Source, "sequence", h.Sequence)
+		for key := range f.partials {
+			if key.peer == h.Source {
+				delete(f.partials, key)
+			}
+		}
+		for key := range f.completed {
+			if key.peer == h.Source {
+				delete(f.completed, key)
+			}
+		}
+	}
+
+	key := peerSequence{h.Source, h.Sequence}
+	// The whole message is sent again when its ACK got lost; hand it up once more so
+	// the layer above can acknowledge it again
+	if m, ok := f.completed[key]; ok {
+		if frag.Index == frag.Count-1 {
+			enqueue(f.rx, m.data)
+		}
+		return
+	}
+
+	now := time.Now()
+	p, ok := f.partials[key]
+	if !ok {
+		f.evict(h.Source)
+		p = &partial{count: frag.Count, fragments: make([][]byte, frag.Count), started: now}
+		f.partials[key] = p
+	}
+
+	if frag.Count != p.count {
+		log.Debug("[ LoRa ] Fragment count mismatch", "source", h.Source, "sequence", h.Sequence, "count", frag.Count, "expected", p.count)
+		return
+	}
+
+	p.last = now
+	if p.fragments[frag.Index] != nil {
+		return
+	}
+	p.fragments[frag.Index] = frag.Data
+	p.received++
+	p.size += len(frag.Data)
+
+	if p.size > int(f.cfg.MaxMessage) {
+		log.Warn("[ LoRa ] Message larger than max_message, dropped", "source", h.Source, "sequence", h.Sequence, "size", p.size)
+		delete(f.partials, key)
+		return
+	}
+
+	if p.received < int(p.count) {
+		return
+	}
+
+	message := bytes.Join(p.fragments, nil)
+	delete(f.partials, key)
+	f.completed[key] = completedMessage{data: message, at: now}
+
+	log.Debug("[ LoRa ] Message reassembled", "source", h.Source, "sequence", h.Sequence, "size", p.size, "fragments", p.count)
+	enqueue(f.rx, message)
+}
+
+// evict makes room for one more message from source; the oldest one goes first
+func (f *Fragmenter) evict(source packet.Address) {
+	limit := max(int(f.cfg.MaxPartials), 1)
+
+	for {
+		var oldest peerSequence
+		var oldestAt time.Time
+		count := 0
+
+		for key, p := range f.partials {
+			if key.peer != source {
+				continue
+			}
+			count++
+			if oldestAt.IsZero() || p.started.Before(oldestAt) {
+				oldest, oldestAt = key, p.started
+			}
+		}
+
+		if count < limit {
+			return
+		}
+		slog.Warn("[ LoRa ] Too many incomplete messages, oldest dropped", "source", source, "sequence", oldest.sequence, "package", "lora")
+		delete(f.partials, oldest)
+	}
+}
+
+func (f *Fragmenter) resend(h packet.Header, req *packet.FragmentRequest) {
+	log := slog.With("func", "Fragmenter.resend()", "params", "(packet.Header, *packet.FragmentRequest)", "return", "(-)", "package", "lora")
+
+	f.mu.Lock()
+	var frames [][]uint8
+	if m, ok := f.sent[h.Sequence]; ok {
+		for _, i := range req.Missing {
+			if int(i) < len(m.frames) {
+				frames = append(frames, m.frames[i])
+			}
+		}
+	}
+	f.mu.Unlock()
+
+	if len(frames) == 0 {
+		log.Debug("[ LoRa ] Requested fragments no longer kept", "source", h.Source, "sequence", h.Sequence)
+		return
+	}
+
+	log.Debug("[ LoRa ] Resending fragments", "destination", h.Source, "sequence", h.Sequence, "fragments", req.Missing)
+	for _, frame := range frames {
+		if err := f.link.Tx(frame); err != nil {
+			log.Warn("[ LoRa ] Could not resend fragment", "sequence", h.Sequence, "error", err)
+			return
+		}
+	}
+}
+
+// expire drops what is past reassembly_timeout and asks for missing fragments once
+// the air has been quiet for a couple of frames
+func (f *Fragmenter) expire() {
+	log := slog.With("func", "Fragmenter.expire()", "params", "(-)", "return", "(-)", "package", "lora")
+
+	now := time.Now()
+	gap := 2*f.link.TimeOnAir(f.link.MTU()) + ackTurnaround
+	limit := packet.MaxPayload(f.link.MTU())
+
+	type request struct {
+		key     peerSequence
+		missing []uint8
+	}
+	var requests []request
+
+	f.mu.Lock()
+	for key, p := range f.partials {
+		if now.Sub(p.started) > f.cfg.ReassemblyTimeout {
+			log.Warn("[ LoRa ] Incomplete message dropped", "source", key.peer, "sequence", key.sequence, "received", p.received, "count", p.count)
+			delete(f.partials, key)
+			continue
+		}
+
+		if now.Sub(p.last) > gap && p.requests < maxFragmentRequests {
+			p.requests++
+			p.last = now
+			requests = append(requests, request{key, p.missing(limit)})
+		}
+	}
+
+	for key, m := range f.completed {
+		if now.Sub(m.at) > f.cfg.ReassemblyTimeout {
+			delete(f.completed, key)
+		}
+	}
+	for sequence, m := range f.sent {
+		if now.Sub(m.at) > f.cfg.ReassemblyTimeout {
+			delete(f.sent, sequence)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, r := range requests {
+		data, err := packet.Encode(packet.Packet{
+			Header:  packet.Header{Source: f.address, Destination: r.key.peer, Sequence: r.key.sequence},
+			Payload: &packet.FragmentRequest{Missing: r.missing},
+		}, f.link.MTU())
+		if err == nil {
+			err = f.link.Tx(data)
+		}
+		if err != nil {
+			log.Warn("[ LoRa ] Could not request missing fragments", "source", r.key.peer, "sequence", r.key.sequence, "error", err)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package lora_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/lora"
+	"wbs/internal/lora/packet"
+	"wbs/internal/lora/sim"
+)
+
+func linkConfig() *config.Link {
+	return &config.Link{Fragment: true, MaxMessage: 512, ReassemblyTimeout: 30 * time.Second, MaxPartials: 4}
+}
+
+func newFragmenter(t *testing.T, ctx context.Context, link lora.Link, cfg *config.Link, address packet.Address) *lora.Fragmenter {
+	t.Helper()
+
+	f, err := lora.NewFragmenter(link, cfg, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go f.Run(ctx)
+
+	return f
+}
+
+// message is a packet from 1 to 2 three 64 byte frames long
+func message(t *testing.T, sequence uint16) []uint8 {
+	t.Helper()
+
+	data, err := packet.Encode(packet.Packet{
+		Header:  packet.Header{Source: 1, Destination: 2, Sequence: sequence},
+		Payload: &packet.Command{Key: "note", Value: strings.Repeat("fragmented ", 12)},
+	}, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// fragments of data the way a Fragmenter with a 64 byte MTU sends them
+func fragments(t *testing.T, data []uint8) [][]uint8 {
+	t.Helper()
+
+	h, err := packet.DecodeHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := 64 - packet.FragmentOverhead
+	count := (len(data) + chunk - 1) / chunk
+
+	frames := make([][]uint8, count)
+	for i := range frames {
+		frames[i], err = packet.Encode(packet.Packet{
+			Header:  h,
+			Payload: &packet.Fragment{Index: uint8(i), Count: uint8(count), Data: data[i*chunk : min((i+1)*chunk, len(data))]},
+		}, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return frames
+}
+
+// received drains f until it stays quiet for timeout
+func received(f *lora.Fragmenter, timeout time.Duration) [][]uint8 {
+	var messages [][]uint8
+	for {
+		data, err := f.Rx(timeout)
+		if err != nil {
+			return messages
+		}
+		messages = append(messages, data)
+	}
+}
+
+func TestFragmenterRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := sim.NewChannel(sim.WithSeed(1))
+	a, _ := newNode(t, ctx, ch, testConfig())
+	b, _ := newNode(t, ctx, ch, testConfig())
+	station := newFragmenter(t, ctx, a, linkConfig(), 1)
+	gateway := newFragmenter(t, ctx, b, linkConfig(), 2)
+
+	data := message(t, 1)
+	if len(fragments(t, data)) != 3 {
+		t.Fatalf("message of %d bytes is not three fragments", len(data))
+	}
+	if err := station.Tx(data); err != nil {
+		t.Fatal(err)
+	}
+
+	got := received(gateway, 300*time.Millisecond)
+	if len(got) != 1 || !bytes.Equal(got[0], data) {
+		t.Errorf("received %d messages, want the one sent", len(got))
+	}
+}
+
+func TestFragmenterReassembly(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []int
+	}{
+		{"in order", []int{0, 1, 2}},
+		{"out of order", []int{2, 0, 1}},
+		{"duplicates", []int{0, 1, 1, 0, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			ch := sim.NewChannel(sim.WithSeed(1))
+			station, _ := newNode(t, ctx, ch, testConfig())
+			b, _ := newNode(t, ctx, ch, testConfig())
+			gateway := newFragmenter(t, ctx, b, linkConfig(), 2)
+
+			data := message(t, 1)
+			frames := fragments(t, data)
+			for _, i := range tt.order {
+				if err := station.Tx(frames[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := received(gateway, 300*time.Millisecond)
+			if len(got) != 1 || !bytes.Equal(got[0], data) {
+				t.Errorf("received %d messages, want the one sent once", len(got))
+			}
+		})
+	}
+}
+
+// A source with more than max_partials messages in reassembly loses the oldest one
+func TestFragmenterMaxPartials(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := linkConfig()
+	cfg.MaxPartials = 2
+
+	ch := sim.NewChannel(sim.WithSeed(1))
+	station, _ := newNode(t, ctx, ch, testConfig())
+	b, _ := newNode(t, ctx, ch, testConfig())
+	gateway := newFragmenter(t, ctx, b, cfg, 2)
+
+	sent := make([][][]uint8, 3)
+	for i := range sent {
+		sent[i] = fragments(t, message(t, uint16(i+1)))
+	}
+
+	// The start of 3 drops 1, the rest of 1 comes too late
+	order := []struct{ message, part int }{
+		{0, 0}, {1, 0},
+		{2, 0}, {2, 1}, {2, 2},
+		{1, 1}, {1, 2},
+		{0, 1}, {0, 2},
+	}
+	for _, o := range order {
+		if err := station.Tx(sent[o.message][o.part]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var sequences []uint16
+	for _, data := range received(gateway, 300*time.Millisecond) {
+		h, err := packet.DecodeHeader(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sequences = append(sequences, h.Sequence)
+	}
+	if len(sequences) != 2 || sequences[0] != 3 || sequences[1] != 2 {
+		t.Errorf("reassembled %v, want [3 2]", sequences)
+	}
+}
+
+// Fragments of a message dropped after reassembly_timeout don't complete it
+func TestFragmenterReassemblyTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := linkConfig()
+	cfg.ReassemblyTimeout = 300 * time.Millisecond
+
+	ch := sim.NewChannel(sim.WithSeed(1))
+	station, _ := newNode(t, ctx, ch, testConfig())
+	b, _ := newNode(t, ctx, ch, testConfig())
+	gateway := newFragmenter(t, ctx, b, cfg, 2)
+
+	frames := fragments(t, message(t, 1))
+	for _, frame := range frames[:2] {
+		if err := station.Tx(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Run expires messages after every Rx, at the latest a second after the last frame
+	time.Sleep(1200 * time.Millisecond)
+	if err := station.Tx(frames[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := received(gateway, 300*time.Millisecond); len(got) != 0 {
+		t.Errorf("received %d messages, want none", len(got))
+	}
+}
+
+// The gateway asks for the one fragment it missed and the station sends only that one again
+func TestFragmentRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := sim.NewChannel(sim.WithSeed(1))
+	a, radioA := newNode(t, ctx, ch, testConfig())
+	relay, _ := newNode(t, ctx, ch, testConfig())
+	b, radioB := newNode(t, ctx, ch, testConfig())
+	station := newFragmenter(t, ctx, a, linkConfig(), 1)
+	gateway := newFragmenter(t, ctx, b, linkConfig(), 2)
+
+	// The gateway hears nothing of the station's own transmission...
+	data := message(t, 1)
+	ch.SetPathLoss(radioA, radioB, 200)
+	if err := station.Tx(data); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	ch.SetPathLoss(radioA, radioB, 80)
+
+	// ...and all but the middle fragment from elsewhere
+	frames := fragments(t, data)
+	for _, i := range []int{0, 2} {
+		if err := relay.Tx(frames[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := gateway.Rx(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("reassembled % X, want % X", got, data)
+	}
+
+	if stats, _ := radioB.GetStats(); stats.NbPktReceived != 3 {
+		t.Errorf("gateway received %d frames, want 3", stats.NbPktReceived)
+	}
+}
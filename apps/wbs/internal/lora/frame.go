@@ -0,0 +1,155 @@
+package lora
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+// Frame is a received payload with the link quality the modem reported for it
+type Frame struct {
+	Payload    []uint8
+	RSSI       float32 // dBm, average over the frame
+	SNR        float32 // dB
+	SignalRSSI float32 // dBm, LoRa signal after despreading
+	Error      bool    // CrcErr or HeaderErr latched with the frame
+	Frequency  uint32  // Hz
+	Time       time.Time
+
+	// RSSI, SNR and Error were read with this frame, not after it; see Node.Receive
+	Latched bool
+}
+
+// Stats are the modem's packet counters, see 13.5.4 GetStats; they wrap at 65535
+type Stats struct {
+	Received     uint16
+	CRCErrors    uint16
+	HeaderErrors uint16
+}
+
+// WithStatsHandler is called with the modem's packet counters every interval while Run is running
+func WithStatsHandler(interval time.Duration, h func(s Stats)) NodeOption {
+	return func(n *Node) {
+		if interval > 0 {
+			n.statsInterval = interval
+			n.onStats = h
+		}
+	}
+}
+
+// WithFrameHandler is called with every received frame, e.g. for ADRController.ObserveFrame
+func WithFrameHandler(h func(f Frame)) NodeOption {
+	return func(n *Node) { n.onFrame = h }
+}
+
+// Receive is Rx with the link quality of the frame. A FrameQueue hands it over with the
+// frame and the Frame is Latched; otherwise packet status and IRQ flags are read after the
+// dequeue and belong to the latest frame the modem received, which is a later one when
+// frames queue up. Whatever judges a station by its frames, like ADR, needs Latched ones.
+func (n *Node) Receive(timeout time.Duration) (Frame, error) {
+	var (
+		f   Frame
+		err error
+	)
+	if q, ok := n.hw.(FrameQueue); ok {
+		f, err = q.DequeueFrame(timeout)
+		f.Latched = true
+	} else {
+		f, err = n.dequeue(timeout)
+	}
+	if err != nil {
+		return Frame{}, err
+	}
+
+	cfg := n.config()
+	if f.Frequency == 0 {
+		f.Frequency = cfg.Frequency
+	}
+	if f.Time.IsZero() {
+		f.Time = time.Now()
+	}
+
+	n.record(cfg, CaptureRx, f)
+	if n.onFrame != nil {
+		n.onFrame(f)
+	}
+	return f, nil
+}
+
+// dequeue reads the status of the latest frame after taking the next one off the queue
+func (n *Node) dequeue(timeout time.Duration) (Frame, error) {
+	log := slog.With("func", "dequeue()", "params", "(time.Duration)", "return", "(Frame, error)", "package", "lora")
+
+	payload, err := n.hw.DequeueRx(timeout)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	f := Frame{Payload: payload}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// = 13.5.3 GetPacketStatus ========
+	status, err := n.hw.GetPacketStatus()
+	if err != nil {
+		log.Warn("[ LoRa ] Could not read packet status", "error", err)
+	} else {
+		f.RSSI, f.SNR, f.SignalRSSI = status.RssiPkt, status.SnrPkt, status.SignalRssiPkt
+	}
+	// ---------------------------------
+
+	// = 13.3.3 GetIrqStatus ===========
+	errMask := sx126x.IrqCrcErr | sx126x.IrqHeaderErr
+	irq, err := n.hw.GetIrqStatus()
+	if err != nil {
+		log.Warn("[ LoRa ] Could not read IRQ status", "error", err)
+	} else if sx126x.IrqMask(irq)&errMask != 0 {
+		f.Error = true
+		if err := n.hw.ClearIrqStatus(errMask); err != nil {
+			log.Warn("[ LoRa ] Could not clear IRQ status", "error", err)
+		}
+	}
+	// ---------------------------------
+
+	return f, nil
+}
+
+// Stats reads the modem's packet counters
+func (n *Node) Stats() (Stats, error) {
+	// = 13.5.4 GetStats ===============
+	n.mu.Lock()
+	stats, err := n.hw.GetStats()
+	n.mu.Unlock()
+	if err != nil {
+		return Stats{}, err
+	}
+	// ---------------------------------
+
+	return Stats{Received: stats.NbPktReceived, CRCErrors: stats.NbPktCrcError, HeaderErrors: stats.NbPktHeaderErr}, nil
+}
+
+func (n *Node) reportStats(ctx context.Context) {
+	log := slog.With("func", "reportStats()", "params", "(context.Context)", "return", "(-)", "package", "lora")
+
+	ticker := time.NewTicker(n.statsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stats, err := n.Stats()
+		if err != nil {
+			log.Warn("[ LoRa ] Could not read packet statistics", "error", err)
+			continue
+		}
+		log.Debug("[ LoRa ] Packet statistics", "received", stats.Received, "crc_errors", stats.CRCErrors, "header_errors", stats.HeaderErrors)
+		n.onStats(stats)
+	}
+}
@@ -0,0 +1,114 @@
+package lora_test
+
+import (
+	"context"
+	"testing"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/lora"
+	"wbs/internal/lora/packet"
+	"wbs/internal/lora/sim"
+)
+
+// plainRadio hides sim.Radio's DequeueFrame like the real driver, which has none
+type plainRadio struct {
+	lora.Transceiver
+}
+
+func uplink(t *testing.T, source packet.Address) []uint8 {
+	t.Helper()
+
+	data, err := packet.Encode(packet.Packet{
+		Header:  packet.Header{Source: source, Destination: 1, Sequence: 1},
+		Payload: &packet.Command{Key: "interval", Value: "60s"},
+	}, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Two frames wait in the queue; each comes out with the link quality it was received with
+func TestReceiveQueuedStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := sim.NewChannel(sim.WithSeed(1))
+	near, radioNear := newNode(t, ctx, ch, testConfig())
+	far, radioFar := newNode(t, ctx, ch, testConfig())
+	gateway, radioGateway := newNode(t, ctx, ch, testConfig())
+	ch.SetPathLoss(radioNear, radioGateway, 70)
+	ch.SetPathLoss(radioFar, radioGateway, 110)
+
+	if err := near.Tx(uplink(t, 2)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := far.Tx(uplink(t, 3)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	first, err := gateway.Receive(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := gateway.Receive(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Latched == false || second.Latched == false {
+		t.Errorf("frames not latched: %v, %v", first.Latched, second.Latched)
+	}
+	if diff := first.RSSI - second.RSSI; diff < 35 || diff > 45 {
+		t.Errorf("RSSI %.1f and %.1f dBm, want the near frame 40 dB stronger", first.RSSI, second.RSSI)
+	}
+	if first.SNR <= second.SNR {
+		t.Errorf("SNR %.1f and %.1f dB, want the near frame ahead", first.SNR, second.SNR)
+	}
+}
+
+// Without a FrameQueue the status is read after the frame; ADR leaves such frames alone
+func TestReceiveUnlatched(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := sim.NewChannel(sim.WithSeed(1))
+	station, _ := newNode(t, ctx, ch, testConfig())
+
+	cfg := testConfig()
+	gateway, err := lora.New(&plainRadio{ch.NewRadio(cfg)}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lora.Setup(gateway); err != nil {
+		t.Fatal(err)
+	}
+	go gateway.Run(ctx)
+
+	if err := station.Tx(uplink(t, 2)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := gateway.Receive(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Latched {
+		t.Error("frame from DequeueRx latched")
+	}
+
+	adr := &config.ADR{Enable: true, History: 1, MinTxPower: 2, MaxTxPower: 14}
+	controller, err := lora.NewADRController(gateway, adr, cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := controller.ObserveFrame(f); ok {
+		t.Error("ADR observed a frame without latched status")
+	}
+
+	f.Latched = true
+	if source, _, ok := controller.ObserveFrame(f); !ok || source != 2 {
+		t.Errorf("ObserveFrame = %d, %v; want station 2 observed", source, ok)
+	}
+}
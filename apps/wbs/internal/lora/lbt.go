@@ -0,0 +1,239 @@
+package lora
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync/atomic"
+	"time"
+	"wbs/internal/config"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+var ErrChannelBusy = errors.New("[ LoRa ] Channel busy")
+
+const (
+	// SPI round trips and IRQ latency on top of the CAD symbols themselves
+	cadMargin = 50 * time.Millisecond
+	// 13.5.1 GetStatus - chip mode while transmitting
+	chipModeTx = 0x6
+)
+
+// CADStats are running totals since the Node was created
+type CADStats struct {
+	Runs   uint64
+	Clear  uint64
+	Busy   uint64 // CadDetected
+	GaveUp uint64 // Transmissions that failed after lbt.attempts busy detections
+	Errors uint64 // Modem errors and missing CadDone; the frame is sent anyway
+}
+
+type listenBeforeTalk struct {
+	cfg *config.LBT
+
+	// When the frames handed to the driver are off the air; n.mu guards it
+	txUntil time.Time
+
+	runs, clear, busy, gaveUp, errors atomic.Uint64
+}
+
+// WithListenBeforeTalk runs a channel activity detection before every Tx
+func WithListenBeforeTalk(cfg *config.LBT) NodeOption {
+	return func(n *Node) {
+		if cfg != nil && cfg.Enable {
+			n.lbt = &listenBeforeTalk{cfg: cfg}
+		}
+	}
+}
+
+var wordToCadSymbols = map[uint8]sx126x.CadSymbolNum{
+	1:  sx126x.Cad01Symbol,
+	2:  sx126x.Cad02Symbol,
+	4:  sx126x.Cad04Symbol,
+	8:  sx126x.Cad08Symbol,
+	16: sx126x.Cad16Symbol,
+}
+
+// setCadParams sends the CAD part of cfg to the modem; n.mu must be held
+func (n *Node) setCadParams(log *slog.Logger) error {
+	cad := n.cfg.LoRa.CAD
+
+	symbols, ok := wordToCadSymbols[cad.SymbolNumber]
+	if !ok {
+		symbols = sx126x.Cad02Symbol
+		log.Warn("[ LoRa ] Unknown CAD symbol number", "symbols", cad.SymbolNumber)
+		log.Warn("[ LoRa ] Limiting CAD symbol number to 2")
+	}
+
+	exit := sx126x.CadOnly
+	if cad.ExitMode == 1 {
+		exit = sx126x.CadRx
+	}
+
+	return n.hw.SetCadParams(n.hw.CADConfig(symbols, cad.DetectionPeak, cad.DetectionMinimum, exit, cad.Timeout))
+}
+
+// cadTimeout is how long CadDone may take with the current modulation; n.mu must be held
+func (n *Node) cadTimeout() time.Duration {
+	if n.cfg.Bandwidth == 0 {
+		return cadMargin
+	}
+
+	symbols := float64(max(n.cfg.LoRa.CAD.SymbolNumber, 1))
+	symbol := math.Exp2(float64(n.cfg.LoRa.SpreadingFactor)) / float64(n.cfg.Bandwidth) // s
+
+	return time.Duration((symbols+1)*symbol*float64(time.Second)) + cadMargin
+}
+
+// cad runs a single channel activity detection; true when LoRa preamble was detected.
+// It leaves the modem in Rx, where the driver's Run expects it: the driver goes back to
+// Rx after a Tx only when it found the modem there.
+func (n *Node) cad() (detected bool, err error) {
+	n.lbt.runs.Add(1)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// The driver may only just have started the last queued frame; SetCAD would cut it short
+	if err := n.awaitChipMode(chipModeTx, cadMargin); err != nil {
+		return false, err
+	}
+
+	// = 13.1.6 SetCAD =================
+	if err := n.hw.SetCAD(); err != nil {
+		return false, err
+	}
+
+	// CadOnly, and CadRx without detection, end in standby
+	defer func() {
+		if detected && n.cfg.LoRa.CAD.ExitMode == 1 {
+			return
+		}
+		if rxErr := n.hw.SetRx(int32(sx126x.RxContinuous)); rxErr != nil && err == nil {
+			err = fmt.Errorf("[ LoRa ] Could not return to Rx: %w", rxErr)
+		}
+	}()
+
+	timeout := n.cadTimeout()
+	if n.hw.WaitForIRQ(timeout) == false {
+		return false, fmt.Errorf("[ LoRa ] No CadDone within %s", timeout)
+	}
+
+	status, err := n.hw.GetIrqStatus()
+	if err != nil {
+		return false, err
+	}
+	if err := n.hw.ClearIrqStatus(sx126x.IrqCadDone | sx126x.IrqCadDetected); err != nil {
+		return false, err
+	}
+
+	irq := sx126x.IrqMask(status)
+	if irq&sx126x.IrqCadDone == 0 {
+		return false, fmt.Errorf("[ LoRa ] CAD not done; IRQ status 0x%04X", status)
+	}
+	return irq&sx126x.IrqCadDetected != 0, nil
+}
+
+// awaitChipMode polls GetStatus while the modem is in mode, at most for timeout; n.mu must be held
+func (n *Node) awaitChipMode(mode uint8, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		// = 13.5.1 GetStatus ==============
+		status, err := n.hw.GetStatus()
+		if err != nil {
+			return err
+		}
+		// ---------------------------------
+
+		if status.ChipMode != mode {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("[ LoRa ] Modem still in chip mode 0x%X after %s", mode, timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// awaitTx waits until the frames handed to the driver are off the air; a CAD
+// meanwhile would abort the one being sent.
+func (n *Node) awaitTx() {
+	n.mu.RLock()
+	wait := time.Until(n.lbt.txUntil)
+	n.mu.RUnlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// listen blocks until the channel is clear; busy channels are retried with a randomized
+// exponential backoff until lbt.attempts detections failed.
+func (n *Node) listen() error {
+	log := slog.With("func", "listen()", "params", "(-)", "return", "(error)", "package", "lora")
+
+	if n.lbt == nil || n.config().Modem != "lora" {
+		return nil
+	}
+
+	attempts := max(int(n.lbt.cfg.Attempts), 1)
+	for attempt := 1; ; attempt++ {
+		n.awaitTx()
+
+		busy, err := n.cad()
+		if err != nil {
+			// Better a possible collision than a station that never talks again
+			n.lbt.errors.Add(1)
+			log.Warn("[ LoRa ] Channel activity detection failure, transmitting anyway", "error", err)
+			return nil
+		}
+
+		if busy == false {
+			n.lbt.clear.Add(1)
+			return nil
+		}
+		n.lbt.busy.Add(1)
+
+		if attempt >= attempts {
+			n.lbt.gaveUp.Add(1)
+			return fmt.Errorf("%w; activity detected %d times", ErrChannelBusy, attempt)
+		}
+
+		wait := backoff(n.lbt.cfg.Backoff, attempt)
+		log.Debug("[ LoRa ] Channel busy, backing off", "attempt", attempt, "backoff", wait)
+		time.Sleep(wait)
+	}
+}
+
+// lbtDelay is the longest listen holds a frame back before giving up, with every
+// backoff at its maximum; the CAD symbols themselves are left out.
+func lbtDelay(cfg *config.LBT) time.Duration {
+	if cfg == nil || cfg.Enable == false {
+		return 0
+	}
+
+	attempts := max(int(cfg.Attempts), 1)
+	delay := time.Duration(attempts) * cadMargin
+	for attempt := 1; attempt < attempts; attempt++ {
+		delay += cfg.Backoff << (attempt - 1) * 3 / 2
+	}
+	return delay
+}
+
+// CADStats is zero when listen before talk is off
+func (n *Node) CADStats() CADStats {
+	if n.lbt == nil {
+		return CADStats{}
+	}
+
+	return CADStats{
+		Runs:   n.lbt.runs.Load(),
+		Clear:  n.lbt.clear.Load(),
+		Busy:   n.lbt.busy.Load(),
+		GaveUp: n.lbt.gaveUp.Load(),
+		Errors: n.lbt.errors.Load(),
+	}
+}
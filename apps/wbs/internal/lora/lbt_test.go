@@ -0,0 +1,127 @@
+package lora_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/lora"
+	"wbs/internal/lora/sim"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+// jam puts an endless preamble on the air from a radio of its own until the returned
+// func is called
+func jam(t *testing.T, ch *sim.Channel) (stop func()) {
+	t.Helper()
+
+	cfg := testConfig()
+	radio := ch.NewRadio(cfg)
+	n, err := lora.New(radio, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lora.Setup(n); err != nil {
+		t.Fatal(err)
+	}
+	if err := radio.SetTxInfinitePreamble(); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		if err := radio.SetStandby(sx126x.StandbyRc); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// cadFailure is a radio whose channel activity detection never starts
+type cadFailure struct {
+	*sim.Radio
+}
+
+func (r *cadFailure) SetCAD() error {
+	return errors.New("SPI transfer failed")
+}
+
+// The channel clears while the station backs off, the frame goes out after it
+func TestListenBeforeTalkBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := sim.NewChannel(sim.WithSeed(1))
+	lbt := &config.LBT{Enable: true, Attempts: 10, Backoff: 50 * time.Millisecond}
+	station, _ := newNode(t, ctx, ch, testConfig(), lora.WithListenBeforeTalk(lbt))
+	gateway, _ := newNode(t, ctx, ch, testConfig())
+
+	stop := jam(t, ch)
+	time.AfterFunc(100*time.Millisecond, stop)
+
+	start := time.Now()
+	if err := station.Tx([]uint8("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Tx after %v, before the channel cleared", elapsed)
+	}
+	if _, err := gateway.Rx(200 * time.Millisecond); err != nil {
+		t.Errorf("gateway: %v", err)
+	}
+
+	stats := station.CADStats()
+	if stats.Busy == 0 || stats.Clear != 1 || stats.GaveUp != 0 || stats.Runs != stats.Busy+1 {
+		t.Errorf("CAD stats %+v, want busy runs and then one clear", stats)
+	}
+}
+
+func TestListenBeforeTalkGiveUp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := sim.NewChannel(sim.WithSeed(1))
+	lbt := &config.LBT{Enable: true, Attempts: 3, Backoff: 10 * time.Millisecond}
+	station, _ := newNode(t, ctx, ch, testConfig(), lora.WithListenBeforeTalk(lbt))
+
+	stop := jam(t, ch)
+	defer stop()
+
+	if err := station.Tx([]uint8("ping")); !errors.Is(err, lora.ErrChannelBusy) {
+		t.Fatalf("Tx on a busy channel = %v, want ErrChannelBusy", err)
+	}
+	if stats := station.CADStats(); stats.Runs != 3 || stats.Busy != 3 || stats.GaveUp != 1 {
+		t.Errorf("CAD stats %+v, want 3 busy runs and one give up", stats)
+	}
+}
+
+// A modem that can't run CAD still transmits
+func TestListenBeforeTalkCADError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := sim.NewChannel(sim.WithSeed(1))
+	gateway, _ := newNode(t, ctx, ch, testConfig())
+
+	cfg := testConfig()
+	station, err := lora.New(&cadFailure{ch.NewRadio(cfg)}, cfg,
+		lora.WithListenBeforeTalk(&config.LBT{Enable: true, Attempts: 3, Backoff: 10 * time.Millisecond}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lora.Setup(station); err != nil {
+		t.Fatal(err)
+	}
+	go station.Run(ctx)
+
+	if err := station.Tx([]uint8("ping")); err != nil {
+		t.Fatalf("Tx after a CAD error = %v, want it sent anyway", err)
+	}
+	if _, err := gateway.Rx(200 * time.Millisecond); err != nil {
+		t.Errorf("gateway: %v", err)
+	}
+	if stats := station.CADStats(); stats.Runs != 1 || stats.Errors != 1 {
+		t.Errorf("CAD stats %+v, want one run that failed", stats)
+	}
+}
@@ -6,17 +6,22 @@ import (
 	"github.com/Regeneric/iot-drivers/libs/sx126x"
 )
 
+// SlogAdapter forwards sx126x driver logs to Log, or to slog.Default() when Log is nil
 type SlogAdapter struct {
 	Log *slog.Logger
 }
 
-func (l SlogAdapter) With(kv ...any) sx126x.Logger {
+func (l SlogAdapter) logger() *slog.Logger {
 	if l.Log == nil {
-		return SlogAdapter{Log: slog.Default().With(kv...)}
+		return slog.Default().With("package", "lora")
 	}
-	return SlogAdapter{Log: l.Log.With(kv...)}
+	return l.Log
+}
+
+func (l SlogAdapter) With(kv ...any) sx126x.Logger {
+	return SlogAdapter{Log: l.logger().With(kv...)}
 }
-func (l SlogAdapter) Debug(msg string, kv ...any) { l.Log.Debug(msg, kv...) }
-func (l SlogAdapter) Info(msg string, kv ...any)  { l.Log.Info(msg, kv...) }
-func (l SlogAdapter) Warn(msg string, kv ...any)  { l.Log.Warn(msg, kv...) }
-func (l SlogAdapter) Error(msg string, kv ...any) { l.Log.Error(msg, kv...) }
+func (l SlogAdapter) Debug(msg string, kv ...any) { l.logger().Debug(msg, kv...) }
+func (l SlogAdapter) Info(msg string, kv ...any)  { l.logger().Info(msg, kv...) }
+func (l SlogAdapter) Warn(msg string, kv ...any)  { l.logger().Warn(msg, kv...) }
+func (l SlogAdapter) Error(msg string, kv ...any) { l.logger().Error(msg, kv...) }
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log/slog"
 	"reflect"
+	"sync"
 	"time"
+	"wbs/internal/lora/packet"
 
 	"github.com/Regeneric/iot-drivers/libs/sx126x"
 	"periph.io/x/conn/v3/gpio"
@@ -13,12 +15,27 @@ import (
 )
 
 type Node struct {
-	hw  Transceiver
-	cfg *sx126x.Config
+	hw Transceiver
+
+	// Guards cfg and every modem command sequence; the driver's Run, the watcher's
+	// Reconfigure and every link layer's Tx / Rx reach the modem concurrently.
+	mu   sync.RWMutex
+	cfg  *sx126x.Config // What the modem runs: base with the ADR data rate on top
+	base *sx126x.Config // As configured, see Reconfigure
+	rate *packet.ADR    // Set by SetDataRate; nil - the configured one
+
+	duty     *DutyCycle
+	onBudget func(b Budget)
+	lbt      *listenBeforeTalk
+	capture  *Capture
+
+	statsInterval time.Duration
+	onStats       func(s Stats)
+	onFrame       func(f Frame)
 }
 
-func New(modem Transceiver, cfg *sx126x.Config) (*Node, error) {
-	log := slog.With("func", "New()", "params", "(Transceiver, *sx126x.Config)", "return", "(*Node, error)", "package", "lora")
+func New(modem Transceiver, cfg *sx126x.Config, opts ...NodeOption) (*Node, error) {
+	log := slog.With("func", "New()", "params", "(Transceiver, *sx126x.Config, ...NodeOption)", "return", "(*Node, error)", "package", "lora")
 	log.Info("[ LoRa ] Modem constructor")
 
 	if cfg == nil {
@@ -31,11 +48,20 @@ func New(modem Transceiver, cfg *sx126x.Config) (*Node, error) {
 	if cfg.Enable == false {
 		return nil, fmt.Errorf("LoRa modem disabled in the config")
 	}
+	if cfg.Modem == "fsk" {
+		return nil, fmt.Errorf("LoRa modem state improper; sx126x.modem fsk is run by fsk.Node")
+	}
 
-	return &Node{
-		hw:  modem,
-		cfg: cfg,
-	}, nil
+	n := &Node{
+		hw:   modem,
+		cfg:  cfg,
+		base: cfg,
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+
+	return n, nil
 }
 
 func Setup(n *Node) error {
@@ -52,6 +78,9 @@ func Setup(n *Node) error {
 		return fmt.Errorf("LoRa modem state improper; hw is nil")
 	}
 
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
 	if n.cfg.Enable == false {
 		return fmt.Errorf("LoRa modem disabled in the config")
 	}
@@ -59,48 +88,9 @@ func Setup(n *Node) error {
 	// ************************************************************************
 	// = 14.3 Circuit Configuration for Basic Rx Operation ===
 	// ------------------------------------------------------------------------
-	if err := n.hw.HardReset(); err != nil {
-		return err
-	}
-
-	// = 13.6.2 ClearDeviceErrors ========
-	if err := n.hw.ClearDeviceErrors(true); err != nil {
-		log.Error("Could not clear device errors", "error", err)
-	}
-	// ---------------------------------
-
-	// = 13.1.11 SetRegulatorMode ======
-	if err := n.hw.SetStandby(sx126x.StandbyRc); err != nil {
-		return err
-	}
-
-	regulator := sx126x.RegulatorLdo
-	if n.cfg.DC_DC == true {
-		regulator = sx126x.RegulatorDcDc
-	}
-
-	if err := n.hw.SetRegulatorMode(regulator); err != nil {
+	if err := Reset(n.hw, n.cfg, log); err != nil {
 		return err
 	}
-	// ---------------------------------
-
-	// = 13.1.2 SetStandby =============
-	stringToStandby := map[string]sx126x.StandbyMode{
-		"rc":   sx126x.StandbyRc,
-		"xosc": sx126x.StandbyXosc,
-	}
-
-	standby, ok := stringToStandby[n.cfg.StandbyMode]
-	if !ok {
-		standby = sx126x.StandbyRc
-		log.Warn("[ LoRa ] Unknown standby mode", "mode", n.cfg.StandbyMode)
-		log.Warn("[ LoRa ] Limiting standby mode to RC")
-	}
-
-	if err := n.hw.SetStandby(standby); err != nil {
-		return err
-	}
-	// ---------------------------------
 
 	// = 13.4.2 SetPacketType ==========
 	stringToPacket := map[string]sx126x.PacketType{
@@ -120,85 +110,75 @@ func Setup(n *Node) error {
 	}
 	// ---------------------------------
 
-	// = 13.1.13 CalibrateImage ========
-	wordToFreq := map[uint16]sx126x.CalibrationImageFreq{
-		430: sx126x.CalImg430,
-		440: sx126x.CalImg440,
-		470: sx126x.CalImg470,
-		510: sx126x.CalImg510,
-		779: sx126x.CalImg779,
-		787: sx126x.CalImg787,
-		863: sx126x.CalImg863,
-		870: sx126x.CalImg870,
-		902: sx126x.CalImg902,
-		928: sx126x.CalImg928,
-	}
-
-	freq1, freq1Ok := wordToFreq[n.cfg.FrequencyRange[0]]
-	freq2, freq2Ok := wordToFreq[n.cfg.FrequencyRange[1]]
-
-	if !freq1Ok || !freq2Ok {
-		freq1 = sx126x.CalImg430
-		freq2 = sx126x.CalImg440
-
-		log.Warn("[ LoRa ] Unknown frequency", "freq1", n.cfg.FrequencyRange[0], "freq2", n.cfg.FrequencyRange[1])
-		log.Warn("[ LoRa ] Limiting frequency range to 430-440")
+	// = RF, PA and buffers ===========
+	if err := SetRf(n.hw, n.cfg, log); err != nil {
+		return err
 	}
+	// ---------------------------------
 
-	if err := n.hw.CalibrateImage(freq1, freq2); err != nil {
+	// = 13.4.5 SetModulationParams ====
+	if err := n.setModulationParams(); err != nil {
 		return err
 	}
 	// ---------------------------------
 
-	// = 13.4.1 SetRfFrequency =========
-	if err := n.hw.SetRfFrequency(sx126x.Frequency(n.cfg.Frequency)); err != nil {
+	// = 13.4.6 SetPacketParams ========
+	if err := n.setPacketParams(); err != nil {
 		return err
 	}
 	// ---------------------------------
 
-	// = 13.1.14 SetPaConfig ===========
-	if err := n.hw.SetPaConfig(); err != nil {
-		return err
+	// = 13.4.7 SetCadParams ===========
+	if n.cfg.Modem == "lora" {
+		if err := n.setCadParams(log); err != nil {
+			return err
+		}
 	}
 	// ---------------------------------
 
-	// = 13.4.4 SetTxParams ============
-	wordToRamp := map[uint16]sx126x.RampTime{
-		10:   sx126x.PaRamp10u,
-		20:   sx126x.PaRamp20u,
-		40:   sx126x.PaRamp40u,
-		80:   sx126x.PaRamp80u,
-		200:  sx126x.PaRamp200u,
-		800:  sx126x.PaRamp800u,
-		1700: sx126x.PaRamp1700u,
-		3400: sx126x.PaRamp3400u,
-	}
-
-	ramp, ok := wordToRamp[n.cfg.RampTime]
-	if !ok {
-		ramp = sx126x.PaRamp800u
-		log.Warn("[ LoRa ] Unknown ramp time value", "rampTime", n.cfg.RampTime)
-		log.Warn("[ LoRa ] Limiting ramp time to 800us")
+	// = 13.3.1 SetDioIrqParams ========
+	mask := sx126x.IrqTxDone | sx126x.IrqRxDone | sx126x.IrqTimeout | sx126x.IrqCrcErr | sx126x.IrqHeaderErr // Default mask, can be changed later
+	if n.lbt != nil {
+		mask |= sx126x.IrqCadDone | sx126x.IrqCadDetected
 	}
+	if err := n.hw.SetDioIrqParams(mask); err != nil {
+		return err
+	}
+	// ---------------------------------
 
-	if err := n.hw.SetTxParams(n.cfg.TransmitPower, ramp); err != nil {
+	// = LoRa SyncWord =================
+	if err := n.setSyncWord(log); err != nil {
 		return err
 	}
 	// ---------------------------------
 
-	// = 13.4.8 SetBufferBaseAddress ===
-	if err := n.hw.SetBufferBaseAddress(n.cfg.TxBufferAddress, n.cfg.RxBufferAddress); err != nil {
+	// = 13.3.5 SetDIO2AsRfSwitchCtrl ==
+	if err := n.hw.SetDIO2AsRfSwitchCtrl(n.cfg.DIO2AsRfSwitch); err != nil {
 		return err
 	}
 	// ---------------------------------
 
-	// = 13.4.5 SetModulationParams ====
-	if err := n.hw.SetModulationParams(n.hw.ModulationConfigLoRa(n.cfg.LoRa.SpreadingFactor, n.cfg.LoRa.CodingRate, sx126x.Frequency(n.cfg.Bandwidth), n.cfg.LoRa.LDRO)); err != nil {
+	// = 13.1.5 SetRx ==================
+	if err := n.hw.SetRx(int32(sx126x.RxContinuous)); err != nil {
 		return err
 	}
 	// ---------------------------------
 
-	// = 13.4.6 SetPacketParams ========
+	// ------------------------------------------------------------------------
+	return nil
+}
+
+// The set* helpers send cfg to the modem; n.mu must be held
+
+func (n *Node) setTxParams(log *slog.Logger) error {
+	return SetTxParams(n.hw, n.cfg, log)
+}
+
+func (n *Node) setModulationParams() error {
+	return n.hw.SetModulationParams(n.hw.ModulationConfigLoRa(n.cfg.LoRa.SpreadingFactor, n.cfg.LoRa.CodingRate, sx126x.Frequency(n.cfg.Bandwidth), n.cfg.LoRa.LDRO))
+}
+
+func (n *Node) setPacketParams() error {
 	header := sx126x.HeaderExplicit
 	if n.cfg.LoRa.HeaderImplicit == true {
 		header = sx126x.HeaderImplicit
@@ -214,95 +194,205 @@ func Setup(n *Node) error {
 		iq = sx126x.IqInverted
 	}
 
-	if err := n.hw.SetPacketParams(n.hw.PacketLoRaConfig(n.cfg.PreambleLength, header, int(n.cfg.PayloadLength), crc, iq)); err != nil {
+	return n.hw.SetPacketParams(n.hw.PacketLoRaConfig(n.cfg.PreambleLength, header, int(n.cfg.PayloadLength), crc, iq))
+}
+
+func (n *Node) setSyncWord(log *slog.Logger) error {
+	if _, err := n.hw.WriteRegister(uint16(sx126x.RegLoraSyncWordMsb), []uint8{uint8(n.cfg.LoRa.SyncWord >> 8), uint8(n.cfg.LoRa.SyncWord)}); err != nil {
+		return err
+	}
+
+	syncWord := make([]uint8, 2)
+	if _, err := n.hw.ReadRegister(uint16(sx126x.RegLoraSyncWordMsb), syncWord); err != nil {
+		return err
+	}
+
+	log.Info("[ LoRa ] Read register success", "syncWord", fmt.Sprintf("% X", syncWord))
+	return nil
+}
+
+// HotReloadable are the sx126x config paths Reconfigure applies without a hard reset
+var HotReloadable = []string{
+	"sx126x.bandwidth",
+	"sx126x.frequency",
+	"sx126x.preamble_length",
+	"sx126x.payload_length",
+	"sx126x.tx_power",
+	"sx126x.ramp_time",
+	"sx126x.lora.spreading_factor",
+	"sx126x.lora.coding_rate",
+	"sx126x.lora.ldro",
+	"sx126x.lora.header_implicit",
+	"sx126x.lora.crc",
+	"sx126x.lora.inverted_iq",
+	"sx126x.lora.sync_word",
+	"sx126x.lora.cad.symbol_number",
+	"sx126x.lora.cad.detection_peak",
+	"sx126x.lora.cad.detection_minimum",
+	"sx126x.lora.cad.exit_mode",
+	"sx126x.lora.cad.timeout",
+}
+
+// Reconfigure reapplies RF, modulation and packet params from cfg. The modem goes through
+// standby, so an ongoing reception is dropped, but no reset or calibration is done.
+// Frequency must stay within the frequency_range the image was calibrated for at Setup;
+// a new frequency_range itself takes a restart. A data rate set with SetDataRate stays
+// on top of cfg.
+func (n *Node) Reconfigure(cfg *sx126x.Config) error {
+	log := slog.With("func", "Reconfigure()", "params", "(*sx126x.Config)", "return", "(error)", "package", "lora")
+	log.Info("[ LoRa ] Modem reconfiguration")
+
+	if cfg == nil {
+		return fmt.Errorf("LoRa modem state improper; cfg is nil")
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	calibrated := n.base.FrequencyRange
+	if low, high := uint32(calibrated[0])*1_000_000, uint32(calibrated[1])*1_000_000; cfg.Frequency < low || cfg.Frequency > high {
+		return fmt.Errorf("LoRa frequency %d Hz outside the calibrated frequency_range %d-%d MHz", cfg.Frequency, calibrated[0], calibrated[1])
+	}
+	if cfg.FrequencyRange != calibrated {
+		next := *cfg
+		next.FrequencyRange = calibrated
+		cfg = &next
+	}
+
+	n.base = cfg
+	n.cfg = n.withDataRate(cfg)
+
+	// = 13.1.2 SetStandby =============
+	if err := n.hw.SetStandby(sx126x.StandbyRc); err != nil {
 		return err
 	}
 	// ---------------------------------
 
-	// = 13.3.1 SetDioIrqParams ========
-	mask := sx126x.IrqTxDone | sx126x.IrqRxDone | sx126x.IrqTimeout | sx126x.IrqCrcErr | sx126x.IrqHeaderErr // Default mask, can be changed later
-	if err := n.hw.SetDioIrqParams(mask); err != nil {
+	// = 13.4.1 SetRfFrequency =========
+	if err := n.hw.SetRfFrequency(sx126x.Frequency(n.cfg.Frequency)); err != nil {
 		return err
 	}
 	// ---------------------------------
 
-	// = LoRa SyncWord =================
-	if _, err := n.hw.WriteRegister(uint16(sx126x.RegLoraSyncWordMsb), []uint8{uint8(n.cfg.LoRa.SyncWord >> 8), uint8(n.cfg.LoRa.SyncWord)}); err != nil {
+	// = 13.4.4 SetTxParams ============
+	if err := n.setTxParams(log); err != nil {
 		return err
 	}
+	// ---------------------------------
 
-	syncWord := make([]uint8, 2)
-	if _, err := n.hw.ReadRegister(uint16(sx126x.RegLoraSyncWordMsb), syncWord); err != nil {
+	// = 13.4.5 SetModulationParams ====
+	if err := n.setModulationParams(); err != nil {
 		return err
-	} else {
-		log.Info("[ LoRa ] Read register success", "syncWord", fmt.Sprintf("% X", syncWord))
 	}
 	// ---------------------------------
 
-	// = 13.3.5 SetDIO2AsRfSwitchCtrl ==
-	if err := n.hw.SetDIO2AsRfSwitchCtrl(n.cfg.DIO2AsRfSwitch); err != nil {
+	// = 13.4.6 SetPacketParams ========
+	if err := n.setPacketParams(); err != nil {
 		return err
 	}
 	// ---------------------------------
 
-	// = 13.1.5 SetRx ==================
-	if err := n.hw.SetRx(int32(sx126x.RxContinuous)); err != nil {
+	// = 13.4.7 SetCadParams ===========
+	if n.cfg.Modem == "lora" {
+		if err := n.setCadParams(log); err != nil {
+			return err
+		}
+	}
+	// ---------------------------------
+
+	// = LoRa SyncWord =================
+	if err := n.setSyncWord(log); err != nil {
 		return err
 	}
 	// ---------------------------------
 
-	// ------------------------------------------------------------------------
-	return nil
+	// = 13.1.5 SetRx ==================
+	return n.hw.SetRx(int32(sx126x.RxContinuous))
 }
 
 func (n *Node) Close() error {
 	log := slog.With("func", "Close()", "params", "(-)", "return", "(error)", "package", "lora")
 	log.Info("[ LoRa ] LoRa modem destructor")
 
-	stringToSleep := map[string]sx126x.SleepConfig{
-		"cold_start":     sx126x.SleepColdStart,
-		"warm_start":     sx126x.SleepWarmStart,
-		"cold_start_rtc": sx126x.SleepColdStartRtc,
-		"warm_start_rtc": sx126x.SleepWarmStartRtc,
-	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
 
-	mode, ok := stringToSleep[n.cfg.SleepMode]
-	if !ok {
-		mode = sx126x.SleepWarmStart
-		log.Warn("[ LoRa ] Unknown sleep mode", "mode", n.cfg.SleepMode)
-		log.Warn("[ LoRa ] Limiting sleep mode to Warm Start")
+	if n.lbt != nil {
+		stats := n.CADStats()
+		log.Info("[ LoRa ] CAD statistics", "runs", stats.Runs, "clear", stats.Clear, "busy", stats.Busy, "gave_up", stats.GaveUp, "errors", stats.Errors)
 	}
 
-	if err := n.hw.Close(mode); err != nil {
-		return fmt.Errorf("Critical failure during SX126X modem shutdown: %w", err)
-	}
+	return Sleep(n.hw, n.cfg, log)
+}
 
-	return nil
+// config is the current cfg; Reconfigure and SetDataRate swap it, never change it in place
+func (n *Node) config() *sx126x.Config {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return n.cfg
+}
+
+// MTU is the largest payload a single frame carries
+func (n *Node) MTU() int {
+	return int(n.config().PayloadLength)
 }
 
 func (n *Node) Tx(data []uint8) error {
 	log := slog.With("func", "Tx()", "params", "([]uint8)", "return", "(error)", "package", "lora")
 	log.Info("[ LoRa ] Data transmit")
 
-	return n.hw.EnqueueTx(data)
+	// Budget first: waiting for it would make a clear channel stale
+	cfg := n.config()
+	if err := n.reserveAirtime(cfg, len(data)); err != nil {
+		return err
+	}
+	if err := n.listen(); err != nil {
+		n.releaseAirtime(cfg, len(data))
+		return err
+	}
+
+	n.mu.Lock()
+	err := n.hw.EnqueueTx(data)
+	if err == nil && n.lbt != nil {
+		// The driver sends queued frames one after another
+		start := time.Now()
+		if n.lbt.txUntil.After(start) {
+			start = n.lbt.txUntil
+		}
+		n.lbt.txUntil = start.Add(TimeOnAir(n.cfg, len(data)))
+	}
+	n.mu.Unlock()
+	if err != nil {
+		n.releaseAirtime(cfg, len(data))
+		return err
+	}
+
+	n.record(cfg, CaptureTx, Frame{Payload: data, Frequency: cfg.Frequency, Time: time.Now()})
+	return nil
 }
 
 func (n *Node) Rx(timeout time.Duration) ([]uint8, error) {
 	log := slog.With("func", "Rx()", "params", "(time.Duration)", "return", "([]uint8, error)", "package", "lora")
-	log.Info("[ LoRa ] Data receive")
 
-	payload, err := n.hw.DequeueRx(timeout)
+	f, err := n.Receive(timeout)
 	if err != nil {
 		return nil, err
 	}
 
-	return payload, nil
+	// Link layers poll Rx every second, only frames are worth a line
+	log.Debug("[ LoRa ] Data receive", "size", len(f.Payload))
+	return f.Payload, nil
 }
 
 func (n *Node) Run(ctx context.Context) error {
 	if err := ctx.Err(); err != nil {
 		return err
 	}
+
+	if n.onStats != nil {
+		go n.reportStats(ctx)
+	}
 	return n.hw.Run(ctx)
 }
 
@@ -0,0 +1,91 @@
+package lora_test
+
+import (
+	"context"
+	"testing"
+	"time"
+	"wbs/internal/lora"
+	"wbs/internal/lora/sim"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+// SF7 at 500 kHz keeps every frame in the tests a few ms on the air
+func testConfig() *sx126x.Config {
+	return &sx126x.Config{
+		Enable:         true,
+		Modem:          "lora",
+		Type:           "1262",
+		Bandwidth:      500_000,
+		Frequency:      869_500_000,
+		PreambleLength: 8,
+		PayloadLength:  64,
+		TransmitPower:  14,
+		StandbyMode:    "rc",
+		SleepMode:      "warm_start",
+		FrequencyRange: [2]uint16{863, 870},
+		RampTime:       40,
+		LoRa:           sx126x.LoRa{SpreadingFactor: 7, CodingRate: 5, CRC: true, SyncWord: 0x1424},
+	}
+}
+
+// newNode puts a lora.Node on a new radio of ch, set up and running until ctx is cancelled
+func newNode(t *testing.T, ctx context.Context, ch *sim.Channel, cfg *sx126x.Config, opts ...lora.NodeOption) (*lora.Node, *sim.Radio) {
+	t.Helper()
+
+	radio := ch.NewRadio(cfg)
+	n, err := lora.New(radio, cfg, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lora.Setup(n); err != nil {
+		t.Fatal(err)
+	}
+	go n.Run(ctx)
+
+	return n, radio
+}
+
+// heard reports whether to receives what from sends
+func heard(t *testing.T, from, to *lora.Node) bool {
+	t.Helper()
+
+	if err := from.Tx([]uint8("ping")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := to.Rx(200 * time.Millisecond)
+	return err == nil
+}
+
+// The image stays calibrated for the range of Setup; a frequency outside of it is
+// rejected even when the new config moves frequency_range along
+func TestReconfigureFrequencyRange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := sim.NewChannel(sim.WithSeed(1))
+	a, _ := newNode(t, ctx, ch, testConfig())
+	b, _ := newNode(t, ctx, ch, testConfig())
+
+	moved := testConfig()
+	moved.FrequencyRange, moved.Frequency = [2]uint16{430, 440}, 433_500_000
+	if err := a.Reconfigure(moved); err == nil {
+		t.Error("Reconfigure to 433.5 MHz succeeded")
+	}
+	if !heard(t, a, b) {
+		t.Error("a left 869.5 MHz after a rejected Reconfigure")
+	}
+
+	// In range, the new frequency_range is ignored
+	inRange := testConfig()
+	inRange.FrequencyRange, inRange.Frequency = [2]uint16{430, 440}, 868_100_000
+	if err := a.Reconfigure(inRange); err != nil {
+		t.Fatal(err)
+	}
+	if heard(t, a, b) {
+		t.Error("b at 869.5 MHz heard a at 868.1 MHz")
+	}
+	if err := a.Reconfigure(moved); err == nil {
+		t.Error("Reconfigure to 433.5 MHz succeeded after the range came in through a reload")
+	}
+}
@@ -0,0 +1,178 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Wire format, big endian:
+//
+//	0      version << 4 | type
+//	1      flags
+//	2..3   source address
+//	4..5   destination address
+//	6..7   sequence number
+//	8..    payload, layout depends on type
+const (
+	Version    = 1
+	HeaderSize = 8
+)
+
+var (
+	ErrTooLarge    = errors.New("[ PACKET ] Packet does not fit into payload length")
+	ErrShort       = errors.New("[ PACKET ] Packet too short")
+	ErrVersion     = errors.New("[ PACKET ] Unsupported packet version")
+	ErrUnknownType = errors.New("[ PACKET ] Unknown message type")
+	ErrMalformed   = errors.New("[ PACKET ] Malformed payload")
+)
+
+type Address uint16
+
+// Broadcast is accepted by every station
+const Broadcast Address = 0xFFFF
+
+type Type uint8
+
+const (
+	TypeTelemetry Type = iota + 1
+	TypeAck
+	TypeCommand
+	TypeBeacon
+	TypeFragment
+	TypeFragmentRequest
+	TypeADR
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeTelemetry:
+		return "telemetry"
+	case TypeAck:
+		return "ack"
+	case TypeCommand:
+		return "command"
+	case TypeBeacon:
+		return "beacon"
+	case TypeFragment:
+		return "fragment"
+	case TypeFragmentRequest:
+		return "fragment_request"
+	case TypeADR:
+		return "adr"
+	default:
+		return fmt.Sprintf("type(%d)", uint8(t))
+	}
+}
+
+type Flags uint8
+
+const (
+	FlagAckRequest Flags = 1 << iota // Receiver should answer with TypeAck
+	FlagEncrypted                    // Payload is a frame counter, AES-CCM ciphertext and tag
+)
+
+func (f Flags) Has(flag Flags) bool {
+	return f&flag != 0
+}
+
+type Header struct {
+	Version     uint8
+	Type        Type
+	Flags       Flags
+	Source      Address
+	Destination Address
+	Sequence    uint16
+}
+
+type Packet struct {
+	Header
+	Payload Payload
+}
+
+// Payload is one of the typed message bodies below
+type Payload interface {
+	Type() Type
+	AppendBinary(b []byte) ([]byte, error)
+}
+
+var decoders = map[Type]func(b []byte) (Payload, error){
+	TypeTelemetry: decodeTelemetry,
+	TypeAck:       decodeAck,
+	TypeCommand:   decodeCommand,
+	TypeBeacon:    decodeBeacon,
+
+	TypeFragment:        decodeFragment,
+	TypeFragmentRequest: decodeFragmentRequest,
+
+	TypeADR: decodeADR,
+}
+
+// MaxPayload is the room left for the payload in a frame of payloadLength bytes
+func MaxPayload(payloadLength int) int {
+	return max(payloadLength-HeaderSize, 0)
+}
+
+// Encode serializes p; Version and Type are taken from the codec and the payload,
+// whatever the header says. payloadLength is sx126x.Config.PayloadLength.
+func Encode(p Packet, payloadLength int) ([]uint8, error) {
+	if p.Payload == nil {
+		return nil, fmt.Errorf("[ PACKET ] Packet state improper; payload is nil")
+	}
+
+	b := make([]uint8, HeaderSize, max(payloadLength, HeaderSize))
+	b[0] = Version<<4 | uint8(p.Payload.Type())&0x0F
+	b[1] = uint8(p.Flags)
+	binary.BigEndian.PutUint16(b[2:], uint16(p.Source))
+	binary.BigEndian.PutUint16(b[4:], uint16(p.Destination))
+	binary.BigEndian.PutUint16(b[6:], p.Sequence)
+
+	b, err := p.Payload.AppendBinary(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) > payloadLength {
+		return nil, fmt.Errorf("%w; %d > %d bytes", ErrTooLarge, len(b), payloadLength)
+	}
+	return b, nil
+}
+
+// DecodeHeader reads only the header, e.g. to drop packets for other stations early
+func DecodeHeader(data []uint8) (Header, error) {
+	if len(data) < HeaderSize {
+		return Header{}, fmt.Errorf("%w; %d bytes", ErrShort, len(data))
+	}
+
+	h := Header{
+		Version:     data[0] >> 4,
+		Type:        Type(data[0] & 0x0F),
+		Flags:       Flags(data[1]),
+		Source:      Address(binary.BigEndian.Uint16(data[2:])),
+		Destination: Address(binary.BigEndian.Uint16(data[4:])),
+		Sequence:    binary.BigEndian.Uint16(data[6:]),
+	}
+
+	if h.Version != Version {
+		return h, fmt.Errorf("%w; %d", ErrVersion, h.Version)
+	}
+	return h, nil
+}
+
+func Decode(data []uint8) (Packet, error) {
+	h, err := DecodeHeader(data)
+	if err != nil {
+		return Packet{Header: h}, err
+	}
+
+	decode, ok := decoders[h.Type]
+	if !ok {
+		return Packet{Header: h}, fmt.Errorf("%w; %d", ErrUnknownType, h.Type)
+	}
+
+	payload, err := decode(data[HeaderSize:])
+	if err != nil {
+		return Packet{Header: h}, err
+	}
+	return Packet{Header: h, Payload: payload}, nil
+}
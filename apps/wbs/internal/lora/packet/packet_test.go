@@ -0,0 +1,154 @@
+package packet
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+	"wbs/internal/sensors"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload Payload
+	}{
+		{"telemetry", &Telemetry{
+			Time: time.Unix(1_760_000_000, 0),
+			Values: []Value{
+				{Sensor: 0, Quantity: sensors.QuantityTemperature, Quality: sensors.QualityGood, Value: 21.5},
+				{Sensor: 1, Quantity: sensors.QuantityParticles10, Quality: 3, Value: -1},
+			},
+		}},
+		{"telemetry empty", &Telemetry{Time: time.Unix(0, 0), Values: []Value{}}},
+		{"ack", &Ack{Sequence: 0xBEEF, Status: AckInvalidValue}},
+		{"command", &Command{Key: "station.interval", Value: "30s"}},
+		{"command empty value", &Command{Key: "k", Value: ""}},
+		{"beacon", &Beacon{Uptime: 3 * time.Hour, Sensors: []string{"bme280_0", "pms5003_0"}}},
+		{"beacon no sensors", &Beacon{Uptime: 0, Sensors: []string{}}},
+		{"fragment", &Fragment{Index: 2, Count: 3, Data: []byte{0x00, 0xFF, 0x0A}}},
+		{"fragment request", &FragmentRequest{Missing: []uint8{0, 4, 7}}},
+		{"adr", &ADR{SpreadingFactor: 9, TxPower: -9}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := Packet{
+				Header:  Header{Flags: FlagAckRequest, Source: 1, Destination: Broadcast, Sequence: 42},
+				Payload: tt.payload,
+			}
+
+			data, err := Encode(in, 255)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+
+			out, err := Decode(data)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+
+			want := in.Header
+			want.Version, want.Type = Version, tt.payload.Type()
+			if out.Header != want {
+				t.Errorf("header = %+v, want %+v", out.Header, want)
+			}
+			if !reflect.DeepEqual(out.Payload, tt.payload) {
+				t.Errorf("payload = %#v, want %#v", out.Payload, tt.payload)
+			}
+		})
+	}
+}
+
+func TestEncodeTooLarge(t *testing.T) {
+	p := Packet{Payload: &Command{Key: "station.interval", Value: "30s"}}
+
+	if _, err := Encode(p, 16); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Encode into 16 bytes = %v, want ErrTooLarge", err)
+	}
+}
+
+func TestTelemetryCapacity(t *testing.T) {
+	for _, payloadLength := range []int{0, 8, 13, 19, 32, 255} {
+		capacity := TelemetryCapacity(payloadLength)
+
+		telemetry := &Telemetry{Values: make([]Value, capacity)}
+		for i := range telemetry.Values {
+			telemetry.Values[i].Quantity = sensors.QuantityTemperature
+		}
+		if _, err := Encode(Packet{Payload: telemetry}, payloadLength); err != nil && capacity > 0 {
+			t.Errorf("%d values into %d bytes: %v", capacity, payloadLength, err)
+		}
+
+		telemetry.Values = append(telemetry.Values, Value{Quantity: sensors.QuantityTemperature})
+		if _, err := Encode(Packet{Payload: telemetry}, payloadLength); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("%d values into %d bytes = %v, want ErrTooLarge", capacity+1, payloadLength, err)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []uint8
+		want error
+	}{
+		{"short", []uint8{0x11, 0, 0, 1}, ErrShort},
+		{"version", []uint8{0x21, 0, 0, 1, 0, 0, 0, 1}, ErrVersion},
+		{"unknown type", []uint8{0x1F, 0, 0, 1, 0, 0, 0, 1}, ErrUnknownType},
+		{"ack length", []uint8{0x12, 0, 0, 1, 0, 0, 0, 1, 0}, ErrMalformed},
+		{"telemetry count", []uint8{0x11, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 2}, ErrMalformed},
+		{"fragment index", []uint8{0x15, 0, 0, 1, 0, 0, 0, 1, 3, 3}, ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(tt.data); !errors.Is(err, tt.want) {
+				t.Errorf("Decode = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// FuzzDecode feeds arbitrary frames to the decoder, as a noisy channel would. Decode
+// must never panic, and whatever it accepts must encode back to the same bytes.
+func FuzzDecode(f *testing.F) {
+	seeds := []Payload{
+		&Telemetry{Time: time.Unix(1_760_000_000, 0), Values: []Value{{Quantity: sensors.QuantityPM25, Value: 12}}},
+		&Ack{Sequence: 7},
+		&Command{Key: "station.interval", Value: "30s"},
+		&Beacon{Uptime: time.Minute, Sensors: []string{"bme280_0"}},
+		&Fragment{Index: 0, Count: 2, Data: []byte{1, 2, 3}},
+		&FragmentRequest{Missing: []uint8{1}},
+		&ADR{SpreadingFactor: 7, TxPower: 14},
+	}
+	for _, p := range seeds {
+		data, err := Encode(Packet{Header: Header{Source: 1, Destination: 2, Sequence: 3}, Payload: p}, 255)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0x11})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := Decode(data)
+		if err != nil {
+			return
+		}
+
+		again, err := Encode(p, len(data))
+		if err != nil {
+			t.Fatalf("decoded %x, but Encode fails: %v", data, err)
+		}
+
+		// Telemetry quality takes two bits of the quantity byte, flags and version are kept as is
+		if p.Type == TypeTelemetry || p.Type == TypeBeacon {
+			return
+		}
+		if !reflect.DeepEqual(again, data) {
+			t.Fatalf("Encode(Decode(%x)) = %x", data, again)
+		}
+	})
+}
@@ -0,0 +1,343 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+	"wbs/internal/sensors"
+)
+
+// ************************************************************************
+// = Telemetry ===
+// ------------------------------------------------------------------------
+
+// Code of a quantity on air is its index; append only, never reorder
+var quantities = []string{
+	"",
+	sensors.QuantityECO2,
+	sensors.QuantityTVOC,
+	sensors.QuantityTemperature,
+	sensors.QuantityHumidity,
+	sensors.QuantityPressure,
+	sensors.QuantityPM1,
+	sensors.QuantityPM25,
+	sensors.QuantityPM10,
+	sensors.QuantityParticles03,
+	sensors.QuantityParticles05,
+	sensors.QuantityParticles1,
+	sensors.QuantityParticles25,
+	sensors.QuantityParticles5,
+	sensors.QuantityParticles10,
+}
+
+var quantityCodes = func() map[string]uint8 {
+	codes := make(map[string]uint8, len(quantities))
+	for i, q := range quantities[1:] {
+		codes[q] = uint8(i + 1)
+	}
+	return codes
+}()
+
+const (
+	telemetryHeader = 5 // time + count
+	valueSize       = 6 // sensor + quality << 6 | quantity + float32
+)
+
+type Value struct {
+	Sensor   uint8 // Index into Beacon.Sensors
+	Quantity string
+	Quality  sensors.Quality
+	Value    float32
+}
+
+// Telemetry carries readings; time has a one second resolution
+type Telemetry struct {
+	Time   time.Time
+	Values []Value
+}
+
+// TelemetryCapacity is the number of values that fit into a frame of payloadLength bytes
+func TelemetryCapacity(payloadLength int) int {
+	return max(MaxPayload(payloadLength)-telemetryHeader, 0) / valueSize
+}
+
+func (t *Telemetry) Type() Type {
+	return TypeTelemetry
+}
+
+func (t *Telemetry) AppendBinary(b []byte) ([]byte, error) {
+	if len(t.Values) > math.MaxUint8 {
+		return nil, fmt.Errorf("%w; %d values", ErrTooLarge, len(t.Values))
+	}
+
+	b = binary.BigEndian.AppendUint32(b, uint32(t.Time.Unix()))
+	b = append(b, uint8(len(t.Values)))
+
+	for _, v := range t.Values {
+		code, ok := quantityCodes[v.Quantity]
+		if !ok {
+			return nil, fmt.Errorf("[ PACKET ] Quantity %q has no code", v.Quantity)
+		}
+		if v.Quality > 3 {
+			return nil, fmt.Errorf("[ PACKET ] Quality %d has no code", v.Quality)
+		}
+
+		b = append(b, v.Sensor, uint8(v.Quality)<<6|code)
+		b = binary.BigEndian.AppendUint32(b, math.Float32bits(v.Value))
+	}
+	return b, nil
+}
+
+func decodeTelemetry(b []byte) (Payload, error) {
+	if len(b) < telemetryHeader {
+		return nil, fmt.Errorf("%w; telemetry header", ErrMalformed)
+	}
+
+	t := &Telemetry{Time: time.Unix(int64(binary.BigEndian.Uint32(b)), 0)}
+	count := int(b[4])
+	b = b[telemetryHeader:]
+
+	if len(b) != count*valueSize {
+		return nil, fmt.Errorf("%w; %d values in %d bytes", ErrMalformed, count, len(b))
+	}
+
+	t.Values = make([]Value, count)
+	for i := range t.Values {
+		v := b[i*valueSize:]
+
+		code := v[1] & 0x3F
+		if int(code) >= len(quantities) || code == 0 {
+			return nil, fmt.Errorf("%w; quantity code %d", ErrMalformed, code)
+		}
+
+		t.Values[i] = Value{
+			Sensor:   v[0],
+			Quantity: quantities[code],
+			Quality:  sensors.Quality(v[1] >> 6),
+			Value:    math.Float32frombits(binary.BigEndian.Uint32(v[2:])),
+		}
+	}
+	return t, nil
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Ack ===
+// ------------------------------------------------------------------------
+type AckStatus uint8
+
+const (
+	AckOK AckStatus = iota
+	AckUnknownCommand
+	AckInvalidValue
+)
+
+// Ack confirms the packet with Sequence from the station it is addressed to
+type Ack struct {
+	Sequence uint16
+	Status   AckStatus
+}
+
+func (a *Ack) Type() Type {
+	return TypeAck
+}
+
+func (a *Ack) AppendBinary(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, a.Sequence)
+	return append(b, uint8(a.Status)), nil
+}
+
+func decodeAck(b []byte) (Payload, error) {
+	if len(b) != 3 {
+		return nil, fmt.Errorf("%w; ack is %d bytes", ErrMalformed, len(b))
+	}
+	return &Ack{Sequence: binary.BigEndian.Uint16(b), Status: AckStatus(b[2])}, nil
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Command ===
+// ------------------------------------------------------------------------
+
+// Command sets a config value; Key is the YAML path, e.g. station.interval
+type Command struct {
+	Key   string
+	Value string
+}
+
+func (c *Command) Type() Type {
+	return TypeCommand
+}
+
+func (c *Command) AppendBinary(b []byte) ([]byte, error) {
+	if len(c.Key) == 0 || len(c.Key) > math.MaxUint8 {
+		return nil, fmt.Errorf("[ PACKET ] Command key length %d out of range; 1 - 255", len(c.Key))
+	}
+
+	b = append(b, uint8(len(c.Key)))
+	b = append(b, c.Key...)
+	return append(b, c.Value...), nil
+}
+
+func decodeCommand(b []byte) (Payload, error) {
+	if len(b) < 1 || b[0] == 0 || len(b) < 1+int(b[0]) {
+		return nil, fmt.Errorf("%w; command key", ErrMalformed)
+	}
+
+	n := 1 + int(b[0])
+	return &Command{Key: string(b[1:n]), Value: string(b[n:])}, nil
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Beacon ===
+// ------------------------------------------------------------------------
+
+// Beacon announces a station; Sensors maps Value.Sensor indexes to sensor IDs
+type Beacon struct {
+	Uptime  time.Duration // Second resolution
+	Sensors []string
+}
+
+func (bc *Beacon) Type() Type {
+	return TypeBeacon
+}
+
+func (bc *Beacon) AppendBinary(b []byte) ([]byte, error) {
+	if len(bc.Sensors) > math.MaxUint8 {
+		return nil, fmt.Errorf("%w; %d sensors", ErrTooLarge, len(bc.Sensors))
+	}
+
+	b = binary.BigEndian.AppendUint32(b, uint32(bc.Uptime/time.Second))
+	b = append(b, uint8(len(bc.Sensors)))
+
+	for _, id := range bc.Sensors {
+		if len(id) > math.MaxUint8 {
+			return nil, fmt.Errorf("[ PACKET ] Sensor ID %q too long", id)
+		}
+		b = append(b, uint8(len(id)))
+		b = append(b, id...)
+	}
+	return b, nil
+}
+
+func decodeBeacon(b []byte) (Payload, error) {
+	if len(b) < 5 {
+		return nil, fmt.Errorf("%w; beacon header", ErrMalformed)
+	}
+
+	bc := &Beacon{Uptime: time.Duration(binary.BigEndian.Uint32(b)) * time.Second}
+	count := int(b[4])
+	b = b[5:]
+
+	bc.Sensors = make([]string, 0, count)
+	for range count {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return nil, fmt.Errorf("%w; beacon sensor list", ErrMalformed)
+		}
+		n := 1 + int(b[0])
+		bc.Sensors = append(bc.Sensors, string(b[1:n]))
+		b = b[n:]
+	}
+
+	if len(b) != 0 {
+		return nil, fmt.Errorf("%w; %d trailing bytes", ErrMalformed, len(b))
+	}
+	return bc, nil
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Fragment ===
+// ------------------------------------------------------------------------
+
+// FragmentOverhead is what every fragment frame spends on headers
+const FragmentOverhead = HeaderSize + 2
+
+// Fragment is one part of a message larger than the payload length. The header
+// Sequence is the one of the message; Data of all fragments in Index order is the
+// encoded message packet.
+type Fragment struct {
+	Index uint8
+	Count uint8
+	Data  []byte
+}
+
+func (f *Fragment) Type() Type {
+	return TypeFragment
+}
+
+func (f *Fragment) AppendBinary(b []byte) ([]byte, error) {
+	if f.Count == 0 || f.Index >= f.Count {
+		return nil, fmt.Errorf("[ PACKET ] Fragment %d of %d out of range", f.Index, f.Count)
+	}
+
+	b = append(b, f.Index, f.Count)
+	return append(b, f.Data...), nil
+}
+
+func decodeFragment(b []byte) (Payload, error) {
+	if len(b) < 2 || b[1] == 0 || b[0] >= b[1] {
+		return nil, fmt.Errorf("%w; fragment header", ErrMalformed)
+	}
+	return &Fragment{Index: b[0], Count: b[1], Data: append([]byte(nil), b[2:]...)}, nil
+}
+
+// FragmentRequest asks the source of a message, by header Sequence, to send the
+// listed fragments again
+type FragmentRequest struct {
+	Missing []uint8
+}
+
+func (f *FragmentRequest) Type() Type {
+	return TypeFragmentRequest
+}
+
+func (f *FragmentRequest) AppendBinary(b []byte) ([]byte, error) {
+	if len(f.Missing) == 0 {
+		return nil, fmt.Errorf("[ PACKET ] Fragment request state improper; nothing missing")
+	}
+	return append(b, f.Missing...), nil
+}
+
+func decodeFragmentRequest(b []byte) (Payload, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%w; empty fragment request", ErrMalformed)
+	}
+	return &FragmentRequest{Missing: append([]uint8(nil), b...)}, nil
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = ADR ===
+// ------------------------------------------------------------------------
+
+// ADR carries data rate settings. From the gateway it tells a station what to
+// use from now on; from a station it reports what it uses after falling back.
+type ADR struct {
+	SpreadingFactor uint8
+	TxPower         int8 // dBm
+}
+
+func (a *ADR) Type() Type {
+	return TypeADR
+}
+
+func (a *ADR) AppendBinary(b []byte) ([]byte, error) {
+	return append(b, a.SpreadingFactor, uint8(a.TxPower)), nil
+}
+
+func decodeADR(b []byte) (Payload, error) {
+	if len(b) != 2 {
+		return nil, fmt.Errorf("%w; adr is %d bytes", ErrMalformed, len(b))
+	}
+	return &ADR{SpreadingFactor: b[0], TxPower: int8(b[1])}, nil
+}
+
+// ------------------------------------------------------------------------
@@ -0,0 +1,424 @@
+package lora
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/lora/packet"
+)
+
+var ErrNoAck = errors.New("[ LoRa ] No ACK received")
+
+const (
+	// Receiver decoding the packet and switching the modem from Rx to Tx
+	ackTurnaround = 200 * time.Millisecond
+	// Sequence numbers wrap, a (source, sequence) pair is only a duplicate for so long
+	dedupTTL = 10 * time.Minute
+	// A sequence further than this from the last one of its source means the source rebooted
+	restartWindow = 256
+	// Packets waiting for Rx before new ones are dropped
+	rxBacklog = 16
+	// Largest frame the SX126x can send, ACKs always fit
+	maxFrame = 255
+)
+
+// Link is satisfied by *Node and by the layers stacked on top of it
+type Link interface {
+	Tx(data []uint8) error
+	Rx(timeout time.Duration) ([]uint8, error)
+	TimeOnAir(payload int) time.Duration
+	MTU() int
+}
+
+// Delivery is the future of a single Send; Err and Status are valid once Done is closed.
+type Delivery struct {
+	Sequence    uint16
+	Destination packet.Address
+
+	done     chan struct{}
+	err      error
+	attempts int
+	status   packet.AckStatus
+}
+
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err is nil when the packet was acknowledged, or sent at all for broadcasts
+func (d *Delivery) Err() error {
+	return d.err
+}
+
+func (d *Delivery) Attempts() int {
+	return d.attempts
+}
+
+func (d *Delivery) Status() packet.AckStatus {
+	return d.status
+}
+
+func (d *Delivery) Wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.done:
+		return d.err
+	}
+}
+
+type ReliableOption func(*Reliable)
+
+// WithDeliveryHandler is called once for every Send, after its Delivery is done
+func WithDeliveryHandler(h func(d *Delivery)) ReliableOption {
+	return func(r *Reliable) { r.onDelivery = h }
+}
+
+// WithChannelAccess stretches the ACK window by the longest the receiver's listen before
+// talk and duty cycle delay may hold its ACK back; the network shares these settings.
+func WithChannelAccess(lbt *config.LBT, duty *config.DutyCycle) ReliableOption {
+	return func(r *Reliable) {
+		r.ackDelay = lbtDelay(lbt)
+		if duty != nil && duty.Enable && duty.Delay {
+			r.ackDelay += duty.MaxDelay
+		}
+	}
+}
+
+type peerSequence struct {
+	peer     packet.Address
+	sequence uint16
+}
+
+// Reliable adds ACKs, retries and duplicate suppression on top of a Link. Unicast packets
+// get FlagAckRequest and are retried until the destination acknowledges them; broadcasts
+// and ACKs are sent once. Received packets come out of Rx without duplicates.
+type Reliable struct {
+	link       Link
+	cfg        *config.Link
+	address    packet.Address
+	onDelivery func(d *Delivery)
+	ackDelay   time.Duration // Receiver's channel access on top of the ACK window
+
+	mu      sync.Mutex
+	pending map[peerSequence]chan *packet.Ack
+	seen    map[peerSequence]time.Time
+	latest  sequences
+	rx      chan []uint8
+}
+
+func NewReliable(link Link, cfg *config.Link, address packet.Address, opts ...ReliableOption) (*Reliable, error) {
+	log := slog.With("func", "NewReliable()", "params", "(Link, *config.Link, packet.Address, ...ReliableOption)", "return", "(*Reliable, error)", "package", "lora")
+	log.Info("[ LoRa ] Reliable link constructor", "address", address)
+
+	if cfg == nil {
+		return nil, fmt.Errorf("LoRa link state improper; cfg is nil")
+	}
+	if link == nil || reflect.ValueOf(link).IsNil() {
+		return nil, fmt.Errorf("LoRa link state improper; link is nil")
+	}
+
+	r := &Reliable{
+		link:    link,
+		cfg:     cfg,
+		address: address,
+		onDelivery: func(d *Delivery) {
+			slog.Debug("[ LoRa ] Delivery done", "sequence", d.Sequence, "destination", d.Destination, "attempts", d.attempts, "error", d.err, "package", "lora")
+		},
+		pending: make(map[peerSequence]chan *packet.Ack),
+		seen:    make(map[peerSequence]time.Time),
+		latest:  make(sequences),
+		rx:      make(chan []uint8, rxBacklog),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r, nil
+}
+
+// Send transmits a packet encoded with the packet codec and returns at once.
+// Data that isn't a valid packet fails the Delivery right away.
+func (r *Reliable) Send(ctx context.Context, data []uint8) *Delivery {
+	d := &Delivery{done: make(chan struct{})}
+
+	h, err := packet.DecodeHeader(data)
+	if err != nil {
+		r.finish(d, err)
+		return d
+	}
+	d.Sequence, d.Destination = h.Sequence, h.Destination
+
+	if r.cfg.Reliable == false || h.Destination == packet.Broadcast || h.Type == packet.TypeAck {
+		d.attempts = 1
+		r.finish(d, r.link.Tx(data))
+		return d
+	}
+
+	data = slices.Clone(data)
+	data[1] |= uint8(packet.FlagAckRequest)
+
+	key := peerSequence{h.Destination, h.Sequence}
+	acks := make(chan *packet.Ack, 1)
+
+	r.mu.Lock()
+	r.pending[key] = acks
+	r.mu.Unlock()
+
+	go r.deliver(ctx, d, data, key, acks)
+	return d
+}
+
+func (r *Reliable) deliver(ctx context.Context, d *Delivery, data []uint8, key peerSequence, acks <-chan *packet.Ack) {
+	log := slog.With("func", "Reliable.deliver()", "params", "(context.Context, *Delivery, []uint8, peerSequence, <-chan *packet.Ack)", "return", "(-)", "package", "lora")
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, key)
+		r.mu.Unlock()
+	}()
+
+	// Own frame, then the ACK frame, then the receiver turning around and getting on the air
+	window := r.link.TimeOnAir(len(data)) + r.link.TimeOnAir(packet.HeaderSize+3) + ackTurnaround + r.ackDelay
+
+	for attempt := 0; attempt <= int(r.cfg.Retries); attempt++ {
+		if attempt > 0 {
+			wait := backoff(r.cfg.Backoff, attempt)
+			log.Debug("[ LoRa ] No ACK, retrying", "sequence", d.Sequence, "attempt", attempt, "backoff", wait)
+
+			if err := sleep(ctx, wait); err != nil {
+				r.finish(d, err)
+				return
+			}
+		}
+
+		d.attempts++
+		if err := r.link.Tx(data); err != nil {
+			log.Warn("[ LoRa ] Transmission failure", "sequence", d.Sequence, "error", err)
+			continue
+		}
+
+		timer := time.NewTimer(window)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			r.finish(d, ctx.Err())
+			return
+		case ack := <-acks:
+			timer.Stop()
+			d.status = ack.Status
+			r.finish(d, nil)
+			return
+		case <-timer.C:
+		}
+	}
+
+	r.finish(d, fmt.Errorf("%w; sequence %d after %d attempts", ErrNoAck, d.Sequence, d.attempts))
+}
+
+// backoff doubles with every attempt and is spread by ±50%, so two stations that
+// collided once don't collide on every retry
+func backoff(base time.Duration, attempt int) time.Duration {
+	base <<= attempt - 1
+	return time.Duration(float64(base) * (0.5 + rand.Float64()))
+}
+
+func (r *Reliable) finish(d *Delivery, err error) {
+	d.err = err
+	close(d.done)
+	r.onDelivery(d)
+}
+
+// Tx sends data and blocks until it is acknowledged or the retries run out
+func (r *Reliable) Tx(data []uint8) error {
+	return r.Send(context.Background(), data).Wait(context.Background())
+}
+
+func (r *Reliable) TimeOnAir(payload int) time.Duration {
+	return r.link.TimeOnAir(payload)
+}
+
+func (r *Reliable) MTU() int {
+	return r.link.MTU()
+}
+
+// Rx returns the next received packet that isn't an ACK or a duplicate
+func (r *Reliable) Rx(timeout time.Duration) ([]uint8, error) {
+	return dequeue(r.rx, timeout)
+}
+
+// Run owns the Link's receive side until ctx is cancelled; Rx only works while it runs.
+func (r *Reliable) Run(ctx context.Context) error {
+	log := slog.With("func", "Reliable.Run()", "params", "(context.Context)", "return", "(error)", "package", "lora")
+	log.Info("[ LoRa ] Reliable link event loop")
+
+	if ctx == nil {
+		return fmt.Errorf("LoRa link state improper; ctx is nil")
+	}
+
+	for ctx.Err() == nil {
+		payload, err := r.link.Rx(time.Second)
+		if err != nil || len(payload) == 0 {
+			continue
+		}
+		r.handle(payload)
+	}
+	return nil
+}
+
+func (r *Reliable) handle(payload []uint8) {
+	log := slog.With("func", "Reliable.handle()", "params", "([]uint8)", "return", "(-)", "package", "lora")
+
+	h, err := packet.DecodeHeader(payload)
+	if err != nil {
+		// Not a packet, let the application decide
+		enqueue(r.rx, payload)
+		return
+	}
+
+	if h.Destination != r.address && h.Destination != packet.Broadcast {
+		log.Debug("[ LoRa ] Packet for another station", "destination", h.Destination)
+		return
+	}
+
+	if h.Type == packet.TypeAck {
+		p, err := packet.Decode(payload)
+		if err != nil {
+			log.Debug("[ LoRa ] Malformed ACK", "source", h.Source, "error", err)
+			return
+		}
+		ack := p.Payload.(*packet.Ack)
+
+		r.mu.Lock()
+		acks, ok := r.pending[peerSequence{h.Source, ack.Sequence}]
+		r.mu.Unlock()
+
+		if ok {
+			select {
+			case acks <- ack:
+			default: // Already acknowledged
+			}
+		}
+		return
+	}
+
+	// Duplicates are acknowledged again, the first ACK may be what got lost
+	if h.Flags.Has(packet.FlagAckRequest) && h.Destination == r.address {
+		r.ack(h)
+	}
+
+	if r.duplicate(h) {
+		log.Debug("[ LoRa ] Duplicate packet dropped", "source", h.Source, "sequence", h.Sequence)
+		return
+	}
+	enqueue(r.rx, payload)
+}
+
+func (r *Reliable) ack(h packet.Header) {
+	log := slog.With("func", "Reliable.ack()", "params", "(packet.Header)", "return", "(-)", "package", "lora")
+
+	data, err := packet.Encode(packet.Packet{
+		Header:  packet.Header{Source: r.address, Destination: h.Source, Sequence: h.Sequence},
+		Payload: &packet.Ack{Sequence: h.Sequence, Status: packet.AckOK},
+	}, maxFrame)
+	if err == nil {
+		err = r.link.Tx(data)
+	}
+	if err != nil {
+		log.Warn("[ LoRa ] Could not send ACK", "destination", h.Source, "sequence", h.Sequence, "error", err)
+	}
+}
+
+func (r *Reliable) duplicate(h packet.Header) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for key, at := range r.seen {
+		if now.Sub(at) > dedupTTL {
+			delete(r.seen, key)
+		}
+	}
+
+	if r.latest.restarted(h) {
+		slog.Debug("[ LoRa ] Source restarted, its sequences are forgotten", "source", h.Source, "sequence", h.Sequence, "package", "lora")
+		for key := range r.seen {
+			if key.peer == h.Source {
+				delete(r.seen, key)
+			}
+		}
+	}
+
+	key := peerSequence{h.Source, h.Sequence}
+	if _, ok := r.seen[key]; ok {
+		return true
+	}
+	r.seen[key] = now
+	return false
+}
+
+// sequences is the latest sequence of every source, kept apart for the two halves
+// of the sequence space: stations count telemetry in the lower one and ADR reports
+// in the upper one, see adrSequenceBase.
+type sequences map[peerSequence]uint16
+
+// restarted tells whether h jumps away from the sequences its source used so far. Sources
+// start from a random sequence on every boot, so the (source, sequence) pairs kept from
+// before describe other packets than the ones with the same sequence after it.
+func (s sequences) restarted(h packet.Header) bool {
+	key := peerSequence{h.Source, h.Sequence & adrSequenceBase}
+	latest, ok := s[key]
+	if ok == false {
+		s[key] = h.Sequence
+		return false
+	}
+
+	// Distance within the 15 bit half; retries and reordering go a few steps back
+	distance := int16((h.Sequence-latest)<<1) >> 1
+	if distance <= 0 && distance > -restartWindow {
+		return false
+	}
+	s[key] = h.Sequence
+	return distance > restartWindow || distance <= -restartWindow
+}
+
+// enqueue hands a received packet to Rx without ever blocking the receive loop
+func enqueue(rx chan<- []uint8, payload []uint8) {
+	select {
+	case rx <- payload:
+	default:
+		slog.Warn("[ LoRa ] Rx backlog full, packet dropped", "size", len(payload), "package", "lora")
+	}
+}
+
+func dequeue(rx <-chan []uint8, timeout time.Duration) ([]uint8, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case payload := <-rx:
+		return payload, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("[ LoRa ] Nothing received in %s", timeout)
+	}
+}
+
+// sleep blocks for d or until ctx is cancelled
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
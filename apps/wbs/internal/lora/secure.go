@@ -0,0 +1,313 @@
+package lora
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/lora/packet"
+)
+
+const (
+	counterSize = 4
+	// Frame counter and CCM tag added to every frame
+	secureOverhead = counterSize + ccmTagSize
+	// Counters are saved this far ahead; after a crash a station skips at most as many Tx
+	// counters and the receiver drops at most as many frames per source, none is reused
+	counterReserve = 64
+)
+
+// SecureStats are running totals since the Secure layer was created
+type SecureStats struct {
+	Sent         uint64
+	Received     uint64
+	AuthFailures uint64 // Unencrypted, malformed or forged frames
+	Replays      uint64 // Authentic frames with an old counter
+}
+
+// counterState is the counter file; Tx is the first counter not yet handed out,
+// Rx the last one accepted from every source. Both may be ahead, see counterReserve.
+type counterState struct {
+	Tx uint32                    `json:"tx"`
+	Rx map[packet.Address]uint32 `json:"rx"`
+}
+
+// Secure encrypts and authenticates every frame with AES-CCM and the network_secret.
+// The packet header stays readable but is authenticated, the payload is encrypted.
+// Every frame carries the source's frame counter, which makes the nonce unique and
+// lets receivers drop replays; both survive restarts through counter_file.
+//
+//	[ header 8 ][ counter 4 ][ ciphertext ][ tag 8 ]
+type Secure struct {
+	link Link
+	cfg  *config.Link
+	aead cipher.AEAD
+
+	mu       sync.Mutex
+	tx       uint32 // Next Tx counter
+	reserved uint32 // Tx counters below are saved as used
+	last     map[packet.Address]uint32
+	floor    map[packet.Address]uint32 // Rx counters up to these are saved as seen
+	rx       chan []uint8
+
+	sent, received, authFailures, replays atomic.Uint64
+}
+
+func NewSecure(link Link, cfg *config.Link) (*Secure, error) {
+	log := slog.With("func", "NewSecure()", "params", "(Link, *config.Link)", "return", "(*Secure, error)", "package", "lora")
+	log.Info("[ LoRa ] Secure link constructor")
+
+	if cfg == nil {
+		return nil, fmt.Errorf("LoRa link state improper; cfg is nil")
+	}
+	if link == nil || reflect.ValueOf(link).IsNil() {
+		return nil, fmt.Errorf("LoRa link state improper; link is nil")
+	}
+
+	key, err := hex.DecodeString(cfg.NetworkSecret)
+	if err != nil {
+		return nil, fmt.Errorf("[ LoRa ] network_secret is not a hex string")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("[ LoRa ] network_secret is no AES key: %w", err)
+	}
+	aead, err := newCCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := loadCounters(cfg.CounterFile)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("[ LoRa ] Frame counters loaded", "file", cfg.CounterFile, "tx", state.Tx, "sources", len(state.Rx))
+
+	return &Secure{
+		link:     link,
+		cfg:      cfg,
+		aead:     aead,
+		tx:       state.Tx,
+		reserved: state.Tx,
+		last:     state.Rx,
+		floor:    maps.Clone(state.Rx),
+		rx:       make(chan []uint8, rxBacklog),
+	}, nil
+}
+
+func loadCounters(path string) (counterState, error) {
+	state := counterState{Rx: make(map[packet.Address]uint32)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("[ LoRa ] Could not read counter file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("[ LoRa ] Corrupted counter file %s: %w", path, err)
+	}
+	if state.Rx == nil {
+		state.Rx = make(map[packet.Address]uint32)
+	}
+	return state, nil
+}
+
+// save writes the counters through a temporary file, so a crash never leaves half a file
+// behind; s.mu must be held.
+func (s *Secure) save() error {
+	data, err := json.Marshal(counterState{Tx: s.reserved, Rx: s.floor})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.cfg.CounterFile), filepath.Base(s.cfg.CounterFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.cfg.CounterFile)
+}
+
+// nextCounter hands out a Tx counter; a new block is saved before its first counter is used
+func (s *Secure) nextCounter() (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tx == math.MaxUint32 {
+		return 0, fmt.Errorf("[ LoRa ] Frame counters used up; change network_secret and delete %s", s.cfg.CounterFile)
+	}
+
+	if s.tx >= s.reserved {
+		s.reserved = uint32(min(uint64(s.tx)+counterReserve, math.MaxUint32))
+		if err := s.save(); err != nil {
+			return 0, fmt.Errorf("[ LoRa ] Could not save frame counter: %w", err)
+		}
+	}
+
+	counter := s.tx
+	s.tx++
+	return counter, nil
+}
+
+// nonce is unique as long as every station has its own address and counters never repeat
+func nonce(source packet.Address, counter uint32) []byte {
+	n := make([]byte, ccmNonceSize)
+	binary.BigEndian.PutUint16(n, uint16(source))
+	binary.BigEndian.PutUint32(n[2:], counter)
+	return n
+}
+
+// MTU leaves room for the counter and the tag
+func (s *Secure) MTU() int {
+	return s.link.MTU() - secureOverhead
+}
+
+func (s *Secure) TimeOnAir(payload int) time.Duration {
+	return s.link.TimeOnAir(payload + secureOverhead)
+}
+
+func (s *Secure) Stats() SecureStats {
+	return SecureStats{
+		Sent:         s.sent.Load(),
+		Received:     s.received.Load(),
+		AuthFailures: s.authFailures.Load(),
+		Replays:      s.replays.Load(),
+	}
+}
+
+func (s *Secure) Tx(data []uint8) error {
+	h, err := packet.DecodeHeader(data)
+	if err != nil {
+		return fmt.Errorf("[ LoRa ] Only packets can be encrypted: %w", err)
+	}
+	if len(data) > s.MTU() {
+		return fmt.Errorf("[ LoRa ] Packet of %d bytes larger than %d with encryption", len(data), s.MTU())
+	}
+
+	counter, err := s.nextCounter()
+	if err != nil {
+		return err
+	}
+
+	frame := slices.Clone(data[:packet.HeaderSize])
+	frame[1] |= uint8(packet.FlagEncrypted)
+	frame = binary.BigEndian.AppendUint32(frame, counter)
+	frame = s.aead.Seal(frame, nonce(h.Source, counter), data[packet.HeaderSize:], frame)
+
+	if err := s.link.Tx(frame); err != nil {
+		return err
+	}
+	s.sent.Add(1)
+	return nil
+}
+
+// Rx returns the next authentic packet, decrypted and with FlagEncrypted cleared
+func (s *Secure) Rx(timeout time.Duration) ([]uint8, error) {
+	return dequeue(s.rx, timeout)
+}
+
+// Run owns the Link's receive side until ctx is cancelled; Rx only works while it runs.
+func (s *Secure) Run(ctx context.Context) error {
+	log := slog.With("func", "Secure.Run()", "params", "(context.Context)", "return", "(error)", "package", "lora")
+	log.Info("[ LoRa ] Secure link event loop")
+
+	if ctx == nil {
+		return fmt.Errorf("LoRa link state improper; ctx is nil")
+	}
+
+	for ctx.Err() == nil {
+		payload, err := s.link.Rx(time.Second)
+		if err != nil || len(payload) == 0 {
+			continue
+		}
+		s.handle(payload)
+	}
+
+	// A clean stop saves the exact Rx counters, no frame is dropped after the restart
+	s.mu.Lock()
+	s.floor = maps.Clone(s.last)
+	err := s.save()
+	s.mu.Unlock()
+	if err != nil {
+		log.Warn("[ LoRa ] Could not save frame counters", "error", err)
+	}
+	return nil
+}
+
+func (s *Secure) handle(payload []uint8) {
+	log := slog.With("func", "Secure.handle()", "params", "([]uint8)", "return", "(-)", "package", "lora")
+
+	h, err := packet.DecodeHeader(payload)
+	if err != nil || h.Flags.Has(packet.FlagEncrypted) == false || len(payload) < packet.HeaderSize+secureOverhead {
+		s.authFailures.Add(1)
+		log.Warn("[ LoRa ] Unencrypted frame dropped", "size", len(payload), "auth_failures", s.authFailures.Load())
+		return
+	}
+
+	aad := payload[:packet.HeaderSize+counterSize]
+	counter := binary.BigEndian.Uint32(payload[packet.HeaderSize:])
+
+	plaintext, err := s.aead.Open(nil, nonce(h.Source, counter), payload[len(aad):], aad)
+	if err != nil {
+		s.authFailures.Add(1)
+		log.Warn("[ LoRa ] Frame failed authentication, dropped", "source", h.Source, "counter", counter, "auth_failures", s.authFailures.Load())
+		return
+	}
+
+	// Only authentic frames move the counter, a forged one can't lock a source out
+	s.mu.Lock()
+	last, seen := s.last[h.Source]
+	if seen && counter <= last {
+		s.mu.Unlock()
+		s.replays.Add(1)
+		log.Warn("[ LoRa ] Replayed frame dropped", "source", h.Source, "counter", counter, "last", last, "replays", s.replays.Load())
+		return
+	}
+	s.last[h.Source] = counter
+
+	// Like Tx, a block of counters is saved ahead instead of every frame
+	if floor, ok := s.floor[h.Source]; ok == false || counter > floor {
+		s.floor[h.Source] = uint32(min(uint64(counter)+counterReserve, math.MaxUint32))
+		err = s.save()
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		log.Warn("[ LoRa ] Could not save frame counter", "error", err)
+	}
+
+	s.received.Add(1)
+	header := slices.Clone(payload[:packet.HeaderSize])
+	header[1] &^= uint8(packet.FlagEncrypted)
+	enqueue(s.rx, append(header, plaintext...))
+}
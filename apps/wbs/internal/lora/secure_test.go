@@ -0,0 +1,222 @@
+package lora
+
+import (
+	"context"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/lora/packet"
+)
+
+// pipe is a Link whose Tx comes out of its own Rx
+type pipe struct {
+	frames chan []uint8
+}
+
+func newPipe() *pipe {
+	return &pipe{frames: make(chan []uint8, rxBacklog)}
+}
+
+func (p *pipe) Tx(data []uint8) error {
+	p.frames <- data
+	return nil
+}
+
+func (p *pipe) Rx(timeout time.Duration) ([]uint8, error) {
+	return dequeue(p.frames, timeout)
+}
+
+func (p *pipe) TimeOnAir(payload int) time.Duration {
+	return 0
+}
+
+func (p *pipe) MTU() int {
+	return 64
+}
+
+func secureConfig(t *testing.T, name string) *config.Link {
+	return &config.Link{
+		Encrypt:       true,
+		NetworkSecret: "000102030405060708090A0B0C0D0E0F",
+		CounterFile:   filepath.Join(t.TempDir(), name),
+	}
+}
+
+func newSecure(t *testing.T, cfg *config.Link) (*Secure, *pipe) {
+	t.Helper()
+
+	link := newPipe()
+	s, err := NewSecure(link, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, link
+}
+
+// sealed sends a packet from 1 to 2 through s and returns the encrypted frame
+func sealed(t *testing.T, s *Secure, link *pipe, sequence uint16) []uint8 {
+	t.Helper()
+
+	data, err := packet.Encode(packet.Packet{
+		Header:  packet.Header{Source: 1, Destination: 2, Sequence: sequence},
+		Payload: &packet.Command{Key: "interval", Value: "60s"},
+	}, s.MTU())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Tx(data); err != nil {
+		t.Fatal(err)
+	}
+
+	frame, err := link.Rx(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func counter(frame []uint8) uint32 {
+	return binary.BigEndian.Uint32(frame[packet.HeaderSize:])
+}
+
+// accepted hands frame to s and reports whether it came out of Rx
+func accepted(s *Secure, frame []uint8) bool {
+	s.handle(frame)
+	_, err := s.Rx(10 * time.Millisecond)
+	return err == nil
+}
+
+func TestSecureRoundTrip(t *testing.T) {
+	station, link := newSecure(t, secureConfig(t, "station.json"))
+	gateway, _ := newSecure(t, secureConfig(t, "gateway.json"))
+
+	frame := sealed(t, station, link, 7)
+	gateway.handle(frame)
+
+	data, err := gateway.Rx(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := packet.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Sequence != 7 || p.Flags.Has(packet.FlagEncrypted) {
+		t.Errorf("received %+v, want sequence 7 without FlagEncrypted", p.Header)
+	}
+	if cmd, ok := p.Payload.(*packet.Command); !ok || cmd.Value != "60s" {
+		t.Errorf("payload %+v", p.Payload)
+	}
+}
+
+func TestSecureTamper(t *testing.T) {
+	station, link := newSecure(t, secureConfig(t, "station.json"))
+	gateway, _ := newSecure(t, secureConfig(t, "gateway.json"))
+
+	tests := []struct {
+		name   string
+		tamper func(frame []uint8)
+	}{
+		{"header", func(frame []uint8) { frame[7] ^= 0x01 }},
+		{"counter", func(frame []uint8) { frame[packet.HeaderSize+3] ^= 0x01 }},
+		{"payload", func(frame []uint8) { frame[packet.HeaderSize+counterSize] ^= 0x01 }},
+		{"tag", func(frame []uint8) { frame[len(frame)-1] ^= 0x01 }},
+		{"unencrypted", func(frame []uint8) { frame[1] &^= uint8(packet.FlagEncrypted) }},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := sealed(t, station, link, uint16(i))
+			tt.tamper(frame)
+
+			if accepted(gateway, frame) {
+				t.Error("tampered frame accepted")
+			}
+		})
+	}
+
+	if got := gateway.Stats().AuthFailures; got != uint64(len(tests)) {
+		t.Errorf("%d authentication failures, want %d", got, len(tests))
+	}
+}
+
+// A frame counter at or below the last accepted one is a replay
+func TestSecureReplay(t *testing.T) {
+	station, link := newSecure(t, secureConfig(t, "station.json"))
+	gateway, _ := newSecure(t, secureConfig(t, "gateway.json"))
+
+	first := sealed(t, station, link, 1)
+	second := sealed(t, station, link, 2)
+
+	if accepted(gateway, second) == false {
+		t.Fatal("second frame dropped")
+	}
+	if accepted(gateway, second) {
+		t.Error("second frame accepted twice")
+	}
+	if accepted(gateway, first) {
+		t.Error("first frame accepted after the second")
+	}
+
+	if stats := gateway.Stats(); stats.Replays != 2 || stats.Received != 1 {
+		t.Errorf("stats %+v, want 1 received, 2 replays", stats)
+	}
+}
+
+// After a restart that wasn't clean a station skips the reserved counters, and the
+// receiver drops what it could have seen before
+func TestSecureCounterReload(t *testing.T) {
+	stationCfg, gatewayCfg := secureConfig(t, "station.json"), secureConfig(t, "gateway.json")
+
+	station, link := newSecure(t, stationCfg)
+	gateway, _ := newSecure(t, gatewayCfg)
+
+	old := sealed(t, station, link, 1)
+	if counter(old) != 0 || accepted(gateway, old) == false {
+		t.Fatalf("first frame with counter %d dropped", counter(old))
+	}
+
+	station, link = newSecure(t, stationCfg)
+	gateway, _ = newSecure(t, gatewayCfg)
+
+	frame := sealed(t, station, link, 2)
+	if counter(frame) != counterReserve {
+		t.Errorf("counter %d after reload, want %d", counter(frame), counterReserve)
+	}
+	if accepted(gateway, old) {
+		t.Error("frame from before the reload accepted")
+	}
+
+	// The gateway keeps its whole reserve too, the station's next frame is past it
+	if next := sealed(t, station, link, 3); accepted(gateway, next) == false {
+		t.Errorf("frame with counter %d dropped", counter(next))
+	}
+}
+
+// A clean stop saves the exact Rx counters; after the restart the next frame of a source
+// is accepted, not dropped as if the whole reserve had been seen
+func TestSecureCleanStop(t *testing.T) {
+	station, link := newSecure(t, secureConfig(t, "station.json"))
+	gatewayCfg := secureConfig(t, "gateway.json")
+	gateway, gatewayLink := newSecure(t, gatewayCfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { gateway.Run(ctx); close(done) }()
+
+	for sequence := uint16(1); sequence <= 2; sequence++ {
+		gatewayLink.Tx(sealed(t, station, link, sequence))
+		if _, err := gateway.Rx(time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	<-done
+
+	gateway, _ = newSecure(t, gatewayCfg)
+	if next := sealed(t, station, link, 3); accepted(gateway, next) == false {
+		t.Errorf("frame with counter %d dropped after a clean restart", counter(next))
+	}
+}
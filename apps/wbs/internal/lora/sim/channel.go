@@ -0,0 +1,250 @@
+// Package sim is an in-memory SX126x. A Radio implements lora.Transceiver, so lora.Setup,
+// lora.Node and everything stacked on top run without a Raspberry Pi, an SX1262 or SPI.
+// Radios created from the same Channel hear each other.
+package sim
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+const (
+	// A transmission survives an overlapping one that is weaker by at least this much
+	captureThreshold = 6.0 // dB
+	// Thermal noise density plus a typical SX126x noise figure
+	noiseDensity = -174.0 // dBm/Hz
+	noiseFigure  = 6.0    // dB
+	// Transmissions this old can't overlap anything new anymore
+	historyTTL = time.Minute
+)
+
+// End of a carrier nobody stopped yet
+var farFuture = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type ChannelOption func(*Channel)
+
+// WithLoss drops each delivery with probability p, on top of collisions and weak signals
+func WithLoss(p float64) ChannelOption {
+	return func(c *Channel) { c.loss = p }
+}
+
+// WithLatency delays deliveries after the end of the frame
+func WithLatency(d time.Duration) ChannelOption {
+	return func(c *Channel) { c.latency = d }
+}
+
+// WithPathLoss between any two radios without their own SetPathLoss
+func WithPathLoss(dB float64) ChannelOption {
+	return func(c *Channel) { c.pathLoss = dB }
+}
+
+// WithCollisions off makes overlapping transmissions harmless
+func WithCollisions(enable bool) ChannelOption {
+	return func(c *Channel) { c.collisions = enable }
+}
+
+// WithSeed makes loss decisions repeatable
+func WithSeed(seed uint64) ChannelOption {
+	return func(c *Channel) { c.rand = rand.New(rand.NewPCG(seed, seed)) }
+}
+
+type pair struct {
+	a, b *Radio
+}
+
+// transmission is a frame on the air; CW and infinite preamble end at farFuture until stopped
+type transmission struct {
+	from    *Radio
+	params  airParams
+	power   int8 // dBm
+	payload []uint8
+	start   time.Time
+	end     time.Time
+}
+
+func (t *transmission) overlaps(o *transmission) bool {
+	return t.start.Before(o.end) && o.start.Before(t.end)
+}
+
+// Channel is the shared medium; it decides who hears a transmission and how well
+type Channel struct {
+	mu         sync.Mutex
+	radios     []*Radio
+	air        []*transmission
+	pathLosses map[pair]float64
+
+	loss       float64
+	latency    time.Duration
+	pathLoss   float64 // dB
+	collisions bool
+	rand       *rand.Rand
+}
+
+func NewChannel(opts ...ChannelOption) *Channel {
+	c := &Channel{
+		pathLosses: make(map[pair]float64),
+		pathLoss:   80,
+		collisions: true,
+		rand:       rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// SetPathLoss between two radios, both directions
+func (c *Channel) SetPathLoss(a, b *Radio, dB float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pathLosses[pair{a, b}] = dB
+	c.pathLosses[pair{b, a}] = dB
+}
+
+// rssi of a transmission at a radio; c.mu must be held
+func (c *Channel) rssi(t *transmission, at *Radio) float64 {
+	loss, ok := c.pathLosses[pair{t.from, at}]
+	if !ok {
+		loss = c.pathLoss
+	}
+	return float64(t.power) - loss
+}
+
+func noiseFloor(bandwidth uint32) float64 {
+	return noiseDensity + 10*math.Log10(float64(max(bandwidth, 1))) + noiseFigure
+}
+
+func (c *Channel) attach(r *Radio) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.radios = append(c.radios, r)
+}
+
+// begin puts a frame on the air and schedules its delivery; listeners are fixed at the start,
+// a radio that starts listening mid-frame missed the preamble.
+func (c *Channel) begin(t *transmission) {
+	c.mu.Lock()
+	now := time.Now()
+
+	kept := c.air[:0]
+	for _, o := range c.air {
+		if now.Sub(o.end) < historyTTL {
+			kept = append(kept, o)
+		}
+	}
+	c.air = append(kept, t)
+
+	radios := slices.Clone(c.radios)
+	c.mu.Unlock()
+
+	if t.end.After(now.Add(historyTTL)) {
+		return // Carrier only, nothing to deliver
+	}
+
+	// Radios lock themselves and may call into the channel, so c.mu can't be held here
+	type listener struct {
+		radio *Radio
+		epoch uint64
+	}
+	var listeners []listener
+	for _, r := range radios {
+		if r == t.from {
+			continue
+		}
+		if epoch, ok := r.listening(t.params); ok {
+			listeners = append(listeners, listener{r, epoch})
+		}
+	}
+
+	time.AfterFunc(t.end.Sub(now)+c.latency, func() {
+		for _, l := range listeners {
+			c.deliver(t, l.radio, l.epoch)
+		}
+	})
+}
+
+// stop ends a transmission early, e.g. CW interrupted by another command
+func (c *Channel) stop(t *transmission) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now := time.Now(); t.end.After(now) {
+		t.end = now
+	}
+}
+
+func (c *Channel) deliver(t *transmission, to *Radio, epoch uint64) {
+	c.mu.Lock()
+	rssi := c.rssi(t, to)
+	snr := rssi - noiseFloor(t.params.bandwidth)
+
+	collided := false
+	if c.collisions {
+		for _, o := range c.air {
+			if o == t || o.from == to || o.params.frequency != t.params.frequency || !o.overlaps(t) {
+				continue
+			}
+			if c.rssi(o, to) > rssi-captureThreshold {
+				collided = true
+				break
+			}
+		}
+	}
+	lost := c.loss > 0 && c.rand.Float64() < c.loss
+	c.mu.Unlock()
+
+	switch {
+	case lost, snr < t.params.demodulationLimit():
+		return // Never detected
+	case collided:
+		to.corrupted(epoch)
+	default:
+		to.received(epoch, t.payload, rssi, snr)
+	}
+}
+
+// busy reports whether a matching transmission is on the air at r right now, for CAD
+func (c *Channel) busy(r *Radio, params airParams) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for _, t := range c.air {
+		if t.from == r || t.params.packetType != params.packetType || t.params.frequency != params.frequency {
+			continue
+		}
+		if t.params.packetType == sx126x.PacketTypeLoRa && (t.params.spreadingFactor != params.spreadingFactor || t.params.bandwidth != params.bandwidth) {
+			continue
+		}
+		if now.Before(t.start) || !now.Before(t.end) {
+			continue
+		}
+		if c.rssi(t, r)-noiseFloor(params.bandwidth) >= params.demodulationLimit() {
+			return true
+		}
+	}
+	return false
+}
+
+// rssiAt is the strongest signal on the frequency at r right now, or the noise floor
+func (c *Channel) rssiAt(r *Radio, frequency, bandwidth uint32) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	strongest := noiseFloor(bandwidth)
+	for _, t := range c.air {
+		if t.from == r || t.params.frequency != frequency || now.Before(t.start) || !now.Before(t.end) {
+			continue
+		}
+		strongest = max(strongest, c.rssi(t, r))
+	}
+	return strongest
+}
@@ -0,0 +1,1069 @@
+package sim
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+	"wbs/internal/lora"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+var (
+	_ lora.Transceiver = (*Radio)(nil)
+	_ lora.FrameQueue  = (*Radio)(nil)
+)
+
+// BUSY after a command, roughly as in the SX126x datasheet
+const (
+	busyCommand   = 10 * time.Microsecond
+	busyMode      = 100 * time.Microsecond // Rx / Tx / FS / CAD transitions
+	busyWarmStart = 340 * time.Microsecond
+	busyColdStart = 3500 * time.Microsecond
+	busyCalibrate = 3500 * time.Microsecond
+	busyReset     = 3500 * time.Microsecond
+
+	// SetRx and SetTx timeouts count steps of 15.625 us
+	timeoutStep = 15625 * time.Nanosecond
+
+	xtal = 32_000_000 // Hz
+)
+
+type State uint8
+
+const (
+	StateSleep State = iota
+	StateStandbyRC
+	StateStandbyXOSC
+	StateFS
+	StateRx
+	StateTx
+	StateCAD
+)
+
+func (s State) String() string {
+	switch s {
+	case StateSleep:
+		return "sleep"
+	case StateStandbyRC:
+		return "standby_rc"
+	case StateStandbyXOSC:
+		return "standby_xosc"
+	case StateFS:
+		return "fs"
+	case StateRx:
+		return "rx"
+	case StateTx:
+		return "tx"
+	case StateCAD:
+		return "cad"
+	default:
+		return "unknown"
+	}
+}
+
+// 13.5.1 GetStatus - chip mode
+func (s State) chipMode() uint8 {
+	switch s {
+	case StateStandbyXOSC:
+		return 0x3
+	case StateFS:
+		return 0x4
+	case StateRx, StateCAD:
+		return 0x5
+	case StateTx:
+		return 0x6
+	default:
+		return 0x2
+	}
+}
+
+// 13.5.1 GetStatus - command status
+const (
+	statusDataAvailable = 0x2
+	statusTimeout       = 0x3
+	statusTxDone        = 0x6
+)
+
+// airParams is what a frame is sent with; only matching receivers hear it
+type airParams struct {
+	packetType sx126x.PacketType
+	frequency  uint32
+	bandwidth  uint32 // Hz; GFSK about 2 * deviation + bitrate
+
+	spreadingFactor uint8
+	codingRate      uint8
+	ldro            bool
+	implicit        bool
+	invertedIQ      bool
+
+	bitrate   uint32
+	syncBits  uint8
+	variable  bool
+	crcLength uint8
+
+	preamble      uint16
+	payloadLength uint8
+	crc           bool
+	syncWord      [8]uint8
+}
+
+func (p airParams) matches(o airParams) bool {
+	if p.packetType != o.packetType || p.frequency != o.frequency || p.syncWord != o.syncWord {
+		return false
+	}
+	if p.packetType == sx126x.PacketTypeLoRa {
+		return p.spreadingFactor == o.spreadingFactor && p.bandwidth == o.bandwidth && p.implicit == o.implicit && p.invertedIQ == o.invertedIQ
+	}
+	return p.bitrate == o.bitrate && p.syncBits == o.syncBits && p.variable == o.variable
+}
+
+// demodulationLimit is the lowest SNR a frame is still received with
+func (p airParams) demodulationLimit() float64 {
+	if p.packetType == sx126x.PacketTypeLoRa {
+		return -2.5 * (float64(p.spreadingFactor) - 4) // SF7 -7.5 dB ... SF12 -20 dB
+	}
+	return 10
+}
+
+func (p airParams) timeOnAir(payload int) time.Duration {
+	if p.packetType == sx126x.PacketTypeLoRa {
+		return lora.TimeOnAir(&sx126x.Config{
+			Bandwidth:      p.bandwidth,
+			PreambleLength: p.preamble,
+			LoRa: sx126x.LoRa{
+				SpreadingFactor: p.spreadingFactor,
+				CodingRate:      p.codingRate,
+				LDRO:            p.ldro,
+				HeaderImplicit:  p.implicit,
+				CRC:             p.crc,
+			},
+		}, payload)
+	}
+
+	if p.bitrate == 0 {
+		return 0
+	}
+	bits := int(p.preamble) + int(p.syncBits) + 8*payload + 8*int(p.crcLength)
+	if p.variable {
+		bits += 8
+	}
+	return time.Duration(math.Ceil(float64(bits) / float64(p.bitrate) * float64(time.Second)))
+}
+
+// cadSymbols of SetCadParams as a symbol count
+func cadSymbols(n sx126x.CadSymbolNum) int {
+	return 1 << int(n)
+}
+
+type cadParams struct {
+	symbols sx126x.CadSymbolNum
+	exit    sx126x.CadExitMode
+	timeout uint32
+}
+
+// Radio is one simulated SX126x together with the driver's Tx / Rx queues. Like the driver,
+// it handles TxDone and RxDone itself; every other IRQ is left for GetIrqStatus. Received
+// frames are queued with their packet status, see DequeueFrame.
+type Radio struct {
+	ch  *Channel
+	cfg *sx126x.Config
+
+	mu         sync.Mutex
+	state      State
+	epoch      uint64 // Changes with every state change, a reception must not outlive it
+	continuous bool
+	retain     bool // Warm start keeps the configuration through sleep
+	busyUntil  time.Time
+	closed     bool
+
+	packetType sx126x.PacketType
+	params     airParams
+	cad        cadParams
+	power      int8
+	registers  map[uint16]uint8
+	buffer     [256]uint8
+	txBase     uint8
+	rxBase     uint8
+
+	irq       uint16
+	irqMask   uint16
+	dio1Mask  uint16
+	irqSignal chan struct{}
+
+	commandStatus uint8
+	bufferStatus  sx126x.BufferStatus
+	packetStatus  sx126x.PacketStatus
+	stats         sx126x.PacketStats
+
+	onAir   *transmission
+	txDone  chan struct{}
+	rxTimer *time.Timer
+
+	// Set by the *Config builders and applied by the matching Set*Params
+	pendingModulation *airParams
+	pendingPacket     *airParams
+	pendingCAD        *cadParams
+
+	tx chan []uint8
+	rx chan lora.Frame
+}
+
+// NewRadio attaches a new radio to the channel; cfg only sizes the Tx / Rx queues,
+// the modem itself is configured through the Transceiver methods as on hardware.
+func (c *Channel) NewRadio(cfg *sx126x.Config) *Radio {
+	txSize, rxSize := 10, 10
+	if cfg != nil && cfg.TxQueueSize > 0 {
+		txSize = cfg.TxQueueSize
+	}
+	if cfg != nil && cfg.RxQueueSize > 0 {
+		rxSize = cfg.RxQueueSize
+	}
+
+	r := &Radio{
+		ch:        c,
+		cfg:       cfg,
+		irqSignal: make(chan struct{}, 1),
+		tx:        make(chan []uint8, txSize),
+		rx:        make(chan lora.Frame, rxSize),
+	}
+	r.reset()
+	c.attach(r)
+
+	return r
+}
+
+// reset is the power-on state; r.mu must be held
+func (r *Radio) reset() {
+	r.setState(StateStandbyRC)
+	r.packetType = sx126x.PacketTypeGFSK
+	r.params = airParams{packetType: sx126x.PacketTypeGFSK, preamble: 8}
+	r.cad = cadParams{}
+	r.power = 0
+	r.buffer = [256]uint8{}
+	r.txBase, r.rxBase = 0, 0
+	r.irq, r.irqMask, r.dio1Mask = 0, 0, 0
+	r.registers = map[uint16]uint8{
+		0x0740: 0x14, 0x0741: 0x24, // LoRa sync word, private network
+		0x06BC: 0x1D, 0x06BD: 0x0F, // GFSK CRC seed
+		0x06BE: 0x10, 0x06BF: 0x21, // GFSK CRC polynomial
+	}
+}
+
+// setState leaves the current state; an ongoing reception or carrier ends with it.
+// r.mu must be held.
+func (r *Radio) setState(s State) {
+	if r.onAir != nil && s != StateTx {
+		r.ch.stop(r.onAir)
+		r.onAir = nil
+	}
+	if r.rxTimer != nil {
+		r.rxTimer.Stop()
+		r.rxTimer = nil
+	}
+	r.state = s
+	r.epoch++
+}
+
+func (r *Radio) State() State {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.state
+}
+
+// exec runs a command the way the driver does: wait for BUSY, wake the chip if it
+// sleeps, run it, then hold BUSY for d.
+func (r *Radio) exec(d time.Duration, fn func() error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if wait := time.Until(r.busyUntil); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	if r.state == StateSleep {
+		if r.retain {
+			d += busyWarmStart
+		} else {
+			d += busyColdStart
+			r.reset()
+		}
+		r.buffer = [256]uint8{}
+		r.setState(StateStandbyRC)
+	}
+
+	err := fn()
+	r.busyUntil = time.Now().Add(d)
+	return err
+}
+
+// air are the params a frame would be sent with right now; r.mu must be held
+func (r *Radio) air() airParams {
+	p := r.params
+	p.packetType = r.packetType
+	p.syncWord = [8]uint8{}
+	if r.packetType == sx126x.PacketTypeLoRa {
+		p.syncWord[0], p.syncWord[1] = r.registers[0x0740], r.registers[0x0741]
+	} else {
+		for i := 0; i < int(p.syncBits/8) && i < 8; i++ {
+			p.syncWord[i] = r.registers[0x06C0+uint16(i)]
+		}
+	}
+	return p
+}
+
+func (r *Radio) status() uint8 {
+	return r.state.chipMode()<<4 | r.commandStatus<<1
+}
+
+// raise sets IRQ flags enabled in the mask and wakes WaitForIRQ; r.mu must be held
+func (r *Radio) raise(mask sx126x.IrqMask) {
+	r.irq |= uint16(mask) & r.irqMask
+	if r.irq&r.dio1Mask != 0 {
+		select {
+		case r.irqSignal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// listening reports the epoch of an Rx that hears params; called by the channel
+func (r *Radio) listening(params airParams) (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state != StateRx || !r.air().matches(params) {
+		return 0, false
+	}
+	return r.epoch, true
+}
+
+func (r *Radio) received(epoch uint64, payload []uint8, rssi, snr float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.epoch != epoch || r.state != StateRx {
+		return // Left Rx while the frame was on the air
+	}
+
+	// Fixed length frames carry no length, the receiver takes payload_length bytes
+	data := append([]uint8(nil), payload...)
+	if (r.packetType == sx126x.PacketTypeLoRa && r.params.implicit) || (r.packetType == sx126x.PacketTypeGFSK && !r.params.variable) {
+		data = append(data, make([]uint8, 256)...)[:r.params.payloadLength]
+	}
+
+	r.store(data, rssi, snr)
+	r.raise(sx126x.IrqRxDone)
+
+	if r.continuous == false {
+		r.setState(StateStandbyRC)
+	}
+
+	// The driver's part: hand the payload on with its status and acknowledge RxDone
+	select {
+	case r.rx <- r.frame(data):
+	default:
+	}
+	r.irq &^= uint16(sx126x.IrqRxDone)
+}
+
+// store puts a received frame where the modem keeps it; r.mu must be held
+func (r *Radio) store(data []uint8, rssi, snr float64) {
+	for i, b := range data {
+		r.buffer[(int(r.rxBase)+i)%len(r.buffer)] = b
+	}
+	r.bufferStatus = sx126x.BufferStatus{PayloadLengthRx: uint8(len(data)), RxStartBufferPointer: r.rxBase}
+	// SnrPkt is a signed byte in steps of 0.25 dB; below the noise floor the signal is weaker than the RSSI
+	snr = min(max(snr, -32), 31.75)
+	r.packetStatus = sx126x.PacketStatus{RssiPkt: float32(rssi), SnrPkt: float32(snr), SignalRssiPkt: float32(rssi + min(snr, 0))}
+	r.stats.NbPktReceived++
+	r.commandStatus = statusDataAvailable
+}
+
+// frame is data with the packet status store just latched; r.mu must be held
+func (r *Radio) frame(data []uint8) lora.Frame {
+	return lora.Frame{
+		Payload:    data,
+		RSSI:       r.packetStatus.RssiPkt,
+		SNR:        r.packetStatus.SnrPkt,
+		SignalRSSI: r.packetStatus.SignalRssiPkt,
+		Frequency:  r.params.frequency,
+		Time:       time.Now(),
+	}
+}
+
+func (r *Radio) corrupted(epoch uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.epoch != epoch || r.state != StateRx {
+		return
+	}
+
+	if r.params.crc || r.params.crcLength > 0 {
+		r.stats.NbPktCrcError++
+		r.raise(sx126x.IrqCrcErr)
+	} else {
+		r.stats.NbPktHeaderErr++
+		r.raise(sx126x.IrqHeaderErr)
+	}
+	r.irq &^= uint16(sx126x.IrqCrcErr | sx126x.IrqHeaderErr)
+
+	if r.continuous == false {
+		r.setState(StateStandbyRC)
+	}
+}
+
+// ************************************************************************
+// = 13.1 Operational Modes ===
+// ------------------------------------------------------------------------
+func (r *Radio) SetSleep(mode sx126x.SleepConfig) error {
+	return r.exec(0, func() error {
+		r.retain = mode == sx126x.SleepWarmStart || mode == sx126x.SleepWarmStartRtc
+		r.setState(StateSleep)
+		return nil
+	})
+}
+
+func (r *Radio) SetStandby(mode sx126x.StandbyMode) error {
+	return r.exec(busyCommand, func() error {
+		if mode == sx126x.StandbyXosc {
+			r.setState(StateStandbyXOSC)
+		} else {
+			r.setState(StateStandbyRC)
+		}
+		return nil
+	})
+}
+
+func (r *Radio) SetFs() error {
+	return r.exec(busyMode, func() error {
+		r.setState(StateFS)
+		return nil
+	})
+}
+
+// SetTx sends payload_length bytes from the Tx buffer base; TxDone follows after the time on air
+func (r *Radio) SetTx(timeout int32) error {
+	var t *transmission
+	err := r.exec(busyMode, func() error {
+		r.setState(StateTx)
+
+		p := r.air()
+		data := make([]uint8, p.payloadLength)
+		for i := range data {
+			data[i] = r.buffer[(int(r.txBase)+i)%len(r.buffer)]
+		}
+
+		now := time.Now()
+		t = &transmission{from: r, params: p, power: r.power, payload: data, start: now, end: now.Add(p.timeOnAir(len(data)))}
+		r.onAir = t
+
+		done := make(chan struct{})
+		r.txDone = done
+		epoch := r.epoch
+		time.AfterFunc(t.end.Sub(now), func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			if r.epoch == epoch {
+				r.onAir = nil
+				r.commandStatus = statusTxDone
+				r.raise(sx126x.IrqTxDone)
+				r.setState(StateStandbyRC)
+			}
+			close(done)
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.ch.begin(t)
+	return nil
+}
+
+// SetRx listens until timeout * 15.625 us; 0 is single mode, RxContinuous never times out
+func (r *Radio) SetRx(timeout int32) error {
+	return r.exec(busyMode, func() error {
+		r.setState(StateRx)
+		r.continuous = timeout == int32(sx126x.RxContinuous)
+
+		if timeout > 0 && r.continuous == false {
+			epoch := r.epoch
+			r.rxTimer = time.AfterFunc(time.Duration(timeout)*timeoutStep, func() {
+				r.mu.Lock()
+				defer r.mu.Unlock()
+
+				if r.epoch == epoch && r.state == StateRx {
+					r.commandStatus = statusTimeout
+					r.raise(sx126x.IrqTimeout)
+					r.setState(StateStandbyRC)
+				}
+			})
+		}
+		return nil
+	})
+}
+
+func (r *Radio) StopTimerOnPreamble(enable bool) error {
+	return r.exec(busyCommand, func() error { return nil })
+}
+
+// SetRxDutyCycle is modelled as continuous Rx; the sleep periods only save power
+func (r *Radio) SetRxDutyCycle(rxPeriod, sleepPeriod uint32) error {
+	return r.SetRx(int32(sx126x.RxContinuous))
+}
+
+// SetCAD looks for LoRa preamble on the channel; CadDone, and CadDetected when something
+// matching is on the air, follow after the configured number of symbols.
+func (r *Radio) SetCAD() error {
+	return r.exec(busyMode, func() error {
+		r.setState(StateCAD)
+
+		p := r.air()
+		detected := r.ch.busy(r, p)
+
+		symbol := math.Exp2(float64(p.spreadingFactor)) / float64(max(p.bandwidth, 1))
+		duration := time.Duration(float64(cadSymbols(r.cad.symbols)) * symbol * float64(time.Second))
+
+		epoch := r.epoch
+		time.AfterFunc(duration, func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			if r.epoch != epoch {
+				return
+			}
+
+			if detected && r.cad.exit == sx126x.CadRx {
+				r.setState(StateRx)
+				r.continuous = false
+			} else {
+				r.setState(StateStandbyRC)
+			}
+
+			mask := sx126x.IrqCadDone
+			if detected {
+				mask |= sx126x.IrqCadDetected
+			}
+			r.raise(mask)
+		})
+		return nil
+	})
+}
+
+func (r *Radio) SetTxContinuousWave() error {
+	return r.carrier()
+}
+
+func (r *Radio) SetTxInfinitePreamble() error {
+	return r.carrier()
+}
+
+// carrier occupies the channel until the next state change
+func (r *Radio) carrier() error {
+	var t *transmission
+	err := r.exec(busyMode, func() error {
+		r.setState(StateTx)
+		t = &transmission{from: r, params: r.air(), power: r.power, start: time.Now(), end: farFuture}
+		r.onAir = t
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.ch.begin(t)
+	return nil
+}
+
+func (r *Radio) SetRegulatorMode(mode sx126x.RegulatorMode) error {
+	return r.exec(busyCommand, func() error { return nil })
+}
+
+func (r *Radio) Calibrate(param sx126x.CalibrationParam) error {
+	return r.exec(busyCalibrate, func() error { return nil })
+}
+
+func (r *Radio) CalibrateImage(freq1, freq2 sx126x.CalibrationImageFreq) error {
+	return r.exec(busyCalibrate, func() error { return nil })
+}
+
+func (r *Radio) SetPaConfig(opts ...sx126x.OptionsPa) error {
+	return r.exec(busyCommand, func() error { return nil })
+}
+
+func (r *Radio) SetRxTxFallbackMode(mode sx126x.FallbackMode) error {
+	return r.exec(busyCommand, func() error { return nil })
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = 13.3 DIO and IRQ Control ===
+// ------------------------------------------------------------------------
+func (r *Radio) SetDioIrqParams(irqMask sx126x.IrqMask, dioIRQ ...sx126x.IrqMask) error {
+	return r.exec(busyCommand, func() error {
+		r.irqMask = uint16(irqMask)
+		r.dio1Mask = uint16(irqMask)
+		if len(dioIRQ) > 0 {
+			r.dio1Mask = uint16(dioIRQ[0])
+		}
+		return nil
+	})
+}
+
+func (r *Radio) GetIrqStatus() (uint16, error) {
+	var irq uint16
+	err := r.exec(busyCommand, func() error {
+		irq = r.irq
+		return nil
+	})
+	return irq, err
+}
+
+func (r *Radio) ClearIrqStatus(mask sx126x.IrqMask) error {
+	return r.exec(busyCommand, func() error {
+		r.irq &^= uint16(mask)
+		return nil
+	})
+}
+
+func (r *Radio) SetDIO2AsRfSwitchCtrl(enable bool) error {
+	return r.exec(busyCommand, func() error { return nil })
+}
+
+func (r *Radio) SetDIO3AsTCXOCtrl(voltage sx126x.TcxoVoltage, timeout int32) error {
+	return r.exec(busyCommand, func() error { return nil })
+}
+
+// WaitForIRQ blocks until an IRQ routed to DIO1 is pending
+func (r *Radio) WaitForIRQ(timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		r.mu.Lock()
+		pending := r.irq&r.dio1Mask != 0
+		r.mu.Unlock()
+
+		if pending {
+			return true
+		}
+
+		select {
+		case <-r.irqSignal:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = 13.4 RF, Modulation and Packet Commands ===
+// ------------------------------------------------------------------------
+func (r *Radio) SetRfFrequency(frequency sx126x.Frequency) error {
+	return r.exec(busyCommand, func() error {
+		r.params.frequency = uint32(frequency)
+		return nil
+	})
+}
+
+func (r *Radio) SetPacketType(packet sx126x.PacketType) error {
+	return r.exec(busyCommand, func() error {
+		r.packetType = packet
+		return nil
+	})
+}
+
+func (r *Radio) GetPacketType() (uint8, error) {
+	var packet uint8
+	err := r.exec(busyCommand, func() error {
+		packet = uint8(r.packetType)
+		return nil
+	})
+	return packet, err
+}
+
+func (r *Radio) SetTxParams(dbm int8, rampTime sx126x.RampTime) error {
+	return r.exec(busyCommand, func() error {
+		r.power = dbm
+		return nil
+	})
+}
+
+func (r *Radio) SetModulationParams(opts ...sx126x.OptionsModulation) error {
+	return r.exec(busyCommand, func() error {
+		if m := r.pendingModulation; m != nil {
+			r.params.spreadingFactor, r.params.codingRate, r.params.bandwidth, r.params.ldro = m.spreadingFactor, m.codingRate, m.bandwidth, m.ldro
+			r.pendingModulation = nil
+		}
+		return nil
+	})
+}
+
+func (r *Radio) SetPacketParams(opts ...sx126x.OptionsPacket) error {
+	return r.exec(busyCommand, func() error {
+		if p := r.pendingPacket; p != nil {
+			r.params.preamble, r.params.implicit, r.params.payloadLength, r.params.crc, r.params.invertedIQ = p.preamble, p.implicit, p.payloadLength, p.crc, p.invertedIQ
+			r.pendingPacket = nil
+		}
+		return nil
+	})
+}
+
+func (r *Radio) SetCadParams(opts ...sx126x.OptionsCAD) error {
+	return r.exec(busyCommand, func() error {
+		if c := r.pendingCAD; c != nil {
+			r.cad = *c
+			r.pendingCAD = nil
+		}
+		return nil
+	})
+}
+
+func (r *Radio) SetBufferBaseAddress(txBaseAddress, rxBaseAddress uint8) error {
+	return r.exec(busyCommand, func() error {
+		r.txBase, r.rxBase = txBaseAddress, rxBaseAddress
+		return nil
+	})
+}
+
+func (r *Radio) SetLoRaSymbNumTimeout(symbols uint8) error {
+	return r.exec(busyCommand, func() error { return nil })
+}
+
+// The option builders can't be inspected from outside the driver, so the simulator keeps
+// their values aside until the matching Set*Params call and hands back nil.
+
+func (r *Radio) PaConfig(txPower int8, paDutyCycle, hpMax, paLut uint8, deviceSel sx126x.PaConfigDeviceSel) sx126x.OptionsPa {
+	return nil
+}
+
+func (r *Radio) ModulationConfigLoRa(spreadingFactor, codingRate uint8, bandwidth sx126x.Frequency, ldro bool) sx126x.OptionsModulation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pendingModulation = &airParams{spreadingFactor: spreadingFactor, codingRate: codingRate, bandwidth: uint32(bandwidth), ldro: ldro}
+	return nil
+}
+
+func (r *Radio) PacketLoRaConfig(preambleLength uint16, headerType sx126x.LoRaHeaderType, payloadLength int, crc sx126x.LoRaCrcMode, iq sx126x.LoRaIQMode) sx126x.OptionsPacket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pendingPacket = &airParams{
+		preamble:      preambleLength,
+		implicit:      headerType == sx126x.HeaderImplicit,
+		payloadLength: uint8(payloadLength),
+		crc:           crc == sx126x.CrcOn,
+		invertedIQ:    iq == sx126x.IqInverted,
+	}
+	return nil
+}
+
+func (r *Radio) CADConfig(symbol sx126x.CadSymbolNum, detectionPeak, detectionMin uint8, exitMode sx126x.CadExitMode, timeout uint32) sx126x.OptionsCAD {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pendingCAD = &cadParams{symbols: symbol, exit: exitMode, timeout: timeout}
+	return nil
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = 13.5 Communication Status Information ===
+// ------------------------------------------------------------------------
+func (r *Radio) GetStatus() (sx126x.ModemStatus, error) {
+	var status sx126x.ModemStatus
+	err := r.exec(busyCommand, func() error {
+		status = sx126x.ModemStatus{ChipMode: r.state.chipMode(), CommandStatus: r.commandStatus}
+		return nil
+	})
+	return status, err
+}
+
+func (r *Radio) GetRxBufferStatus() (sx126x.BufferStatus, error) {
+	var status sx126x.BufferStatus
+	err := r.exec(busyCommand, func() error {
+		status = r.bufferStatus
+		return nil
+	})
+	return status, err
+}
+
+func (r *Radio) GetPacketStatus() (sx126x.PacketStatus, error) {
+	var status sx126x.PacketStatus
+	err := r.exec(busyCommand, func() error {
+		status = r.packetStatus
+		return nil
+	})
+	return status, err
+}
+
+func (r *Radio) GetRssiInst() (int8, error) {
+	var rssi float64
+	err := r.exec(busyCommand, func() error {
+		p := r.air()
+		rssi = r.ch.rssiAt(r, p.frequency, p.bandwidth)
+		return nil
+	})
+	return int8(max(rssi, math.MinInt8)), err
+}
+
+func (r *Radio) GetStats() (sx126x.PacketStats, error) {
+	var stats sx126x.PacketStats
+	err := r.exec(busyCommand, func() error {
+		stats = r.stats
+		return nil
+	})
+	return stats, err
+}
+
+func (r *Radio) ResetStats(resetInternalCache bool) error {
+	return r.exec(busyCommand, func() error {
+		r.stats = sx126x.PacketStats{}
+		return nil
+	})
+}
+
+func (r *Radio) GetDeviceErrors() (sx126x.DeviceError, error) {
+	return 0, r.exec(busyCommand, func() error { return nil })
+}
+
+func (r *Radio) ClearDeviceErrors(resetInternalCache bool) error {
+	return r.exec(busyCommand, func() error { return nil })
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = SPI and pins ===
+// ------------------------------------------------------------------------
+
+// BusyCheck waits for the BUSY line to drop
+func (r *Radio) BusyCheck(timeout <-chan time.Time, sleep ...time.Duration) error {
+	poll := 10 * time.Microsecond
+	if len(sleep) > 0 {
+		poll = sleep[0]
+	}
+
+	for {
+		r.mu.Lock()
+		busy := time.Now().Before(r.busyUntil)
+		r.mu.Unlock()
+
+		if !busy {
+			return nil
+		}
+
+		select {
+		case <-timeout:
+			return fmt.Errorf("[ SIM ] BUSY timeout")
+		case <-time.After(poll):
+		}
+	}
+}
+
+func (r *Radio) HardReset(timeout ...<-chan time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.reset()
+	r.retain = false
+	r.busyUntil = time.Now().Add(busyReset)
+	return nil
+}
+
+// Write is a raw command; the simulator understands the GFSK params the driver has no
+// builders for, see fsk.Node, and acknowledges everything else.
+func (r *Radio) Write(w []uint8, rd []uint8, timeout ...<-chan time.Time) error {
+	if len(w) == 0 {
+		return fmt.Errorf("[ SIM ] Empty command")
+	}
+
+	return r.exec(busyCommand, func() error {
+		switch {
+		case w[0] == 0x8B && len(w) >= 9 && r.packetType == sx126x.PacketTypeGFSK:
+			br := uint32(w[1])<<16 | uint32(w[2])<<8 | uint32(w[3])
+			fdev := uint32(w[6])<<16 | uint32(w[7])<<8 | uint32(w[8])
+			if br > 0 {
+				r.params.bitrate = uint32(32 * uint64(xtal) / uint64(br))
+			}
+			deviation := uint32(uint64(fdev) * xtal >> 25)
+			r.params.bandwidth = 2*deviation + r.params.bitrate
+
+		case w[0] == 0x8C && len(w) >= 10 && r.packetType == sx126x.PacketTypeGFSK:
+			r.params.preamble = uint16(w[1])<<8 | uint16(w[2])
+			r.params.syncBits = w[4]
+			r.params.variable = w[6] == 0x01
+			r.params.payloadLength = w[7]
+			switch w[8] {
+			case 0x00, 0x04:
+				r.params.crcLength = 1
+			case 0x02, 0x06:
+				r.params.crcLength = 2
+			default:
+				r.params.crcLength = 0
+			}
+		}
+
+		for i := range rd {
+			rd[i] = r.status()
+		}
+		return nil
+	})
+}
+
+func (r *Radio) WriteRegister(address uint16, data []uint8) (uint8, error) {
+	var status uint8
+	err := r.exec(busyCommand, func() error {
+		for i, b := range data {
+			r.registers[address+uint16(i)] = b
+		}
+		status = r.status()
+		return nil
+	})
+	return status, err
+}
+
+func (r *Radio) ReadRegister(address uint16, data []uint8) (uint8, error) {
+	var status uint8
+	err := r.exec(busyCommand, func() error {
+		for i := range data {
+			data[i] = r.registers[address+uint16(i)]
+		}
+		status = r.status()
+		return nil
+	})
+	return status, err
+}
+
+func (r *Radio) WriteBuffer(offset uint8, data []uint8) (uint8, error) {
+	var status uint8
+	err := r.exec(busyCommand, func() error {
+		for i, b := range data {
+			r.buffer[(int(offset)+i)%len(r.buffer)] = b
+		}
+		status = r.status()
+		return nil
+	})
+	return status, err
+}
+
+func (r *Radio) ReadBuffer(offset uint8, data []uint8) (uint8, error) {
+	var status uint8
+	err := r.exec(busyCommand, func() error {
+		for i := range data {
+			data[i] = r.buffer[(int(offset)+i)%len(r.buffer)]
+		}
+		status = r.status()
+		return nil
+	})
+	return status, err
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Driver queues ===
+// ------------------------------------------------------------------------
+func (r *Radio) EnqueueTx(payload []uint8) error {
+	r.mu.Lock()
+	closed := r.closed
+	r.mu.Unlock()
+
+	if closed {
+		return fmt.Errorf("[ SIM ] Radio closed")
+	}
+	if len(payload) == 0 || len(payload) > 255 {
+		return fmt.Errorf("[ SIM ] Payload of %d bytes; 1 - 255", len(payload))
+	}
+
+	select {
+	case r.tx <- append([]uint8(nil), payload...):
+		return nil
+	default:
+		return fmt.Errorf("[ SIM ] Tx queue full")
+	}
+}
+
+func (r *Radio) DequeueRx(timeout time.Duration) ([]uint8, error) {
+	f, err := r.DequeueFrame(timeout)
+	return f.Payload, err
+}
+
+// DequeueFrame is DequeueRx with the packet status as it was when the frame came in
+func (r *Radio) DequeueFrame(timeout time.Duration) (lora.Frame, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case f := <-r.rx:
+		return f, nil
+	case <-timer.C:
+		return lora.Frame{}, fmt.Errorf("[ SIM ] Nothing received in %s", timeout)
+	}
+}
+
+// Run sends queued payloads one after another and returns to Rx afterwards, like the driver
+func (r *Radio) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case payload := <-r.tx:
+			r.transmit(ctx, payload)
+		}
+	}
+}
+
+func (r *Radio) transmit(ctx context.Context, payload []uint8) {
+	r.mu.Lock()
+	resume := r.state == StateRx && r.continuous
+	r.params.payloadLength = uint8(len(payload))
+	r.mu.Unlock()
+
+	if _, err := r.WriteBuffer(r.txBase, payload); err != nil {
+		return
+	}
+	if err := r.SetTx(0); err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	done := r.txDone
+	r.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-done:
+	}
+
+	r.mu.Lock()
+	r.irq &^= uint16(sx126x.IrqTxDone)
+	r.mu.Unlock()
+
+	if resume {
+		r.SetRx(int32(sx126x.RxContinuous))
+	}
+}
+
+func (r *Radio) Close(sleepMode sx126x.SleepConfig) error {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+
+	return r.SetSleep(sleepMode)
+}
+
+// ------------------------------------------------------------------------
@@ -0,0 +1,113 @@
+package sim
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+	"wbs/internal/lora"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+var (
+	_ lora.Transceiver = (*Replay)(nil)
+	_ lora.FrameQueue  = (*Replay)(nil)
+)
+
+// Replay feeds the rx frames of a capture through DequeueFrame with their RSSI and SNR,
+// which GetPacketStatus reports as well. Everything else is a Radio alone on its own Channel, so Tx goes
+// nowhere. Frames are handed over one at a time and never dropped; a slow reader
+// delays the rest of the capture instead.
+type Replay struct {
+	*Radio
+
+	records []lora.CaptureRecord
+	speed   float64
+
+	frames chan lora.CaptureRecord
+	once   sync.Once
+	done   chan struct{}
+}
+
+// NewReplay plays records at speed times the original pace; 0 hands them over as fast as they are read
+func NewReplay(records []lora.CaptureRecord, speed float64, cfg *sx126x.Config) *Replay {
+	return &Replay{
+		Radio:   NewChannel().NewRadio(cfg),
+		records: records,
+		speed:   max(speed, 0),
+		frames:  make(chan lora.CaptureRecord),
+		done:    make(chan struct{}),
+	}
+}
+
+// Done is closed once every rx frame of the capture was handed over
+func (r *Replay) Done() <-chan struct{} {
+	return r.done
+}
+
+func (r *Replay) Run(ctx context.Context) error {
+	r.once.Do(func() { go r.feed(ctx) })
+	return r.Radio.Run(ctx)
+}
+
+func (r *Replay) feed(ctx context.Context) {
+	log := slog.With("func", "feed()", "params", "(context.Context)", "return", "(-)", "package", "sim")
+	defer close(r.done)
+
+	start := time.Now()
+	var first time.Time
+	fed := 0
+
+	for _, rec := range r.records {
+		if rec.Direction != lora.CaptureRx {
+			continue
+		}
+
+		if first.IsZero() {
+			first = rec.Time
+		}
+		if r.speed > 0 {
+			at := start.Add(time.Duration(float64(rec.Time.Sub(first)) / r.speed))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Until(at)):
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case r.frames <- rec:
+			fed++
+		}
+	}
+
+	log.Info("[ SIM ] Capture replayed", "frames", fed)
+}
+
+func (r *Replay) DequeueRx(timeout time.Duration) ([]uint8, error) {
+	f, err := r.DequeueFrame(timeout)
+	return f.Payload, err
+}
+
+// DequeueFrame hands over the next frame of the capture, received on the capture's frequency just now
+func (r *Replay) DequeueFrame(timeout time.Duration) (lora.Frame, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case rec := <-r.frames:
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.store(rec.Data, float64(rec.RSSI), float64(rec.SNR))
+		f := r.frame(append([]uint8(nil), rec.Data...))
+		f.Frequency = rec.Frequency
+		return f, nil
+	case <-timer.C:
+		return lora.Frame{}, fmt.Errorf("[ SIM ] Nothing received in %s", timeout)
+	}
+}
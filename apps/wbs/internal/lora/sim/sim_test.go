@@ -0,0 +1,338 @@
+package sim
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/lora"
+	"wbs/internal/lora/packet"
+
+	"github.com/Regeneric/iot-drivers/libs/sx126x"
+)
+
+// SF7 at 500 kHz keeps every frame in the tests a few ms on the air
+func testConfig() *sx126x.Config {
+	return &sx126x.Config{
+		Enable:         true,
+		Modem:          "lora",
+		Type:           "1262",
+		Bandwidth:      500_000,
+		Frequency:      869_500_000,
+		PreambleLength: 8,
+		PayloadLength:  64,
+		TransmitPower:  14,
+		StandbyMode:    "rc",
+		SleepMode:      "warm_start",
+		FrequencyRange: [2]uint16{863, 870},
+		RampTime:       40,
+		LoRa:           sx126x.LoRa{SpreadingFactor: 7, CodingRate: 1, CRC: true, SyncWord: 0x1424},
+	}
+}
+
+// newNode puts a lora.Node on a new radio of ch, set up and running until ctx is cancelled
+func newNode(t *testing.T, ctx context.Context, ch *Channel, opts ...lora.NodeOption) (*lora.Node, *Radio) {
+	t.Helper()
+
+	cfg := testConfig()
+	radio := ch.NewRadio(cfg)
+
+	n, err := lora.New(radio, cfg, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lora.Setup(n); err != nil {
+		t.Fatal(err)
+	}
+	go n.Run(ctx)
+
+	return n, radio
+}
+
+func newReliable(t *testing.T, ctx context.Context, link lora.Link, address packet.Address) *lora.Reliable {
+	t.Helper()
+
+	r, err := lora.NewReliable(link, &config.Link{Reliable: true, Retries: 3, Backoff: 300 * time.Millisecond}, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.Run(ctx)
+
+	return r
+}
+
+// The receiver takes a moment to hand a frame up and ACK it; without it the ACK could start
+// before the sender is back in Rx
+const turnaround = 10 * time.Millisecond
+
+func command(t *testing.T, from, to packet.Address, sequence uint16) []uint8 {
+	t.Helper()
+
+	data, err := packet.Encode(packet.Packet{
+		Header:  packet.Header{Source: from, Destination: to, Sequence: sequence},
+		Payload: &packet.Command{Key: "interval", Value: "60s"},
+	}, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// ************************************************************************
+// = Reliable ===
+// ------------------------------------------------------------------------
+func TestReliableAck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := NewChannel(WithSeed(1), WithLatency(turnaround))
+	a, _ := newNode(t, ctx, ch)
+	b, _ := newNode(t, ctx, ch)
+	station := newReliable(t, ctx, a, 1)
+	gateway := newReliable(t, ctx, b, 2)
+
+	d := station.Send(ctx, command(t, 1, 2, 7))
+	if err := d.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d.Attempts() != 1 || d.Status() != packet.AckOK {
+		t.Errorf("attempts %d, status %v; want 1, OK", d.Attempts(), d.Status())
+	}
+
+	data, err := gateway.Rx(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := packet.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Source != 1 || p.Sequence != 7 || p.Flags.Has(packet.FlagAckRequest) == false {
+		t.Errorf("received %+v, want sequence 7 from 1 with an ACK request", p.Header)
+	}
+
+	// The ACK itself never comes out of Rx
+	if data, err := gateway.Rx(100 * time.Millisecond); err == nil {
+		t.Errorf("second packet % X", data)
+	}
+	if data, err := station.Rx(100 * time.Millisecond); err == nil {
+		t.Errorf("station received % X", data)
+	}
+}
+
+func TestReliableRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := NewChannel(WithSeed(1), WithLatency(turnaround))
+	a, radioA := newNode(t, ctx, ch)
+	b, radioB := newNode(t, ctx, ch)
+	station := newReliable(t, ctx, a, 1)
+	gateway := newReliable(t, ctx, b, 2)
+
+	// The first attempt drowns in the noise; the link is back long before the earliest
+	// retry, ACK window plus half the backoff
+	ch.SetPathLoss(radioA, radioB, 200)
+	time.AfterFunc(100*time.Millisecond, func() { ch.SetPathLoss(radioA, radioB, 80) })
+
+	d := station.Send(ctx, command(t, 1, 2, 8))
+	if err := d.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d.Attempts() != 2 {
+		t.Errorf("acknowledged after %d attempts, want 2", d.Attempts())
+	}
+
+	if _, err := gateway.Rx(time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReliableNoAck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := NewChannel(WithSeed(1))
+	a, _ := newNode(t, ctx, ch)
+	station, err := lora.NewReliable(a, &config.Link{Reliable: true, Retries: 2, Backoff: 10 * time.Millisecond}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go station.Run(ctx)
+
+	// Nobody at address 2
+	d := station.Send(ctx, command(t, 1, 2, 9))
+	if err := d.Wait(ctx); !errors.Is(err, lora.ErrNoAck) {
+		t.Fatalf("Wait = %v, want ErrNoAck", err)
+	}
+	if d.Attempts() != 3 {
+		t.Errorf("%d attempts, want 3", d.Attempts())
+	}
+}
+
+// slowLink holds every Tx back like a receiver that had to back off from a busy channel
+type slowLink struct {
+	lora.Link
+	delay time.Duration
+}
+
+func (l *slowLink) Tx(data []uint8) error {
+	time.Sleep(l.delay)
+	return l.Link.Tx(data)
+}
+
+func TestReliableChannelAccess(t *testing.T) {
+	// Two CAD runs and one backoff of at most 450 ms, 550 ms on top of the ACK window
+	lbt := &config.LBT{Enable: true, Attempts: 2, Backoff: 300 * time.Millisecond}
+
+	tests := []struct {
+		name     string
+		opts     []lora.ReliableOption
+		attempts int
+	}{
+		{"without", nil, 2},
+		{"with listen before talk", []lora.ReliableOption{lora.WithChannelAccess(lbt, nil)}, 1},
+		{"with duty cycle delay", []lora.ReliableOption{
+			lora.WithChannelAccess(nil, &config.DutyCycle{Enable: true, Delay: true, MaxDelay: time.Second}),
+		}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			ch := NewChannel(WithSeed(1), WithLatency(turnaround))
+			a, _ := newNode(t, ctx, ch)
+			b, _ := newNode(t, ctx, ch)
+
+			cfg := &config.Link{Reliable: true, Retries: 3, Backoff: 300 * time.Millisecond}
+			station, err := lora.NewReliable(a, cfg, 1, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go station.Run(ctx)
+			newReliable(t, ctx, &slowLink{Link: b, delay: 400 * time.Millisecond}, 2)
+
+			d := station.Send(ctx, command(t, 1, 2, 10))
+			if err := d.Wait(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if d.Attempts() != tt.attempts {
+				t.Errorf("acknowledged after %d attempts, want %d", d.Attempts(), tt.attempts)
+			}
+		})
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Channel ===
+// ------------------------------------------------------------------------
+func TestCollision(t *testing.T) {
+	tests := []struct {
+		name     string
+		pathLoss float64 // dB from c to the gateway, a is at 80
+		want     []packet.Address
+		crcErrs  uint16
+	}{
+		{"equal", 80, nil, 2},
+		{"within the capture threshold", 76, nil, 2},
+		// c is 20 dB stronger and captures the receiver, a is lost
+		{"capture", 60, []packet.Address{3}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			ch := NewChannel(WithSeed(1))
+			a, _ := newNode(t, ctx, ch)
+			c, radioC := newNode(t, ctx, ch)
+			gateway, radioGateway := newNode(t, ctx, ch)
+			ch.SetPathLoss(radioC, radioGateway, tt.pathLoss)
+
+			// Both go out within the same ms, the frames overlap for most of their time on air
+			if err := a.Tx(command(t, 1, 2, 1)); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Tx(command(t, 3, 2, 1)); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []packet.Address
+			for {
+				data, err := gateway.Rx(200 * time.Millisecond)
+				if err != nil {
+					break
+				}
+				h, err := packet.DecodeHeader(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, h.Source)
+			}
+
+			if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+				t.Errorf("received from %v, want %v", got, tt.want)
+			}
+			if stats, _ := radioGateway.GetStats(); stats.NbPktCrcError != tt.crcErrs {
+				t.Errorf("%d CRC errors, want %d", stats.NbPktCrcError, tt.crcErrs)
+			}
+		})
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = Duty cycle ===
+// ------------------------------------------------------------------------
+func TestDutyCycle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	frame := command(t, 1, 2, 1)
+	airtime := lora.TimeOnAir(testConfig(), len(frame))
+
+	// 5% of 40 frames, two of them fit
+	duty := &config.DutyCycle{
+		Enable: true,
+		Window: 40 * airtime,
+		Bands:  map[string]config.Band{"869.4": {Low: 869_400_000, High: 869_650_000, Limit: 5}},
+	}
+
+	ch := NewChannel(WithSeed(1))
+	station, _ := newNode(t, ctx, ch, lora.WithDutyCycle(duty))
+	gateway, _ := newNode(t, ctx, ch)
+
+	for i := 0; i < 2; i++ {
+		if err := station.Tx(frame); err != nil {
+			t.Fatalf("Tx %d: %v", i, err)
+		}
+	}
+	if err := station.Tx(frame); !errors.Is(err, lora.ErrDutyCycle) {
+		t.Fatalf("Tx over budget = %v, want ErrDutyCycle", err)
+	}
+
+	if b, ok := station.Budget(); !ok || b.Remaining != 0 || b.Band != "869.4" {
+		t.Errorf("budget %+v, want 869.4 used up", b)
+	}
+
+	// The rejected frame never reached the air
+	received := 0
+	for {
+		if _, err := gateway.Rx(200 * time.Millisecond); err != nil {
+			break
+		}
+		received++
+	}
+	if received != 2 {
+		t.Errorf("gateway received %d frames, want 2", received)
+	}
+}
+
+// ------------------------------------------------------------------------
@@ -66,3 +66,9 @@ type Transceiver interface {
 	Run(ctx context.Context) error
 	Close(sleepMode sx126x.SleepConfig) error
 }
+
+// FrameQueue is a Transceiver that reads packet status and IRQ flags as it queues a
+// received frame; Receive prefers it over DequeueRx, see there.
+type FrameQueue interface {
+	DequeueFrame(timeout time.Duration) (Frame, error)
+}
@@ -0,0 +1,243 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"wbs/internal/config"
+	"wbs/internal/sensors"
+)
+
+// Entity is a single Home Assistant sensor, e.g. the eCO2 channel of sgp30_0.
+type Entity struct {
+	Sensor      string // Map key from the config, e.g. sgp30_0
+	Name        string // Human friendly name, falls back to the map key
+	Location    string
+	Model       string
+	Quantity    string // Last segment of the state topic, e.g. eco2
+	DeviceClass string
+	Unit        string
+}
+
+type quantity struct {
+	name        string
+	deviceClass string
+	unit        string
+}
+
+var (
+	quantitiesSGP30 = []quantity{
+		{sensors.QuantityECO2, "carbon_dioxide", sensors.UnitPPM},
+		{sensors.QuantityTVOC, "volatile_organic_compounds_parts", sensors.UnitPPB},
+	}
+	quantitiesBME280 = []quantity{
+		{sensors.QuantityTemperature, "temperature", sensors.UnitCelsius},
+		{sensors.QuantityHumidity, "humidity", sensors.UnitPercent},
+		{sensors.QuantityPressure, "atmospheric_pressure", sensors.UnitHectoPascal},
+	}
+	quantitiesDHT = []quantity{
+		{sensors.QuantityTemperature, "temperature", sensors.UnitCelsius},
+		{sensors.QuantityHumidity, "humidity", sensors.UnitPercent},
+	}
+	quantitiesDS18B20 = []quantity{
+		{sensors.QuantityTemperature, "temperature", sensors.UnitCelsius},
+	}
+	quantitiesPMS5003 = []quantity{
+		{sensors.QuantityPM1, "pm1", sensors.UnitMicrogramsM3},
+		{sensors.QuantityPM25, "pm25", sensors.UnitMicrogramsM3},
+		{sensors.QuantityPM10, "pm10", sensors.UnitMicrogramsM3},
+		{sensors.QuantityParticles03, "", sensors.UnitPerDeciliter},
+		{sensors.QuantityParticles05, "", sensors.UnitPerDeciliter},
+		{sensors.QuantityParticles1, "", sensors.UnitPerDeciliter},
+		{sensors.QuantityParticles25, "", sensors.UnitPerDeciliter},
+		{sensors.QuantityParticles5, "", sensors.UnitPerDeciliter},
+		{sensors.QuantityParticles10, "", sensors.UnitPerDeciliter},
+	}
+	quantitiesDutyCycle = []quantity{
+		{sensors.QuantityDutyCycle, "", sensors.UnitPercent},
+	}
+	quantitiesLoRaStats = []quantity{
+		{sensors.QuantityPacketsReceived, "", sensors.UnitPackets},
+		{sensors.QuantityCRCErrors, "", sensors.UnitPackets},
+		{sensors.QuantityHeaderErrors, "", sensors.UnitPackets},
+	}
+)
+
+// Entities lists every enabled sensor channel from the config, sorted by sensor key.
+func Entities(cfg *config.Config) []Entity {
+	var entities []Entity
+
+	add := func(key, name, location, model string, qs []quantity) {
+		if name == "" {
+			name = key
+		}
+		for _, q := range qs {
+			entities = append(entities, Entity{
+				Sensor:      key,
+				Name:        name,
+				Location:    location,
+				Model:       model,
+				Quantity:    q.name,
+				DeviceClass: q.deviceClass,
+				Unit:        q.unit,
+			})
+		}
+	}
+
+	if cfg.SGP30.Enable {
+		for _, key := range sortedKeys(cfg.SGP30.Devices) {
+			dev := cfg.SGP30.Devices[key]
+			if dev.Enable {
+				add(key, dev.Name, dev.Location, "SGP30", quantitiesSGP30)
+			}
+		}
+	}
+
+	if cfg.BME280.Enable {
+		for _, key := range sortedKeys(cfg.BME280.Devices) {
+			dev := cfg.BME280.Devices[key]
+			if dev.Enable {
+				add(key, dev.Name, dev.Location, "BME280", quantitiesBME280)
+			}
+		}
+	}
+
+	if cfg.DHT.Enable {
+		for _, key := range sortedKeys(cfg.DHT.Devices) {
+			dev := cfg.DHT.Devices[key]
+			if dev.Enable {
+				add(key, dev.Name, dev.Location, fmt.Sprintf("DHT%d", dev.Type), quantitiesDHT)
+			}
+		}
+	}
+
+	if cfg.DS18B20.Enable {
+		for _, key := range sortedKeys(cfg.DS18B20.Devices) {
+			dev := cfg.DS18B20.Devices[key]
+			if dev.Enable {
+				add(key, dev.Name, dev.Location, "DS18B20", quantitiesDS18B20)
+			}
+		}
+	}
+
+	if cfg.PMS5003.Enable {
+		for _, key := range sortedKeys(cfg.PMS5003.Devices) {
+			dev := cfg.PMS5003.Devices[key]
+			if dev.Enable {
+				add(key, dev.Name, dev.Location, "PMS5003", quantitiesPMS5003)
+			}
+		}
+	}
+
+	if cfg.SX126X.Enable && cfg.SX126X.Modem != "fsk" {
+		var qs []quantity
+		if cfg.Duty.Enable {
+			qs = append(qs, quantitiesDutyCycle...)
+		}
+		if cfg.Link.StatsInterval > 0 {
+			qs = append(qs, quantitiesLoRaStats...)
+		}
+		add("lora", "LoRa", "", "SX"+cfg.SX126X.Type, qs)
+	}
+
+	return entities
+}
+
+type discoveryDevice struct {
+	Identifiers   []string `json:"identifiers"`
+	Name          string   `json:"name"`
+	Model         string   `json:"model,omitempty"`
+	SuggestedArea string   `json:"suggested_area,omitempty"`
+}
+
+type discoveryPayload struct {
+	Name              string          `json:"name"`
+	UniqueID          string          `json:"unique_id"`
+	ObjectID          string          `json:"object_id"`
+	DeviceClass       string          `json:"device_class,omitempty"`
+	StateClass        string          `json:"state_class"`
+	Unit              string          `json:"unit_of_measurement,omitempty"`
+	StateTopic        string          `json:"state_topic"`
+	AvailabilityTopic string          `json:"availability_topic"`
+	Device            discoveryDevice `json:"device"`
+}
+
+// DiscoveryTopic is <prefix>/sensor/<device_name>/<sensor>_<quantity>/config
+func (c *Client) DiscoveryTopic(e Entity) string {
+	return join(c.cfg.DiscoveryPrefix, "sensor", objectID(c.cfg.DeviceName), objectID(e.Sensor, e.Quantity), "config")
+}
+
+func (c *Client) discoveryPayload(e Entity) ([]byte, error) {
+	label := strings.ToUpper(e.Quantity)
+	if e.DeviceClass != "" {
+		label = strings.ReplaceAll(e.DeviceClass, "_", " ")
+	}
+
+	name := e.Name
+	if e.Location != "" {
+		name = fmt.Sprintf("%s (%s)", name, e.Location)
+	}
+
+	p := discoveryPayload{
+		Name:              fmt.Sprintf("%s %s", name, label),
+		UniqueID:          objectID(c.cfg.DeviceName, e.Sensor, e.Quantity),
+		ObjectID:          objectID(c.cfg.DeviceName, e.Sensor, e.Quantity),
+		DeviceClass:       e.DeviceClass,
+		StateClass:        "measurement",
+		Unit:              e.Unit,
+		StateTopic:        c.StateTopics(e.Sensor, e.Quantity)[0],
+		AvailabilityTopic: c.AvailabilityTopic(),
+		Device: discoveryDevice{
+			Identifiers:   []string{objectID(c.cfg.DeviceName, e.Sensor)},
+			Name:          name,
+			Model:         e.Model,
+			SuggestedArea: e.Location,
+		},
+	}
+
+	return json.Marshal(p)
+}
+
+// PublishDiscovery announces all entities to Home Assistant as retained config messages.
+func (c *Client) PublishDiscovery(entities []Entity) error {
+	log := slog.With("func", "Client.PublishDiscovery()", "params", "([]Entity)", "return", "(error)", "package", "mqtt")
+	log.Info("[ MQTT ] Home Assistant discovery", "entities", len(entities))
+
+	for _, e := range entities {
+		payload, err := c.discoveryPayload(e)
+		if err != nil {
+			return fmt.Errorf("[ MQTT ] Could not encode discovery payload for %s/%s: %w", e.Sensor, e.Quantity, err)
+		}
+
+		if err := c.publish(c.DiscoveryTopic(e), payload, true); err != nil {
+			return err
+		}
+		log.Debug("[ MQTT ] Entity announced", "sensor", e.Sensor, "quantity", e.Quantity)
+	}
+
+	return nil
+}
+
+// HA only allows [a-zA-Z0-9_-] in object IDs
+func objectID(parts ...string) string {
+	id := strings.ToLower(strings.Join(parts, "_"))
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, id)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,293 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/sensors"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	availabilityOnline  = "online"
+	availabilityOffline = "offline"
+
+	publishTimeout = 5 * time.Second
+)
+
+// Dialer opens the raw connection to the broker. Production code leaves it nil
+// and paho dials TCP itself; tests hand in net.Pipe() ends of an in-process broker.
+type Dialer func(uri *url.URL, options paho.ClientOptions) (net.Conn, error)
+
+type Option func(*Client)
+
+func WithDialer(d Dialer) Option {
+	return func(c *Client) { c.dialer = d }
+}
+
+// WithDiscovery announces the given entities to Home Assistant on every (re)connect
+func WithDiscovery(entities []Entity) Option {
+	return func(c *Client) { c.entities = entities }
+}
+
+func WithQoS(qos uint8) Option {
+	return func(c *Client) { c.qos = qos }
+}
+
+type Client struct {
+	cfg    *config.MQTT
+	cli    paho.Client
+	dialer Dialer
+	qos    uint8
+
+	entities []Entity
+
+	mu        sync.Mutex
+	connected bool
+}
+
+func New(cfg *config.MQTT, opts ...Option) (*Client, error) {
+	log := slog.With("func", "New()", "params", "(*config.MQTT, ...Option)", "return", "(*Client, error)", "package", "mqtt")
+	log.Info("[ MQTT ] Client constructor")
+
+	if cfg == nil {
+		return nil, fmt.Errorf("[ MQTT ] Client state improper; cfg is nil")
+	}
+
+	if cfg.Enable == false {
+		return nil, fmt.Errorf("[ MQTT ] Client disabled in the config")
+	}
+
+	if len(cfg.Topic) == 0 {
+		return nil, fmt.Errorf("[ MQTT ] Client state improper; no topic configured")
+	}
+
+	c := &Client{cfg: cfg}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	c.cli = paho.NewClient(c.options())
+	return c, nil
+}
+
+func (c *Client) options() *paho.ClientOptions {
+	log := slog.With("package", "mqtt")
+
+	o := paho.NewClientOptions()
+	o.AddBroker(fmt.Sprintf("tcp://%s:%d", c.cfg.BrokerAddress, c.cfg.BrokerPort))
+	o.SetClientID(c.cfg.DeviceName)
+	o.SetUsername(c.cfg.Username)
+	o.SetPassword(c.cfg.Password)
+	o.SetKeepAlive(c.cfg.KeepAlive)
+	o.SetCleanSession(true)
+
+	// Broker publishes this on our behalf when keep-alive expires
+	o.SetWill(c.AvailabilityTopic(), availabilityOffline, c.qos, true)
+
+	o.SetAutoReconnect(c.cfg.AutoReconnect)
+	o.SetConnectRetry(c.cfg.AutoReconnect)
+	o.SetConnectRetryInterval(c.cfg.ReconnectInterval)
+	o.SetMaxReconnectInterval(c.cfg.ReconnectInterval)
+
+	if c.dialer != nil {
+		o.SetCustomOpenConnectionFn(paho.OpenConnectionFunc(c.dialer))
+	}
+
+	o.SetOnConnectHandler(func(cli paho.Client) {
+		log.Info("[ MQTT ] Connected to broker", "broker", c.cfg.BrokerAddress, "port", c.cfg.BrokerPort)
+
+		c.mu.Lock()
+		c.connected = true
+		c.mu.Unlock()
+
+		// Retained, so late subscribers still see the station as online
+		token := cli.Publish(c.AvailabilityTopic(), c.qos, true, availabilityOnline)
+		if !token.WaitTimeout(publishTimeout) || token.Error() != nil {
+			log.Warn("[ MQTT ] Could not publish availability", "error", token.Error())
+		}
+
+		if c.cfg.Discovery && len(c.entities) > 0 {
+			if err := c.PublishDiscovery(c.entities); err != nil {
+				log.Warn("[ MQTT ] Home Assistant discovery failed", "error", err)
+			}
+		}
+	})
+
+	o.SetConnectionLostHandler(func(_ paho.Client, err error) {
+		c.mu.Lock()
+		c.connected = false
+		c.mu.Unlock()
+
+		if c.cfg.AutoReconnect {
+			log.Warn("[ MQTT ] Connection lost, reconnecting", "error", err, "interval", c.cfg.ReconnectInterval)
+		} else {
+			log.Error("[ MQTT ] Connection lost", "error", err)
+		}
+	})
+
+	o.SetReconnectingHandler(func(_ paho.Client, _ *paho.ClientOptions) {
+		log.Debug("[ MQTT ] Reconnect attempt", "broker", c.cfg.BrokerAddress)
+	})
+
+	return o
+}
+
+func (c *Client) Connect(ctx context.Context) error {
+	log := slog.With("func", "Client.Connect()", "params", "(context.Context)", "return", "(error)", "package", "mqtt")
+	log.Info("[ MQTT ] Connecting to broker", "broker", c.cfg.BrokerAddress, "port", c.cfg.BrokerPort)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// With ConnectRetry enabled the token only completes once a connection is made,
+	// so don't hold the caller hostage - paho keeps retrying in the background.
+	token := c.cli.Connect()
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("[ MQTT ] Failed to connect to %s:%d: %w", c.cfg.BrokerAddress, c.cfg.BrokerPort, err)
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(c.connectWait()):
+		if c.cfg.AutoReconnect == false {
+			return fmt.Errorf("[ MQTT ] Timed out connecting to %s:%d", c.cfg.BrokerAddress, c.cfg.BrokerPort)
+		}
+		log.Warn("[ MQTT ] Broker unreachable, retrying in background", "interval", c.cfg.ReconnectInterval)
+	}
+
+	return nil
+}
+
+func (c *Client) connectWait() time.Duration {
+	if c.cfg.ReconnectInterval > 0 {
+		return c.cfg.ReconnectInterval
+	}
+	return publishTimeout
+}
+
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+// AvailabilityTopic is <topic[0]>/<device_name>/status, carrying "online" / "offline".
+func (c *Client) AvailabilityTopic() string {
+	return join(c.cfg.Topic[0], c.cfg.DeviceName, "status")
+}
+
+// StateTopics returns <topic>/<device_name>/<sensor>/<quantity> for every configured topic.
+func (c *Client) StateTopics(sensor, quantity string) []string {
+	topics := make([]string, 0, len(c.cfg.Topic))
+	for _, t := range c.cfg.Topic {
+		topics = append(topics, join(t, c.cfg.DeviceName, sensor, quantity))
+	}
+	return topics
+}
+
+// Publish sends a single sensor value to all configured topics.
+// Values are sent as plain text, which every MQTT consumer understands.
+func (c *Client) Publish(sensor, quantity string, value any) error {
+	if c.Connected() == false {
+		return fmt.Errorf("[ MQTT ] Not connected; dropping %s/%s", sensor, quantity)
+	}
+
+	payload := fmt.Sprintf("%v", value)
+	for _, topic := range c.StateTopics(sensor, quantity) {
+		if err := c.publish(topic, payload, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) PublishReading(r sensors.Reading) error {
+	return c.Publish(r.SensorID, r.Quantity, strconv.FormatFloat(r.Value, 'f', -1, 64))
+}
+
+// Run forwards readings from the sensor bus, at most one per sensor quantity every PublishInterval.
+func (c *Client) Run(ctx context.Context, readings <-chan sensors.Reading) error {
+	log := slog.With("func", "Client.Run()", "params", "(context.Context, <-chan sensors.Reading)", "return", "(error)", "package", "mqtt")
+	log.Info("[ MQTT ] Client event loop")
+
+	last := make(map[string]time.Time)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r, ok := <-readings:
+			if !ok {
+				return nil
+			}
+
+			if r.Quality == sensors.QualityInvalid {
+				continue
+			}
+
+			key := r.SensorID + "/" + r.Quantity
+			if r.Time.Sub(last[key]) < c.cfg.PublishInterval {
+				continue
+			}
+
+			if err := c.PublishReading(r); err != nil {
+				log.Warn("[ MQTT ] Publish failure", "sensor", r.SensorID, "quantity", r.Quantity, "error", err)
+				continue
+			}
+			last[key] = r.Time
+		}
+	}
+}
+
+func (c *Client) publish(topic string, payload any, retained bool) error {
+	token := c.cli.Publish(topic, c.qos, retained, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("[ MQTT ] Publish to %s timed out", topic)
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("[ MQTT ] Publish to %s failed: %w", topic, err)
+	}
+	return nil
+}
+
+func (c *Client) Close() error {
+	log := slog.With("func", "Client.Close()", "params", "(-)", "return", "(error)", "package", "mqtt")
+	log.Info("[ MQTT ] Client destructor")
+
+	// Graceful disconnect doesn't trigger the will, so say goodbye ourselves
+	if c.Connected() {
+		if err := c.publish(c.AvailabilityTopic(), availabilityOffline, true); err != nil {
+			log.Warn("[ MQTT ] Could not publish availability", "error", err)
+		}
+	}
+
+	c.cli.Disconnect(250)
+
+	c.mu.Lock()
+	c.connected = false
+	c.mu.Unlock()
+
+	return nil
+}
+
+func join(parts ...string) string {
+	clean := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.Trim(p, "/")
+		if p != "" {
+			clean = append(clean, p)
+		}
+	}
+	return strings.Join(clean, "/")
+}
@@ -0,0 +1,246 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+	"wbs/internal/config"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+const brokerWait = 5 * time.Second
+
+// broker stands in for an MQTT broker at the other end of net.Pipe(); it acknowledges
+// whatever the client sends and hands CONNECT and PUBLISH packets to the test
+type broker struct {
+	connects  chan *packets.ConnectPacket
+	publishes chan *packets.PublishPacket
+
+	mu      sync.Mutex
+	conn    net.Conn
+	refused bool // Dials fail while set
+}
+
+func newBroker() *broker {
+	return &broker{
+		connects:  make(chan *packets.ConnectPacket, 8),
+		publishes: make(chan *packets.PublishPacket, 64),
+	}
+}
+
+func (b *broker) dial(_ *url.URL, _ paho.ClientOptions) (net.Conn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.refused {
+		return nil, errors.New("connection refused")
+	}
+
+	client, server := net.Pipe()
+	b.conn = server
+
+	go b.serve(server)
+	return client, nil
+}
+
+// drop closes the connection under the client, as a broker restart would; the
+// broker refuses connections until it is back up
+func (b *broker) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refused = true
+	b.conn.Close()
+}
+
+func (b *broker) up() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refused = false
+}
+
+func (b *broker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		var reply packets.ControlPacket
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			b.connects <- p
+			reply = packets.NewControlPacket(packets.Connack)
+		case *packets.PublishPacket:
+			b.publishes <- p
+			if p.Qos == 1 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				reply = ack
+			}
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+
+		if reply != nil {
+			if err := reply.Write(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (b *broker) connect(t *testing.T) *packets.ConnectPacket {
+	t.Helper()
+
+	select {
+	case p := <-b.connects:
+		return p
+	case <-time.After(brokerWait):
+		t.Fatal("no CONNECT")
+		return nil
+	}
+}
+
+func (b *broker) publish(t *testing.T) *packets.PublishPacket {
+	t.Helper()
+
+	select {
+	case p := <-b.publishes:
+		return p
+	case <-time.After(brokerWait):
+		t.Fatal("no PUBLISH")
+		return nil
+	}
+}
+
+func testConfig() *config.MQTT {
+	return &config.MQTT{
+		Enable:            true,
+		BrokerAddress:     "broker",
+		BrokerPort:        1883,
+		Topic:             []string{"wbs/", "backup"},
+		KeepAlive:         time.Minute,
+		ReconnectInterval: 50 * time.Millisecond,
+		AutoReconnect:     true,
+		DeviceName:        "station_0",
+	}
+}
+
+func TestClient(t *testing.T) {
+	b := newBroker()
+
+	c, err := New(testConfig(), WithDialer(b.dial), WithQoS(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), brokerWait)
+	defer cancel()
+
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// = Last will on connect =========
+	connect := b.connect(t)
+	if connect.WillFlag == false || connect.WillRetain == false || connect.WillQos != 1 {
+		t.Errorf("will flag %t, retain %t, QoS %d; want a retained QoS 1 will", connect.WillFlag, connect.WillRetain, connect.WillQos)
+	}
+	if connect.WillTopic != "wbs/station_0/status" || string(connect.WillMessage) != availabilityOffline {
+		t.Errorf("will %s = %q, want wbs/station_0/status = %q", connect.WillTopic, connect.WillMessage, availabilityOffline)
+	}
+	if connect.ClientIdentifier != "station_0" {
+		t.Errorf("client ID %q, want station_0", connect.ClientIdentifier)
+	}
+
+	online := b.publish(t)
+	if online.TopicName != "wbs/station_0/status" || string(online.Payload) != availabilityOnline || online.Retain == false {
+		t.Errorf("first publish %s = %q (retain %t), want retained %q", online.TopicName, online.Payload, online.Retain, availabilityOnline)
+	}
+	// ---------------------------------
+
+	// = Publish ======================
+	waitConnected(t, c, true)
+	if err := c.Publish("bme280_0", "temperature", 21.5); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"wbs/station_0/bme280_0/temperature", "backup/station_0/bme280_0/temperature"} {
+		p := b.publish(t)
+		if p.TopicName != want || string(p.Payload) != "21.5" || p.Retain {
+			t.Errorf("publish %s = %q (retain %t), want %s = \"21.5\"", p.TopicName, p.Payload, p.Retain, want)
+		}
+	}
+	// ---------------------------------
+
+	// = Reconnect ====================
+	b.drop()
+	waitConnected(t, c, false)
+
+	if err := c.Publish("bme280_0", "temperature", 21.5); err == nil {
+		t.Error("Publish while disconnected succeeded")
+	}
+	b.up()
+
+	if reconnect := b.connect(t); reconnect.WillTopic != connect.WillTopic {
+		t.Errorf("will after reconnect %s, want %s", reconnect.WillTopic, connect.WillTopic)
+	}
+	if p := b.publish(t); p.TopicName != "wbs/station_0/status" || string(p.Payload) != availabilityOnline {
+		t.Errorf("first publish after reconnect %s = %q, want %q", p.TopicName, p.Payload, availabilityOnline)
+	}
+
+	waitConnected(t, c, true)
+	if err := c.Publish("bme280_0", "humidity", 40); err != nil {
+		t.Fatal(err)
+	}
+	if p := b.publish(t); p.TopicName != "wbs/station_0/bme280_0/humidity" {
+		t.Errorf("publish after reconnect to %s", p.TopicName)
+	}
+	b.publish(t)
+	// ---------------------------------
+
+	// = Close ========================
+	c.Close()
+	if p := b.publish(t); p.TopicName != "wbs/station_0/status" || string(p.Payload) != availabilityOffline || p.Retain == false {
+		t.Errorf("publish on close %s = %q (retain %t), want retained %q", p.TopicName, p.Payload, p.Retain, availabilityOffline)
+	}
+	// ---------------------------------
+}
+
+func TestNew(t *testing.T) {
+	cfg := testConfig()
+	cfg.Enable = false
+	if _, err := New(cfg); err == nil {
+		t.Error("New with MQTT disabled succeeded")
+	}
+
+	cfg = testConfig()
+	cfg.Topic = nil
+	if _, err := New(cfg); err == nil {
+		t.Error("New without topics succeeded")
+	}
+}
+
+func waitConnected(t *testing.T, c *Client, want bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(brokerWait)
+	for c.Connected() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Connected() stays %t", !want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
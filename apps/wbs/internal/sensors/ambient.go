@@ -0,0 +1,105 @@
+package sensors
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Conditions older than this are not used for compensation
+const ambientMaxAge = 10 * time.Minute
+
+type Conditions struct {
+	Temperature float64 // °C
+	Humidity    float64 // %RH
+	Time        time.Time
+}
+
+// Ambient keeps the latest temperature / humidity per sensor kind (dht, bme280), so
+// managers configured with use_dht / use_bme can compensate their own readings.
+type Ambient struct {
+	mu     sync.RWMutex
+	kinds  map[string]string // Sensor ID -> kind
+	latest map[string]Conditions
+}
+
+func NewAmbient() *Ambient {
+	return &Ambient{
+		kinds:  make(map[string]string),
+		latest: make(map[string]Conditions),
+	}
+}
+
+// Run consumes readings from the sensor bus until ctx is cancelled or the channel closes.
+func (a *Ambient) Run(ctx context.Context, readings <-chan Reading, sensors []Sensor) {
+	a.mu.Lock()
+	for _, s := range sensors {
+		info := s.Describe()
+		a.kinds[info.ID] = info.Kind
+	}
+	a.mu.Unlock()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r, ok := <-readings:
+			if !ok {
+				return
+			}
+			a.Observe(r)
+		}
+	}
+}
+
+func (a *Ambient) Observe(r Reading) {
+	if r.Quality == QualityInvalid {
+		return
+	}
+	if r.Quantity != QuantityTemperature && r.Quantity != QuantityHumidity {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	kind, ok := a.kinds[r.SensorID]
+	if !ok {
+		return
+	}
+
+	c := a.latest[kind]
+	switch r.Quantity {
+	case QuantityTemperature:
+		c.Temperature = r.Value
+	case QuantityHumidity:
+		c.Humidity = r.Value
+	}
+	c.Time = r.Time
+	a.latest[kind] = c
+}
+
+// Conditions returns the freshest conditions reported by any of the given kinds.
+func (a *Ambient) Conditions(kinds ...string) (Conditions, bool) {
+	if a == nil {
+		return Conditions{}, false
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	var best Conditions
+	found := false
+	for _, kind := range kinds {
+		c, ok := a.latest[kind]
+		if !ok || time.Since(c.Time) > ambientMaxAge {
+			continue
+		}
+		if !found || c.Time.After(best.Time) {
+			best = c
+			found = true
+		}
+	}
+
+	return best, found
+}
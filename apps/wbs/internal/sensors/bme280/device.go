@@ -0,0 +1,305 @@
+package bme_manager
+
+import (
+	"fmt"
+	"time"
+
+	"periph.io/x/conn/v3/i2c"
+	"periph.io/x/conn/v3/spi"
+)
+
+// ************************************************************************
+// = 5.3 Memory map ===
+// ------------------------------------------------------------------------
+const (
+	regCalib00   uint8 = 0x88 // 0x88 - 0xA1, dig_T1 - dig_H1
+	regChipID    uint8 = 0xD0
+	regReset     uint8 = 0xE0
+	regCalib26   uint8 = 0xE1 // 0xE1 - 0xE7, dig_H2 - dig_H6
+	regCtrlHum   uint8 = 0xF2
+	regStatus    uint8 = 0xF3
+	regCtrlMeas  uint8 = 0xF4
+	regConfig    uint8 = 0xF5
+	regPressMsb  uint8 = 0xF7 // 0xF7 - 0xFE, press / temp / hum burst read
+	chipID       uint8 = 0x60
+	resetCommand uint8 = 0xB6
+
+	statusMeasuring uint8 = 1 << 3
+	statusImUpdate  uint8 = 1 << 0
+
+	modeSleep  uint8 = 0x00
+	modeNormal uint8 = 0x03
+)
+
+// ------------------------------------------------------------------------
+
+// Bus is a register level view of the sensor, independent of I2C / SPI wiring.
+type Bus interface {
+	ReadRegisters(reg uint8, data []uint8) error
+	WriteRegister(reg uint8, value uint8) error
+}
+
+type I2CBus struct {
+	Bus     i2c.Bus
+	Address uint16
+}
+
+func (b I2CBus) ReadRegisters(reg uint8, data []uint8) error {
+	return b.Bus.Tx(b.Address, []uint8{reg}, data)
+}
+
+func (b I2CBus) WriteRegister(reg uint8, value uint8) error {
+	return b.Bus.Tx(b.Address, []uint8{reg, value}, nil)
+}
+
+// = 6.3 SPI interface; bit 7 of the control byte selects read (1) / write (0)
+type SPIBus struct {
+	Conn spi.Conn
+}
+
+func (b SPIBus) ReadRegisters(reg uint8, data []uint8) error {
+	w := make([]uint8, len(data)+1)
+	r := make([]uint8, len(data)+1)
+	w[0] = reg | 0x80
+
+	if err := b.Conn.Tx(w, r); err != nil {
+		return err
+	}
+	copy(data, r[1:])
+	return nil
+}
+
+func (b SPIBus) WriteRegister(reg uint8, value uint8) error {
+	return b.Conn.Tx([]uint8{reg & 0x7F, value}, nil)
+}
+
+// = 4.2.2 Trimming parameter readout ===
+type calibration struct {
+	T1 uint16
+	T2 int16
+	T3 int16
+
+	P1 uint16
+	P2 int16
+	P3 int16
+	P4 int16
+	P5 int16
+	P6 int16
+	P7 int16
+	P8 int16
+	P9 int16
+
+	H1 uint8
+	H2 int16
+	H3 uint8
+	H4 int16
+	H5 int16
+	H6 int8
+}
+
+func parseCalibration(c00 []uint8, c26 []uint8) calibration {
+	u16 := func(b []uint8, i int) uint16 { return uint16(b[i+1])<<8 | uint16(b[i]) }
+	s16 := func(b []uint8, i int) int16 { return int16(u16(b, i)) }
+
+	return calibration{
+		T1: u16(c00, 0),
+		T2: s16(c00, 2),
+		T3: s16(c00, 4),
+
+		P1: u16(c00, 6),
+		P2: s16(c00, 8),
+		P3: s16(c00, 10),
+		P4: s16(c00, 12),
+		P5: s16(c00, 14),
+		P6: s16(c00, 16),
+		P7: s16(c00, 18),
+		P8: s16(c00, 20),
+		P9: s16(c00, 22),
+
+		H1: c00[25],
+		H2: s16(c26, 0),
+		H3: c26[2],
+		// 12-bit signed values split across 0xE4 - 0xE6
+		H4: int16(int8(c26[3]))<<4 | int16(c26[4]&0x0F),
+		H5: int16(int8(c26[5]))<<4 | int16(c26[4]>>4),
+		H6: int8(c26[6]),
+	}
+}
+
+// Settings are raw register field values, see 5.4.3 - 5.4.6
+type Settings struct {
+	OversamplingT uint8
+	OversamplingP uint8
+	OversamplingH uint8
+	Filter        uint8
+	Standby       uint8
+}
+
+type Device struct {
+	bus   Bus
+	calib calibration
+}
+
+// Measurement in SI friendly units
+type Measurement struct {
+	Temperature float64 // °C
+	Pressure    float64 // hPa
+	Humidity    float64 // %RH
+}
+
+func NewDevice(bus Bus) (*Device, error) {
+	if bus == nil {
+		return nil, fmt.Errorf("[ BME ] Sensor state improper; bus is nil")
+	}
+
+	d := &Device{bus: bus}
+
+	id := make([]uint8, 1)
+	if err := bus.ReadRegisters(regChipID, id); err != nil {
+		return nil, fmt.Errorf("[ BME ] Could not read chip ID: %w", err)
+	}
+	if id[0] != chipID {
+		return nil, fmt.Errorf("[ BME ] Unexpected chip ID 0x%02X, expected 0x%02X", id[0], chipID)
+	}
+
+	return d, nil
+}
+
+// Init soft resets the sensor, loads the trimming parameters and starts normal mode.
+func (d *Device) Init(s Settings) error {
+	if err := d.bus.WriteRegister(regReset, resetCommand); err != nil {
+		return fmt.Errorf("[ BME ] Soft reset failure: %w", err)
+	}
+
+	// NVM copy to image registers takes ~2 ms after reset
+	status := make([]uint8, 1)
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for {
+		time.Sleep(2 * time.Millisecond)
+		if err := d.bus.ReadRegisters(regStatus, status); err != nil {
+			return fmt.Errorf("[ BME ] Could not read status: %w", err)
+		}
+		if status[0]&statusImUpdate == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("[ BME ] Timed out waiting for NVM copy")
+		}
+	}
+
+	c00 := make([]uint8, 26)
+	if err := d.bus.ReadRegisters(regCalib00, c00); err != nil {
+		return fmt.Errorf("[ BME ] Could not read calibration block 0x88: %w", err)
+	}
+
+	c26 := make([]uint8, 7)
+	if err := d.bus.ReadRegisters(regCalib26, c26); err != nil {
+		return fmt.Errorf("[ BME ] Could not read calibration block 0xE1: %w", err)
+	}
+
+	d.calib = parseCalibration(c00, c26)
+
+	return d.Configure(s)
+}
+
+// Configure applies oversampling, IIR filter and standby time in normal mode.
+func (d *Device) Configure(s Settings) error {
+	// Writes to config are ignored in normal mode
+	if err := d.bus.WriteRegister(regCtrlMeas, modeSleep); err != nil {
+		return err
+	}
+
+	if err := d.bus.WriteRegister(regConfig, (s.Standby&0x07)<<5|(s.Filter&0x07)<<2); err != nil {
+		return err
+	}
+
+	// ctrl_hum only becomes effective after a write to ctrl_meas
+	if err := d.bus.WriteRegister(regCtrlHum, s.OversamplingH&0x07); err != nil {
+		return err
+	}
+
+	return d.bus.WriteRegister(regCtrlMeas, (s.OversamplingT&0x07)<<5|(s.OversamplingP&0x07)<<2|modeNormal)
+}
+
+// Sense reads the latest conversion result and applies the Bosch compensation formulas.
+func (d *Device) Sense() (Measurement, error) {
+	raw := make([]uint8, 8)
+	if err := d.bus.ReadRegisters(regPressMsb, raw); err != nil {
+		return Measurement{}, fmt.Errorf("[ BME ] Could not read measurement: %w", err)
+	}
+
+	adcP := int32(raw[0])<<12 | int32(raw[1])<<4 | int32(raw[2])>>4
+	adcT := int32(raw[3])<<12 | int32(raw[4])<<4 | int32(raw[5])>>4
+	adcH := int32(raw[6])<<8 | int32(raw[7])
+
+	// 0x80000 / 0x8000 are the reset values, i.e. measurement skipped
+	if adcT == 0x80000 {
+		return Measurement{}, fmt.Errorf("[ BME ] No temperature conversion available")
+	}
+
+	t, tFine := d.calib.compensateT(adcT)
+
+	m := Measurement{Temperature: float64(t) / 100}
+	if adcP != 0x80000 {
+		m.Pressure = float64(d.calib.compensateP(adcP, tFine)) / 256 / 100
+	}
+	if adcH != 0x8000 {
+		m.Humidity = float64(d.calib.compensateH(adcH, tFine)) / 1024
+	}
+
+	return m, nil
+}
+
+// ************************************************************************
+// = 4.2.3 Compensation formulas ===
+// ------------------------------------------------------------------------
+
+// Returns temperature in 0.01 °C and t_fine carried over to P and H
+func (c calibration) compensateT(adcT int32) (int32, int32) {
+	var1 := (((adcT >> 3) - (int32(c.T1) << 1)) * int32(c.T2)) >> 11
+	var2 := (((((adcT >> 4) - int32(c.T1)) * ((adcT >> 4) - int32(c.T1))) >> 12) * int32(c.T3)) >> 14
+	tFine := var1 + var2
+
+	return (tFine*5 + 128) >> 8, tFine
+}
+
+// Returns pressure in Pa as Q24.8
+func (c calibration) compensateP(adcP int32, tFine int32) uint32 {
+	var1 := int64(tFine) - 128000
+	var2 := var1 * var1 * int64(c.P6)
+	var2 = var2 + ((var1 * int64(c.P5)) << 17)
+	var2 = var2 + (int64(c.P4) << 35)
+	var1 = ((var1 * var1 * int64(c.P3)) >> 8) + ((var1 * int64(c.P2)) << 12)
+	var1 = (((int64(1) << 47) + var1) * int64(c.P1)) >> 33
+
+	if var1 == 0 {
+		return 0 // Avoid division by zero
+	}
+
+	p := int64(1048576 - adcP)
+	p = (((p << 31) - var2) * 3125) / var1
+	var1 = (int64(c.P9) * (p >> 13) * (p >> 13)) >> 25
+	var2 = (int64(c.P8) * p) >> 19
+	p = ((p + var1 + var2) >> 8) + (int64(c.P7) << 4)
+
+	return uint32(p)
+}
+
+// Returns relative humidity in %RH as Q22.10
+func (c calibration) compensateH(adcH int32, tFine int32) uint32 {
+	v := tFine - 76800
+	v = ((((adcH << 14) - (int32(c.H4) << 20) - (int32(c.H5) * v)) + 16384) >> 15) *
+		(((((((v*int32(c.H6))>>10)*(((v*int32(c.H3))>>11)+32768))>>10)+2097152)*int32(c.H2) + 8192) >> 14)
+	v = v - (((((v >> 15) * (v >> 15)) >> 7) * int32(c.H1)) >> 4)
+
+	if v < 0 {
+		v = 0
+	}
+	if v > 419430400 {
+		v = 419430400
+	}
+
+	return uint32(v >> 12)
+}
+
+// ------------------------------------------------------------------------
@@ -0,0 +1,239 @@
+package bme_manager
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"periph.io/x/conn/v3/physic"
+)
+
+const testAddress = 0x76
+
+// Trimming parameters of the compensation example in the BMP280 datasheet, 3.12, which
+// BME280 shares for T and P; the H ones are within the range of real parts
+var (
+	dumpCalib00 = []uint8{ // 0x88 - 0xA1
+		0x70, 0x6B, 0x43, 0x67, 0x18, 0xFC, 0x7D, 0x8E, 0x43, 0xD6, 0xD0, 0x0B, 0x27,
+		0x0B, 0x8C, 0x00, 0xF9, 0xFF, 0x8C, 0x3C, 0xF8, 0xC6, 0x70, 0x17, 0x00, 0x4B,
+	}
+	dumpCalib26 = []uint8{0x6A, 0x01, 0x00, 0x13, 0x29, 0x03, 0x1E} // 0xE1 - 0xE7
+
+	// adc_P 415148, adc_T 519888 of the same example; adc_H 30000
+	dumpData = []uint8{0x65, 0x5A, 0xC0, 0x7E, 0xED, 0x00, 0x75, 0x30} // 0xF7 - 0xFE
+
+	wantCalibration = calibration{
+		T1: 27504, T2: 26435, T3: -1000,
+		P1: 36477, P2: -10685, P3: 3024, P4: 2855, P5: 140, P6: -7, P7: 15500, P8: -14600, P9: 6000,
+		H1: 75, H2: 362, H3: 0, H4: 313, H5: 50, H6: 30,
+	}
+)
+
+type write struct {
+	reg   uint8
+	value uint8
+}
+
+// fakeBus is an i2c.Bus with a single BME280 behind it, backed by its register map
+type fakeBus struct {
+	regs   [256]uint8
+	writes []write
+}
+
+func newFakeBus() *fakeBus {
+	b := &fakeBus{}
+	b.regs[regChipID] = chipID
+	copy(b.regs[regCalib00:], dumpCalib00)
+	copy(b.regs[regCalib26:], dumpCalib26)
+	copy(b.regs[regPressMsb:], dumpData)
+	return b
+}
+
+func (b *fakeBus) String() string { return "fake" }
+
+func (b *fakeBus) SetSpeed(physic.Frequency) error { return nil }
+
+func (b *fakeBus) Tx(addr uint16, w, r []byte) error {
+	if addr != testAddress {
+		return fmt.Errorf("no ACK from 0x%02X", addr)
+	}
+
+	switch {
+	case len(w) == 1 && len(r) > 0:
+		// Burst reads auto-increment the register address
+		copy(r, b.regs[w[0]:])
+	case len(w) == 2 && r == nil:
+		b.writes = append(b.writes, write{w[0], w[1]})
+		if w[0] != regReset {
+			b.regs[w[0]] = w[1]
+		}
+	default:
+		return fmt.Errorf("unexpected transaction w=%x r=%d", w, len(r))
+	}
+	return nil
+}
+
+func TestParseCalibration(t *testing.T) {
+	if got := parseCalibration(dumpCalib00, dumpCalib26); got != wantCalibration {
+		t.Errorf("parseCalibration = %+v, want %+v", got, wantCalibration)
+	}
+}
+
+// Worked example of the BMP280 datasheet, 3.12
+func TestCompensateDatasheet(t *testing.T) {
+	temp, tFine := wantCalibration.compensateT(519888)
+	if temp != 2508 || tFine != 128422 {
+		t.Errorf("compensateT = %d, t_fine %d; want 2508, 128422", temp, tFine)
+	}
+
+	// The example gives 100653.27 Pa with the floating point formulas
+	if p := float64(wantCalibration.compensateP(415148, tFine)) / 256; math.Abs(p-100653.27) > 0.5 {
+		t.Errorf("compensateP = %.2f Pa, want 100653.27", p)
+	}
+}
+
+// The integer formulas of 4.2.3 against the floating point ones of 8.1
+func TestCompensateReference(t *testing.T) {
+	c := wantCalibration
+
+	for _, adcT := range []int32{400000, 480000, 519888, 560000} {
+		temp, tFine := c.compensateT(adcT)
+		wantT, wantFine := referenceT(c, adcT)
+		if math.Abs(float64(temp)/100-wantT) > 0.01 || math.Abs(float64(tFine)-wantFine) > 2 {
+			t.Errorf("adc_T %d: %.2f °C, t_fine %d; want %.2f °C, %.0f", adcT, float64(temp)/100, tFine, wantT, wantFine)
+		}
+
+		for _, adcP := range []int32{300000, 415148, 500000} {
+			p := float64(c.compensateP(adcP, tFine)) / 256
+			if want := referenceP(c, adcP, float64(tFine)); math.Abs(p-want) > 1 {
+				t.Errorf("adc_T %d, adc_P %d: %.2f Pa, want %.2f", adcT, adcP, p, want)
+			}
+		}
+
+		for _, adcH := range []int32{20000, 30000, 40000} {
+			h := float64(c.compensateH(adcH, tFine)) / 1024
+			if want := referenceH(c, adcH, float64(tFine)); math.Abs(h-want) > 0.1 {
+				t.Errorf("adc_T %d, adc_H %d: %.2f %%RH, want %.2f", adcT, adcH, h, want)
+			}
+		}
+	}
+}
+
+func TestDevice(t *testing.T) {
+	bus := newFakeBus()
+
+	d, err := NewDevice(I2CBus{Bus: bus, Address: testAddress})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Settings{OversamplingT: 2, OversamplingP: 5, OversamplingH: 1, Filter: 4, Standby: 5}
+	if err := d.Init(s); err != nil {
+		t.Fatal(err)
+	}
+	if d.calib != wantCalibration {
+		t.Errorf("calibration = %+v, want %+v", d.calib, wantCalibration)
+	}
+
+	// Sleep before config, ctrl_hum before the ctrl_meas that applies it
+	want := []write{
+		{regReset, resetCommand},
+		{regCtrlMeas, modeSleep},
+		{regConfig, 5<<5 | 4<<2},
+		{regCtrlHum, 1},
+		{regCtrlMeas, 2<<5 | 5<<2 | modeNormal},
+	}
+	if fmt.Sprint(bus.writes) != fmt.Sprint(want) {
+		t.Errorf("writes = %x, want %x", bus.writes, want)
+	}
+
+	m, err := d.Sense()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Temperature != 25.08 {
+		t.Errorf("temperature = %v °C, want 25.08", m.Temperature)
+	}
+	if math.Abs(m.Pressure-1006.5327) > 0.005 {
+		t.Errorf("pressure = %v hPa, want 1006.53", m.Pressure)
+	}
+	if want := referenceH(wantCalibration, 30000, 128422); math.Abs(m.Humidity-want) > 0.1 {
+		t.Errorf("humidity = %v %%RH, want %.2f", m.Humidity, want)
+	}
+}
+
+func TestDeviceSkipped(t *testing.T) {
+	bus := newFakeBus()
+	d, err := NewDevice(I2CBus{Bus: bus, Address: testAddress})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Init(Settings{OversamplingT: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Oversampling 0 leaves the reset values in the data registers
+	copy(bus.regs[regPressMsb:], []uint8{0x80, 0x00, 0x00, 0x7E, 0xED, 0x00, 0x80, 0x00})
+	m, err := d.Sense()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Temperature != 25.08 || m.Pressure != 0 || m.Humidity != 0 {
+		t.Errorf("Sense = %+v, want only the temperature", m)
+	}
+
+	copy(bus.regs[regPressMsb:], []uint8{0x80, 0x00, 0x00, 0x80, 0x00, 0x00, 0x80, 0x00})
+	if _, err := d.Sense(); err == nil {
+		t.Error("Sense without a temperature conversion succeeded")
+	}
+}
+
+func TestNewDevice(t *testing.T) {
+	bus := newFakeBus()
+
+	if _, err := NewDevice(I2CBus{Bus: bus, Address: 0x77}); err == nil {
+		t.Error("NewDevice at an address without a device succeeded")
+	}
+
+	bus.regs[regChipID] = 0x58 // BMP280
+	if _, err := NewDevice(I2CBus{Bus: bus, Address: testAddress}); err == nil {
+		t.Error("NewDevice with a BMP280 chip ID succeeded")
+	}
+}
+
+// ************************************************************************
+// = 8.1 Compensation formulas in double precision floating point ===
+// ------------------------------------------------------------------------
+
+func referenceT(c calibration, adcT int32) (float64, float64) {
+	var1 := (float64(adcT)/16384 - float64(c.T1)/1024) * float64(c.T2)
+	var2 := (float64(adcT)/131072 - float64(c.T1)/8192) * (float64(adcT)/131072 - float64(c.T1)/8192) * float64(c.T3)
+	return (var1 + var2) / 5120, var1 + var2
+}
+
+func referenceP(c calibration, adcP int32, tFine float64) float64 {
+	var1 := tFine/2 - 64000
+	var2 := var1 * var1 * float64(c.P6) / 32768
+	var2 = var2 + var1*float64(c.P5)*2
+	var2 = var2/4 + float64(c.P4)*65536
+	var1 = (float64(c.P3)*var1*var1/524288 + float64(c.P2)*var1) / 524288
+	var1 = (1 + var1/32768) * float64(c.P1)
+	if var1 == 0 {
+		return 0
+	}
+	p := 1048576 - float64(adcP)
+	p = (p - var2/4096) * 6250 / var1
+	var1 = float64(c.P9) * p * p / 2147483648
+	var2 = p * float64(c.P8) / 32768
+	return p + (var1+var2+float64(c.P7))/16
+}
+
+func referenceH(c calibration, adcH int32, tFine float64) float64 {
+	h := tFine - 76800
+	h = (float64(adcH) - (float64(c.H4)*64 + float64(c.H5)/16384*h)) *
+		(float64(c.H2) / 65536 * (1 + float64(c.H6)/67108864*h*(1+float64(c.H3)/67108864*h)))
+	h = h * (1 - float64(c.H1)*h/524288)
+	return min(max(h, 0), 100)
+}
+
+// ------------------------------------------------------------------------
@@ -0,0 +1,257 @@
+package bme_manager
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/sensors"
+)
+
+type BME struct {
+	ID       string
+	Name     string
+	Location string
+	Interval time.Duration
+	HW       *Device
+	Bus      *sensors.Bus
+	Settings Settings
+
+	mu     sync.Mutex
+	latest []sensors.Reading
+	err    error
+	cancel context.CancelFunc
+}
+
+// Factory instantiates every enabled BME280 from the config on the I2C / SPI buses in deps.
+func Factory(cfg *config.Config, deps *sensors.Deps) ([]sensors.Sensor, func(), error) {
+	log := slog.With("func", "Factory()", "params", "(*config.Config, *sensors.Deps)", "return", "([]sensors.Sensor, func(), error)", "package", "bme_manager")
+	log.Info("[ BME ] Sensor setup")
+
+	if cfg.BME280.Enable == false {
+		return nil, func() {}, nil
+	}
+
+	var list []sensors.Sensor
+	for key, dev := range cfg.BME280.Devices {
+		if dev.Enable == false {
+			continue
+		}
+
+		var bus Bus
+		if dev.UseI2C {
+			conn, ok := deps.I2C[dev.Bus]
+			if !ok {
+				return nil, func() {}, fmt.Errorf("[ BME ] Sensor %s: I2C bus %s not configured", key, dev.Bus)
+			}
+			bus = I2CBus{Bus: conn, Address: uint16(dev.Address)}
+		} else {
+			conn, ok := deps.SPI[dev.Bus]
+			if !ok {
+				return nil, func() {}, fmt.Errorf("[ BME ] Sensor %s: SPI bus %s not configured", key, dev.Bus)
+			}
+			bus = SPIBus{Conn: conn}
+		}
+
+		hw, err := NewDevice(bus)
+		if err != nil {
+			return nil, func() {}, fmt.Errorf("[ BME ] Sensor %s: %w", key, err)
+		}
+
+		settings := settingsFromConfig(log.With("sensor", key), dev.OversamplingT, dev.OversamplingP, dev.OversamplingH, dev.Filter, dev.StandbyTime)
+
+		list = append(list, &BME{
+			ID:       key,
+			Name:     dev.Name,
+			Location: dev.Location,
+			Interval: dev.Interval,
+			HW:       hw,
+			Bus:      deps.Bus,
+			Settings: settings,
+		})
+	}
+
+	return list, func() {}, nil
+}
+
+func settingsFromConfig(log *slog.Logger, osrsT, osrsP, osrsH, iir uint8, standbyTime time.Duration) Settings {
+	// = 5.4.3 - 5.4.5 osrs_h / osrs_t / osrs_p ===
+	wordToOversampling := map[uint8]uint8{
+		0:  0x00, // Skipped
+		1:  0x01,
+		2:  0x02,
+		4:  0x03,
+		8:  0x04,
+		16: 0x05,
+	}
+
+	oversampling := func(name string, value uint8) uint8 {
+		osrs, ok := wordToOversampling[value]
+		if !ok {
+			osrs = 0x01
+			log.Warn("[ BME ] Unknown oversampling value", "channel", name, "oversampling", value)
+			log.Warn("[ BME ] Limiting oversampling to x1")
+		}
+		return osrs
+	}
+
+	// = 5.4.6 filter ===
+	wordToFilter := map[uint8]uint8{
+		0:  0x00,
+		2:  0x01,
+		4:  0x02,
+		8:  0x03,
+		16: 0x04,
+	}
+
+	filter, ok := wordToFilter[iir]
+	if !ok {
+		filter = 0x00
+		log.Warn("[ BME ] Unknown IIR filter coefficient", "filter", iir)
+		log.Warn("[ BME ] Limiting IIR filter to off")
+	}
+
+	// = 5.4.6 t_sb ===
+	durationToStandby := map[time.Duration]uint8{
+		500 * time.Microsecond:   0x00,
+		62500 * time.Microsecond: 0x01,
+		125 * time.Millisecond:   0x02,
+		250 * time.Millisecond:   0x03,
+		500 * time.Millisecond:   0x04,
+		1000 * time.Millisecond:  0x05,
+		10 * time.Millisecond:    0x06,
+		20 * time.Millisecond:    0x07,
+	}
+
+	standby, ok := durationToStandby[standbyTime]
+	if !ok {
+		standby = 0x05
+		log.Warn("[ BME ] Unknown standby time", "standbyTime", standbyTime)
+		log.Warn("[ BME ] Limiting standby time to 1000ms")
+	}
+
+	return Settings{
+		OversamplingT: oversampling("temperature", osrsT),
+		OversamplingP: oversampling("pressure", osrsP),
+		OversamplingH: oversampling("humidity", osrsH),
+		Filter:        filter,
+		Standby:       standby,
+	}
+}
+
+func (b *BME) Describe() sensors.Info {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return sensors.Info{ID: b.ID, Kind: "bme280", Name: b.Name, Location: b.Location}
+}
+
+func (b *BME) SetLabel(name, location string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.Name, b.Location = name, location
+}
+
+func (b *BME) Read() ([]sensors.Reading, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.latest == nil {
+		return nil, fmt.Errorf("[ BME ] No measurement yet")
+	}
+
+	return append([]sensors.Reading(nil), b.latest...), nil
+}
+
+func (b *BME) Stop() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.cancel != nil {
+		b.cancel()
+	}
+	return nil
+}
+
+func (b *BME) readings(m Measurement, at time.Time) []sensors.Reading {
+	reading := func(quantity, unit string, value float64) sensors.Reading {
+		return sensors.Reading{SensorID: b.ID, Location: b.Location, Quantity: quantity, Unit: unit, Value: value, Time: at, Quality: sensors.QualityGood}
+	}
+
+	list := []sensors.Reading{reading(sensors.QuantityTemperature, sensors.UnitCelsius, m.Temperature)}
+	if b.Settings.OversamplingP != 0 {
+		list = append(list, reading(sensors.QuantityPressure, sensors.UnitHectoPascal, m.Pressure))
+	}
+	if b.Settings.OversamplingH != 0 {
+		list = append(list, reading(sensors.QuantityHumidity, sensors.UnitPercent, m.Humidity))
+	}
+	return list
+}
+
+func (b *BME) Start(ctx context.Context) error {
+	log := slog.With("func", "BME.Start()", "params", "(context.Context)", "return", "(error)", "package", "bme_manager")
+	log.Info("[ BME ] Sensor event loop", "id", b.ID)
+
+	if ctx == nil || reflect.ValueOf(ctx).IsNil() {
+		return fmt.Errorf("[ BME ] Sensor state improper; ctx is nil")
+	}
+
+	if b.HW == nil {
+		return fmt.Errorf("[ BME ] Sensor state improper; HW is nil")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	b.mu.Lock()
+	b.cancel = cancel
+	b.mu.Unlock()
+
+	if err := b.HW.Init(b.Settings); err != nil {
+		return err
+	}
+
+	interval := b.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	measureTicker := time.NewTicker(interval)
+	defer measureTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-measureTicker.C:
+			m, err := b.HW.Sense()
+			if err != nil {
+				log.Warn("[ BME ] Measurement failure", "id", b.ID, "error", err)
+
+				b.mu.Lock()
+				b.err = err
+				b.mu.Unlock()
+				continue
+			}
+
+			b.mu.Lock()
+			readings := b.readings(m, time.Now())
+			b.latest = readings
+			b.err = nil
+			b.mu.Unlock()
+
+			b.Bus.Publish(readings...)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package sensors
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// Bus fans readings out to independent consumers (MQTT, LoRa, storage, HTTP...).
+// Publish never blocks - a consumer that can't keep up loses its own readings only.
+type Bus struct {
+	mu     sync.RWMutex
+	subs   map[string]*subscription
+	closed bool
+}
+
+type subscription struct {
+	ch      chan Reading
+	dropped atomic.Uint64
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[string]*subscription)}
+}
+
+// Subscribe registers a named consumer. The returned func unsubscribes and closes the channel.
+func (b *Bus) Subscribe(name string, size int) (<-chan Reading, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := &subscription{ch: make(chan Reading, size)}
+	if b.closed {
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+
+	if old, ok := b.subs[name]; ok {
+		close(old.ch)
+	}
+	b.subs[name] = sub
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			if b.subs[name] == sub {
+				delete(b.subs, name)
+				close(sub.ch)
+			}
+		})
+	}
+}
+
+func (b *Bus) Publish(readings ...Reading) {
+	if b == nil {
+		return
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return
+	}
+
+	for name, sub := range b.subs {
+		for _, r := range readings {
+			select {
+			case sub.ch <- r:
+			default:
+				dropped := sub.dropped.Add(1)
+				slog.Debug("[ BUS ] Subscriber too slow, reading dropped", "subscriber", name, "sensor", r.SensorID, "dropped", dropped)
+			}
+		}
+	}
+}
+
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+
+	for name, sub := range b.subs {
+		close(sub.ch)
+		delete(b.subs, name)
+	}
+}
@@ -0,0 +1,18 @@
+package sensors
+
+// CRC8 is the checksum of the SGP30 words and the DHT20 frame: polynomial
+// x^8 + x^5 + x^4 + 1 (0x31), init 0xFF
+func CRC8(data []uint8) uint8 {
+	crc := uint8(0xFF)
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x31
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
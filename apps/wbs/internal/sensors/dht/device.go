@@ -0,0 +1,243 @@
+package dht_manager
+
+import (
+	"fmt"
+	"time"
+	"wbs/internal/sensors"
+
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/i2c"
+)
+
+type Measurement struct {
+	Temperature float64 // °C
+	Humidity    float64 // %RH
+}
+
+// Driver is implemented by both the I2C DHT20 and the single-wire DHT11 / DHT22.
+type Driver interface {
+	Init() error
+	Sense() (Measurement, error)
+	// MinInterval is the shortest period between two conversions allowed by the datasheet
+	MinInterval() time.Duration
+}
+
+// ErrFrame marks a corrupted frame (checksum, CRC, short read) worth retrying
+type ErrFrame struct {
+	Reason string
+}
+
+func (e ErrFrame) Error() string {
+	return fmt.Sprintf("[ DHT ] Bad frame: %s", e.Reason)
+}
+
+// ************************************************************************
+// = DHT20 (AHT20 core), I2C ===
+// ------------------------------------------------------------------------
+const (
+	dht20CmdStatus  uint8 = 0x71
+	dht20CmdTrigger uint8 = 0xAC
+
+	dht20StatusBusy       uint8 = 1 << 7
+	dht20StatusCalibrated uint8 = 0x18
+)
+
+type DHT20 struct {
+	Bus     i2c.Bus
+	Address uint16
+}
+
+func (d *DHT20) MinInterval() time.Duration { return 2 * time.Second }
+
+func (d *DHT20) Init() error {
+	// Sensor needs 100 ms after power on before it answers
+	time.Sleep(100 * time.Millisecond)
+
+	status := make([]uint8, 1)
+	if err := d.Bus.Tx(d.Address, []uint8{dht20CmdStatus}, status); err != nil {
+		return fmt.Errorf("[ DHT ] Could not read DHT20 status: %w", err)
+	}
+
+	// 7.4 - registers 0x1B, 0x1C and 0x1E have to be reinitialised when the calibration bits are off
+	if status[0]&dht20StatusCalibrated != dht20StatusCalibrated {
+		for _, reg := range []uint8{0x1B, 0x1C, 0x1E} {
+			if err := d.resetRegister(reg); err != nil {
+				return fmt.Errorf("[ DHT ] Could not initialize DHT20 register 0x%02X: %w", reg, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (d *DHT20) resetRegister(reg uint8) error {
+	if err := d.Bus.Tx(d.Address, []uint8{reg, 0x00, 0x00}, nil); err != nil {
+		return err
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	value := make([]uint8, 3)
+	if err := d.Bus.Tx(d.Address, nil, value); err != nil {
+		return err
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	return d.Bus.Tx(d.Address, []uint8{0xB0 | reg, value[1], value[2]}, nil)
+}
+
+func (d *DHT20) Sense() (Measurement, error) {
+	if err := d.Bus.Tx(d.Address, []uint8{dht20CmdTrigger, 0x33, 0x00}, nil); err != nil {
+		return Measurement{}, fmt.Errorf("[ DHT ] Could not trigger DHT20 measurement: %w", err)
+	}
+
+	// Conversion takes 80 ms, poll the busy flag a few times afterwards
+	frame := make([]uint8, 7)
+	time.Sleep(80 * time.Millisecond)
+
+	for attempt := 0; ; attempt++ {
+		if err := d.Bus.Tx(d.Address, nil, frame); err != nil {
+			return Measurement{}, fmt.Errorf("[ DHT ] Could not read DHT20 measurement: %w", err)
+		}
+		if frame[0]&dht20StatusBusy == 0 {
+			break
+		}
+		if attempt == 5 {
+			return Measurement{}, ErrFrame{Reason: "DHT20 still busy"}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if crc := sensors.CRC8(frame[:6]); crc != frame[6] {
+		return Measurement{}, ErrFrame{Reason: fmt.Sprintf("CRC mismatch, got 0x%02X want 0x%02X", frame[6], crc)}
+	}
+
+	rawH := uint32(frame[1])<<12 | uint32(frame[2])<<4 | uint32(frame[3])>>4
+	rawT := uint32(frame[3]&0x0F)<<16 | uint32(frame[4])<<8 | uint32(frame[5])
+
+	return Measurement{
+		Humidity:    float64(rawH) / (1 << 20) * 100,
+		Temperature: float64(rawT)/(1<<20)*200 - 50,
+	}, nil
+}
+
+// ------------------------------------------------------------------------
+
+// ************************************************************************
+// = DHT11 / DHT22, single-wire ===
+// ------------------------------------------------------------------------
+const (
+	frameBits = 40
+
+	// Bit value is encoded in the length of the high pulse; 26-28 us is 0, 70 us is 1
+	bitThreshold = 50 * time.Microsecond
+	frameTimeout = 10 * time.Millisecond
+)
+
+type SingleWire struct {
+	Pin  gpio.PinIO
+	Type uint8 // 11 / 22
+}
+
+func (d *SingleWire) MinInterval() time.Duration {
+	if d.Type == 11 {
+		return 1 * time.Second
+	}
+	return 2 * time.Second
+}
+
+func (d *SingleWire) Init() error {
+	// Idle state of the data line is high
+	if err := d.Pin.In(gpio.PullUp, gpio.NoEdge); err != nil {
+		return fmt.Errorf("[ DHT ] Could not configure pin %s: %w", d.Pin, err)
+	}
+
+	// Sensor is unstable for 1 s after power on
+	time.Sleep(1 * time.Second)
+	return nil
+}
+
+func (d *SingleWire) Sense() (Measurement, error) {
+	frame, err := d.readFrame()
+	if err != nil {
+		return Measurement{}, err
+	}
+
+	if sum := frame[0] + frame[1] + frame[2] + frame[3]; sum != frame[4] {
+		return Measurement{}, ErrFrame{Reason: fmt.Sprintf("checksum mismatch, got 0x%02X want 0x%02X", frame[4], sum)}
+	}
+
+	if d.Type == 11 {
+		t := float64(frame[2]) + float64(frame[3]&0x7F)/10
+		if frame[3]&0x80 != 0 {
+			t = -t
+		}
+		return Measurement{Humidity: float64(frame[0]) + float64(frame[1])/10, Temperature: t}, nil
+	}
+
+	t := float64(uint16(frame[2]&0x7F)<<8|uint16(frame[3])) / 10
+	if frame[2]&0x80 != 0 {
+		t = -t
+	}
+	return Measurement{Humidity: float64(uint16(frame[0])<<8|uint16(frame[1])) / 10, Temperature: t}, nil
+}
+
+func (d *SingleWire) readFrame() ([5]uint8, error) {
+	var frame [5]uint8
+
+	// Start signal; DHT11 needs at least 18 ms low, DHT22 at least 1 ms
+	start := 2 * time.Millisecond
+	if d.Type == 11 {
+		start = 20 * time.Millisecond
+	}
+
+	if err := d.Pin.Out(gpio.Low); err != nil {
+		return frame, fmt.Errorf("[ DHT ] Could not drive pin %s: %w", d.Pin, err)
+	}
+	time.Sleep(start)
+
+	if err := d.Pin.In(gpio.PullUp, gpio.NoEdge); err != nil {
+		return frame, fmt.Errorf("[ DHT ] Could not release pin %s: %w", d.Pin, err)
+	}
+
+	// Busy-poll the line and record the length of every completed high pulse.
+	// Expected: host release, 80 us response high, then 40 data bits.
+	highs := make([]time.Duration, 0, frameBits+2)
+	level := d.Pin.Read()
+	last := time.Now()
+	deadline := last.Add(frameTimeout)
+
+	for {
+		now := time.Now()
+		if now.After(deadline) {
+			break
+		}
+
+		l := d.Pin.Read()
+		if l == level {
+			continue
+		}
+
+		if level == gpio.High {
+			highs = append(highs, now.Sub(last))
+		}
+		level = l
+		last = now
+	}
+
+	if len(highs) < frameBits {
+		return frame, ErrFrame{Reason: fmt.Sprintf("short frame, %d of %d bits", len(highs), frameBits)}
+	}
+
+	// Leading pulses belong to the handshake
+	highs = highs[len(highs)-frameBits:]
+	for i, h := range highs {
+		frame[i/8] <<= 1
+		if h > bitThreshold {
+			frame[i/8] |= 1
+		}
+	}
+
+	return frame, nil
+}
+
+// ------------------------------------------------------------------------
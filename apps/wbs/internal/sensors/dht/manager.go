@@ -0,0 +1,220 @@
+package dht_manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/sensors"
+
+	"periph.io/x/conn/v3/gpio/gpioreg"
+)
+
+type DHT struct {
+	ID       string
+	Name     string
+	Location string
+	Interval time.Duration
+	Retries  uint8
+	HW       Driver
+	Bus      *sensors.Bus
+
+	mu     sync.Mutex
+	latest []sensors.Reading
+	err    error
+	cancel context.CancelFunc
+}
+
+// Factory instantiates every enabled DHT from the config; DHT20 on the I2C buses in deps,
+// DHT11 / DHT22 on a GPIO pin.
+func Factory(cfg *config.Config, deps *sensors.Deps) ([]sensors.Sensor, func(), error) {
+	log := slog.With("func", "Factory()", "params", "(*config.Config, *sensors.Deps)", "return", "([]sensors.Sensor, func(), error)", "package", "dht_manager")
+	log.Info("[ DHT ] Sensor setup")
+
+	if cfg.DHT.Enable == false {
+		return nil, func() {}, nil
+	}
+
+	var list []sensors.Sensor
+	for key, dev := range cfg.DHT.Devices {
+		if dev.Enable == false {
+			continue
+		}
+
+		var hw Driver
+		switch dev.Type {
+		case 20:
+			bus, ok := deps.I2C[dev.Bus]
+			if !ok {
+				return nil, func() {}, fmt.Errorf("[ DHT ] Sensor %s: I2C bus %s not configured", key, dev.Bus)
+			}
+			hw = &DHT20{Bus: bus, Address: uint16(dev.Address)}
+		case 11, 22:
+			pin := gpioreg.ByName(dev.Pin)
+			if pin == nil {
+				return nil, func() {}, fmt.Errorf("[ DHT ] Sensor %s: unknown pin %s", key, dev.Pin)
+			}
+			hw = &SingleWire{Pin: pin, Type: dev.Type}
+		default:
+			return nil, func() {}, fmt.Errorf("[ DHT ] Sensor %s: unknown type %d", key, dev.Type)
+		}
+
+		interval := dev.Interval
+		if interval < hw.MinInterval() {
+			log.Warn("[ DHT ] Interval shorter than sensor allows", "sensor", key, "interval", interval)
+			log.Warn("[ DHT ] Limiting interval to sensor minimum", "interval", hw.MinInterval())
+			interval = hw.MinInterval()
+		}
+
+		list = append(list, &DHT{
+			ID:       key,
+			Name:     dev.Name,
+			Location: dev.Location,
+			Interval: interval,
+			Retries:  dev.Retries,
+			HW:       hw,
+			Bus:      deps.Bus,
+		})
+	}
+
+	return list, func() {}, nil
+}
+
+func (d *DHT) Describe() sensors.Info {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return sensors.Info{ID: d.ID, Kind: "dht", Name: d.Name, Location: d.Location}
+}
+
+func (d *DHT) SetLabel(name, location string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Name, d.Location = name, location
+}
+
+func (d *DHT) Read() ([]sensors.Reading, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	if d.latest == nil {
+		return nil, fmt.Errorf("[ DHT ] No measurement yet")
+	}
+
+	return append([]sensors.Reading(nil), d.latest...), nil
+}
+
+func (d *DHT) Stop() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cancel != nil {
+		d.cancel()
+	}
+	return nil
+}
+
+func (d *DHT) readings(m Measurement, at time.Time) []sensors.Reading {
+	return []sensors.Reading{
+		{SensorID: d.ID, Location: d.Location, Quantity: sensors.QuantityTemperature, Unit: sensors.UnitCelsius, Value: m.Temperature, Time: at, Quality: sensors.QualityGood},
+		{SensorID: d.ID, Location: d.Location, Quantity: sensors.QuantityHumidity, Unit: sensors.UnitPercent, Value: m.Humidity, Time: at, Quality: sensors.QualityGood},
+	}
+}
+
+// sense retries corrupted frames. The sensor won't start a new conversion before
+// MinInterval has passed, so every retry has to wait for it as well.
+func (d *DHT) sense(ctx context.Context) (Measurement, error) {
+	log := slog.With("package", "dht_manager")
+
+	var err error
+	for attempt := uint8(0); attempt <= d.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return Measurement{}, ctx.Err()
+			case <-time.After(d.HW.MinInterval()):
+			}
+		}
+
+		var m Measurement
+		m, err = d.HW.Sense()
+		if err == nil {
+			return m, nil
+		}
+
+		var frameErr ErrFrame
+		if !errors.As(err, &frameErr) {
+			return Measurement{}, err
+		}
+		log.Debug("[ DHT ] Bad frame, retrying", "id", d.ID, "attempt", attempt+1, "error", err)
+	}
+
+	return Measurement{}, err
+}
+
+func (d *DHT) Start(ctx context.Context) error {
+	log := slog.With("func", "DHT.Start()", "params", "(context.Context)", "return", "(error)", "package", "dht_manager")
+	log.Info("[ DHT ] Sensor event loop", "id", d.ID)
+
+	if ctx == nil || reflect.ValueOf(ctx).IsNil() {
+		return fmt.Errorf("[ DHT ] Sensor state improper; ctx is nil")
+	}
+
+	if d.HW == nil {
+		return fmt.Errorf("[ DHT ] Sensor state improper; HW is nil")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	d.mu.Lock()
+	d.cancel = cancel
+	d.mu.Unlock()
+
+	if err := d.HW.Init(); err != nil {
+		return err
+	}
+
+	measureTicker := time.NewTicker(d.Interval)
+	defer measureTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-measureTicker.C:
+			m, err := d.sense(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				log.Warn("[ DHT ] Measurement failure", "id", d.ID, "error", err)
+
+				d.mu.Lock()
+				d.err = err
+				d.mu.Unlock()
+				continue
+			}
+
+			d.mu.Lock()
+			readings := d.readings(m, time.Now())
+			d.latest = readings
+			d.err = nil
+			d.mu.Unlock()
+
+			d.Bus.Publish(readings...)
+		}
+	}
+}
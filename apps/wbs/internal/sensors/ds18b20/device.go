@@ -0,0 +1,109 @@
+package ds18b20_manager
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"periph.io/x/conn/v3/onewire"
+)
+
+// ************************************************************************
+// = DS18B20 function commands ===
+// ------------------------------------------------------------------------
+const (
+	cmdSkipROM         uint8 = 0xCC
+	cmdConvertT        uint8 = 0x44
+	cmdWriteScratchpad uint8 = 0x4E
+	cmdReadScratchpad  uint8 = 0xBE
+
+	familyCode uint8 = 0x28
+
+	// Scratchpad content after power-on, 85 °C
+	powerOnReset int16 = 0x0550
+)
+
+// ------------------------------------------------------------------------
+
+// Configuration register R1:R0 and max conversion time, see table 2
+var resolutions = map[uint8]struct {
+	config     uint8
+	conversion time.Duration
+	mask       int16 // Undefined low bits for lower resolutions
+}{
+	9:  {0x1F, 94 * time.Millisecond, ^int16(0x07)},
+	10: {0x3F, 188 * time.Millisecond, ^int16(0x03)},
+	11: {0x5F, 375 * time.Millisecond, ^int16(0x01)},
+	12: {0x7F, 750 * time.Millisecond, ^int16(0x00)},
+}
+
+// ROM formats the address the way the Linux w1 driver names the device, e.g. 28-0000012345ab
+func ROM(addr onewire.Address) string {
+	return fmt.Sprintf("%02x-%012x", uint64(addr)&0xFF, (uint64(addr)>>8)&0xFFFFFFFFFFFF)
+}
+
+// ParseROM accepts both the w1 notation (28-0000012345ab) and a full 64-bit
+// periph address (0x7a0000012345ab28) and returns the w1 notation.
+func ParseROM(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	if family, serial, ok := strings.Cut(s, "-"); ok {
+		f, err := strconv.ParseUint(family, 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("[ DS18B20 ] Invalid family code in ROM %q: %w", s, err)
+		}
+		n, err := strconv.ParseUint(serial, 16, 48)
+		if err != nil {
+			return "", fmt.Errorf("[ DS18B20 ] Invalid serial number in ROM %q: %w", s, err)
+		}
+		return fmt.Sprintf("%02x-%012x", f, n), nil
+	}
+
+	addr, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+	if err != nil {
+		return "", fmt.Errorf("[ DS18B20 ] Invalid ROM %q: %w", s, err)
+	}
+	return ROM(onewire.Address(addr)), nil
+}
+
+type Probe struct {
+	Dev        onewire.Dev
+	Resolution uint8
+}
+
+// Configure writes the resolution to the scratchpad (TH / TL alarm bytes are left at 0).
+func (p *Probe) Configure() error {
+	res, ok := resolutions[p.Resolution]
+	if !ok {
+		return fmt.Errorf("[ DS18B20 ] Unsupported resolution %d bits", p.Resolution)
+	}
+
+	return p.Dev.Tx([]uint8{cmdWriteScratchpad, 0x00, 0x00, res.config}, nil)
+}
+
+// Temperature reads the scratchpad of a probe after a conversion.
+// Returns the raw register value as well, so callers can spot the 85 °C reset value.
+func (p *Probe) Temperature() (float64, int16, error) {
+	scratchpad := make([]uint8, 9)
+	if err := p.Dev.Tx([]uint8{cmdReadScratchpad}, scratchpad); err != nil {
+		return 0, 0, fmt.Errorf("[ DS18B20 ] Could not read scratchpad of %s: %w", ROM(p.Dev.Addr), err)
+	}
+
+	if !onewire.CheckCRC(scratchpad) {
+		return 0, 0, fmt.Errorf("[ DS18B20 ] Scratchpad CRC mismatch for %s", ROM(p.Dev.Addr))
+	}
+
+	raw := int16(uint16(scratchpad[1])<<8 | uint16(scratchpad[0]))
+	if res, ok := resolutions[p.Resolution]; ok {
+		raw &= res.mask
+	}
+
+	return float64(raw) / 16, raw, nil
+}
+
+// ConvertAll starts a temperature conversion on every probe of the bus at once.
+// Strong pull-up keeps parasite powered probes alive during the conversion.
+func ConvertAll(bus onewire.Bus) error {
+	return bus.Tx([]uint8{cmdSkipROM, cmdConvertT}, nil, onewire.StrongPullup)
+}
@@ -0,0 +1,369 @@
+package ds18b20_manager
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/sensors"
+
+	"periph.io/x/conn/v3/onewire"
+)
+
+type probeConfig struct {
+	ID         string
+	Name       string
+	Location   string
+	Resolution uint8
+}
+
+// DS runs every DS18B20 on a single 1-Wire bus. All probes convert at the same time,
+// so a whole bus is a single sensor for the registry while readings carry the probe IDs.
+type DS struct {
+	ID       string
+	OW       onewire.Bus
+	Interval time.Duration
+	Rescan   time.Duration
+	Probes   map[string]probeConfig // ROM -> config
+	Bus      *sensors.Bus
+
+	mu      sync.Mutex
+	present map[string]*Probe // ROM -> probe found by the last ROM search
+	unknown map[string]bool   // ROMs already reported as missing from the config
+	last    map[string]float64
+	latest  map[string]sensors.Reading
+	err     error
+	cancel  context.CancelFunc
+}
+
+// Factory groups every enabled DS18B20 from the config by the 1-Wire bus in deps it sits on.
+func Factory(cfg *config.Config, deps *sensors.Deps) ([]sensors.Sensor, func(), error) {
+	log := slog.With("func", "Factory()", "params", "(*config.Config, *sensors.Deps)", "return", "([]sensors.Sensor, func(), error)", "package", "ds18b20_manager")
+	log.Info("[ DS18B20 ] Sensor setup")
+
+	if cfg.DS18B20.Enable == false {
+		return nil, func() {}, nil
+	}
+
+	if len(deps.OneWire) == 0 {
+		return nil, func() {}, fmt.Errorf("[ DS18B20 ] No 1-Wire bus configured")
+	}
+
+	probes := make(map[string]map[string]probeConfig)
+	for key, dev := range cfg.DS18B20.Devices {
+		if dev.Enable == false {
+			continue
+		}
+
+		if _, ok := deps.OneWire[dev.Bus]; !ok {
+			return nil, func() {}, fmt.Errorf("[ DS18B20 ] Sensor %s: 1-Wire bus %s not configured", key, dev.Bus)
+		}
+
+		rom, err := ParseROM(dev.ROM)
+		if err != nil {
+			return nil, func() {}, fmt.Errorf("[ DS18B20 ] Sensor %s: %w", key, err)
+		}
+
+		resolution := dev.Resolution
+		if _, ok := resolutions[resolution]; !ok {
+			log.Warn("[ DS18B20 ] Unknown resolution", "sensor", key, "resolution", resolution)
+			log.Warn("[ DS18B20 ] Limiting resolution to 12 bits")
+			resolution = 12
+		}
+
+		if probes[dev.Bus] == nil {
+			probes[dev.Bus] = make(map[string]probeConfig)
+		}
+		probes[dev.Bus][rom] = probeConfig{ID: key, Name: dev.Name, Location: dev.Location, Resolution: resolution}
+	}
+
+	// Buses without configured probes are still searched, so new probes show up in the log
+	var list []sensors.Sensor
+	for key, bus := range deps.OneWire {
+		list = append(list, &DS{
+			ID:       key,
+			OW:       bus,
+			Interval: cfg.DS18B20.Interval,
+			Rescan:   cfg.DS18B20.Rescan,
+			Probes:   probes[key],
+			Bus:      deps.Bus,
+		})
+	}
+
+	return list, func() {}, nil
+}
+
+func (d *DS) Describe() sensors.Info {
+	return sensors.Info{ID: d.ID, Kind: "ds18b20", Name: d.OW.String()}
+}
+
+// SetProbeLabel renames the probe with config key id; false when it isn't on this bus
+// or nothing changed.
+func (d *DS) SetProbeLabel(id, name, location string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for rom, pc := range d.Probes {
+		if pc.ID != id {
+			continue
+		}
+		if pc.Name == name && pc.Location == location {
+			return false
+		}
+
+		pc.Name, pc.Location = name, location
+		d.Probes[rom] = pc
+		if r, ok := d.latest[id]; ok {
+			r.Location = location
+			d.latest[id] = r
+		}
+		return true
+	}
+	return false
+}
+
+func (d *DS) Read() ([]sensors.Reading, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.latest) == 0 {
+		return nil, fmt.Errorf("[ DS18B20 ] No measurement yet")
+	}
+
+	list := make([]sensors.Reading, 0, len(d.latest))
+	for _, r := range d.latest {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].SensorID < list[j].SensorID })
+
+	return list, nil
+}
+
+func (d *DS) Stop() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cancel != nil {
+		d.cancel()
+	}
+	return nil
+}
+
+// scan runs a ROM search, configures newly found probes and reports the unknown / missing ones.
+func (d *DS) scan() error {
+	log := slog.With("func", "DS.scan()", "params", "(-)", "return", "(error)", "package", "ds18b20_manager")
+
+	addrs, err := d.OW.Search(false)
+	if err != nil {
+		return fmt.Errorf("[ DS18B20 ] ROM search on %s failed: %w", d.ID, err)
+	}
+
+	found := make(map[string]bool)
+	for _, addr := range addrs {
+		if uint8(addr&0xFF) != familyCode {
+			continue
+		}
+
+		rom := ROM(addr)
+		found[rom] = true
+
+		pc, ok := d.Probes[rom]
+		if !ok {
+			if !d.unknown[rom] {
+				log.Warn("[ DS18B20 ] Unknown probe, add it to the config to use it", "bus", d.ID, "rom", rom)
+				d.unknown[rom] = true
+			}
+			continue
+		}
+
+		if _, ok := d.present[rom]; ok {
+			continue
+		}
+
+		probe := &Probe{Dev: onewire.Dev{Bus: d.OW, Addr: addr}, Resolution: pc.Resolution}
+		if err := probe.Configure(); err != nil {
+			log.Warn("[ DS18B20 ] Could not configure probe", "sensor", pc.ID, "rom", rom, "error", err)
+			continue
+		}
+		d.present[rom] = probe
+		log.Info("[ DS18B20 ] Probe found", "sensor", pc.ID, "rom", rom, "resolution", pc.Resolution)
+	}
+
+	for rom, pc := range d.Probes {
+		if found[rom] {
+			continue
+		}
+		if _, ok := d.present[rom]; ok {
+			delete(d.present, rom)
+			delete(d.latest, pc.ID)
+		}
+		log.Warn("[ DS18B20 ] Configured probe not found on bus", "sensor", pc.ID, "bus", d.ID, "rom", rom)
+	}
+
+	return nil
+}
+
+// measure converts every present probe at once and reads the scratchpads one by one.
+// It takes d.mu itself and lets go of it for the conversion, which lasts up to 750 ms,
+// so Read and Stop don't wait for it.
+func (d *DS) measure(ctx context.Context) ([]sensors.Reading, error) {
+	log := slog.With("func", "DS.measure()", "params", "(context.Context)", "return", "([]sensors.Reading, error)", "package", "ds18b20_manager")
+
+	d.mu.Lock()
+	if len(d.present) == 0 {
+		d.mu.Unlock()
+		return nil, nil
+	}
+
+	var wait time.Duration
+	for _, probe := range d.present {
+		wait = max(wait, resolutions[probe.Resolution].conversion)
+	}
+
+	err := ConvertAll(d.OW)
+	d.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("[ DS18B20 ] Could not start conversion on %s: %w", d.ID, err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(wait):
+	}
+
+	// Probes only come and go in scan, which runs on this goroutine too
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	at := time.Now()
+	var readings []sensors.Reading
+	for rom, probe := range d.present {
+		pc := d.Probes[rom]
+
+		value, raw, err := probe.Temperature()
+		if err != nil {
+			log.Warn("[ DS18B20 ] Measurement failure", "sensor", pc.ID, "error", err)
+			continue
+		}
+
+		quality := sensors.QualityGood
+
+		// 85 °C straight after power-on means the probe browned out and lost its
+		// scratchpad; unless we were already near 85 °C, drop it and reapply resolution.
+		prev, ok := d.last[rom]
+		if raw == powerOnReset && (!ok || math.Abs(prev-value) > 1) {
+			log.Warn("[ DS18B20 ] Power-on reset value read, probe lost power", "sensor", pc.ID, "rom", rom)
+			quality = sensors.QualityInvalid
+
+			if err := probe.Configure(); err != nil {
+				log.Warn("[ DS18B20 ] Could not configure probe", "sensor", pc.ID, "rom", rom, "error", err)
+			}
+		} else {
+			d.last[rom] = value
+		}
+
+		readings = append(readings, sensors.Reading{SensorID: pc.ID, Location: pc.Location, Quantity: sensors.QuantityTemperature, Unit: sensors.UnitCelsius, Value: value, Time: at, Quality: quality})
+	}
+
+	return readings, nil
+}
+
+func (d *DS) Start(ctx context.Context) error {
+	log := slog.With("func", "DS.Start()", "params", "(context.Context)", "return", "(error)", "package", "ds18b20_manager")
+	log.Info("[ DS18B20 ] Sensor event loop", "bus", d.ID)
+
+	if ctx == nil || reflect.ValueOf(ctx).IsNil() {
+		return fmt.Errorf("[ DS18B20 ] Sensor state improper; ctx is nil")
+	}
+
+	if d.OW == nil {
+		return fmt.Errorf("[ DS18B20 ] Sensor state improper; OW is nil")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	d.mu.Lock()
+	d.cancel = cancel
+	d.present = make(map[string]*Probe)
+	d.unknown = make(map[string]bool)
+	d.last = make(map[string]float64)
+	d.latest = make(map[string]sensors.Reading)
+	d.mu.Unlock()
+
+	// The search is repeated on rescan, a failure here is not fatal
+	d.mu.Lock()
+	if err := d.scan(); err != nil {
+		log.Warn("[ DS18B20 ] ROM search failure", "bus", d.ID, "error", err)
+	}
+	d.mu.Unlock()
+
+	interval := d.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	rescan := d.Rescan
+	if rescan <= 0 {
+		rescan = 10 * time.Minute
+	}
+
+	measureTicker := time.NewTicker(interval)
+	defer measureTicker.Stop()
+
+	rescanTicker := time.NewTicker(rescan)
+	defer rescanTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-rescanTicker.C:
+			d.mu.Lock()
+			err := d.scan()
+			d.mu.Unlock()
+
+			if err != nil {
+				log.Warn("[ DS18B20 ] ROM search failure", "bus", d.ID, "error", err)
+			}
+		case <-measureTicker.C:
+			readings, err := d.measure(ctx)
+
+			d.mu.Lock()
+			if err != nil {
+				d.err = err
+			} else {
+				d.err = nil
+				for _, r := range readings {
+					if r.Quality != sensors.QualityInvalid {
+						d.latest[r.SensorID] = r
+					}
+				}
+			}
+			d.mu.Unlock()
+
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				log.Warn("[ DS18B20 ] Measurement failure", "bus", d.ID, "error", err)
+				continue
+			}
+
+			d.Bus.Publish(readings...)
+		}
+	}
+}
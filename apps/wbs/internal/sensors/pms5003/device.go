@@ -0,0 +1,160 @@
+package pms_manager
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"periph.io/x/conn/v3"
+)
+
+// ************************************************************************
+// = PMS5003 protocol ===
+// ------------------------------------------------------------------------
+const (
+	startByte1 uint8 = 0x42
+	startByte2 uint8 = 0x4D
+
+	FrameSize   = 32
+	frameLength = FrameSize - 4 // Length field counts data + checksum
+
+	cmdRead  uint8 = 0xE2
+	cmdMode  uint8 = 0xE1
+	cmdSleep uint8 = 0xE4
+
+	modePassive uint8 = 0x00
+	modeActive  uint8 = 0x01
+
+	sleepOn  uint8 = 0x00
+	sleepOff uint8 = 0x01
+
+	// Fan needs at least 30 s after wake-up before the data is stable
+	WakeUpTime = 30 * time.Second
+)
+
+// Measurement is a single data frame; standard particle (CF=1) values are left out,
+// atmospheric environment values are what every other tool reports.
+type Measurement struct {
+	PM1  uint16 // µg/m³
+	PM25 uint16
+	PM10 uint16
+
+	Particles03 uint16 // Count of particles above 0.3 µm in 0.1 L of air
+	Particles05 uint16
+	Particles1  uint16
+	Particles25 uint16
+	Particles5  uint16
+	Particles10 uint16
+}
+
+// ParseFrame decodes a complete 32 byte frame, header included.
+func ParseFrame(frame []uint8) (Measurement, error) {
+	if len(frame) != FrameSize {
+		return Measurement{}, fmt.Errorf("[ PMS ] Invalid frame size %d", len(frame))
+	}
+
+	if frame[0] != startByte1 || frame[1] != startByte2 {
+		return Measurement{}, fmt.Errorf("[ PMS ] Invalid frame header 0x%02X 0x%02X", frame[0], frame[1])
+	}
+
+	if length := binary.BigEndian.Uint16(frame[2:4]); length != frameLength {
+		return Measurement{}, fmt.Errorf("[ PMS ] Invalid frame length %d", length)
+	}
+
+	var sum uint16
+	for _, b := range frame[:FrameSize-2] {
+		sum += uint16(b)
+	}
+	if checksum := binary.BigEndian.Uint16(frame[FrameSize-2:]); checksum != sum {
+		return Measurement{}, fmt.Errorf("[ PMS ] Checksum mismatch, got 0x%04X want 0x%04X", checksum, sum)
+	}
+
+	data := func(n int) uint16 {
+		return binary.BigEndian.Uint16(frame[4+2*(n-1):])
+	}
+
+	// Data 1 - 3 are CF=1 values, data 13 is reserved
+	return Measurement{
+		PM1:         data(4),
+		PM25:        data(5),
+		PM10:        data(6),
+		Particles03: data(7),
+		Particles05: data(8),
+		Particles1:  data(9),
+		Particles25: data(10),
+		Particles5:  data(11),
+		Particles10: data(12),
+	}, nil
+}
+
+type Device struct {
+	Conn conn.Conn
+}
+
+func (d *Device) command(cmd, data uint8) error {
+	frame := []uint8{startByte1, startByte2, cmd, 0x00, data, 0x00, 0x00}
+
+	var sum uint16
+	for _, b := range frame[:5] {
+		sum += uint16(b)
+	}
+	binary.BigEndian.PutUint16(frame[5:], sum)
+
+	if err := d.Conn.Tx(frame, nil); err != nil {
+		return fmt.Errorf("[ PMS ] Could not send command 0x%02X: %w", cmd, err)
+	}
+	return nil
+}
+
+func (d *Device) SetPassive() error { return d.command(cmdMode, modePassive) }
+func (d *Device) SetActive() error  { return d.command(cmdMode, modeActive) }
+func (d *Device) Sleep() error      { return d.command(cmdSleep, sleepOn) }
+func (d *Device) WakeUp() error     { return d.command(cmdSleep, sleepOff) }
+
+// RequestRead asks for a single frame in passive mode.
+func (d *Device) RequestRead() error { return d.command(cmdRead, 0x00) }
+
+// ReadFrame scans the stream for the frame header, so command responses and partial
+// frames left in the buffer are skipped.
+func (d *Device) ReadFrame() (Measurement, error) {
+	frame := make([]uint8, FrameSize)
+	b := make([]uint8, 1)
+
+	// Two frames worth of bytes is enough to find a header in a healthy stream
+	for skipped := 0; skipped < 2*FrameSize; skipped++ {
+		if err := d.Conn.Tx(nil, b); err != nil {
+			return Measurement{}, fmt.Errorf("[ PMS ] Could not read frame: %w", err)
+		}
+
+		if b[0] != startByte1 {
+			continue
+		}
+
+		if err := d.Conn.Tx(nil, b); err != nil {
+			return Measurement{}, fmt.Errorf("[ PMS ] Could not read frame: %w", err)
+		}
+		if b[0] != startByte2 {
+			continue
+		}
+
+		frame[0], frame[1] = startByte1, startByte2
+		if err := d.Conn.Tx(nil, frame[2:4]); err != nil {
+			return Measurement{}, fmt.Errorf("[ PMS ] Could not read frame: %w", err)
+		}
+
+		// Answers to mode / sleep commands are 8 bytes long
+		if length := binary.BigEndian.Uint16(frame[2:4]); length != frameLength {
+			continue
+		}
+
+		if err := d.Conn.Tx(nil, frame[4:]); err != nil {
+			return Measurement{}, fmt.Errorf("[ PMS ] Could not read frame: %w", err)
+		}
+
+		return ParseFrame(frame)
+	}
+
+	return Measurement{}, fmt.Errorf("[ PMS ] No frame header found in the stream")
+}
+
+// ------------------------------------------------------------------------
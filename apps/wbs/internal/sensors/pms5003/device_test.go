@@ -0,0 +1,157 @@
+package pms_manager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"periph.io/x/conn/v3"
+)
+
+// Active mode frame in clean indoor air: PM 5 / 8 / 9 µg/m³ atmospheric, CF=1 a bit lower
+var testFrame = []uint8{
+	0x42, 0x4D, 0x00, 0x1C,
+	0x00, 0x04, 0x00, 0x07, 0x00, 0x08, // CF=1
+	0x00, 0x05, 0x00, 0x08, 0x00, 0x09, // Atmospheric
+	0x03, 0x4E, 0x00, 0xF5, 0x00, 0x2C, 0x00, 0x04, 0x00, 0x01, 0x00, 0x00, // Particles
+	0x97, 0x00, // Reserved
+	0x02, 0xE2,
+}
+
+var testMeasurement = Measurement{
+	PM1: 5, PM25: 8, PM10: 9,
+	Particles03: 846, Particles05: 245, Particles1: 44, Particles25: 4, Particles5: 1, Particles10: 0,
+}
+
+// frame builds a checksummed frame with the given data words
+func frame(data [13]uint16) []uint8 {
+	f := []uint8{startByte1, startByte2, 0x00, frameLength}
+	for _, d := range data {
+		f = binary.BigEndian.AppendUint16(f, d)
+	}
+
+	var sum uint16
+	for _, b := range f {
+		sum += uint16(b)
+	}
+	return binary.BigEndian.AppendUint16(f, sum)
+}
+
+// fakeUART plays back a byte stream, as the sensor's UART would
+type fakeUART struct {
+	r io.Reader
+}
+
+func (u *fakeUART) String() string { return "fake" }
+
+func (u *fakeUART) Duplex() conn.Duplex { return conn.Full }
+
+func (u *fakeUART) Tx(w, r []byte) error {
+	if len(r) == 0 {
+		return nil
+	}
+	_, err := io.ReadFull(u.r, r)
+	return err
+}
+
+func TestParseFrame(t *testing.T) {
+	m, err := ParseFrame(testFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != testMeasurement {
+		t.Errorf("ParseFrame = %+v, want %+v", m, testMeasurement)
+	}
+
+	if !bytes.Equal(frame([13]uint16{4, 7, 8, 5, 8, 9, 846, 245, 44, 4, 1, 0, 0x9700}), testFrame) {
+		t.Error("frame() disagrees with testFrame")
+	}
+}
+
+func TestParseFrameErrors(t *testing.T) {
+	corrupt := func(i int, b uint8) []uint8 {
+		f := bytes.Clone(testFrame)
+		f[i] = b
+		return f
+	}
+
+	tests := []struct {
+		name  string
+		frame []uint8
+	}{
+		{"short", testFrame[:FrameSize-1]},
+		{"long", append(bytes.Clone(testFrame), 0)},
+		{"header", corrupt(1, 0x4E)},
+		{"length", corrupt(3, 0x04)},
+		{"checksum", corrupt(12, 0x09)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseFrame(tt.frame); err == nil {
+				t.Error("ParseFrame succeeded")
+			}
+		})
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	var stream []uint8
+	stream = append(stream, testFrame[20:]...)                              // Tail of a frame
+	stream = append(stream, 0x42, 0x4D, 0x00, 0x04, 0xE1, 0x01, 0x01, 0x75) // Answer to SetActive
+	stream = append(stream, 0x42, 0x42, 0x4D)                               // Noise before the header
+	stream = append(stream, testFrame...)
+
+	d := &Device{Conn: &fakeUART{r: bytes.NewReader(stream)}}
+	m, err := d.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != testMeasurement {
+		t.Errorf("ReadFrame = %+v, want %+v", m, testMeasurement)
+	}
+
+	if _, err := d.ReadFrame(); err == nil {
+		t.Error("ReadFrame at the end of the stream succeeded")
+	}
+
+	d = &Device{Conn: &fakeUART{r: bytes.NewReader(make([]uint8, 3*FrameSize))}}
+	if _, err := d.ReadFrame(); err == nil {
+		t.Error("ReadFrame without a header succeeded")
+	}
+}
+
+// FuzzParseFrame makes sure line noise never panics the parser, and that whatever it
+// accepts carries a valid checksum and the atmospheric values at their offsets.
+func FuzzParseFrame(f *testing.F) {
+	f.Add(testFrame)
+	f.Add(frame([13]uint16{}))
+	f.Add(frame([13]uint16{0xFFFF, 0xFFFF, 0xFFFF, 0xFFFF, 0xFFFF, 0xFFFF, 0xFFFF, 0xFFFF, 0xFFFF, 0xFFFF, 0xFFFF, 0xFFFF, 0xFFFF}))
+	f.Add([]uint8{0x42, 0x4D, 0x00, 0x04, 0xE1, 0x01, 0x01, 0x75})
+	f.Add([]uint8{})
+
+	f.Fuzz(func(t *testing.T, data []uint8) {
+		m, err := ParseFrame(data)
+		if err != nil {
+			return
+		}
+
+		var words [13]uint16
+		for i := range words {
+			words[i] = binary.BigEndian.Uint16(data[4+2*i:])
+		}
+		if !bytes.Equal(frame(words), data) {
+			t.Fatalf("ParseFrame accepted %x, which isn't a well formed frame", data)
+		}
+		if m.PM25 != words[4] || m.Particles10 != words[11] {
+			t.Fatalf("ParseFrame(%x) = %+v", data, m)
+		}
+
+		// The same bytes as a UART stream must not trip ReadFrame either
+		d := &Device{Conn: &fakeUART{r: bytes.NewReader(data)}}
+		if got, err := d.ReadFrame(); err != nil || got != m {
+			t.Fatalf("ReadFrame(%x) = %+v, %v; want %+v", data, got, err, m)
+		}
+	})
+}
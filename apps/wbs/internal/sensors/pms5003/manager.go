@@ -0,0 +1,377 @@
+package pms_manager
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/sensors"
+)
+
+const (
+	// Hygroscopicity of typical urban aerosol, κ-Köhler growth model
+	kappa = 0.4
+	// Growth factor explodes close to saturation
+	maxHumidity = 95.0
+
+	// Pause after a failed frame read, doubled on every failure in a row; a port that
+	// fails at once would otherwise keep the goroutine spinning
+	streamBackoff    = 100 * time.Millisecond
+	maxStreamBackoff = 10 * time.Second
+)
+
+type PMS struct {
+	ID       string
+	Name     string
+	Location string
+	Interval time.Duration
+	Passive  bool
+	Sleep    bool // Passive mode only; fan is stopped between measurements
+	Samples  int  // Moving average window, 1 is raw data
+	HW       *Device
+	Bus      *sensors.Bus
+	Ambient  *sensors.Ambient
+
+	HumidityCompensation bool
+	AmbientKinds         []string
+
+	mu     sync.Mutex
+	window []Measurement
+	latest []sensors.Reading
+	err    error
+	cancel context.CancelFunc
+}
+
+// Factory instantiates every enabled PMS5003 from the config on the UART ports in deps.
+func Factory(cfg *config.Config, deps *sensors.Deps) ([]sensors.Sensor, func(), error) {
+	log := slog.With("func", "Factory()", "params", "(*config.Config, *sensors.Deps)", "return", "([]sensors.Sensor, func(), error)", "package", "pms_manager")
+	log.Info("[ PMS ] Sensor setup")
+
+	if cfg.PMS5003.Enable == false {
+		return nil, func() {}, nil
+	}
+
+	wordToPassive := map[string]bool{
+		"passive": true,
+		"active":  false,
+	}
+
+	var list []sensors.Sensor
+	for key, dev := range cfg.PMS5003.Devices {
+		if dev.Enable == false {
+			continue
+		}
+
+		port, ok := deps.UART[dev.Port]
+		if !ok {
+			return nil, func() {}, fmt.Errorf("[ PMS ] Sensor %s: UART port %s not configured", key, dev.Port)
+		}
+
+		passive, ok := wordToPassive[dev.Mode]
+		if !ok {
+			passive = true
+			log.Warn("[ PMS ] Unknown mode", "sensor", key, "mode", dev.Mode)
+			log.Warn("[ PMS ] Limiting mode to passive")
+		}
+
+		sleep := dev.Sleep
+		if sleep && (!passive || dev.Interval <= WakeUpTime) {
+			sleep = false
+			log.Warn("[ PMS ] Sleep needs passive mode and interval longer than wake-up time", "sensor", key, "interval", dev.Interval)
+			log.Warn("[ PMS ] Limiting sleep to off")
+		}
+
+		samples := 1
+		if dev.NormalizeData {
+			samples = max(int(dev.Samples), 1)
+		}
+
+		var kinds []string
+		if dev.UseDHT {
+			kinds = append(kinds, "dht")
+		}
+		if dev.UseBME {
+			kinds = append(kinds, "bme280")
+		}
+		if dev.HumidityCompensation && len(kinds) == 0 {
+			log.Warn("[ PMS ] Humidity compensation enabled without use_dht / use_bme", "sensor", key)
+		}
+
+		list = append(list, &PMS{
+			ID:                   key,
+			Name:                 dev.Name,
+			Location:             dev.Location,
+			Interval:             dev.Interval,
+			Passive:              passive,
+			Sleep:                sleep,
+			Samples:              samples,
+			HW:                   &Device{Conn: port},
+			Bus:                  deps.Bus,
+			Ambient:              deps.Ambient,
+			HumidityCompensation: dev.HumidityCompensation,
+			AmbientKinds:         kinds,
+		})
+	}
+
+	return list, func() {}, nil
+}
+
+func (p *PMS) Describe() sensors.Info {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return sensors.Info{ID: p.ID, Kind: "pms5003", Name: p.Name, Location: p.Location}
+}
+
+func (p *PMS) SetLabel(name, location string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.Name, p.Location = name, location
+}
+
+func (p *PMS) Read() ([]sensors.Reading, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.latest == nil {
+		return nil, fmt.Errorf("[ PMS ] No measurement yet")
+	}
+
+	return append([]sensors.Reading(nil), p.latest...), nil
+}
+
+func (p *PMS) Stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cancel != nil {
+		p.cancel()
+	}
+	return nil
+}
+
+// smooth adds m to the moving average window and returns the mean of every field.
+func (p *PMS) smooth(m Measurement) [9]float64 {
+	p.window = append(p.window, m)
+	if len(p.window) > p.Samples {
+		p.window = p.window[len(p.window)-p.Samples:]
+	}
+
+	var mean [9]float64
+	for _, w := range p.window {
+		for i, v := range [9]uint16{w.PM1, w.PM25, w.PM10, w.Particles03, w.Particles05, w.Particles1, w.Particles25, w.Particles5, w.Particles10} {
+			mean[i] += float64(v) / float64(len(p.window))
+		}
+	}
+	return mean
+}
+
+// growthFactor is the ratio of wet to dry particle mass; the laser counter sees wet particles.
+func growthFactor(humidity float64) float64 {
+	humidity = min(humidity, maxHumidity)
+	if humidity <= 0 {
+		return 1
+	}
+	return 1 + (kappa/1.65)/(100/humidity-1)
+}
+
+func (p *PMS) readings(m Measurement, at time.Time) []sensors.Reading {
+	values := p.smooth(m)
+
+	quality := sensors.QualityGood
+	factor := 1.0
+	if p.HumidityCompensation {
+		if c, ok := p.Ambient.Conditions(p.AmbientKinds...); ok {
+			factor = growthFactor(c.Humidity)
+		} else {
+			quality = sensors.QualityDegraded
+		}
+	}
+
+	if p.Samples > 1 && len(p.window) < p.Samples {
+		quality = max(quality, sensors.QualityWarmingUp)
+	}
+
+	reading := func(quantity, unit string, value float64) sensors.Reading {
+		return sensors.Reading{SensorID: p.ID, Location: p.Location, Quantity: quantity, Unit: unit, Value: math.Round(value*10) / 10, Time: at, Quality: quality}
+	}
+
+	// Mass concentrations are corrected for humidity, counts are left as seen by the sensor
+	return []sensors.Reading{
+		reading(sensors.QuantityPM1, sensors.UnitMicrogramsM3, values[0]/factor),
+		reading(sensors.QuantityPM25, sensors.UnitMicrogramsM3, values[1]/factor),
+		reading(sensors.QuantityPM10, sensors.UnitMicrogramsM3, values[2]/factor),
+		reading(sensors.QuantityParticles03, sensors.UnitPerDeciliter, values[3]),
+		reading(sensors.QuantityParticles05, sensors.UnitPerDeciliter, values[4]),
+		reading(sensors.QuantityParticles1, sensors.UnitPerDeciliter, values[5]),
+		reading(sensors.QuantityParticles25, sensors.UnitPerDeciliter, values[6]),
+		reading(sensors.QuantityParticles5, sensors.UnitPerDeciliter, values[7]),
+		reading(sensors.QuantityParticles10, sensors.UnitPerDeciliter, values[8]),
+	}
+}
+
+func (p *PMS) store(m Measurement, err error) {
+	p.mu.Lock()
+	if err != nil {
+		p.err = err
+		p.mu.Unlock()
+		return
+	}
+
+	readings := p.readings(m, time.Now())
+	p.latest = readings
+	p.err = nil
+	p.mu.Unlock()
+
+	p.Bus.Publish(readings...)
+}
+
+// stream reads the frames sent every ~1 s in active mode. Reads can't be interrupted,
+// so the goroutine exits on the first frame after ctx is cancelled.
+func (p *PMS) stream(ctx context.Context, frames chan<- Measurement) {
+	log := slog.With("func", "PMS.stream()", "params", "(context.Context, chan<- Measurement)", "return", "(-)", "package", "pms_manager")
+
+	backoff := streamBackoff
+	for ctx.Err() == nil {
+		m, err := p.HW.ReadFrame()
+		if err != nil {
+			log.Debug("[ PMS ] Bad frame", "id", p.ID, "error", err, "backoff", backoff)
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxStreamBackoff)
+			continue
+		}
+		backoff = streamBackoff
+
+		select {
+		case frames <- m:
+		default: // Event loop busy, the next frame is a second away anyway
+		}
+	}
+}
+
+func (p *PMS) Start(ctx context.Context) error {
+	log := slog.With("func", "PMS.Start()", "params", "(context.Context)", "return", "(error)", "package", "pms_manager")
+	log.Info("[ PMS ] Sensor event loop", "id", p.ID, "passive", p.Passive, "sleep", p.Sleep)
+
+	if ctx == nil || reflect.ValueOf(ctx).IsNil() {
+		return fmt.Errorf("[ PMS ] Sensor state improper; ctx is nil")
+	}
+
+	if p.HW == nil {
+		return fmt.Errorf("[ PMS ] Sensor state improper; HW is nil")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	p.mu.Lock()
+	p.cancel = cancel
+	p.mu.Unlock()
+
+	interval := p.Interval
+	if interval <= 0 {
+		interval = 60 * time.Second
+	}
+
+	// Sensor may have been left asleep by a previous run
+	if err := p.HW.WakeUp(); err != nil {
+		return err
+	}
+
+	if p.Passive == false {
+		if err := p.HW.SetActive(); err != nil {
+			return err
+		}
+
+		frames := make(chan Measurement, 1)
+		go p.stream(ctx, frames)
+
+		publishTicker := time.NewTicker(interval)
+		defer publishTicker.Stop()
+
+		var last Measurement
+		received := false
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case m := <-frames:
+				last = m
+				received = true
+			case <-publishTicker.C:
+				if received == false {
+					log.Warn("[ PMS ] No frame received", "id", p.ID)
+					p.store(Measurement{}, fmt.Errorf("[ PMS ] No frame received in %s", interval))
+					continue
+				}
+				p.store(last, nil)
+				received = false
+			}
+		}
+	}
+
+	if err := p.HW.SetPassive(); err != nil {
+		return err
+	}
+
+	// Fan has to spin up before the first measurement either way
+	timer := time.NewTimer(WakeUpTime)
+	defer timer.Stop()
+
+	asleep := false
+	for {
+		select {
+		case <-ctx.Done():
+			if p.Sleep {
+				_ = p.HW.Sleep()
+			}
+			return nil
+		case <-timer.C:
+			if asleep {
+				if err := p.HW.WakeUp(); err != nil {
+					log.Warn("[ PMS ] Could not wake up sensor", "id", p.ID, "error", err)
+				}
+				asleep = false
+				timer.Reset(WakeUpTime)
+				continue
+			}
+
+			err := p.HW.RequestRead()
+			var m Measurement
+			if err == nil {
+				m, err = p.HW.ReadFrame()
+			}
+			if err != nil {
+				log.Warn("[ PMS ] Measurement failure", "id", p.ID, "error", err)
+			}
+			p.store(m, err)
+
+			if p.Sleep {
+				if err := p.HW.Sleep(); err != nil {
+					log.Warn("[ PMS ] Could not put sensor to sleep", "id", p.ID, "error", err)
+				} else {
+					asleep = true
+					timer.Reset(interval - WakeUpTime)
+					continue
+				}
+			}
+			timer.Reset(interval)
+		}
+	}
+}
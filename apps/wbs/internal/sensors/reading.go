@@ -0,0 +1,82 @@
+package sensors
+
+import (
+	"time"
+)
+
+type Quality uint8
+
+const (
+	QualityGood      Quality = iota
+	QualityWarmingUp         // Sensor is still settling, value is plausible but not trustworthy
+	QualityDegraded          // Value is usable but e.g. missing compensation
+	QualityInvalid           // Checksum / range failure, keep only for diagnostics
+)
+
+func (q Quality) String() string {
+	switch q {
+	case QualityGood:
+		return "good"
+	case QualityWarmingUp:
+		return "warming_up"
+	case QualityDegraded:
+		return "degraded"
+	case QualityInvalid:
+		return "invalid"
+	default:
+		return "unknown"
+	}
+}
+
+func (q Quality) MarshalText() ([]byte, error) {
+	return []byte(q.String()), nil
+}
+
+// Quantity names double as the last segment of MQTT state topics
+const (
+	QuantityECO2        = "eco2"
+	QuantityTVOC        = "tvoc"
+	QuantityTemperature = "temperature"
+	QuantityHumidity    = "humidity"
+	QuantityPressure    = "pressure"
+	QuantityPM1         = "pm1"
+	QuantityPM25        = "pm25"
+	QuantityPM10        = "pm10"
+
+	// Particle counts, diameter above the given size in µm
+	QuantityParticles03 = "particles_0_3"
+	QuantityParticles05 = "particles_0_5"
+	QuantityParticles1  = "particles_1"
+	QuantityParticles25 = "particles_2_5"
+	QuantityParticles5  = "particles_5"
+	QuantityParticles10 = "particles_10"
+
+	// Airtime left in the LoRa modem's duty cycle window
+	QuantityDutyCycle = "duty_cycle_remaining"
+
+	// LoRa modem packet counters, reset with the modem
+	QuantityPacketsReceived = "packets_received"
+	QuantityCRCErrors       = "crc_errors"
+	QuantityHeaderErrors    = "header_errors"
+)
+
+const (
+	UnitPPM          = "ppm"
+	UnitPPB          = "ppb"
+	UnitCelsius      = "°C"
+	UnitPercent      = "%"
+	UnitHectoPascal  = "hPa"
+	UnitMicrogramsM3 = "µg/m³"
+	UnitPerDeciliter = "#/dL" // PMS5003 counts particles in 0.1 L of air
+	UnitPackets      = "packets"
+)
+
+type Reading struct {
+	SensorID string    `json:"sensor_id"`
+	Location string    `json:"location,omitempty"`
+	Quantity string    `json:"quantity"`
+	Unit     string    `json:"unit"`
+	Value    float64   `json:"value"`
+	Time     time.Time `json:"time"`
+	Quality  Quality   `json:"quality"`
+}
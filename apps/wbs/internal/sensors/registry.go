@@ -0,0 +1,165 @@
+package sensors
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"wbs/internal/config"
+)
+
+// Factory instantiates every enabled device of one kind. Same contract as the HAL
+// Setup functions - the returned func releases whatever the factory opened.
+type Factory func(cfg *config.Config, deps *Deps) ([]Sensor, func(), error)
+
+type Registry struct {
+	factories map[string]Factory
+	sensors   []Sensor
+	closers   []func()
+	wg        sync.WaitGroup
+}
+
+func NewRegistry() *Registry {
+	return &Registry{factories: make(map[string]Factory)}
+}
+
+func (r *Registry) Register(kind string, factory Factory) {
+	r.factories[kind] = factory
+}
+
+// Setup runs every registered factory. A failing kind is logged and skipped, so a
+// broken PMS5003 doesn't take the SGP30 down with it.
+func (r *Registry) Setup(cfg *config.Config, deps *Deps) error {
+	log := slog.With("func", "Registry.Setup()", "params", "(*config.Config, *Deps)", "return", "(error)", "package", "sensors")
+	log.Info("[ SENSORS ] Registry setup")
+
+	if cfg == nil {
+		return fmt.Errorf("[ SENSORS ] Registry state improper; cfg is nil")
+	}
+	if deps == nil {
+		deps = &Deps{}
+	}
+
+	kinds := make([]string, 0, len(r.factories))
+	for kind := range r.factories {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	for _, kind := range kinds {
+		sensors, closer, err := r.factories[kind](cfg, deps)
+		if err != nil {
+			log.Error("[ SENSORS ] Sensor kind setup failure", "kind", kind, "error", err)
+			continue
+		}
+		r.closers = append(r.closers, closer)
+
+		for _, s := range sensors {
+			info := s.Describe()
+			log.Info("[ SENSORS ] Sensor registered", "kind", info.Kind, "id", info.ID, "name", info.Name, "location", info.Location)
+		}
+		r.sensors = append(r.sensors, sensors...)
+	}
+
+	return nil
+}
+
+// Run starts every sensor in its own goroutine and returns immediately.
+func (r *Registry) Run(ctx context.Context) {
+	for _, s := range r.sensors {
+		r.wg.Add(1)
+		go func(s Sensor) {
+			defer r.wg.Done()
+
+			if err := s.Start(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("[ SENSORS ] Sensor stopped with error", "id", s.Describe().ID, "error", err)
+			}
+		}(s)
+	}
+}
+
+func (r *Registry) Sensors() []Sensor {
+	return r.sensors
+}
+
+// Relabel updates name and location of a running sensor; false when the sensor
+// doesn't exist or can't be relabelled without a restart.
+func (r *Registry) Relabel(kind, id, name, location string) bool {
+	for _, s := range r.sensors {
+		info := s.Describe()
+		if info.Kind != kind || info.ID != id {
+			continue
+		}
+
+		l, ok := s.(Labeler)
+		if !ok {
+			return false
+		}
+		l.SetLabel(name, location)
+		return true
+	}
+	return false
+}
+
+// ApplyLabels relabels every running sensor with the name and location from cfg.
+func (r *Registry) ApplyLabels(cfg *config.Config) {
+	log := slog.With("func", "Registry.ApplyLabels()", "params", "(*config.Config)", "return", "(-)", "package", "sensors")
+
+	for _, s := range r.sensors {
+		info := s.Describe()
+
+		var name, location string
+		found := false
+		switch info.Kind {
+		case "sgp30":
+			dev, ok := cfg.SGP30.Devices[info.ID]
+			name, location, found = dev.Name, dev.Location, ok
+		case "bme280":
+			dev, ok := cfg.BME280.Devices[info.ID]
+			name, location, found = dev.Name, dev.Location, ok
+		case "dht":
+			dev, ok := cfg.DHT.Devices[info.ID]
+			name, location, found = dev.Name, dev.Location, ok
+		case "pms5003":
+			dev, ok := cfg.PMS5003.Devices[info.ID]
+			name, location, found = dev.Name, dev.Location, ok
+		case "ds18b20":
+			// The sensor is a bus, the labels belong to its probes
+			l, ok := s.(ProbeLabeler)
+			if !ok {
+				continue
+			}
+			for key, dev := range cfg.DS18B20.Devices {
+				if dev.Bus == info.ID && l.SetProbeLabel(key, dev.Name, dev.Location) {
+					log.Info("[ SENSORS ] Probe relabelled", "kind", info.Kind, "id", info.ID, "probe", key, "name", dev.Name, "location", dev.Location)
+				}
+			}
+			continue
+		}
+
+		if !found || (name == info.Name && location == info.Location) {
+			continue
+		}
+
+		if r.Relabel(info.Kind, info.ID, name, location) {
+			log.Info("[ SENSORS ] Sensor relabelled", "kind", info.Kind, "id", info.ID, "name", name, "location", location)
+		}
+	}
+}
+
+func (r *Registry) Close() {
+	log := slog.With("func", "Registry.Close()", "params", "(-)", "return", "(-)", "package", "sensors")
+	log.Info("[ SENSORS ] Registry destructor")
+
+	for _, s := range r.sensors {
+		if err := s.Stop(); err != nil {
+			log.Warn("[ SENSORS ] Could not stop sensor", "id", s.Describe().ID, "error", err)
+		}
+	}
+	r.wg.Wait()
+
+	for _, c := range r.closers {
+		c()
+	}
+}
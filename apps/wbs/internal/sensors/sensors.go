@@ -0,0 +1,51 @@
+package sensors
+
+import (
+	"context"
+	"log/slog"
+
+	"periph.io/x/conn/v3"
+	"periph.io/x/conn/v3/i2c"
+	"periph.io/x/conn/v3/onewire"
+	"periph.io/x/conn/v3/spi"
+)
+
+// Sensor is implemented by every device manager under internal/sensors.
+type Sensor interface {
+	// Start runs the sensor event loop and blocks until ctx is cancelled or Stop is called
+	Start(ctx context.Context) error
+	Stop() error
+	// Read returns the latest reading of every quantity the sensor measures
+	Read() ([]Reading, error)
+	Describe() Info
+}
+
+// Labeler is implemented by managers whose name and location can change at runtime,
+// e.g. on config reload.
+type Labeler interface {
+	SetLabel(name, location string)
+}
+
+// ProbeLabeler is implemented by managers running several probes as a single sensor,
+// e.g. a DS18B20 bus; id is the probe key from the config.
+type ProbeLabeler interface {
+	SetProbeLabel(id, name, location string) bool
+}
+
+type Info struct {
+	ID       string // Map key from the config, e.g. sgp30_0
+	Kind     string // Config section, e.g. sgp30
+	Name     string
+	Location string
+}
+
+// Deps are the buses opened by the HAL packages, keyed the same way as in the config.
+type Deps struct {
+	I2C     map[string]i2c.BusCloser
+	SPI     map[string]spi.Conn
+	OneWire map[string]onewire.BusCloser
+	UART    map[string]conn.Conn
+	Bus     *Bus     // Managers publish every new reading here
+	Ambient *Ambient // Latest temperature / humidity for use_dht / use_bme compensation
+	Logger  *slog.Logger
+}
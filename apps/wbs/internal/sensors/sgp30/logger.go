@@ -6,17 +6,22 @@ import (
 	"github.com/Regeneric/iot-drivers/libs/sgp30"
 )
 
+// SlogAdapter is the sgp30.Logger of the manager
 type SlogAdapter struct {
 	Log *slog.Logger
 }
 
-func (l SlogAdapter) With(kv ...any) sgp30.Logger {
+func (l SlogAdapter) logger() *slog.Logger {
 	if l.Log == nil {
-		return SlogAdapter{Log: slog.Default().With(kv...)}
+		return slog.Default().With("package", "sgp_manager")
 	}
-	return SlogAdapter{Log: l.Log.With(kv...)}
+	return l.Log
+}
+
+func (l SlogAdapter) With(kv ...any) sgp30.Logger {
+	return SlogAdapter{Log: l.logger().With(kv...)}
 }
-func (l SlogAdapter) Debug(msg string, kv ...any) { l.Log.Debug(msg, kv...) }
-func (l SlogAdapter) Info(msg string, kv ...any)  { l.Log.Info(msg, kv...) }
-func (l SlogAdapter) Warn(msg string, kv ...any)  { l.Log.Warn(msg, kv...) }
-func (l SlogAdapter) Error(msg string, kv ...any) { l.Log.Error(msg, kv...) }
+func (l SlogAdapter) Debug(msg string, kv ...any) { l.logger().Debug(msg, kv...) }
+func (l SlogAdapter) Info(msg string, kv ...any)  { l.logger().Info(msg, kv...) }
+func (l SlogAdapter) Warn(msg string, kv ...any)  { l.logger().Warn(msg, kv...) }
+func (l SlogAdapter) Error(msg string, kv ...any) { l.logger().Error(msg, kv...) }
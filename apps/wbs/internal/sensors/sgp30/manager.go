@@ -4,25 +4,217 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"math"
 	"os"
 	"reflect"
 	"sync"
 	"time"
+	"wbs/internal/config"
+	"wbs/internal/sensors"
 
 	"github.com/Regeneric/iot-drivers/libs/sgp30"
 )
 
+const (
+	// SGP30 returns fixed 400 ppm / 0 ppb for the first ~15 seconds after IAQ init
+	warmUp = 20 * time.Second
+	// Baseline is only valid when the sensor was off for less than a week
+	baselineMaxAge = 7 * 24 * time.Hour
+)
+
 type SGP struct {
-	HW   *sgp30.Device
-	MU   sync.Mutex
-	ECO2 uint16
-	TVOC uint16
-	Err  error
+	ID           string
+	HW           *sgp30.Device
+	Bus          *sensors.Bus
+	Ambient      *sensors.Ambient
+	AmbientKinds []string
+
+	mu     sync.Mutex
+	latest []sensors.Reading
+	err    error
+	cancel context.CancelFunc
+}
+
+// Factory instantiates every enabled SGP30 from the config on the I2C buses in deps.
+func Factory(cfg *config.Config, deps *sensors.Deps) ([]sensors.Sensor, func(), error) {
+	log := slog.With("func", "Factory()", "params", "(*config.Config, *sensors.Deps)", "return", "([]sensors.Sensor, func(), error)", "package", "sgp_manager")
+	log.Info("[ SGP ] Sensor setup")
+
+	if cfg.SGP30.Enable == false {
+		return nil, func() {}, nil
+	}
+
+	buses := make(map[string]sgp30.Bus)
+	for key, val := range deps.I2C {
+		buses[key] = val
+	}
+
+	adapter := SlogAdapter{}
+	if deps.Logger != nil {
+		adapter.Log = deps.Logger.With("package", "sgp_manager")
+	}
+
+	devices, closer, err := sgp30.Setup(buses, &cfg.SGP30, adapter)
+	if err != nil {
+		return nil, func() {}, fmt.Errorf("[ SGP ] Sensor setup failure: %w", err)
+	}
+
+	list := make([]sensors.Sensor, 0, len(devices))
+	for key, dev := range devices {
+		var kinds []string
+		if dev.Config.UseDHT {
+			kinds = append(kinds, "dht")
+		}
+		if dev.Config.UseBME {
+			kinds = append(kinds, "bme280")
+		}
+		if dev.Config.HumidityCompensation && len(kinds) == 0 {
+			log.Warn("[ SGP ] Humidity compensation enabled without use_dht / use_bme", "sensor", key)
+		}
+
+		list = append(list, &SGP{ID: key, HW: dev, Bus: deps.Bus, Ambient: deps.Ambient, AmbientKinds: kinds})
+	}
+
+	return list, closer, nil
+}
+
+func (s *SGP) Describe() sensors.Info {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := sensors.Info{ID: s.ID, Kind: "sgp30"}
+	if s.HW != nil {
+		info.Name = s.HW.Config.Name
+		info.Location = s.HW.Config.Location
+	}
+	return info
 }
 
-func (s *SGP) Run(ctx context.Context) error {
-	log := slog.With("func", "SGP.Run()", "params", "(context.Context)", "return", "(-)", "package", "sgp_manager")
-	log.Info("[ SGP ] Sensor event loop")
+// SetLabel renames the sensor; the baseline is saved under the new name from the next hour.
+func (s *SGP) SetLabel(name, location string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.HW.Config.Name, s.HW.Config.Location = name, location
+}
+
+func (s *SGP) Read() ([]sensors.Reading, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.latest == nil {
+		return nil, fmt.Errorf("[ SGP ] No measurement yet")
+	}
+
+	return append([]sensors.Reading(nil), s.latest...), nil
+}
+
+func (s *SGP) readings(eco2, tvoc uint16, at time.Time, quality sensors.Quality) []sensors.Reading {
+	info := s.Describe()
+	return []sensors.Reading{
+		{SensorID: info.ID, Location: info.Location, Quantity: sensors.QuantityECO2, Unit: sensors.UnitPPM, Value: float64(eco2), Time: at, Quality: quality},
+		{SensorID: info.ID, Location: info.Location, Quantity: sensors.QuantityTVOC, Unit: sensors.UnitPPB, Value: float64(tvoc), Time: at, Quality: quality},
+	}
+}
+
+func (s *SGP) baselineFile() string {
+	return fmt.Sprintf("sgp30_baseline_%s.bin", s.Describe().Name)
+}
+
+// restoreBaseline writes back the baseline saved by a previous run; without it the
+// sensor needs 12 hours of operation before its readings are reliable again.
+func (s *SGP) restoreBaseline() error {
+	log := slog.With("func", "SGP.restoreBaseline()", "params", "(-)", "return", "(error)", "package", "sgp_manager")
+
+	filename := s.baselineFile()
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		log.Info("[ SGP ] No IAQ baseline saved yet", "id", s.ID, "file", filename)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("[ SGP ] Could not access IAQ baseline file %s: %w", filename, err)
+	}
+
+	if age := time.Since(info.ModTime()); age > baselineMaxAge {
+		log.Warn("[ SGP ] IAQ baseline too old, ignoring", "id", s.ID, "file", filename, "age", age.Round(time.Minute))
+		return nil
+	}
+
+	baseline, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("[ SGP ] Could not read IAQ baseline file %s: %w", filename, err)
+	}
+	if len(baseline) != 6 {
+		return fmt.Errorf("[ SGP ] IAQ baseline file %s corrupted; %d bytes", filename, len(baseline))
+	}
+
+	if err := s.HW.SetIaqBaseline(baseline); err != nil {
+		return fmt.Errorf("[ SGP ] Could not set IAQ baseline: %w", err)
+	}
+
+	log.Info("[ SGP ] IAQ baseline restored", "id", s.ID, "file", filename)
+	return nil
+}
+
+func (s *SGP) saveBaseline(baseline []uint8) error {
+	if err := s.HW.GetIaqBaseline(baseline); err != nil {
+		return fmt.Errorf("[ SGP ] Could not read IAQ baseline value: %w", err)
+	}
+
+	if err := os.WriteFile(s.baselineFile(), baseline, 0644); err != nil {
+		return fmt.Errorf("[ SGP ] Could not save IAQ baseline value to file: %w", err)
+	}
+	return nil
+}
+
+// compensate feeds the absolute humidity from DHT / BME into the sensor.
+// Returns false when compensation is configured but no fresh conditions are available.
+func (s *SGP) compensate() (bool, error) {
+	if s.HW.Config.HumidityCompensation == false {
+		return true, nil
+	}
+
+	c, ok := s.Ambient.Conditions(s.AmbientKinds...)
+	if !ok {
+		return false, nil
+	}
+
+	if err := s.HW.SetAbsoluteHumidity(absoluteHumidity(c.Temperature, c.Humidity)); err != nil {
+		return false, fmt.Errorf("[ SGP ] Could not set absolute humidity: %w", err)
+	}
+	return true, nil
+}
+
+// absoluteHumidity converts temperature and relative humidity into g/m³ and encodes
+// it as 8.8 fixed point with CRC, the format of the Set_absolute_humidity command.
+func absoluteHumidity(temperature, humidity float64) []uint8 {
+	// Magnus formula, saturation vapour pressure in hPa
+	saturation := 6.112 * math.Exp(17.62*temperature/(243.12+temperature))
+	ah := 216.7 * (humidity / 100 * saturation) / (273.15 + temperature)
+
+	// 0 turns compensation off
+	fixed := uint16(math.Max(1, math.Min(ah*256, math.MaxUint16)))
+	word := []uint8{uint8(fixed >> 8), uint8(fixed)}
+	return append(word, sensors.CRC8(word))
+}
+
+func (s *SGP) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+	return nil
+}
+
+func (s *SGP) Start(ctx context.Context) error {
+	log := slog.With("func", "SGP.Start()", "params", "(context.Context)", "return", "(error)", "package", "sgp_manager")
+	log.Info("[ SGP ] Sensor event loop", "id", s.ID)
 
 	if ctx == nil || reflect.ValueOf(ctx).IsNil() {
 		return fmt.Errorf("[ SGP ] Sensor state improper; ctx is nil")
@@ -36,6 +228,25 @@ func (s *SGP) Run(ctx context.Context) error {
 		return err
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s.mu.Lock()
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	// Baseline has to be set right after IAQ init, before the first measurement
+	if err := s.restoreBaseline(); err != nil {
+		log.Warn("[ SGP ] IAQ baseline restore failure", "id", s.ID, "error", err)
+	}
+
+	log.Warn("[ SGP ] Waiting for sensor to initialize...", "id", s.ID, "delay", warmUp)
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-time.After(warmUp):
+	}
+
 	// 1 Hz for accurate readings
 	measureTicker := time.NewTicker(1 * time.Second)
 	defer measureTicker.Stop()
@@ -44,36 +255,60 @@ func (s *SGP) Run(ctx context.Context) error {
 	calibrationTicker := time.NewTicker(1 * time.Hour)
 	defer calibrationTicker.Stop()
 
+	// Ambient conditions don't change faster than DHT / BME report them
+	humidityTicker := time.NewTicker(1 * time.Minute)
+	defer humidityTicker.Stop()
+
 	baseline := make([]uint8, 6)
 	buffer := make([]uint8, 6)
 
-	// 1 Hz measure loop
-	for range measureTicker.C {
-		err := s.HW.MeasureIaq(buffer)
-		if err != nil {
-			continue
-		}
+	compensated, err := s.compensate()
+	if err != nil {
+		log.Warn("[ SGP ] Humidity compensation failure", "id", s.ID, "error", err)
+	}
 
-		eco2 := uint16(buffer[0])<<8 | uint16(buffer[1])
-		tvoc := uint16(buffer[3])<<8 | uint16(buffer[4])
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
 
-		s.MU.Lock()
-		s.ECO2 = eco2
-		s.TVOC = tvoc
-		s.MU.Unlock()
-	}
+		// 1 Hz measure loop
+		case <-measureTicker.C:
+			if err := s.HW.MeasureIaq(buffer); err != nil {
+				s.mu.Lock()
+				s.err = err
+				s.mu.Unlock()
+				continue
+			}
+
+			eco2 := uint16(buffer[0])<<8 | uint16(buffer[1])
+			tvoc := uint16(buffer[3])<<8 | uint16(buffer[4])
 
-	// Calibration loop
-	for range calibrationTicker.C {
-		if err := s.HW.GetIaqBaseline(baseline); err != nil {
-			log.Error("[ SGP ] Could not read IAQ baseline value", "error", err)
-		} else {
-			filename := fmt.Sprintf("sgp30_baseline_%s.bin", s.HW.Config.Name)
-			if err := os.WriteFile(filename, baseline, 0644); err != nil {
-				log.Error("[ SGP ] Could not save IAQ baseline value to file", "error", err)
+			quality := sensors.QualityGood
+			if compensated == false {
+				quality = sensors.QualityDegraded
+			}
+			readings := s.readings(eco2, tvoc, time.Now(), quality)
+
+			s.mu.Lock()
+			s.latest = readings
+			s.err = nil
+			s.mu.Unlock()
+
+			s.Bus.Publish(readings...)
+
+		// Humidity compensation
+		case <-humidityTicker.C:
+			compensated, err = s.compensate()
+			if err != nil {
+				log.Warn("[ SGP ] Humidity compensation failure", "id", s.ID, "error", err)
+			}
+
+		// Calibration loop
+		case <-calibrationTicker.C:
+			if err := s.saveBaseline(baseline); err != nil {
+				log.Error("[ SGP ] IAQ baseline save failure", "id", s.ID, "error", err)
 			}
 		}
 	}
-
-	return nil
 }
@@ -0,0 +1,102 @@
+package station
+
+import "fmt"
+
+type State uint8
+
+const (
+	StateBoot State = iota
+	StateSampling
+	StateTransmitting
+	StateReceiving
+	StateSleeping
+	StateDegraded
+)
+
+func (s State) String() string {
+	switch s {
+	case StateBoot:
+		return "boot"
+	case StateSampling:
+		return "sampling"
+	case StateTransmitting:
+		return "transmitting"
+	case StateReceiving:
+		return "receiving"
+	case StateSleeping:
+		return "sleeping"
+	case StateDegraded:
+		return "degraded"
+	default:
+		return fmt.Sprintf("state(%d)", uint8(s))
+	}
+}
+
+type Event uint8
+
+const (
+	EventReady          Event = iota // Boot checks passed
+	EventFailure                     // Boot checks failed
+	EventSampled                     // At least one sensor has a reading
+	EventNoReadings                  // Every sensor failed or is still warming up
+	EventTransmitted                 // Radio accepted the payload
+	EventTxFailure                   // Encoding or radio failure
+	EventPacketReceived              // Packet arrived in the receive window
+	EventRxTimeout                   // Receive window closed
+	EventTimer                       // Sleep / retry period elapsed
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventReady:
+		return "ready"
+	case EventFailure:
+		return "failure"
+	case EventSampled:
+		return "sampled"
+	case EventNoReadings:
+		return "no_readings"
+	case EventTransmitted:
+		return "transmitted"
+	case EventTxFailure:
+		return "tx_failure"
+	case EventPacketReceived:
+		return "packet_received"
+	case EventRxTimeout:
+		return "rx_timeout"
+	case EventTimer:
+		return "timer"
+	default:
+		return fmt.Sprintf("event(%d)", uint8(e))
+	}
+}
+
+type transition struct {
+	from State
+	on   Event
+}
+
+// Every (state, event) pair not listed here is a bug in a state handler
+var transitions = map[transition]State{
+	{StateBoot, EventReady}:   StateSampling,
+	{StateBoot, EventFailure}: StateDegraded,
+
+	{StateSampling, EventSampled}:    StateTransmitting,
+	{StateSampling, EventNoReadings}: StateDegraded,
+
+	{StateTransmitting, EventTransmitted}: StateReceiving,
+	{StateTransmitting, EventTxFailure}:   StateDegraded,
+
+	// Keep listening after a packet, the gateway may send more than one
+	{StateReceiving, EventPacketReceived}: StateReceiving,
+	{StateReceiving, EventRxTimeout}:      StateSleeping,
+
+	{StateSleeping, EventTimer}: StateSampling,
+	{StateDegraded, EventTimer}: StateBoot,
+}
+
+// Next looks up the transition table; ok is false for pairs the table doesn't define.
+func Next(from State, on Event) (State, bool) {
+	to, ok := transitions[transition{from, on}]
+	return to, ok
+}
@@ -0,0 +1,408 @@
+package station
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/lora/packet"
+	"wbs/internal/sensors"
+)
+
+const (
+	// Largest payload an SX126x frame can carry
+	maxPayload = 255
+	// Sequences 1..telemetrySequences; the upper half belongs to ADR, see lora.adrSequenceBase
+	telemetrySequences = 0x7FFF
+	// The beacon is repeated every so many telemetry packets for gateways that restarted
+	// or missed it
+	beaconEvery = 30
+)
+
+// Radio is satisfied by *lora.Node; Rx returns an error when nothing arrived in time.
+type Radio interface {
+	Tx(data []uint8) error
+	Rx(timeout time.Duration) ([]uint8, error)
+}
+
+// Source is satisfied by *sensors.Registry.
+type Source interface {
+	Sensors() []sensors.Sensor
+}
+
+// Encoder turns the latest readings into the payloads of one transmission, sent in order.
+type Encoder func(readings []sensors.Reading) ([][]uint8, error)
+
+type Option func(*Station)
+
+func WithEncoder(e Encoder) Option {
+	return func(s *Station) { s.encode = e }
+}
+
+// WithPacketHandler is called for every packet received after a transmission
+func WithPacketHandler(h func(payload []uint8)) Option {
+	return func(s *Station) { s.onPacket = h }
+}
+
+// WithTransitionHandler is called after every state change, e.g. for metrics
+func WithTransitionHandler(h func(from, to State, on Event)) Option {
+	return func(s *Station) { s.onTransition = h }
+}
+
+type Station struct {
+	cfg    *config.Station
+	radio  Radio
+	source Source
+
+	encode       Encoder
+	onPacket     func(payload []uint8)
+	onTransition func(from, to State, on Event)
+
+	state      State
+	readings   []sensors.Reading
+	rxDeadline time.Time // End of the current receive window; packets don't extend it
+	handlers   map[State]func(ctx context.Context) Event
+}
+
+func New(cfg *config.Station, radio Radio, source Source, opts ...Option) (*Station, error) {
+	log := slog.With("func", "New()", "params", "(*config.Station, Radio, Source, ...Option)", "return", "(*Station, error)", "package", "station")
+	log.Info("[ STATION ] Station constructor")
+
+	if cfg == nil {
+		return nil, fmt.Errorf("[ STATION ] Station state improper; cfg is nil")
+	}
+	if source == nil || reflect.ValueOf(source).IsNil() {
+		return nil, fmt.Errorf("[ STATION ] Station state improper; source is nil")
+	}
+
+	// A typed nil *lora.Node is not a nil interface
+	if radio != nil && reflect.ValueOf(radio).IsNil() {
+		radio = nil
+	}
+
+	s := &Station{
+		cfg:          cfg,
+		radio:        radio,
+		source:       source,
+		encode:       EncodeText,
+		onPacket:     logPacket,
+		onTransition: func(State, State, Event) {},
+		state:        StateBoot,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.handlers = map[State]func(ctx context.Context) Event{
+		StateBoot:         s.boot,
+		StateSampling:     s.sample,
+		StateTransmitting: s.transmit,
+		StateReceiving:    s.receive,
+		StateSleeping:     s.sleep,
+		StateDegraded:     s.degraded,
+	}
+
+	return s, nil
+}
+
+func (s *Station) State() State {
+	return s.state
+}
+
+// Run drives the state machine until ctx is cancelled.
+func (s *Station) Run(ctx context.Context) error {
+	log := slog.With("func", "Station.Run()", "params", "(context.Context)", "return", "(error)", "package", "station")
+	log.Info("[ STATION ] Station event loop")
+
+	if ctx == nil || reflect.ValueOf(ctx).IsNil() {
+		return fmt.Errorf("[ STATION ] Station state improper; ctx is nil")
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil
+		}
+
+		event := s.handlers[s.state](ctx)
+
+		// Handlers bail out early on cancel; their event means nothing then
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		next, ok := Next(s.state, event)
+		if !ok {
+			log.Error("[ STATION ] No transition defined", "state", s.state, "event", event)
+			next = StateDegraded
+		}
+
+		if next == StateReceiving && s.state != StateReceiving {
+			s.rxDeadline = time.Now().Add(s.cfg.RxWindow)
+		}
+
+		log.Debug("[ STATION ] State transition", "from", s.state, "to", next, "event", event)
+		s.onTransition(s.state, next, event)
+		s.state = next
+	}
+}
+
+// wait blocks for d or until ctx is cancelled.
+func wait(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// ************************************************************************
+// = State handlers ===
+// ------------------------------------------------------------------------
+func (s *Station) boot(ctx context.Context) Event {
+	log := slog.With("package", "station")
+
+	if s.radio == nil {
+		log.Warn("[ STATION ] No radio, readings go to local consumers only")
+		return EventFailure
+	}
+	if len(s.source.Sensors()) == 0 {
+		log.Warn("[ STATION ] No sensors registered")
+		return EventFailure
+	}
+
+	return EventReady
+}
+
+func (s *Station) sample(ctx context.Context) Event {
+	log := slog.With("package", "station")
+
+	s.readings = s.readings[:0]
+	for _, sensor := range s.source.Sensors() {
+		readings, err := sensor.Read()
+		if err != nil {
+			log.Debug("[ STATION ] No reading", "sensor", sensor.Describe().ID, "error", err)
+			continue
+		}
+
+		for _, r := range readings {
+			if r.Quality == sensors.QualityInvalid {
+				continue
+			}
+			log.Info("[ STATION ] Sensor reading", "sensor", r.SensorID, r.Quantity, r.Value, "unit", r.Unit, "quality", r.Quality)
+			s.readings = append(s.readings, r)
+		}
+	}
+
+	if len(s.readings) == 0 {
+		return EventNoReadings
+	}
+	return EventSampled
+}
+
+// transmit sends the readings to the gateway. The gateway itself keeps its readings off
+// the air, they reach MQTT through the sensor bus; it still opens the receive window.
+func (s *Station) transmit(ctx context.Context) Event {
+	log := slog.With("package", "station")
+
+	if s.cfg.Address == s.cfg.Gateway {
+		log.Debug("[ STATION ] Gateway; readings stay local", "readings", len(s.readings))
+		return EventTransmitted
+	}
+
+	payloads, err := s.encode(s.readings)
+	if err != nil {
+		log.Warn("[ STATION ] Could not encode readings", "error", err)
+		return EventTxFailure
+	}
+
+	for _, payload := range payloads {
+		if err := s.radio.Tx(payload); err != nil {
+			log.Warn("[ STATION ] Could not transmit readings", "error", err)
+			return EventTxFailure
+		}
+	}
+
+	return EventTransmitted
+}
+
+// receive listens until the window opened by the transmission closes, however many
+// packets arrive in it; the radio only takes a timeout, so it is polled in short slices
+// to notice cancellation.
+func (s *Station) receive(ctx context.Context) Event {
+	for ctx.Err() == nil {
+		remaining := time.Until(s.rxDeadline)
+		if remaining <= 0 {
+			break
+		}
+
+		payload, err := s.radio.Rx(min(remaining, time.Second))
+		if err == nil && len(payload) > 0 {
+			s.onPacket(payload)
+			return EventPacketReceived
+		}
+	}
+
+	return EventRxTimeout
+}
+
+func (s *Station) sleep(ctx context.Context) Event {
+	wait(ctx, s.cfg.Interval)
+	return EventTimer
+}
+
+func (s *Station) degraded(ctx context.Context) Event {
+	wait(ctx, s.cfg.RetryInterval)
+	return EventTimer
+}
+
+// ------------------------------------------------------------------------
+
+// EncodeText is the default Encoder, one "sensor/quantity=value" line per reading.
+// Readings that don't fit into a single frame are dropped.
+func EncodeText(readings []sensors.Reading) ([][]uint8, error) {
+	var b strings.Builder
+	for _, r := range readings {
+		line := r.SensorID + "/" + r.Quantity + "=" + strconv.FormatFloat(r.Value, 'f', -1, 64) + "\n"
+		if b.Len()+len(line) > maxPayload {
+			break
+		}
+		b.WriteString(line)
+	}
+
+	if b.Len() == 0 {
+		return nil, fmt.Errorf("[ STATION ] Nothing to encode")
+	}
+	return [][]uint8{[]uint8(b.String())}, nil
+}
+
+// PacketEncoder frames readings as packet.Telemetry from cfg.Address to cfg.Gateway.
+// Value.Sensor is the index of the sensor in the sorted IDs of every sensor that has
+// reported so far; a packet.Beacon carrying that list goes out first whenever it changes,
+// and every beaconEvery packets after. When the readings don't fit a single frame, each
+// packet starts where the previous one stopped, so every quantity is sent in turn; the
+// ones left out are logged.
+func PacketEncoder(cfg *config.Station, payloadLength int) Encoder {
+	log := slog.With("func", "PacketEncoder()", "params", "(*config.Station, int)", "return", "(Encoder)", "package", "station")
+
+	var (
+		// Telemetry keeps to the lower half of the sequences and starts anywhere in it, so the
+		// gateway doesn't take the first packets after a reboot for duplicates of the last ones
+		sequence = rand.N[uint16](telemetrySequences)
+		next     int // Rotation offset into the values of the previous call
+
+		boot        = time.Now()
+		known       = make(map[string]bool) // Every sensor ID seen in readings
+		announced   []string                // Sensors of the last beacon
+		sinceBeacon int
+	)
+
+	encode := func(payload packet.Payload) ([]uint8, error) {
+		sequence = sequence%telemetrySequences + 1
+		return packet.Encode(packet.Packet{
+			Header: packet.Header{
+				Source:      packet.Address(cfg.Address),
+				Destination: packet.Address(cfg.Gateway),
+				Sequence:    sequence,
+			},
+			Payload: payload,
+		}, payloadLength)
+	}
+
+	return func(readings []sensors.Reading) ([][]uint8, error) {
+		capacity := packet.TelemetryCapacity(payloadLength)
+		if capacity == 0 {
+			return nil, fmt.Errorf("[ STATION ] Payload length %d can't carry telemetry", payloadLength)
+		}
+
+		// Sorted, so the same sensors get the same indexes after a restart
+		for _, r := range readings {
+			known[r.SensorID] = true
+		}
+		ids := slices.Sorted(maps.Keys(known))
+		if len(ids) > math.MaxUint8 {
+			return nil, fmt.Errorf("[ STATION ] %d sensors, a beacon lists at most %d", len(ids), math.MaxUint8)
+		}
+
+		index := make(map[string]uint8, len(ids))
+		for i, id := range ids {
+			index[id] = uint8(i)
+		}
+
+		var (
+			values []packet.Value
+			names  []string
+		)
+		for _, r := range readings {
+			values = append(values, packet.Value{Sensor: index[r.SensorID], Quantity: r.Quantity, Quality: r.Quality, Value: float32(r.Value)})
+			names = append(names, r.SensorID+"/"+r.Quantity)
+		}
+
+		if len(values) == 0 {
+			return nil, fmt.Errorf("[ STATION ] Nothing to encode")
+		}
+
+		var payloads [][]uint8
+		if slices.Equal(ids, announced) == false || sinceBeacon >= beaconEvery {
+			// Telemetry still goes out, the beacon is tried again with the next packet
+			if beacon, err := encode(&packet.Beacon{Uptime: time.Since(boot), Sensors: ids}); err != nil {
+				log.Warn("[ STATION ] Could not encode beacon", "sensors", len(ids), "error", err)
+			} else {
+				log.Info("[ STATION ] Sensors announced", "sensors", strings.Join(ids, ", "))
+				payloads = append(payloads, beacon)
+			}
+		}
+
+		telemetry := &packet.Telemetry{Time: time.Now(), Values: values}
+		rotated := next
+		if len(values) > capacity {
+			start := next % len(values)
+			telemetry.Values = make([]packet.Value, 0, capacity)
+			for k := 0; k < capacity; k++ {
+				telemetry.Values = append(telemetry.Values, values[(start+k)%len(values)])
+			}
+
+			left := make([]string, 0, len(values)-capacity)
+			for k := capacity; k < len(values); k++ {
+				left = append(left, names[(start+k)%len(values)])
+			}
+			log.Info("[ STATION ] Readings left for the next packet", "capacity", capacity, "readings", len(values), "left", strings.Join(left, ", "))
+
+			rotated = start + capacity
+		}
+
+		data, err := encode(telemetry)
+		if err != nil {
+			return nil, err
+		}
+
+		next = rotated
+		if len(payloads) > 0 {
+			announced, sinceBeacon = ids, 0
+		}
+		sinceBeacon++
+		return append(payloads, data), nil
+	}
+}
+
+// logPacket is the default packet handler; payloads that aren't packets are logged raw
+func logPacket(payload []uint8) {
+	log := slog.With("package", "station")
+
+	p, err := packet.Decode(payload)
+	if err != nil {
+		log.Info("[ STATION ] Packet received", "size", len(payload), "payload", string(payload), "error", err)
+		return
+	}
+
+	log.Info("[ STATION ] Packet received", "type", p.Type, "source", p.Source, "destination", p.Destination, "sequence", p.Sequence, "payload", p.Payload)
+}
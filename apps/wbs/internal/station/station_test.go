@@ -0,0 +1,446 @@
+package station
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"wbs/internal/config"
+	"wbs/internal/lora/packet"
+	"wbs/internal/sensors"
+)
+
+func TestTransitions(t *testing.T) {
+	tests := []struct {
+		from State
+		on   Event
+		to   State
+	}{
+		{StateBoot, EventReady, StateSampling},
+		{StateBoot, EventFailure, StateDegraded},
+		{StateSampling, EventSampled, StateTransmitting},
+		{StateSampling, EventNoReadings, StateDegraded},
+		{StateTransmitting, EventTransmitted, StateReceiving},
+		{StateTransmitting, EventTxFailure, StateDegraded},
+		{StateReceiving, EventPacketReceived, StateReceiving},
+		{StateReceiving, EventRxTimeout, StateSleeping},
+		{StateSleeping, EventTimer, StateSampling},
+		{StateDegraded, EventTimer, StateBoot},
+	}
+
+	defined := make(map[transition]bool)
+	for _, tt := range tests {
+		to, ok := Next(tt.from, tt.on)
+		if !ok || to != tt.to {
+			t.Errorf("Next(%s, %s) = %s, %t; want %s", tt.from, tt.on, to, ok, tt.to)
+		}
+		defined[transition{tt.from, tt.on}] = true
+	}
+
+	// Anything else is a handler bug and must not be silently accepted
+	for from := StateBoot; from <= StateDegraded; from++ {
+		for on := EventReady; on <= EventTimer; on++ {
+			if defined[transition{from, on}] {
+				continue
+			}
+			if to, ok := Next(from, on); ok {
+				t.Errorf("Next(%s, %s) = %s, want no transition", from, on, to)
+			}
+		}
+	}
+}
+
+// ************************************************************************
+// = Fakes ===
+// ------------------------------------------------------------------------
+
+type fakeSensor struct {
+	id       string
+	readings []sensors.Reading
+	err      error
+}
+
+func (s *fakeSensor) Start(ctx context.Context) error { <-ctx.Done(); return nil }
+func (s *fakeSensor) Stop() error                     { return nil }
+func (s *fakeSensor) Describe() sensors.Info          { return sensors.Info{ID: s.id, Kind: "fake"} }
+func (s *fakeSensor) Read() ([]sensors.Reading, error) {
+	return s.readings, s.err
+}
+
+type fakeSource []sensors.Sensor
+
+func (s fakeSource) Sensors() []sensors.Sensor { return s }
+
+// fakeRadio hands out the queued packets, then waits out every Rx timeout
+type fakeRadio struct {
+	mu      sync.Mutex
+	sent    [][]uint8
+	packets [][]uint8
+	txErr   error
+}
+
+func (r *fakeRadio) Tx(data []uint8) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.txErr != nil {
+		return r.txErr
+	}
+	r.sent = append(r.sent, data)
+	return nil
+}
+
+func (r *fakeRadio) Rx(timeout time.Duration) ([]uint8, error) {
+	r.mu.Lock()
+	if len(r.packets) > 0 {
+		p := r.packets[0]
+		r.packets = r.packets[1:]
+		r.mu.Unlock()
+		return p, nil
+	}
+	r.mu.Unlock()
+
+	time.Sleep(timeout)
+	return nil, errors.New("nothing received")
+}
+
+// busyRadio hears a packet every few ms, e.g. a gateway among many stations
+type busyRadio struct {
+	fakeRadio
+}
+
+func (r *busyRadio) Rx(timeout time.Duration) ([]uint8, error) {
+	time.Sleep(min(timeout, 5*time.Millisecond))
+	return []uint8("telemetry"), nil
+}
+
+// ------------------------------------------------------------------------
+
+type step struct {
+	from, to State
+	on       Event
+}
+
+// run starts s and cancels it once stop says so; it fails t unless Run returns soon after
+func run(t *testing.T, s *Station, steps chan step, stop func(step) bool) []step {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	var seen []step
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case st := <-steps:
+			seen = append(seen, st)
+			if stop(st) == false {
+				continue
+			}
+			cancel()
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Run = %v", err)
+			}
+			return seen
+		case <-timeout:
+			t.Fatalf("Run still going after %v", seen)
+		}
+	}
+}
+
+func testStation(t *testing.T, radio Radio, source Source, cfg *config.Station) (*Station, chan step) {
+	t.Helper()
+
+	steps := make(chan step, 64)
+	s, err := New(cfg, radio, source,
+		WithPacketHandler(func([]uint8) {}),
+		WithTransitionHandler(func(from, to State, on Event) { steps <- step{from, to, on} }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, steps
+}
+
+func TestRun(t *testing.T) {
+	source := fakeSource{&fakeSensor{id: "bme280_0", readings: []sensors.Reading{
+		{SensorID: "bme280_0", Quantity: sensors.QuantityTemperature, Value: 21.5, Quality: sensors.QualityGood},
+		{SensorID: "bme280_0", Quantity: sensors.QuantityHumidity, Value: 40, Quality: sensors.QualityInvalid},
+	}}}
+	radio := &fakeRadio{packets: [][]uint8{[]uint8("ack")}}
+	cfg := &config.Station{Interval: 10 * time.Millisecond, RxWindow: 30 * time.Millisecond, RetryInterval: time.Hour, Address: 1}
+
+	s, steps := testStation(t, radio, source, cfg)
+	seen := run(t, s, steps, func(st step) bool { return st.from == StateSleeping })
+
+	want := []step{
+		{StateBoot, StateSampling, EventReady},
+		{StateSampling, StateTransmitting, EventSampled},
+		{StateTransmitting, StateReceiving, EventTransmitted},
+		{StateReceiving, StateReceiving, EventPacketReceived},
+		{StateReceiving, StateSleeping, EventRxTimeout},
+		{StateSleeping, StateSampling, EventTimer},
+	}
+	// Sampling and transmitting don't look at ctx, a few more steps may follow the cancel
+	if len(seen) < len(want) {
+		t.Fatalf("transitions %v, want %v", seen, want)
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Errorf("transition %d = %v, want %v", i, seen[i], want[i])
+		}
+	}
+
+	// Invalid readings stay off the air
+	if len(radio.sent) == 0 || string(radio.sent[0]) != "bme280_0/temperature=21.5\n" {
+		t.Errorf("sent %q", radio.sent)
+	}
+}
+
+// Packets keep coming, the window still closes on time
+func TestRunBusyChannel(t *testing.T) {
+	source := fakeSource{&fakeSensor{id: "a", readings: []sensors.Reading{{SensorID: "a", Quantity: "q", Value: 1}}}}
+	cfg := &config.Station{Interval: time.Hour, RxWindow: 50 * time.Millisecond, RetryInterval: time.Hour}
+
+	s, steps := testStation(t, &busyRadio{}, source, cfg)
+
+	start := time.Now()
+	seen := run(t, s, steps, func(st step) bool { return st.to == StateSleeping })
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("receive window closed after %v, want about %v", elapsed, cfg.RxWindow)
+	}
+	received := 0
+	for _, st := range seen {
+		if st.on == EventPacketReceived {
+			received++
+		}
+	}
+	if received == 0 {
+		t.Error("no packet received in the window")
+	}
+	if last := seen[len(seen)-1]; last != (step{StateReceiving, StateSleeping, EventRxTimeout}) {
+		t.Errorf("last transition %v, want receiving -> sleeping", last)
+	}
+}
+
+func TestRunDegraded(t *testing.T) {
+	tests := []struct {
+		name   string
+		radio  Radio
+		source fakeSource
+		want   step
+	}{
+		{"no radio", nil, fakeSource{&fakeSensor{id: "a"}}, step{StateBoot, StateDegraded, EventFailure}},
+		{"no sensors", &fakeRadio{}, fakeSource{}, step{StateBoot, StateDegraded, EventFailure}},
+		{"no readings", &fakeRadio{}, fakeSource{&fakeSensor{id: "a", err: errors.New("warming up")}}, step{StateSampling, StateDegraded, EventNoReadings}},
+		{"tx failure", &fakeRadio{txErr: errors.New("busy")}, fakeSource{&fakeSensor{id: "a", readings: []sensors.Reading{{SensorID: "a", Quantity: "q", Value: 1}}}}, step{StateTransmitting, StateDegraded, EventTxFailure}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Station{Interval: time.Hour, RxWindow: time.Hour, RetryInterval: time.Hour, Address: 1}
+			s, steps := testStation(t, tt.radio, tt.source, cfg)
+
+			// Cancelled in the middle of the hour long retry wait
+			seen := run(t, s, steps, func(st step) bool { return st.to == StateDegraded })
+			if last := seen[len(seen)-1]; last != tt.want {
+				t.Errorf("last transition %v, want %v", last, tt.want)
+			}
+			if s.State() != StateDegraded {
+				t.Errorf("state after cancel %s, want degraded", s.State())
+			}
+		})
+	}
+}
+
+// The gateway listens for the stations without sending its own readings to itself
+func TestRunGateway(t *testing.T) {
+	source := fakeSource{&fakeSensor{id: "a", readings: []sensors.Reading{{SensorID: "a", Quantity: "q", Value: 1}}}}
+	radio := &fakeRadio{packets: [][]uint8{[]uint8("telemetry")}}
+	cfg := &config.Station{Interval: time.Hour, RxWindow: 30 * time.Millisecond, RetryInterval: time.Hour, Address: 0, Gateway: 0}
+
+	s, steps := testStation(t, radio, source, cfg)
+	seen := run(t, s, steps, func(st step) bool { return st.to == StateSleeping })
+
+	want := []step{
+		{StateBoot, StateSampling, EventReady},
+		{StateSampling, StateTransmitting, EventSampled},
+		{StateTransmitting, StateReceiving, EventTransmitted},
+		{StateReceiving, StateReceiving, EventPacketReceived},
+		{StateReceiving, StateSleeping, EventRxTimeout},
+	}
+	if len(seen) != len(want) {
+		t.Fatalf("transitions %v, want %v", seen, want)
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Errorf("transition %d = %v, want %v", i, seen[i], want[i])
+		}
+	}
+	if len(radio.sent) != 0 {
+		t.Errorf("gateway sent %q", radio.sent)
+	}
+}
+
+// Cancellation in the middle of an hour long receive window returns within one Rx slice
+func TestRunCancelReceiving(t *testing.T) {
+	source := fakeSource{&fakeSensor{id: "a", readings: []sensors.Reading{{SensorID: "a", Quantity: "q", Value: 1}}}}
+	cfg := &config.Station{Interval: time.Hour, RxWindow: time.Hour, RetryInterval: time.Hour}
+
+	s, steps := testStation(t, &fakeRadio{}, source, cfg)
+
+	start := time.Now()
+	run(t, s, steps, func(st step) bool { return st.to == StateReceiving })
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Run returned %v after cancel", elapsed)
+	}
+	if s.State() != StateReceiving {
+		t.Errorf("state after cancel %s, want receiving", s.State())
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(nil, nil, fakeSource{}); err == nil {
+		t.Error("New without cfg succeeded")
+	}
+	if _, err := New(&config.Station{}, nil, nil); err == nil {
+		t.Error("New without source succeeded")
+	}
+
+	// A typed nil radio counts as no radio
+	var radio *fakeRadio
+	s, err := New(&config.Station{}, radio, fakeSource{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.radio != nil {
+		t.Error("typed nil radio kept")
+	}
+}
+
+// ************************************************************************
+// = PacketEncoder ===
+// ------------------------------------------------------------------------
+
+// decodeAll decodes the payloads of one transmission
+func decodeAll(t *testing.T, payloads [][]uint8) []packet.Packet {
+	t.Helper()
+
+	list := make([]packet.Packet, 0, len(payloads))
+	for _, data := range payloads {
+		p, err := packet.Decode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, p)
+	}
+	return list
+}
+
+func temperature(id string, value float64) sensors.Reading {
+	return sensors.Reading{SensorID: id, Quantity: sensors.QuantityTemperature, Value: value, Quality: sensors.QualityGood}
+}
+
+// Probes of a DS18B20 bus report under their own IDs, not the bus one
+func TestPacketEncoder(t *testing.T) {
+	cfg := &config.Station{Address: 3, Gateway: 0}
+	encode := PacketEncoder(cfg, 64)
+
+	readings := []sensors.Reading{temperature("ds18b20_1", 21), temperature("ds18b20_0", 19)}
+	packets := decodeAll(t, must(t, encode, readings))
+	if len(packets) != 2 {
+		t.Fatalf("%d packets at boot, want beacon and telemetry", len(packets))
+	}
+
+	beacon, ok := packets[0].Payload.(*packet.Beacon)
+	if !ok || strings.Join(beacon.Sensors, " ") != "ds18b20_0 ds18b20_1" {
+		t.Fatalf("first packet %+v, want a beacon of ds18b20_0 ds18b20_1", packets[0].Payload)
+	}
+	telemetry := packets[1].Payload.(*packet.Telemetry)
+	for _, v := range telemetry.Values {
+		id := beacon.Sensors[v.Sensor]
+		if want := map[string]float32{"ds18b20_0": 19, "ds18b20_1": 21}[id]; v.Value != want {
+			t.Errorf("%s = %g, want %g", id, v.Value, want)
+		}
+	}
+	if packets[0].Source != 3 || packets[1].Sequence != packets[0].Sequence+1 {
+		t.Errorf("headers %+v, %+v", packets[0].Header, packets[1].Header)
+	}
+
+	// Same sensors, telemetry only
+	if packets := decodeAll(t, must(t, encode, readings)); len(packets) != 1 || packets[0].Type != packet.TypeTelemetry {
+		t.Errorf("second transmission %d packets, want telemetry only", len(packets))
+	}
+
+	// A new sensor is announced before its first value; a missing one keeps its index
+	packets = decodeAll(t, must(t, encode, []sensors.Reading{temperature("bme280_0", 22), temperature("ds18b20_1", 21)}))
+	if len(packets) != 2 {
+		t.Fatalf("%d packets, want beacon and telemetry", len(packets))
+	}
+	beacon = packets[0].Payload.(*packet.Beacon)
+	if strings.Join(beacon.Sensors, " ") != "bme280_0 ds18b20_0 ds18b20_1" {
+		t.Errorf("beacon %v", beacon.Sensors)
+	}
+	telemetry = packets[1].Payload.(*packet.Telemetry)
+	if telemetry.Values[0].Sensor != 0 || telemetry.Values[1].Sensor != 2 {
+		t.Errorf("telemetry %+v, want sensors 0 and 2", telemetry.Values)
+	}
+}
+
+// Indexes don't depend on the order sensors are read in, e.g. after a restart
+func TestPacketEncoderStable(t *testing.T) {
+	cfg := &config.Station{Address: 3}
+
+	a := decodeAll(t, must(t, PacketEncoder(cfg, 64), []sensors.Reading{temperature("b", 1), temperature("a", 2)}))
+	b := decodeAll(t, must(t, PacketEncoder(cfg, 64), []sensors.Reading{temperature("a", 2), temperature("b", 1)}))
+
+	index := func(p []packet.Packet) map[string]uint8 {
+		beacon := p[0].Payload.(*packet.Beacon)
+		m := make(map[string]uint8)
+		for _, v := range p[1].Payload.(*packet.Telemetry).Values {
+			m[beacon.Sensors[v.Sensor]] = v.Sensor
+		}
+		return m
+	}
+	if ia, ib := index(a), index(b); ia["a"] != ib["a"] || ia["b"] != ib["b"] {
+		t.Errorf("indexes %v and %v", ia, ib)
+	}
+}
+
+// The beacon is repeated for gateways that missed it
+func TestPacketEncoderRepeat(t *testing.T) {
+	encode := PacketEncoder(&config.Station{Address: 3}, 64)
+	readings := []sensors.Reading{temperature("a", 1)}
+
+	beacons := 0
+	for i := 0; i < 2*beaconEvery; i++ {
+		for _, p := range decodeAll(t, must(t, encode, readings)) {
+			if p.Type == packet.TypeBeacon {
+				beacons++
+			}
+		}
+	}
+	if beacons != 2 {
+		t.Errorf("%d beacons in %d transmissions, want 2", beacons, 2*beaconEvery)
+	}
+}
+
+func must(t *testing.T, encode Encoder, readings []sensors.Reading) [][]uint8 {
+	t.Helper()
+
+	payloads, err := encode(readings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payloads
+}
+
+// ------------------------------------------------------------------------
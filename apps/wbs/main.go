@@ -2,21 +2,33 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
-	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 	"wbs/internal/config"
+	"wbs/internal/fsk"
 	"wbs/internal/hal/i2c"
+	"wbs/internal/hal/onewire"
 	"wbs/internal/hal/spi"
+	"wbs/internal/hal/uart"
+	"wbs/internal/logging"
 	"wbs/internal/lora"
+	"wbs/internal/lora/packet"
+	"wbs/internal/lora/sim"
+	"wbs/internal/mqtt"
+	"wbs/internal/sensors"
+	bme_manager "wbs/internal/sensors/bme280"
+	dht_manager "wbs/internal/sensors/dht"
+	ds18b20_manager "wbs/internal/sensors/ds18b20"
+	pms_manager "wbs/internal/sensors/pms5003"
 	sgp_manager "wbs/internal/sensors/sgp30"
+	"wbs/internal/station"
 
-	"github.com/Regeneric/iot-drivers/libs/sgp30"
 	"github.com/Regeneric/iot-drivers/libs/sx126x"
 
 	"periph.io/x/host/v3"
@@ -41,29 +53,39 @@ func main() {
 	go func() { <-sigChan; cancel() }() // Wait for Ctrl + C, basically
 
 	configPath := flag.String("config", "config.yaml", "path to configuration file")
+	strict := flag.Bool("strict", false, "refuse to start on any config validation problem")
+	printConfig := flag.Bool("print-effective-config", false, "print the merged configuration with the source of every value and exit")
 	flag.Parse()
 	// ------------------------------------------------------------------------
 
 	// ************************************************************************
-	// = Logger ===
+	// = Config ===
 	// ------------------------------------------------------------------------
-	opts := &slog.HandlerOptions{
-		Level:     slog.LevelDebug,
-		AddSource: false,
+	cfg, origins, err := config.Load(*configPath)
+	if err != nil {
+		slog.Error("[ MAIN ] Critical error loading configuration", "error", err)
+		os.Exit(1)
 	}
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, opts))
-	slog.SetDefault(logger)
+	if *printConfig {
+		if err := config.PrintEffective(os.Stdout, cfg, origins); err != nil {
+			slog.Error("[ MAIN ] Could not print configuration", "error", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	// ------------------------------------------------------------------------
 
 	// ************************************************************************
-	// = Config ===
+	// = Logger ===
 	// ------------------------------------------------------------------------
-	cfg, err := config.LoadConfig(*configPath)
+	logger, logClose, err := logging.Setup(&cfg.Logging)
 	if err != nil {
-		logger.Error("[ MAIN ] Critical error loading configuration", "error", err)
+		slog.Error("[ MAIN ] Critical logger failure", "error", err)
 		os.Exit(1)
 	}
+	defer logClose()
+	slog.SetDefault(logger)
 
 	if _, err := os.Stat(*configPath); os.IsNotExist(err) {
 		logger.Info("[ MAIN ] Config file not found, using Defaults & Environment Variables only")
@@ -71,8 +93,21 @@ func main() {
 		logger.Info("[ MAIN ] Configuration loaded", "sourceFile", *configPath)
 	}
 
-	cfgJSON, _ := json.MarshalIndent(cfg, "", "  ")
-	fmt.Printf("[ MAIN ] Loaded Config:\n%s\n", string(cfgJSON))
+	// Nothing has touched the hardware yet
+	if err := cfg.Validate(); err != nil {
+		var verr *config.ValidationError
+		if errors.As(err, &verr) {
+			for _, p := range verr.Problems {
+				logger.Warn("[ MAIN ] Invalid config value", "path", p.Path, "problem", p.Message)
+			}
+		}
+
+		if *strict {
+			logger.Error("[ MAIN ] Refusing to start in strict mode", "error", err)
+			os.Exit(1)
+		}
+		logger.Warn("[ MAIN ] Continuing with fallback values for invalid config")
+	}
 	// ------------------------------------------------------------------------
 
 	// ************************************************************************
@@ -108,87 +143,286 @@ func main() {
 	// ------------------------------------------------------------------------
 
 	// ************************************************************************
-	// = SX1262 ===  TODO: automatic reconnects after failure
+	// = 1-Wire ===  TODO: automatic reconnects after failure
 	// ------------------------------------------------------------------------
-	sxlog := lora.SlogAdapter{Log: logger}
-	pinreg := lora.PinReg{}
-
-	hkSX1262_0, err := sx126x.New(hkSPI_0, &cfg.SX126X, sx126x.WithLogger(sxlog), sx126x.WithPinReg(pinreg))
-	if err != nil || hkSX1262_0 == nil {
-		slog.Error("[ MAIN ] Critical SX126x modem failure", "error", err)
-	}
-
-	hkLoRa_0, err := lora.New(hkSX1262_0, &cfg.SX126X)
+	oneWireConnections, oneWireClose, err := onewire.Setup(&cfg.OneWire)
 	if err != nil {
-		slog.Error("[ MAIN ] Critical LoRa mode modem failure", "error", err)
+		slog.Error("[ MAIN ] 1-Wire init failure", "error", err)
+	} else {
+		defer oneWireClose()
 	}
+	// ------------------------------------------------------------------------
 
-	if err := lora.Setup(hkLoRa_0); err != nil {
-		slog.Error("[ MAIN ] Critical LoRa mode modem setup failure", "error", err)
+	// ************************************************************************
+	// = UART ===  TODO: automatic reconnects after failure
+	// ------------------------------------------------------------------------
+	uartConnections, uartClose, err := uart.Setup(&cfg.UART)
+	if err != nil {
+		slog.Error("[ MAIN ] UART init failure", "error", err)
 	} else {
-		defer hkLoRa_0.Close()
+		defer uartClose()
 	}
-
-	go hkLoRa_0.Run(ctx)
 	// ------------------------------------------------------------------------
 
 	// ************************************************************************
-	// = SGP30 ===  TODO: automatic reconnects after failure
+	// = SX1262 ===  TODO: automatic reconnects after failure
 	// ------------------------------------------------------------------------
-	sgplog := sgp_manager.SlogAdapter{Log: logger}
+	// Sensors and the modem's duty cycle budget publish on the same bus
+	bus := sensors.NewBus()
+	defer bus.Close()
 
-	sgp30Buses := make(map[string]sgp30.Bus)
-	for key, val := range i2cConnections {
-		sgp30Buses[key] = val
-	}
+	sxlog := lora.SlogAdapter{Log: logger.With("package", "lora")}
+	pinreg := lora.PinReg{}
 
-	sgp30Sensors, sgp30Close, err := sgp30.Setup(sgp30Buses, &cfg.SGP30, sgplog)
-	if err != nil {
-		slog.Error("[ MAIN ] Critical SGP30 sensor failure", "error", err)
+	// A replayed capture stands in for the SX126x, no SPI needed
+	var hw lora.Transceiver
+	if cfg.Capture.Replay != "" {
+		records, err := lora.LoadCapture(cfg.Capture.Replay, &cfg.SX126X)
+		if err != nil {
+			slog.Error("[ MAIN ] Critical capture replay failure", "error", err)
+		} else {
+			slog.Info("[ MAIN ] Replaying capture instead of the SX126x", "file", cfg.Capture.Replay, "frames", len(records), "speed", cfg.Capture.Speed)
+			hw = sim.NewReplay(records, cfg.Capture.Speed, &cfg.SX126X)
+		}
 	} else {
-		defer sgp30Close()
+		hkSX1262_0, err := sx126x.New(hkSPI_0, &cfg.SX126X, sx126x.WithLogger(sxlog), sx126x.WithPinReg(pinreg))
+		if err != nil || hkSX1262_0 == nil {
+			slog.Error("[ MAIN ] Critical SX126x modem failure", "error", err)
+		} else {
+			hw = hkSX1262_0
+		}
 	}
 
-	hkSGP30_0, ok := sgp30Sensors["sgp30_0"]
-	if !ok {
-		slog.Error("[ MAIN ] Missing SGP30 sensor", "name", "sgp30_0")
+	var capture *lora.Capture
+	if cfg.Capture.File != "" {
+		capture, err = lora.OpenCapture(cfg.Capture.File)
+		if err != nil {
+			slog.Error("[ MAIN ] Capture file failure; not recording", "error", err)
+		} else {
+			defer capture.Close()
+		}
 	}
 
-	if hkSGP30_0 != nil {
-		slog.Warn("[ MAIN ] Waiting 20 seconds for SGP30 sensor to initialize...")
-		time.Sleep(20 * time.Second)
+	var hkLoRa_0 *lora.Node
+	var modem lora.Link
+
+	// The gateway is the node telemetry is sent to; its ADR controller learns the stations'
+	// SNR from every Latched frame the modem receives. A nil channel drops them, see
+	// WithFrameHandler.
+	gateway := cfg.Station.Address == cfg.Station.Gateway
+	var adrFrames chan lora.Frame
+	if cfg.ADR.Enable && gateway {
+		adrFrames = make(chan lora.Frame, 64)
 	}
 
-	hkSGP_PRIMARY := sgp_manager.SGP{HW: hkSGP30_0}
-	go hkSGP_PRIMARY.Run(ctx)
+	if cfg.SX126X.Modem == "fsk" {
+		hkFSK_0, err := fsk.New(hw, &cfg.SX126X, &cfg.FSK,
+			fsk.WithDutyCycle(&cfg.Duty),
+			fsk.WithBudgetHandler(func(b lora.Budget) {
+				bus.Publish(sensors.Reading{SensorID: "lora", Quantity: sensors.QuantityDutyCycle, Unit: sensors.UnitPercent, Value: b.Percent(), Time: time.Now()})
+			}),
+		)
+		if err != nil {
+			slog.Error("[ MAIN ] Critical FSK mode modem failure", "error", err)
+		}
+
+		if err := fsk.Setup(hkFSK_0); err != nil {
+			slog.Error("[ MAIN ] Critical FSK mode modem setup failure", "error", err)
+		} else {
+			defer hkFSK_0.Close()
+			go hkFSK_0.Run(ctx)
+			modem = hkFSK_0
+		}
+	} else {
+		hkLoRa_0, err = lora.New(hw, &cfg.SX126X,
+			lora.WithDutyCycle(&cfg.Duty),
+			lora.WithListenBeforeTalk(&cfg.LBT),
+			lora.WithCapture(capture),
+			lora.WithBudgetHandler(func(b lora.Budget) {
+				bus.Publish(sensors.Reading{SensorID: "lora", Quantity: sensors.QuantityDutyCycle, Unit: sensors.UnitPercent, Value: b.Percent(), Time: time.Now()})
+			}),
+			lora.WithStatsHandler(cfg.Link.StatsInterval, func(s lora.Stats) {
+				now := time.Now()
+				bus.Publish(sensors.Reading{SensorID: "lora", Quantity: sensors.QuantityPacketsReceived, Unit: sensors.UnitPackets, Value: float64(s.Received), Time: now})
+				bus.Publish(sensors.Reading{SensorID: "lora", Quantity: sensors.QuantityCRCErrors, Unit: sensors.UnitPackets, Value: float64(s.CRCErrors), Time: now})
+				bus.Publish(sensors.Reading{SensorID: "lora", Quantity: sensors.QuantityHeaderErrors, Unit: sensors.UnitPackets, Value: float64(s.HeaderErrors), Time: now})
+			}),
+			lora.WithFrameHandler(func(f lora.Frame) {
+				select {
+				case adrFrames <- f:
+				default: // Not the gateway, or the controller is busy sending
+				}
+			}),
+		)
+		if err != nil {
+			slog.Error("[ MAIN ] Critical LoRa mode modem failure", "error", err)
+		}
+
+		if err := lora.Setup(hkLoRa_0); err != nil {
+			slog.Error("[ MAIN ] Critical LoRa mode modem setup failure", "error", err)
+			hkLoRa_0 = nil
+		} else {
+			defer hkLoRa_0.Close()
+			go hkLoRa_0.Run(ctx)
+			modem = hkLoRa_0
+		}
+	}
 	// ------------------------------------------------------------------------
 
-	time.Sleep(1 * time.Second)
-	hkLoRa_0.Tx([]uint8("Hello, world!"))
-	time.Sleep(2 * time.Second)
+	// ************************************************************************
+	// = Link ===
+	// ------------------------------------------------------------------------
+	var radio station.Radio
+	messageLength := int(cfg.SX126X.PayloadLength)
 
-	state := "idle"
-	for {
-		switch state {
-		case "idle":
-			slog.Debug("[ MAIN ] State Machine", "state", state)
+	// The link layers finish their work on the way out, Secure saves its frame counters
+	var links sync.WaitGroup
 
-			slog.Info("[ MAIN ] SGP_PRIMARY", "ECO2", hkSGP_PRIMARY.ECO2)
-			slog.Info("[ MAIN ] SGP_PRIMARY", "TVOC", hkSGP_PRIMARY.TVOC)
+	if modem != nil {
+		link := modem
 
-			data, err := hkLoRa_0.Rx(2 * time.Second)
+		// Never falls back to plaintext, the radio stays off instead
+		if cfg.Link.Encrypt {
+			hkSecure_0, err := lora.NewSecure(link, &cfg.Link)
 			if err != nil {
-				slog.Debug(err.Error()) // It's not really an error
+				slog.Error("[ MAIN ] Critical link encryption failure; radio disabled", "error", err)
+				link = nil
+			} else {
+				links.Go(func() { hkSecure_0.Run(ctx) })
+				link = hkSecure_0
 			}
+		}
 
-			if len(data) > 0 {
-				state = "data_ready"
+		if link != nil && cfg.Link.Fragment {
+			hkFragmenter_0, err := lora.NewFragmenter(link, &cfg.Link, packet.Address(cfg.Station.Address))
+			if err != nil {
+				slog.Error("[ MAIN ] Critical fragmenter failure", "error", err)
+			} else {
+				links.Go(func() { hkFragmenter_0.Run(ctx) })
+				link = hkFragmenter_0
 			}
-		case "data_ready":
-			slog.Debug("[ MAIN ] State Machine", "state", state)
+		}
+
+		if link != nil && cfg.Link.Reliable {
+			hkReliable_0, err := lora.NewReliable(link, &cfg.Link, packet.Address(cfg.Station.Address),
+				lora.WithChannelAccess(&cfg.LBT, &cfg.Duty),
+			)
+			if err != nil {
+				slog.Error("[ MAIN ] Critical reliable link failure", "error", err)
+			} else {
+				links.Go(func() { hkReliable_0.Run(ctx) })
+				link = hkReliable_0
+			}
+		}
+
+		// ADR reconfigures the modem, only a LoRa mode Node has one
+		if link != nil && hkLoRa_0 != nil && cfg.ADR.Enable && gateway {
+			hkADRController_0, err := lora.NewADRController(link, &cfg.ADR, &cfg.SX126X, packet.Address(cfg.Station.Address))
+			if err != nil {
+				slog.Error("[ MAIN ] Critical ADR controller failure", "error", err)
+			} else {
+				links.Go(func() { hkADRController_0.Run(ctx, adrFrames) })
+				link = hkADRController_0
+			}
+		} else if link != nil && hkLoRa_0 != nil && cfg.ADR.Enable {
+			hkADR_0, err := lora.NewADR(link, hkLoRa_0, &cfg.ADR, packet.Address(cfg.Station.Address), packet.Address(cfg.Station.Gateway))
+			if err != nil {
+				slog.Error("[ MAIN ] Critical ADR failure", "error", err)
+			} else {
+				link = hkADR_0
+			}
+		}
 
-			slog.Error("[ MAIN ] ABCD")
-			state = "idle"
+		if link != nil {
+			messageLength = link.MTU()
 		}
+		radio = link
+	}
+	// ------------------------------------------------------------------------
+
+	// ************************************************************************
+	// = Sensors ===  TODO: automatic reconnects after failure
+	// ------------------------------------------------------------------------
+	registry := sensors.NewRegistry()
+	registry.Register("sgp30", sgp_manager.Factory)
+	registry.Register("bme280", bme_manager.Factory)
+	registry.Register("dht", dht_manager.Factory)
+	registry.Register("ds18b20", ds18b20_manager.Factory)
+	registry.Register("pms5003", pms_manager.Factory)
+
+	ambient := sensors.NewAmbient()
+
+	deps := &sensors.Deps{I2C: i2cConnections, SPI: spiConnections, OneWire: oneWireConnections, UART: uartConnections, Bus: bus, Ambient: ambient, Logger: logger}
+	if err := registry.Setup(cfg, deps); err != nil {
+		slog.Error("[ MAIN ] Critical sensor registry failure", "error", err)
+	} else {
+		defer registry.Close()
+	}
+	// ------------------------------------------------------------------------
+
+	// ************************************************************************
+	// = MQTT ===
+	// ------------------------------------------------------------------------
+	hkMQTT_0, err := mqtt.New(&cfg.MQTT, mqtt.WithDiscovery(mqtt.Entities(cfg)))
+	if err != nil {
+		slog.Error("[ MAIN ] MQTT client failure", "error", err)
+	} else if err := hkMQTT_0.Connect(ctx); err != nil {
+		slog.Error("[ MAIN ] MQTT broker connection failure", "error", err)
+	} else {
+		defer hkMQTT_0.Close()
+
+		readings, unsubscribe := bus.Subscribe("mqtt", 64)
+		defer unsubscribe()
+
+		go hkMQTT_0.Run(ctx, readings)
+	}
+	// ------------------------------------------------------------------------
+
+	ambientReadings, ambientUnsubscribe := bus.Subscribe("ambient", 64)
+	defer ambientUnsubscribe()
+
+	go ambient.Run(ctx, ambientReadings, registry.Sensors())
+
+	// Consumers are subscribed, sensors may start publishing
+	registry.Run(ctx)
+
+	// ************************************************************************
+	// = Config reload ===
+	// ------------------------------------------------------------------------
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	watcher := config.NewWatcher(*configPath, cfg)
+	if hkLoRa_0 != nil {
+		watcher.Handle("lora", config.Paths(lora.HotReloadable...), func(next *config.Config, _ []config.Change) error {
+			return hkLoRa_0.Reconfigure(&next.SX126X)
+		})
 	}
+	watcher.Handle("sensors", `^(sgp30|bme280|dht|ds18b20|pms5003)\.device\.[^.]+\.(name|location)$`, func(next *config.Config, _ []config.Change) error {
+		registry.ApplyLabels(next)
+		return nil
+	})
+
+	go watcher.Run(ctx, hupChan)
+	// ------------------------------------------------------------------------
+
+	// ************************************************************************
+	// = Station ===
+	// ------------------------------------------------------------------------
+	hkStation, err := station.New(&cfg.Station, radio, registry,
+		station.WithEncoder(station.PacketEncoder(&cfg.Station, messageLength)),
+	)
+	if err != nil {
+		slog.Error("[ MAIN ] Critical station failure", "error", err)
+		os.Exit(1)
+	}
+
+	if err := hkStation.Run(ctx); err != nil {
+		slog.Error("[ MAIN ] Station stopped with error", "error", err)
+	}
+
+	slog.Info("[ MAIN ] Shutting down")
+	cancel()
+	links.Wait()
+	// ------------------------------------------------------------------------
 }